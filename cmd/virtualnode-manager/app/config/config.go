@@ -17,6 +17,7 @@ import (
 const (
 	DefaultNodeName             = "virtual-Node"
 	DefaultOperatingSystem      = "Linux"
+	DefaultArchitecture         = "amd64"
 	DefaultInformerResyncPeriod = 1 * time.Minute
 	DefaultMetricsAddr          = ""
 	DefaultListenPort           = 10250 // TODO(cpuguy83)(VK1.0): Change this to an addr instead of just a port.. we should not be listening on all interfaces.
@@ -28,6 +29,9 @@ const (
 	DefaultTaintKey              = "virtual-node.io/plugin"
 	DefaultStreamIdleTimeout     = 4 * time.Hour
 	DefaultStreamCreationTimeout = 30 * time.Second
+	DefaultPingTimeout           = 5 * time.Second
+	DefaultCapacityCacheTTL      = 10 * time.Second
+	DefaultExcludeNodeKey        = "clusterrouter.io/exclude"
 )
 
 type Config struct {
@@ -51,9 +55,20 @@ type Opts struct {
 
 	// Node name to use when creating a node in Kubernetes
 	NodeName string
+	// NodeLabelsFile is the path of a YAML or JSON file holding a map of labels set on the virtual node
+	NodeLabelsFile string
+	// ProviderID is set as spec.providerID of the virtual node, e.g. clusterrouter://<cluster>. It must be unique among
+	// the nodes of the master cluster.
+	ProviderID string
 
 	// Operating system to run pods for
 	OperatingSystem string
+	// Architecture advertised by the virtual node
+	Architecture string
+	// Region and Zone set as topology labels on the virtual node. When unset, they are taken from the client cluster
+	// nodes if all of them agree.
+	Region string
+	Zone   string
 
 	Provider           string
 	ProviderConfigPath string
@@ -63,6 +78,28 @@ type Opts struct {
 	TaintValue   string
 	DisableTaint bool
 
+	// NodeTaints is a comma separated list of additional taints of the form key=value:Effect set on the virtual node
+	NodeTaints string
+	// NodeSelector is a label selector picking the nodes of the client cluster the virtual node represents, empty
+	// selects all nodes
+	NodeSelector string
+	// ExcludeNodeKey is the key of a label or annotation which excludes client cluster nodes carrying it with a value
+	// of "true" from the virtual node, even if they are picked by NodeSelector
+	ExcludeNodeKey string
+	// NodeReserved is a comma separated list of resources reserved on every client cluster node for the system, of the
+	// form name=quantity or name=percent%, which is not advertised on the virtual node
+	NodeReserved string
+	// Overcommit is a comma separated list of ratios of the form name=ratio the capacity of the client cluster is
+	// multiplied with when advertised, resources without a ratio are not overcommitted
+	Overcommit string
+	// PropagateTaints reflects taints shared by all schedulable nodes of the client cluster onto the virtual node
+	PropagateTaints bool
+	// PropagateNodeSelector constrains pods created in the client cluster to the nodes selected by NodeSelector
+	PropagateNodeSelector bool
+	// NamespacePrefix is prepended to the namespace of pods, and the objects they depend on, when they are created in
+	// the client cluster. Empty keeps the namespaces of the master cluster.
+	NamespacePrefix string
+
 	MetricsAddr string
 
 	// Only trust clients with tls certs signed by the provided CA
@@ -85,6 +122,27 @@ type Opts struct {
 	// StreamCreationTimeout is the maximum time for streaming connection
 	StreamCreationTimeout time.Duration
 
+	// NodeHeartbeatTimeout is how recent the last heartbeat of a client cluster node must be for it to be considered
+	// ready, 0 disables the check. With node leases, nodes only report their status every few minutes when nothing
+	// changes, so it should be set well above that.
+	NodeHeartbeatTimeout time.Duration
+	// NodeStatusInterval is how often the status of the virtual node is reported even if nothing changed in the client
+	// cluster, 0 only reports changes
+	NodeStatusInterval time.Duration
+	// CapacityHysteresis is how long the resources used by pods of the client cluster must stay lower before the
+	// allocatable of the virtual node grows, 0 disables it
+	CapacityHysteresis time.Duration
+	// CountBoundPods counts pods bound to a client cluster node which did not report a phase yet as using resources
+	CountBoundPods bool
+	// PressureThreshold is the percentage of the allocatable memory or ephemeral storage of the client cluster which,
+	// once used by pods, reports memory or disk pressure on the virtual node. 0 disables it.
+	PressureThreshold float64
+	// CapacityCacheTTL is how long the capacity aggregated over the client cluster is reused before it is recomputed
+	CapacityCacheTTL time.Duration
+
+	// PingTimeout is how long a single ping of the master or client apiserver may take
+	PingTimeout time.Duration
+
 	// KubeAPIQPS is the QPS to use while talking with kubernetes apiserver
 	KubeAPIQPS int32
 	// KubeAPIBurst is the burst to allow while talking with kubernetes apiserver
@@ -107,6 +165,8 @@ func FromEnv() (*Opts, error) {
 	setDefaults(o)
 
 	o.NodeName = getEnv("DEFAULTNODE_NAME", o.NodeName)
+	o.ProviderID = getEnv("VKUBELET_PROVIDER_ID", o.ProviderID)
+	o.NodeLabelsFile = getEnv("VKUBELET_NODE_LABELS_FILE", o.NodeLabelsFile)
 
 	if kp := os.Getenv("KUBELET_PORT"); kp != "" {
 		p, err := strconv.Atoi(kp)
@@ -124,9 +184,90 @@ func FromEnv() (*Opts, error) {
 		}
 	}*/
 
+	if pt := os.Getenv("VKUBELET_PING_TIMEOUT"); pt != "" {
+		timeout, err := time.ParseDuration(pt)
+		if err != nil {
+			return o, errors.Wrap(err, "error parsing VKUBELET_PING_TIMEOUT environment variable")
+		}
+		o.PingTimeout = timeout
+	}
+
+	if ht := os.Getenv("VKUBELET_NODE_HEARTBEAT_TIMEOUT"); ht != "" {
+		timeout, err := time.ParseDuration(ht)
+		if err != nil {
+			return o, errors.Wrap(err, "error parsing VKUBELET_NODE_HEARTBEAT_TIMEOUT environment variable")
+		}
+		o.NodeHeartbeatTimeout = timeout
+	}
+
+	if si := os.Getenv("VKUBELET_NODE_STATUS_INTERVAL"); si != "" {
+		interval, err := time.ParseDuration(si)
+		if err != nil {
+			return o, errors.Wrap(err, "error parsing VKUBELET_NODE_STATUS_INTERVAL environment variable")
+		}
+		o.NodeStatusInterval = interval
+	}
+
+	if h := os.Getenv("VKUBELET_CAPACITY_HYSTERESIS"); h != "" {
+		d, err := time.ParseDuration(h)
+		if err != nil {
+			return o, errors.Wrap(err, "error parsing VKUBELET_CAPACITY_HYSTERESIS environment variable")
+		}
+		o.CapacityHysteresis = d
+	}
+
+	if cb := os.Getenv("VKUBELET_COUNT_BOUND_PODS"); cb != "" {
+		count, err := strconv.ParseBool(cb)
+		if err != nil {
+			return o, errors.Wrap(err, "error parsing VKUBELET_COUNT_BOUND_PODS environment variable")
+		}
+		o.CountBoundPods = count
+	}
+
+	if pt := os.Getenv("VKUBELET_PRESSURE_THRESHOLD"); pt != "" {
+		threshold, err := strconv.ParseFloat(pt, 64)
+		if err != nil {
+			return o, errors.Wrap(err, "error parsing VKUBELET_PRESSURE_THRESHOLD environment variable")
+		}
+		o.PressureThreshold = threshold
+	}
+
+	if ttl := os.Getenv("VKUBELET_CAPACITY_CACHE_TTL"); ttl != "" {
+		d, err := time.ParseDuration(ttl)
+		if err != nil {
+			return o, errors.Wrap(err, "error parsing VKUBELET_CAPACITY_CACHE_TTL environment variable")
+		}
+		o.CapacityCacheTTL = d
+	}
+
+	o.OperatingSystem = getEnv("VKUBELET_NODE_OS", o.OperatingSystem)
+	o.Architecture = getEnv("VKUBELET_NODE_ARCH", o.Architecture)
+	o.Region = getEnv("VKUBELET_NODE_REGION", o.Region)
+	o.Zone = getEnv("VKUBELET_NODE_ZONE", o.Zone)
+
 	o.TaintKey = getEnv("VKUBELET_TAINT_KEY", o.TaintKey)
 	o.TaintValue = getEnv("VKUBELET_TAINT_VALUE", o.TaintValue)
 	o.TaintEffect = getEnv("VKUBELET_TAINT_EFFECT", o.TaintEffect)
+	o.NodeTaints = getEnv("VKUBELET_NODE_TAINTS", o.NodeTaints)
+	o.NodeSelector = getEnv("VKUBELET_NODE_SELECTOR", o.NodeSelector)
+	o.ExcludeNodeKey = getEnv("VKUBELET_EXCLUDE_NODE_KEY", o.ExcludeNodeKey)
+	o.NamespacePrefix = getEnv("VKUBELET_NAMESPACE_PREFIX", o.NamespacePrefix)
+	o.NodeReserved = getEnv("VKUBELET_NODE_RESERVED", o.NodeReserved)
+	o.Overcommit = getEnv("VKUBELET_OVERCOMMIT", o.Overcommit)
+	if pt := os.Getenv("VKUBELET_PROPAGATE_TAINTS"); pt != "" {
+		propagate, err := strconv.ParseBool(pt)
+		if err != nil {
+			return o, errors.Wrap(err, "error parsing VKUBELET_PROPAGATE_TAINTS environment variable")
+		}
+		o.PropagateTaints = propagate
+	}
+	if pn := os.Getenv("VKUBELET_PROPAGATE_NODE_SELECTOR"); pn != "" {
+		propagate, err := strconv.ParseBool(pn)
+		if err != nil {
+			return o, errors.Wrap(err, "error parsing VKUBELET_PROPAGATE_NODE_SELECTOR environment variable")
+		}
+		o.PropagateNodeSelector = propagate
+	}
 
 	return o, nil
 }
@@ -139,6 +280,7 @@ func New() *Opts {
 
 func setDefaults(o *Opts) {
 	o.OperatingSystem = DefaultOperatingSystem
+	o.Architecture = DefaultArchitecture
 	o.NodeName = DefaultNodeName
 	o.TaintKey = DefaultTaintKey
 	o.TaintEffect = DefaultTaintEffect
@@ -150,6 +292,9 @@ func setDefaults(o *Opts) {
 	o.KubeClusterDomain = DefaultKubeClusterDomain
 	o.StreamIdleTimeout = DefaultStreamIdleTimeout
 	o.StreamCreationTimeout = DefaultStreamCreationTimeout
+	o.PingTimeout = DefaultPingTimeout
+	o.CapacityCacheTTL = DefaultCapacityCacheTTL
+	o.ExcludeNodeKey = DefaultExcludeNodeKey
 	o.EnableNodeLease = true
 }
 
@@ -93,6 +93,16 @@ func (o *Options) Flags() cliflag.NamedFlagSets {
 	fs.StringVar(&o.Opts.KubeClusterDomain, "cluster-domain", o.Opts.KubeClusterDomain, "kubernetes cluster-domain (default is 'cluster.local')")
 	fs.StringVar(&o.Opts.NodeName, "nodename", o.Opts.NodeName, "kubernetes node name")
 	fs.StringVar(&o.Opts.OperatingSystem, "os", o.Opts.OperatingSystem, "Operating System (Linux/Windows)")
+	fs.StringVar(&o.Opts.Architecture, "arch", o.Opts.Architecture, "Architecture advertised by the virtual node (amd64/arm64)")
+	fs.StringVar(&o.Opts.Region, "region", o.Opts.Region, "topology region of the virtual node (default is the region shared by the client cluster nodes)")
+	fs.StringVar(&o.Opts.Zone, "zone", o.Opts.Zone, "topology zone of the virtual node (default is the zone shared by the client cluster nodes)")
+	fs.StringVar(&o.Opts.NodeSelector, "node-selector", o.Opts.NodeSelector, "label selector of the client cluster nodes the virtual node represents (default is all nodes)")
+	fs.StringVar(&o.Opts.NodeLabelsFile, "node-labels-file", o.Opts.NodeLabelsFile, "path of a YAML or JSON file holding a map of labels set on the virtual node")
+	fs.StringVar(&o.Opts.ProviderID, "provider-id", o.Opts.ProviderID, "provider ID of the virtual node, e.g. clusterrouter://<cluster>")
+	fs.StringVar(&o.Opts.ExcludeNodeKey, "exclude-node-key", o.Opts.ExcludeNodeKey, "label or annotation key excluding client cluster nodes with the value true from the virtual node")
+	fs.StringVar(&o.Opts.NodeReserved, "node-reserved", o.Opts.NodeReserved, "resources reserved on every client cluster node, e.g. cpu=500m,memory=5%")
+	fs.StringVar(&o.Opts.Overcommit, "overcommit", o.Opts.Overcommit, "ratios the client cluster capacity is multiplied with when advertised, e.g. cpu=2.0")
+	fs.StringVar(&o.Opts.NamespacePrefix, "namespace-prefix", o.Opts.NamespacePrefix, "prefix prepended to the namespaces of pods created in the client cluster")
 	fs.StringVar(&o.Opts.Provider, "provider", o.Opts.Provider, "cloud provider")
 	fs.StringVar(&o.Opts.ProviderConfigPath, "provider-config", o.Opts.ProviderConfigPath, "cloud provider configuration file")
 	fs.StringVar(&o.Opts.MetricsAddr, "metrics-addr", o.Opts.MetricsAddr, "address to listen for metrics/stats requests")
@@ -105,6 +115,13 @@ func (o *Options) Flags() cliflag.NamedFlagSets {
 	fs.BoolVar(&o.Opts.EnableNodeLease, "enable-node-lease", o.Opts.EnableNodeLease, `use node leases (1.13) for node heartbeats`)
 
 	fs.DurationVar(&o.Opts.InformerResyncPeriod, "full-resync-period", o.Opts.InformerResyncPeriod, "how often to perform a full resync of pods between kubernetes and the provider")
+	fs.DurationVar(&o.Opts.PingTimeout, "ping-timeout", o.Opts.PingTimeout, "How long a single ping of the master or client apiserver may take")
+	fs.DurationVar(&o.Opts.NodeHeartbeatTimeout, "node-heartbeat-timeout", o.Opts.NodeHeartbeatTimeout, "How recent the last heartbeat of a client cluster node must be for it to count as ready, 0 disables the check")
+	fs.DurationVar(&o.Opts.NodeStatusInterval, "node-status-interval", o.Opts.NodeStatusInterval, "How often the status of the virtual node is reported even if nothing changed, 0 only reports changes")
+	fs.DurationVar(&o.Opts.CapacityHysteresis, "capacity-hysteresis", o.Opts.CapacityHysteresis, "How long the resources used by pods must stay lower before the allocatable grows, 0 disables it")
+	fs.BoolVar(&o.Opts.CountBoundPods, "count-bound-pods", o.Opts.CountBoundPods, "count pods bound to a client cluster node which did not report a phase yet as using resources")
+	fs.Float64Var(&o.Opts.PressureThreshold, "pressure-threshold", o.Opts.PressureThreshold, "percentage of the allocatable memory or ephemeral storage of the client cluster which, once used, puts the virtual node under pressure, 0 disables it")
+	fs.DurationVar(&o.Opts.CapacityCacheTTL, "capacity-cache-ttl", o.Opts.CapacityCacheTTL, "How long the capacity aggregated over the client cluster is cached, 0 disables caching")
 	fs.DurationVar(&o.Opts.StartupTimeout, "startup-timeout", o.Opts.StartupTimeout, "How long to wait for the cluster-router to start")
 
 	fs.Int32Var(&o.Opts.KubeAPIQPS, "kube-api-qps", o.Opts.KubeAPIQPS,
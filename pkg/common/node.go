@@ -12,8 +12,36 @@ type ProviderNode struct {
 	*corev1.Node
 }
 
-// AddResource add resource to the node
+// AddResource add resource to the allocatable of the node
 func (n *ProviderNode) AddResource(resource *Resource) error {
+	if n.Node == nil {
+		return fmt.Errorf("ProviderNode node has not init")
+	}
+	n.Lock()
+	defer n.Unlock()
+	vkResource := ConvertResource(n.Status.Allocatable)
+
+	vkResource.Add(resource)
+	vkResource.SetAllocatableToNode(n.Node)
+	return nil
+}
+
+// SubResource sub resource from the allocatable of the node
+func (n *ProviderNode) SubResource(resource *Resource) error {
+	if n.Node == nil {
+		return fmt.Errorf("ProviderNode node has not init")
+	}
+	n.Lock()
+	defer n.Unlock()
+	vkResource := ConvertResource(n.Status.Allocatable)
+
+	vkResource.Sub(resource)
+	vkResource.SetAllocatableToNode(n.Node)
+	return nil
+}
+
+// AddCapacity add resource to the capacity of the node
+func (n *ProviderNode) AddCapacity(resource *Resource) error {
 	if n.Node == nil {
 		return fmt.Errorf("ProviderNode node has not init")
 	}
@@ -26,8 +54,8 @@ func (n *ProviderNode) AddResource(resource *Resource) error {
 	return nil
 }
 
-// SubResource sub resource from the node
-func (n *ProviderNode) SubResource(resource *Resource) error {
+// SubCapacity sub resource from the capacity of the node
+func (n *ProviderNode) SubCapacity(resource *Resource) error {
 	if n.Node == nil {
 		return fmt.Errorf("ProviderNode node has not init")
 	}
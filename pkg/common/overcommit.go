@@ -0,0 +1,61 @@
+package common
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// OvercommitRatios maps resources to the factor their capacity is multiplied with when advertised. Resources without a
+// ratio are advertised as is, that is with a ratio of 1.0.
+type OvercommitRatios map[corev1.ResourceName]float64
+
+// ParseOvercommitRatios parses a comma separated list of ratios of the form name=ratio, for example "cpu=2.0". Every
+// ratio must be greater than 0.
+func ParseOvercommitRatios(spec string) (OvercommitRatios, error) {
+	ratios := OvercommitRatios{}
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		kv := strings.SplitN(item, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("overcommit ratio %q must be of the form name=ratio", item)
+		}
+		ratio, err := strconv.ParseFloat(strings.TrimSpace(kv[1]), 64)
+		if err != nil {
+			return nil, fmt.Errorf("overcommit ratio %q is not a number: %v", item, err)
+		}
+		if ratio <= 0 {
+			return nil, fmt.Errorf("overcommit ratio %q must be greater than 0", item)
+		}
+		ratios[corev1.ResourceName(strings.TrimSpace(kv[0]))] = ratio
+	}
+	return ratios, nil
+}
+
+// Apply multiplies the resources of r with their ratio
+func (o OvercommitRatios) Apply(r *Resource) {
+	if len(o) == 0 {
+		return
+	}
+	r.CPU = o.scale(corev1.ResourceCPU, r.CPU)
+	r.Memory = o.scale(corev1.ResourceMemory, r.Memory)
+	r.Pods = o.scale(corev1.ResourcePods, r.Pods)
+	r.EphemeralStorage = o.scale(corev1.ResourceEphemeralStorage, r.EphemeralStorage)
+	for name, quota := range r.Custom {
+		r.Custom[name] = o.scale(name, quota)
+	}
+}
+
+func (o OvercommitRatios) scale(name corev1.ResourceName, q resource.Quantity) resource.Quantity {
+	ratio, ok := o[name]
+	if !ok || ratio == 1 {
+		return q
+	}
+	return *resource.NewMilliQuantity(int64(float64(q.MilliValue())*ratio), q.Format)
+}
@@ -0,0 +1,63 @@
+package common
+
+import (
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+func TestParseOvercommitRatios(t *testing.T) {
+	tests := []struct {
+		name    string
+		spec    string
+		want    OvercommitRatios
+		wantErr bool
+	}{
+		{name: "empty", spec: "", want: OvercommitRatios{}},
+		{
+			name: "ratios",
+			spec: "cpu=2.0, memory=1,",
+			want: OvercommitRatios{corev1.ResourceCPU: 2, corev1.ResourceMemory: 1},
+		},
+		{name: "missing ratio", spec: "cpu", wantErr: true},
+		{name: "not a number", spec: "cpu=double", wantErr: true},
+		{name: "zero", spec: "cpu=0", wantErr: true},
+		{name: "negative", spec: "cpu=-1.5", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseOvercommitRatios(tt.spec)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("expected error %t, got %v", tt.wantErr, err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("expected ratios %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestOvercommitRatiosApply(t *testing.T) {
+	ratios, err := ParseOvercommitRatios("cpu=2.0,memory=1.0,nvidia.com/gpu=1.5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := ConvertResource(corev1.ResourceList{
+		corev1.ResourceCPU:    resource.MustParse("4"),
+		corev1.ResourceMemory: resource.MustParse("8Gi"),
+		corev1.ResourcePods:   resource.MustParse("110"),
+		"nvidia.com/gpu":      resource.MustParse("2"),
+	})
+	ratios.Apply(r)
+	want := ConvertResource(corev1.ResourceList{
+		corev1.ResourceCPU:    resource.MustParse("8"),
+		corev1.ResourceMemory: resource.MustParse("8Gi"),
+		corev1.ResourcePods:   resource.MustParse("110"),
+		"nvidia.com/gpu":      resource.MustParse("3"),
+	})
+	if !r.Equal(want) {
+		t.Fatalf("expected %s once overcommitted, got %s", want, r)
+	}
+}
@@ -0,0 +1,83 @@
+package common
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// Reservation defines the resources reserved on every node for the system and kubelet, which can not be used by pods.
+// A resource is either reserved as an absolute quantity, or as a percentage of the capacity of the node.
+type Reservation struct {
+	// Absolute holds the resources reserved as a fixed quantity per node
+	Absolute corev1.ResourceList
+	// Percent holds the resources reserved as a percentage of the capacity of a node
+	Percent map[corev1.ResourceName]float64
+}
+
+// ParseReservation parses a comma separated list of reservations of the form name=quantity or name=percent%, for
+// example "cpu=500m,memory=5%".
+func ParseReservation(spec string) (*Reservation, error) {
+	r := &Reservation{
+		Absolute: corev1.ResourceList{},
+		Percent:  map[corev1.ResourceName]float64{},
+	}
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		kv := strings.SplitN(item, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("reservation %q must be of the form name=quantity or name=percent%%", item)
+		}
+		name, value := corev1.ResourceName(strings.TrimSpace(kv[0])), strings.TrimSpace(kv[1])
+		if strings.HasSuffix(value, "%") {
+			pct, err := strconv.ParseFloat(strings.TrimSuffix(value, "%"), 64)
+			if err != nil || pct < 0 || pct > 100 {
+				return nil, fmt.Errorf("reservation %q has an invalid percentage", item)
+			}
+			r.Percent[name] = pct
+			continue
+		}
+		quantity, err := resource.ParseQuantity(value)
+		if err != nil {
+			return nil, fmt.Errorf("reservation %q has an invalid quantity: %v", item, err)
+		}
+		if quantity.Sign() < 0 {
+			return nil, fmt.Errorf("reservation %q must not be negative", item)
+		}
+		r.Absolute[name] = quantity
+	}
+	return r, nil
+}
+
+// IsEmpty returns true if nothing is reserved
+func (r *Reservation) IsEmpty() bool {
+	return r == nil || len(r.Absolute) == 0 && len(r.Percent) == 0
+}
+
+// For returns the resources reserved on a single node with the given capacity. Resources the node does not have are
+// not reserved.
+func (r *Reservation) For(capacity corev1.ResourceList) *Resource {
+	if r.IsEmpty() {
+		return NewResource()
+	}
+	reserved := corev1.ResourceList{}
+	for name, quantity := range r.Absolute {
+		if _, ok := capacity[name]; ok {
+			reserved[name] = quantity.DeepCopy()
+		}
+	}
+	for name, pct := range r.Percent {
+		total, ok := capacity[name]
+		if !ok {
+			continue
+		}
+		reserved[name] = *resource.NewMilliQuantity(int64(float64(total.MilliValue())*pct/100), total.Format)
+	}
+	return ConvertResource(reserved)
+}
@@ -0,0 +1,78 @@
+package common
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+func TestParseReservation(t *testing.T) {
+	tests := []struct {
+		name        string
+		spec        string
+		wantAbs     corev1.ResourceList
+		wantPercent map[corev1.ResourceName]float64
+		wantErr     bool
+	}{
+		{name: "empty", spec: ""},
+		{
+			name:        "absolute and percent",
+			spec:        "cpu=500m, memory=5%,",
+			wantAbs:     corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("500m")},
+			wantPercent: map[corev1.ResourceName]float64{corev1.ResourceMemory: 5},
+		},
+		{name: "missing quantity", spec: "cpu", wantErr: true},
+		{name: "empty name", spec: "=1", wantErr: true},
+		{name: "invalid quantity", spec: "cpu=lots", wantErr: true},
+		{name: "negative quantity", spec: "cpu=-1", wantErr: true},
+		{name: "percent over 100", spec: "memory=101%", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := ParseReservation(tt.spec)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("expected error %t, got %v", tt.wantErr, err)
+			}
+			if tt.wantErr {
+				return
+			}
+			if len(r.Absolute) != len(tt.wantAbs) || len(r.Percent) != len(tt.wantPercent) {
+				t.Fatalf("expected %v and %v, got %v and %v", tt.wantAbs, tt.wantPercent, r.Absolute, r.Percent)
+			}
+			for name, want := range tt.wantAbs {
+				if got := r.Absolute[name]; !got.Equal(want) {
+					t.Fatalf("expected %s to be reserved %s, got %s", name, want.String(), got.String())
+				}
+			}
+			for name, want := range tt.wantPercent {
+				if got := r.Percent[name]; got != want {
+					t.Fatalf("expected %v%% of %s to be reserved, got %v%%", want, name, got)
+				}
+			}
+		})
+	}
+}
+
+func TestReservationFor(t *testing.T) {
+	r, err := ParseReservation("cpu=500m,memory=10%,nvidia.com/gpu=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reserved := r.For(corev1.ResourceList{
+		corev1.ResourceCPU:    resource.MustParse("4"),
+		corev1.ResourceMemory: resource.MustParse("10Gi"),
+	})
+	want := ConvertResource(corev1.ResourceList{
+		corev1.ResourceCPU:    resource.MustParse("500m"),
+		corev1.ResourceMemory: resource.MustParse("1Gi"),
+	})
+	// The node has no GPUs, so none are reserved
+	if !reserved.Equal(want) {
+		t.Fatalf("expected %s to be reserved, got %s", want, reserved)
+	}
+	var empty *Reservation
+	if !empty.For(corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("4")}).Equal(NewResource()) {
+		t.Fatal("expected a nil reservation to reserve nothing")
+	}
+}
@@ -1,19 +1,26 @@
 package common
 
 import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/resource"
-	"k8s.io/klog"
+	"k8s.io/klog/v2"
 )
 
-// CustomResources is a key-value map for defining custom resources
+// CustomResources is a key-value map for defining custom resources. It holds every resource other than cpu, memory,
+// pods, and ephemeral-storage, such as extended resources like nvidia.com/gpu, so they are summed and advertised on the
+// virtual node along with the core resources.
 type CustomResources map[corev1.ResourceName]resource.Quantity
 
 // DeepCopy copy the custom resource
 func (cr CustomResources) DeepCopy() CustomResources {
 	crCopy := CustomResources{}
 	for name, quota := range cr {
-		crCopy[name] = quota
+		crCopy[name] = quota.DeepCopy()
 	}
 	return crCopy
 }
@@ -46,7 +53,7 @@ type Resource struct {
 	Pods resource.Quantity
 	// EphemeralStorage requirement
 	EphemeralStorage resource.Quantity
-	// Custom resource requirement
+	// Custom resource requirement, including extended resources such as GPUs
 	Custom CustomResources
 }
 
@@ -57,12 +64,47 @@ func NewResource() *Resource {
 	}
 }
 
+// Clone returns a deep copy of the resource, which can be modified without affecting the original
+func (r *Resource) Clone() *Resource {
+	if r == nil {
+		return nil
+	}
+	return &Resource{
+		CPU:              r.CPU.DeepCopy(),
+		Memory:           r.Memory.DeepCopy(),
+		Pods:             r.Pods.DeepCopy(),
+		EphemeralStorage: r.EphemeralStorage.DeepCopy(),
+		Custom:           r.Custom.DeepCopy(),
+	}
+}
+
 // Equal is for two resources comparision
 func (r *Resource) Equal(other *Resource) bool {
 	return r.CPU.Equal(other.CPU) && r.Memory.Equal(other.Memory) && r.Pods.Equal(other.Pods) && r.
 		EphemeralStorage.Equal(other.EphemeralStorage) && r.Custom.Equal(other.Custom)
 }
 
+// LessThanOrEqual returns true if every resource of r is less than or equal to the same resource of other. Resources
+// missing from either side count as zero.
+func (r *Resource) LessThanOrEqual(other *Resource) bool {
+	if r.CPU.Cmp(other.CPU) > 0 || r.Memory.Cmp(other.Memory) > 0 || r.Pods.Cmp(other.Pods) > 0 ||
+		r.EphemeralStorage.Cmp(other.EphemeralStorage) > 0 {
+		return false
+	}
+	for name, quota := range r.Custom {
+		available := other.Custom[name]
+		if quota.Cmp(available) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Fits returns true if req fits into the resources of r
+func (r *Resource) Fits(req *Resource) bool {
+	return req.LessThanOrEqual(r)
+}
+
 // Add adds resource to the current one
 func (r *Resource) Add(nc *Resource) {
 	r.CPU.Add(nc.CPU)
@@ -82,6 +124,28 @@ func (r *Resource) Add(nc *Resource) {
 	}
 }
 
+// Max raises every resource of r to the same resource of other, if that is larger
+func (r *Resource) Max(other *Resource) {
+	maxQuantity(&r.CPU, other.CPU)
+	maxQuantity(&r.Memory, other.Memory)
+	maxQuantity(&r.Pods, other.Pods)
+	maxQuantity(&r.EphemeralStorage, other.EphemeralStorage)
+	for name, quota := range other.Custom {
+		if r.Custom == nil {
+			r.Custom = CustomResources{}
+		}
+		current := r.Custom[name]
+		maxQuantity(&current, quota)
+		r.Custom[name] = current
+	}
+}
+
+func maxQuantity(q *resource.Quantity, other resource.Quantity) {
+	if other.Cmp(*q) > 0 {
+		*q = other.DeepCopy()
+	}
+}
+
 // Sub subs resource from the current one
 func (r *Resource) Sub(nc *Resource) {
 	r.CPU.Sub(nc.CPU)
@@ -101,36 +165,168 @@ func (r *Resource) Sub(nc *Resource) {
 	}
 }
 
+// SubClamped subs resource from the current one like Sub, but floors every resource at zero, so usage which
+// momentarily exceeds the capacity, for example because of informer lag, never results in a negative capacity. Unlike
+// Sub it is not undone by Add, so it must only be used on values computed from scratch, not on running totals.
+func (r *Resource) SubClamped(nc *Resource) {
+	subClamped(&r.CPU, nc.CPU)
+	subClamped(&r.Memory, nc.Memory)
+	subClamped(&r.Pods, nc.Pods)
+	subClamped(&r.EphemeralStorage, nc.EphemeralStorage)
+	if len(nc.Custom) == 0 {
+		return
+	}
+	for name, quota := range nc.Custom {
+		if r.Custom == nil {
+			r.Custom = CustomResources{}
+		}
+		old := r.Custom[name]
+		subClamped(&old, quota)
+		r.Custom[name] = old
+	}
+}
+
+// subClamped subtracts y from q, setting q to zero if the result would be negative
+func subClamped(q *resource.Quantity, y resource.Quantity) {
+	q.Sub(y)
+	if q.Sign() < 0 {
+		*q = *resource.NewQuantity(0, q.Format)
+	}
+}
+
+// FloorExtendedResources rounds extended resources, such as devices.kubevirt.io/kvm or intel.com/sgx advertised by
+// device plugins, down to whole units. The apiserver rejects nodes advertising fractions of them, which percentage
+// reservations and overcommit ratios may otherwise produce. Only the quantities change, every resource keeps its name,
+// and hugepages, which are no extended resources, are left as they are.
+func (r *Resource) FloorExtendedResources() {
+	for name, quota := range r.Custom {
+		if isExtendedResourceName(name) && quota.MilliValue()%1000 != 0 {
+			r.Custom[name] = *resource.NewQuantity(quota.MilliValue()/1000, quota.Format)
+		}
+	}
+}
+
+// isExtendedResourceName returns true for resources outside of the kubernetes.io namespace, whose quantities must be
+// whole numbers
+func isExtendedResourceName(name corev1.ResourceName) bool {
+	s := string(name)
+	return strings.Contains(s, "/") && !strings.Contains(s, corev1.ResourceDefaultNamespacePrefix) &&
+		!strings.HasPrefix(s, corev1.DefaultResourceRequestsPrefix)
+}
+
 // SetCapacityToNode set the resource the cluster-router node
 func (r *Resource) SetCapacityToNode(node *corev1.Node) {
+	node.Status.Capacity = r.ResourceList()
+	klog.Infof("Set node capacity to %s", r)
+}
+
+// SetAllocatableToNode set the resource of the cluster-router node which can be used by pods
+func (r *Resource) SetAllocatableToNode(node *corev1.Node) {
+	node.Status.Allocatable = r.ResourceList()
+}
+
+// ResourceList converts the resource back to a ResourceList, the reverse of ConvertResource. The core resources are
+// always present, zero if unset, and every custom resource is kept, so no resource is dropped on the round trip. The
+// quantities are copies, the list can be modified without affecting the resource.
+func (r *Resource) ResourceList() corev1.ResourceList {
 	var CPU, mem, Pods, empStorage resource.Quantity
 	if !r.CPU.IsZero() {
-		CPU = r.CPU
+		CPU = r.CPU.DeepCopy()
 	}
 	if !r.Memory.IsZero() {
-		mem = r.Memory
+		mem = r.Memory.DeepCopy()
 	}
 	if !r.Pods.IsZero() {
-		Pods = r.Pods
+		Pods = r.Pods.DeepCopy()
 	}
 	if !r.EphemeralStorage.IsZero() {
-		empStorage = r.EphemeralStorage
+		empStorage = r.EphemeralStorage.DeepCopy()
 	}
-	node.Status.Capacity = corev1.ResourceList{
+	list := corev1.ResourceList{
 		corev1.ResourceCPU:              CPU,
 		corev1.ResourceMemory:           mem,
 		corev1.ResourcePods:             Pods,
 		corev1.ResourceEphemeralStorage: empStorage,
 	}
 	for name, quota := range r.Custom {
-		node.Status.Capacity[name] = quota
+		list[name] = quota.DeepCopy()
 	}
+	return list
+}
 
-	node.Status.Allocatable = node.Status.Capacity.DeepCopy()
-	klog.Infof("%v", node.Status.Capacity)
+// String returns the non-zero resources in the form "cpu=2 memory=4Gi pods=110 nvidia.com/gpu=1", with custom
+// resources sorted by name.
+func (r *Resource) String() string {
+	var parts []string
+	for _, q := range r.quantities() {
+		if q.quantity.IsZero() {
+			continue
+		}
+		parts = append(parts, fmt.Sprintf("%s=%s", q.name, q.quantity.String()))
+	}
+	if len(parts) == 0 {
+		return "<empty>"
+	}
+	return strings.Join(parts, " ")
+}
+
+// MarshalJSON encodes the resource as an object of resource names to quantity strings
+func (r *Resource) MarshalJSON() ([]byte, error) {
+	out := make(map[corev1.ResourceName]string)
+	for _, q := range r.quantities() {
+		out[q.name] = q.quantity.String()
+	}
+	return json.Marshal(out)
+}
+
+type namedQuantity struct {
+	name     corev1.ResourceName
+	quantity resource.Quantity
+}
+
+// quantities returns all resources, the core resources first followed by the custom resources sorted by name
+func (r *Resource) quantities() []namedQuantity {
+	quantities := []namedQuantity{
+		{name: corev1.ResourceCPU, quantity: r.CPU},
+		{name: corev1.ResourceMemory, quantity: r.Memory},
+		{name: corev1.ResourcePods, quantity: r.Pods},
+		{name: corev1.ResourceEphemeralStorage, quantity: r.EphemeralStorage},
+	}
+	names := make([]string, 0, len(r.Custom))
+	for name := range r.Custom {
+		names = append(names, string(name))
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		quantities = append(quantities, namedQuantity{
+			name:     corev1.ResourceName(name),
+			quantity: r.Custom[corev1.ResourceName(name)],
+		})
+	}
+	return quantities
+}
+
+// canonicalResourceName returns the canonical name of a hugepages resource, the page size in the canonical form of a
+// quantity. Other names are returned as is.
+func canonicalResourceName(name corev1.ResourceName) corev1.ResourceName {
+	size := strings.TrimPrefix(string(name), corev1.ResourceHugePagesPrefix)
+	if size == string(name) {
+		return name
+	}
+	quantity, err := resource.ParseQuantity(size)
+	if err != nil {
+		return name
+	}
+	return corev1.ResourceName(corev1.ResourceHugePagesPrefix + quantity.String())
 }
 
 // ConvertResource converts ResourceList to Resource
+//
+// ephemeral-storage is tracked as EphemeralStorage, while hugepages-<size> and extended resources are carried in
+// Custom, so all of them are advertised by SetCapacityToNode and accounted for in pod usage. There is no list of known
+// resources, any other name, like devices.kubevirt.io/kvm, is passed through as is. Every page size is kept
+// as a resource of its own, with its name in canonical form, so the same size spelled differently by different nodes,
+// like hugepages-2048Ki and hugepages-2Mi, is summed, while different sizes never are.
 func ConvertResource(resources corev1.ResourceList) *Resource {
 	var cpu, mem, pods, empStorage resource.Quantity
 	customResource := CustomResources{}
@@ -145,7 +341,10 @@ func ConvertResource(resources corev1.ResourceList) *Resource {
 		case corev1.ResourceEphemeralStorage:
 			empStorage = quota
 		default:
-			customResource[resourceName] = quota
+			resourceName = canonicalResourceName(resourceName)
+			total := customResource[resourceName]
+			total.Add(quota)
+			customResource[resourceName] = total
 		}
 	}
 	return &Resource{
@@ -0,0 +1,334 @@
+package common
+
+import (
+	"encoding/json"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+func TestFloorExtendedResources(t *testing.T) {
+	r := ConvertResource(corev1.ResourceList{
+		corev1.ResourceCPU:                    resource.MustParse("1500m"),
+		"nvidia.com/gpu":                      resource.MustParse("1500m"),
+		"devices.kubevirt.io/kvm":             resource.MustParse("2"),
+		"intel.com/sgx":                       resource.MustParse("999m"),
+		"hugepages-2048Ki":                    resource.MustParse("1500m"),
+		"example.kubernetes.io/foo":           resource.MustParse("1500m"),
+		corev1.ResourceName("requests.a/b"):   resource.MustParse("1500m"),
+		corev1.ResourceName("unprefixed-res"): resource.MustParse("1500m"),
+	})
+	names := map[corev1.ResourceName]bool{}
+	for name := range r.Custom {
+		names[name] = true
+	}
+
+	r.FloorExtendedResources()
+
+	want := map[corev1.ResourceName]string{
+		"nvidia.com/gpu":            "1",
+		"devices.kubevirt.io/kvm":   "2",
+		"intel.com/sgx":             "0",
+		"hugepages-2Mi":             "1500m",
+		"example.kubernetes.io/foo": "1500m",
+		"requests.a/b":              "1500m",
+		"unprefixed-res":            "1500m",
+	}
+	if len(r.Custom) != len(names) {
+		t.Fatalf("expected %d resources, got %v", len(names), r.Custom)
+	}
+	for name, quantity := range want {
+		if !names[name] {
+			t.Fatalf("expected resource %s before flooring, got %v", name, names)
+		}
+		got, ok := r.Custom[name]
+		if !ok {
+			t.Fatalf("resource %s was renamed or dropped, got %v", name, r.Custom)
+		}
+		if !got.Equal(resource.MustParse(quantity)) {
+			t.Errorf("expected %s to be %s, got %s", name, quantity, got.String())
+		}
+	}
+	if !r.CPU.Equal(resource.MustParse("1500m")) {
+		t.Errorf("expected cpu to keep its fraction, got %s", r.CPU.String())
+	}
+}
+
+func TestResourceExtendedResources(t *testing.T) {
+	gpu := corev1.ResourceName("nvidia.com/gpu")
+	first := corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("4"), gpu: resource.MustParse("2")}
+	second := corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("2"), gpu: resource.MustParse("4")}
+
+	total := NewResource()
+	total.Add(ConvertResource(first))
+	total.Add(ConvertResource(second))
+	if got := total.Custom[gpu]; !got.Equal(resource.MustParse("6")) {
+		t.Fatalf("expected 6 GPUs in total, got %s", got.String())
+	}
+	// Summing must not alias the quantities of the nodes
+	if got := first[gpu]; !got.Equal(resource.MustParse("2")) {
+		t.Fatalf("expected the first list to keep 2 GPUs, got %s", got.String())
+	}
+
+	total.Sub(ConvertResource(corev1.ResourceList{gpu: resource.MustParse("1")}))
+	node := &corev1.Node{}
+	total.SetCapacityToNode(node)
+	if got := node.Status.Capacity[gpu]; !got.Equal(resource.MustParse("5")) {
+		t.Fatalf("expected the node to advertise 5 GPUs, got %s", got.String())
+	}
+	if got := node.Status.Capacity[corev1.ResourceCPU]; !got.Equal(resource.MustParse("6")) {
+		t.Fatalf("expected the node to advertise 6 cpus, got %s", got.String())
+	}
+}
+
+func TestConvertResourceStorageAndHugepages(t *testing.T) {
+	r := ConvertResource(corev1.ResourceList{
+		corev1.ResourceEphemeralStorage: resource.MustParse("100Gi"),
+		"hugepages-2048Ki":              resource.MustParse("1Gi"),
+		"hugepages-2Mi":                 resource.MustParse("1Gi"),
+		"hugepages-1Gi":                 resource.MustParse("2Gi"),
+	})
+	if !r.EphemeralStorage.Equal(resource.MustParse("100Gi")) {
+		t.Fatalf("expected 100Gi of ephemeral storage, got %s", r.EphemeralStorage.String())
+	}
+	// Both spellings of the 2Mi page size are summed, while the 1Gi pages are kept apart
+	want := CustomResources{"hugepages-2Mi": resource.MustParse("2Gi"), "hugepages-1Gi": resource.MustParse("2Gi")}
+	if !r.Custom.Equal(want) {
+		t.Fatalf("expected hugepages %v, got %v", want, r.Custom)
+	}
+
+	list := r.ResourceList()
+	for name, quantity := range map[corev1.ResourceName]string{
+		corev1.ResourceEphemeralStorage: "100Gi",
+		"hugepages-2Mi":                 "2Gi",
+		"hugepages-1Gi":                 "2Gi",
+	} {
+		if got := list[name]; !got.Equal(resource.MustParse(quantity)) {
+			t.Fatalf("expected %s of %s in the resource list, got %s", quantity, name, got.String())
+		}
+	}
+}
+
+func TestResourceClone(t *testing.T) {
+	original := ConvertResource(corev1.ResourceList{
+		corev1.ResourceCPU:    resource.MustParse("2"),
+		corev1.ResourceMemory: resource.MustParse("4Gi"),
+		"nvidia.com/gpu":      resource.MustParse("1"),
+	})
+	clone := original.Clone()
+	if !clone.Equal(original) {
+		t.Fatalf("expected the clone %s to equal the original %s", clone, original)
+	}
+	clone.Add(ConvertResource(corev1.ResourceList{
+		corev1.ResourceCPU: resource.MustParse("1"),
+		"nvidia.com/gpu":   resource.MustParse("1"),
+	}))
+	clone.Custom["example.com/foo"] = resource.MustParse("1")
+	if !original.CPU.Equal(resource.MustParse("2")) || len(original.Custom) != 1 {
+		t.Fatalf("expected the original to be left as is, got %s", original)
+	}
+	if gpus := original.Custom["nvidia.com/gpu"]; !gpus.Equal(resource.MustParse("1")) {
+		t.Fatalf("expected the original to keep 1 GPU, got %s", gpus.String())
+	}
+	var empty *Resource
+	if empty.Clone() != nil {
+		t.Fatal("expected the clone of nil to be nil")
+	}
+}
+
+func TestResourceFits(t *testing.T) {
+	list := func(cpu, memory, gpus string) *Resource {
+		l := corev1.ResourceList{}
+		for name, q := range map[corev1.ResourceName]string{
+			corev1.ResourceCPU: cpu, corev1.ResourceMemory: memory, "nvidia.com/gpu": gpus} {
+			if q != "" {
+				l[name] = resource.MustParse(q)
+			}
+		}
+		return ConvertResource(l)
+	}
+	available := list("4", "8Gi", "2")
+	tests := []struct {
+		name string
+		req  *Resource
+		want bool
+	}{
+		{name: "exact fit", req: list("4", "8Gi", "2"), want: true},
+		{name: "smaller", req: list("1", "1Gi", ""), want: true},
+		{name: "empty", req: NewResource(), want: true},
+		{name: "over cpu", req: list("4100m", "1Gi", ""), want: false},
+		{name: "over memory", req: list("1", "9Gi", ""), want: false},
+		{name: "over GPUs", req: list("1", "1Gi", "3"), want: false},
+		{name: "resource not available", req: ConvertResource(corev1.ResourceList{
+			"example.com/foo": resource.MustParse("1")}), want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := available.Fits(tt.req); got != tt.want {
+				t.Fatalf("expected %s to fit into %s: %t", tt.req, available, tt.want)
+			}
+			if got := tt.req.LessThanOrEqual(available); got != tt.want {
+				t.Fatalf("expected %s to be less than or equal to %s: %t", tt.req, available, tt.want)
+			}
+		})
+	}
+	// Resources missing from the request count as zero
+	if !NewResource().LessThanOrEqual(list("", "", "")) {
+		t.Fatal("expected an empty resource to be less than or equal to another empty resource")
+	}
+}
+
+func TestResourceString(t *testing.T) {
+	r := ConvertResource(corev1.ResourceList{
+		corev1.ResourceCPU:    resource.MustParse("2"),
+		corev1.ResourceMemory: resource.MustParse("4Gi"),
+		corev1.ResourcePods:   resource.MustParse("110"),
+		"nvidia.com/gpu":      resource.MustParse("1"),
+		"example.com/foo":     resource.MustParse("3"),
+	})
+	if got, want := r.String(), "cpu=2 memory=4Gi pods=110 example.com/foo=3 nvidia.com/gpu=1"; got != want {
+		t.Fatalf("expected %q, got %q", want, got)
+	}
+	if got := NewResource().String(); got != "<empty>" {
+		t.Fatalf("expected an empty resource to be formatted as <empty>, got %q", got)
+	}
+}
+
+func TestResourceMarshalJSON(t *testing.T) {
+	r := ConvertResource(corev1.ResourceList{
+		corev1.ResourceCPU:    resource.MustParse("1500m"),
+		corev1.ResourceMemory: resource.MustParse("4Gi"),
+		"nvidia.com/gpu":      resource.MustParse("1"),
+	})
+	data, err := json.Marshal(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"cpu":"1500m","ephemeral-storage":"0","memory":"4Gi","nvidia.com/gpu":"1","pods":"0"}`
+	if string(data) != want {
+		t.Fatalf("expected %s, got %s", want, data)
+	}
+	if data, err = json.Marshal(NewResource()); err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"cpu":"0","ephemeral-storage":"0","memory":"0","pods":"0"}`; string(data) != want {
+		t.Fatalf("expected %s, got %s", want, data)
+	}
+}
+
+func TestResourceListRoundTrip(t *testing.T) {
+	list := corev1.ResourceList{
+		corev1.ResourceCPU:              resource.MustParse("4"),
+		corev1.ResourceMemory:           resource.MustParse("8Gi"),
+		corev1.ResourcePods:             resource.MustParse("110"),
+		corev1.ResourceEphemeralStorage: resource.MustParse("100Gi"),
+		"nvidia.com/gpu":                resource.MustParse("2"),
+		"example.com/foo":               resource.MustParse("500m"),
+	}
+	r := ConvertResource(list)
+	got := r.ResourceList()
+	if len(got) != len(list) {
+		t.Fatalf("expected %d resources, got %v", len(list), got)
+	}
+	for name, quantity := range list {
+		if q, ok := got[name]; !ok || !q.Equal(quantity) {
+			t.Fatalf("expected %s to be %s, got %s", name, quantity.String(), q.String())
+		}
+	}
+
+	node := &corev1.Node{}
+	r.SetCapacityToNode(node)
+	if q := node.Status.Capacity["nvidia.com/gpu"]; !q.Equal(resource.MustParse("2")) {
+		t.Fatalf("expected the node capacity to keep the custom resource, got %v", node.Status.Capacity)
+	}
+	// The list is a copy, modifying it leaves the resource unchanged
+	q := got[corev1.ResourceCPU]
+	q.Add(resource.MustParse("1"))
+	got[corev1.ResourceCPU] = q
+	if !r.CPU.Equal(resource.MustParse("4")) {
+		t.Fatalf("expected the resource to be unchanged, got %s", r.CPU.String())
+	}
+}
+
+func TestResourceSubClamped(t *testing.T) {
+	tests := []struct {
+		name     string
+		capacity corev1.ResourceList
+		usage    corev1.ResourceList
+		expected corev1.ResourceList
+	}{
+		{
+			name: "usage below capacity",
+			capacity: corev1.ResourceList{
+				corev1.ResourceCPU: resource.MustParse("4"),
+				"nvidia.com/gpu":   resource.MustParse("2"),
+			},
+			usage: corev1.ResourceList{
+				corev1.ResourceCPU: resource.MustParse("1500m"),
+				"nvidia.com/gpu":   resource.MustParse("1"),
+			},
+			expected: corev1.ResourceList{
+				corev1.ResourceCPU: resource.MustParse("2500m"),
+				"nvidia.com/gpu":   resource.MustParse("1"),
+			},
+		},
+		{
+			name: "usage exceeding capacity",
+			capacity: corev1.ResourceList{
+				corev1.ResourceCPU:    resource.MustParse("1"),
+				corev1.ResourceMemory: resource.MustParse("1Gi"),
+				corev1.ResourcePods:   resource.MustParse("10"),
+				"nvidia.com/gpu":      resource.MustParse("1"),
+			},
+			usage: corev1.ResourceList{
+				corev1.ResourceCPU:    resource.MustParse("2"),
+				corev1.ResourceMemory: resource.MustParse("2Gi"),
+				corev1.ResourcePods:   resource.MustParse("11"),
+				"nvidia.com/gpu":      resource.MustParse("3"),
+			},
+			expected: corev1.ResourceList{},
+		},
+		{
+			name:     "usage of resources without capacity",
+			capacity: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("1")},
+			usage: corev1.ResourceList{
+				corev1.ResourceEphemeralStorage: resource.MustParse("1Gi"),
+				"example.com/foo":               resource.MustParse("1"),
+			},
+			expected: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("1")},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := ConvertResource(tt.capacity)
+			r.SubClamped(ConvertResource(tt.usage))
+			for name, quantity := range r.ResourceList() {
+				expected := tt.expected[name]
+				if quantity.Sign() < 0 || !quantity.Equal(expected) {
+					t.Fatalf("expected %s to be %s, got %s", name, expected.String(), quantity.String())
+				}
+			}
+		})
+	}
+}
+
+func TestResourceSubAddRoundTrip(t *testing.T) {
+	capacity := corev1.ResourceList{
+		corev1.ResourceCPU: resource.MustParse("1"),
+		"nvidia.com/gpu":   resource.MustParse("1"),
+	}
+	usage := ConvertResource(corev1.ResourceList{
+		corev1.ResourceCPU: resource.MustParse("2"),
+		"nvidia.com/gpu":   resource.MustParse("3"),
+	})
+	r := ConvertResource(capacity)
+	r.Sub(usage)
+	if r.CPU.Sign() >= 0 {
+		t.Fatalf("expected Sub to go below zero, got %s", r.CPU.String())
+	}
+	r.Add(usage)
+	if want := ConvertResource(capacity); !r.Equal(want) {
+		t.Fatalf("expected Add to undo Sub, got %s", r)
+	}
+}
@@ -20,13 +20,16 @@ import (
 	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/tools/record"
 	"k8s.io/client-go/util/workqueue"
-	"k8s.io/klog"
+	"k8s.io/klog/v2"
 )
 
-// CommonController is a controller sync configMaps and secrets from master cluster to client cluster
+// CommonController is a controller sync configMaps and secrets from master cluster to client cluster. Only the copies
+// created for virtual pods, which are marked global, are updated and deleted in the client cluster.
 type CommonController struct {
 	client        kubernetes.Interface
 	eventRecorder record.EventRecorder
+	// namespaces maps the namespaces of the master cluster to the ones the copies are created in
+	namespaces utils.NamespaceMapping
 
 	configMapQueue workqueue.RateLimitingInterface
 	secretQueue    workqueue.RateLimitingInterface
@@ -44,7 +47,7 @@ type CommonController struct {
 
 // NewCommonController returns a new *CommonController
 func NewCommonController(client kubernetes.Interface,
-	masterInformer, clientInformer informers.SharedInformerFactory,
+	masterInformer, clientInformer informers.SharedInformerFactory, namespaces utils.NamespaceMapping,
 	configMapRateLimiter, secretRateLimiter workqueue.RateLimiter) Controller {
 	broadcaster := record.NewBroadcaster()
 	broadcaster.StartRecordingToSink(&corev1.EventSinkImpl{Interface: client.CoreV1().Events(v1.NamespaceAll)})
@@ -58,6 +61,7 @@ func NewCommonController(client kubernetes.Interface,
 	ctrl := &CommonController{
 		client:        client,
 		eventRecorder: eventRecorder,
+		namespaces:    namespaces,
 
 		configMapQueue: workqueue.NewNamedRateLimitingQueue(configMapRateLimiter, "vk configMap controller"),
 		secretQueue:    workqueue.NewNamedRateLimitingQueue(secretRateLimiter, "vk secret controller"),
@@ -131,7 +135,7 @@ func (ctrl *CommonController) configMapAdd(obj interface{}) {
 func (ctrl *CommonController) configMapUpdated(old, new interface{}) {
 	newConfigMap := new.(*v1.ConfigMap)
 	oldConfigMap := old.(*v1.ConfigMap)
-	if ctrl.shouldEnqueueUpdateConfigMap(oldConfigMap, newConfigMap) && IsObjectGlobal(&newConfigMap.ObjectMeta) {
+	if ctrl.shouldEnqueueUpdateConfigMap(oldConfigMap, newConfigMap) {
 		key, err := cache.MetaNamespaceKeyFunc(new)
 		if err != nil {
 			runtime.HandleError(err)
@@ -180,7 +184,7 @@ func (ctrl *CommonController) secretAdd(obj interface{}) {
 func (ctrl *CommonController) secretUpdated(old, new interface{}) {
 	newSecret := new.(*v1.Secret)
 	oldSecret := old.(*v1.Secret)
-	if ctrl.shouldEnqueueUpdateSecret(oldSecret, newSecret) && IsObjectGlobal(&newSecret.ObjectMeta) {
+	if ctrl.shouldEnqueueUpdateSecret(oldSecret, newSecret) {
 		key, err := cache.MetaNamespaceKeyFunc(new)
 		if err != nil {
 			runtime.HandleError(err)
@@ -233,6 +237,7 @@ func (ctrl *CommonController) syncConfigMap() {
 		}
 		ctrl.configMapQueue.Forget(key)
 	}()
+	clientNamespace := ctrl.namespaces.ToClient(namespace)
 	var configMap *v1.ConfigMap
 	deleteConfigMapInClient := false
 	configMap, err = ctrl.masterConfigMapLister.ConfigMaps(namespace).Get(configMapName)
@@ -240,7 +245,8 @@ func (ctrl *CommonController) syncConfigMap() {
 		if !apierrs.IsNotFound(err) {
 			return
 		}
-		_, err = ctrl.clientConfigMapLister.ConfigMaps(namespace).Get(configMapName)
+		var configMapInClient *v1.ConfigMap
+		configMapInClient, err = ctrl.clientConfigMapLister.ConfigMaps(clientNamespace).Get(configMapName)
 		if err != nil {
 			if !apierrs.IsNotFound(err) {
 				klog.Errorf("Get configMap from master cluster failed, error: %v", err)
@@ -250,12 +256,15 @@ func (ctrl *CommonController) syncConfigMap() {
 			klog.V(3).Infof("ConfigMap %q deleted", configMapName)
 			return
 		}
+		if !IsObjectGlobal(&configMapInClient.ObjectMeta) {
+			return
+		}
 		deleteConfigMapInClient = true
 
 	}
 
 	if deleteConfigMapInClient || configMap.DeletionTimestamp != nil {
-		if err = ctrl.client.CoreV1().ConfigMaps(namespace).Delete(ctx, configMapName,
+		if err = ctrl.client.CoreV1().ConfigMaps(clientNamespace).Delete(ctx, configMapName,
 			metav1.DeleteOptions{}); err != nil {
 			if !apierrs.IsNotFound(err) {
 				klog.Errorf("Delete configMap from client cluster failed, error: %v", err)
@@ -269,7 +278,7 @@ func (ctrl *CommonController) syncConfigMap() {
 
 	// data updated
 	var configmapInClient *v1.ConfigMap
-	configmapInClient, err = ctrl.clientConfigMapLister.ConfigMaps(namespace).Get(configMapName)
+	configmapInClient, err = ctrl.clientConfigMapLister.ConfigMaps(clientNamespace).Get(configMapName)
 	if err != nil {
 		if apierrs.IsNotFound(err) {
 			err = nil
@@ -278,11 +287,13 @@ func (ctrl *CommonController) syncConfigMap() {
 		klog.Errorf("Get configMap from client cluster failed, error: %v", err)
 		return
 	}
-	utils.UpdateConfigMap(configmapInClient, configMap)
-	if IsObjectGlobal(&configmapInClient.ObjectMeta) {
+	if !IsObjectGlobal(&configmapInClient.ObjectMeta) {
 		return
 	}
-	_, err = ctrl.client.CoreV1().ConfigMaps(configMap.Namespace).Update(ctx,
+	configmapInClient = configmapInClient.DeepCopy()
+	utils.UpdateConfigMap(configmapInClient, configMap)
+	SetObjectGlobal(&configmapInClient.ObjectMeta)
+	_, err = ctrl.client.CoreV1().ConfigMaps(clientNamespace).Update(ctx,
 		configmapInClient, metav1.UpdateOptions{})
 	if err != nil {
 		klog.Errorf("Get configMap from client cluster failed, error: %v", err)
@@ -314,6 +325,7 @@ func (ctrl *CommonController) syncSecret() {
 		ctrl.secretQueue.Forget(key)
 	}()
 
+	clientNamespace := ctrl.namespaces.ToClient(namespace)
 	var secret *v1.Secret
 	deleteSecretInClient := false
 	secret, err = ctrl.masterSecretLister.Secrets(namespace).Get(secretName)
@@ -321,7 +333,8 @@ func (ctrl *CommonController) syncSecret() {
 		if !apierrs.IsNotFound(err) {
 			return
 		}
-		_, err = ctrl.clientSecretLister.Secrets(namespace).Get(secretName)
+		var secretInClient *v1.Secret
+		secretInClient, err = ctrl.clientSecretLister.Secrets(clientNamespace).Get(secretName)
 		if err != nil {
 			if !apierrs.IsNotFound(err) {
 				klog.Errorf("Get secret from master cluster failed, error: %v", err)
@@ -331,12 +344,15 @@ func (ctrl *CommonController) syncSecret() {
 			klog.V(3).Infof("Secret %q deleted", secretName)
 			return
 		}
+		if !IsObjectGlobal(&secretInClient.ObjectMeta) {
+			return
+		}
 		deleteSecretInClient = true
 
 	}
 
 	if deleteSecretInClient || secret.DeletionTimestamp != nil {
-		if err = ctrl.client.CoreV1().Secrets(namespace).Delete(ctx, secretName,
+		if err = ctrl.client.CoreV1().Secrets(clientNamespace).Delete(ctx, secretName,
 			metav1.DeleteOptions{}); err != nil {
 			if !apierrs.IsNotFound(err) {
 				klog.Errorf("Delete secret from client cluster failed, error: %v", err)
@@ -350,7 +366,7 @@ func (ctrl *CommonController) syncSecret() {
 
 	// data updated
 	var old *v1.Secret
-	old, err = ctrl.clientSecretLister.Secrets(namespace).Get(secretName)
+	old, err = ctrl.clientSecretLister.Secrets(clientNamespace).Get(secretName)
 	if err != nil {
 		if apierrs.IsNotFound(err) {
 			err = nil
@@ -359,11 +375,13 @@ func (ctrl *CommonController) syncSecret() {
 		klog.Errorf("Get secret from client cluster failed, error: %v", err)
 		return
 	}
-	utils.UpdateSecret(old, secret)
-	if IsObjectGlobal(&old.ObjectMeta) {
+	if !IsObjectGlobal(&old.ObjectMeta) {
 		return
 	}
-	_, err = ctrl.client.CoreV1().Secrets(secret.Namespace).Update(ctx, old, metav1.UpdateOptions{})
+	old = old.DeepCopy()
+	utils.UpdateSecret(old, secret)
+	SetObjectGlobal(&old.ObjectMeta)
+	_, err = ctrl.client.CoreV1().Secrets(clientNamespace).Update(ctx, old, metav1.UpdateOptions{})
 	if err != nil {
 		klog.Errorf("Get secret from client cluster failed, error: %v", err)
 		return
@@ -438,7 +456,11 @@ func (ctrl *CommonController) gcConfigMap(ctx context.Context) {
 		if !IsObjectGlobal(&configMap.ObjectMeta) {
 			continue
 		}
-		_, err = ctrl.masterConfigMapLister.ConfigMaps(configMap.Namespace).Get(configMap.Name)
+		namespace, ok := ctrl.namespaces.ToMaster(configMap.Namespace)
+		if !ok {
+			continue
+		}
+		_, err = ctrl.masterConfigMapLister.ConfigMaps(namespace).Get(configMap.Name)
 		if err != nil && apierrs.IsNotFound(err) {
 			err := ctrl.client.CoreV1().ConfigMaps(configMap.Namespace).Delete(ctx,
 				configMap.Name, metav1.DeleteOptions{})
@@ -463,7 +485,11 @@ func (ctrl *CommonController) gcSecret(ctx context.Context) {
 		if !IsObjectGlobal(&secret.ObjectMeta) {
 			continue
 		}
-		_, err = ctrl.masterSecretLister.Secrets(secret.Namespace).Get(secret.Name)
+		namespace, ok := ctrl.namespaces.ToMaster(secret.Namespace)
+		if !ok {
+			continue
+		}
+		_, err = ctrl.masterSecretLister.Secrets(namespace).Get(secret.Name)
 		if err != nil && apierrs.IsNotFound(err) {
 			err := ctrl.client.CoreV1().Secrets(secret.Namespace).Delete(ctx, secret.Name, metav1.DeleteOptions{})
 			if err != nil && !apierrs.IsNotFound(err) {
@@ -0,0 +1,136 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	"github.com/clusterrouter-io/clusterrouter/pkg/utils"
+	v1 "k8s.io/api/core/v1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/util/workqueue"
+)
+
+// newTestCommonController returns a controller syncing from a master cluster holding masterObjects to a client cluster
+// holding clientObjects, with the caches of both synced
+func newTestCommonController(t *testing.T, masterObjects, clientObjects []runtime.Object) (*CommonController,
+	*fake.Clientset) {
+	t.Helper()
+	master := fake.NewSimpleClientset(masterObjects...)
+	client := fake.NewSimpleClientset(clientObjects...)
+	masterInformer := informers.NewSharedInformerFactory(master, 0)
+	clientInformer := informers.NewSharedInformerFactory(client, 0)
+	ctrl := NewCommonController(client, masterInformer, clientInformer, utils.NewNamespaceMapping("vk-"),
+		workqueue.DefaultControllerRateLimiter(), workqueue.DefaultControllerRateLimiter()).(*CommonController)
+
+	stopCh := make(chan struct{})
+	t.Cleanup(func() { close(stopCh) })
+	masterInformer.Start(stopCh)
+	clientInformer.Start(stopCh)
+	for typ, synced := range masterInformer.WaitForCacheSync(stopCh) {
+		if !synced {
+			t.Fatalf("master cache of %v not synced", typ)
+		}
+	}
+	for typ, synced := range clientInformer.WaitForCacheSync(stopCh) {
+		if !synced {
+			t.Fatalf("client cache of %v not synced", typ)
+		}
+	}
+	return ctrl, client
+}
+
+func testSecret(namespace string, data string, global bool) *v1.Secret {
+	secret := &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: "creds"},
+		Data:       map[string][]byte{"password": []byte(data)},
+	}
+	if global {
+		SetObjectGlobal(&secret.ObjectMeta)
+	}
+	return secret
+}
+
+func TestSyncSecret(t *testing.T) {
+	tests := []struct {
+		name         string
+		master       []runtime.Object
+		client       *v1.Secret
+		expectedData string
+		deleted      bool
+	}{
+		{
+			name:         "copy updated",
+			master:       []runtime.Object{testSecret("default", "new", false)},
+			client:       testSecret("vk-default", "old", true),
+			expectedData: "new",
+		},
+		{
+			name:         "secret of the client cluster left alone",
+			master:       []runtime.Object{testSecret("default", "new", false)},
+			client:       testSecret("vk-default", "old", false),
+			expectedData: "old",
+		},
+		{
+			name:    "copy deleted with the master secret",
+			client:  testSecret("vk-default", "old", true),
+			deleted: true,
+		},
+		{
+			name:         "secret of the client cluster kept without master secret",
+			client:       testSecret("vk-default", "old", false),
+			expectedData: "old",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl, client := newTestCommonController(t, tt.master, []runtime.Object{tt.client})
+			ctrl.secretQueue.Add("default/creds")
+			ctrl.syncSecret()
+
+			secret, err := client.CoreV1().Secrets("vk-default").Get(context.Background(), "creds", metav1.GetOptions{})
+			if tt.deleted {
+				if !apierrs.IsNotFound(err) {
+					t.Fatalf("expected the copy to be deleted, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if data := string(secret.Data["password"]); data != tt.expectedData {
+				t.Fatalf("expected data %q, got %q", tt.expectedData, data)
+			}
+			if IsObjectGlobal(&secret.ObjectMeta) != IsObjectGlobal(&tt.client.ObjectMeta) {
+				t.Fatalf("expected the secret to stay global %v, got %v", IsObjectGlobal(&tt.client.ObjectMeta),
+					secret.Annotations)
+			}
+		})
+	}
+}
+
+func TestSyncConfigMap(t *testing.T) {
+	masterConfigMap := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "config"},
+		Data:       map[string]string{"key": "new"},
+	}
+	clientConfigMap := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "vk-default", Name: "config"},
+		Data:       map[string]string{"key": "old"},
+	}
+	SetObjectGlobal(&clientConfigMap.ObjectMeta)
+	ctrl, client := newTestCommonController(t, []runtime.Object{masterConfigMap}, []runtime.Object{clientConfigMap})
+	ctrl.configMapQueue.Add("default/config")
+	ctrl.syncConfigMap()
+
+	configMap, err := client.CoreV1().ConfigMaps("vk-default").Get(context.Background(), "config", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if configMap.Data["key"] != "new" {
+		t.Fatalf("expected the copy in the mapped namespace to be updated, got %v", configMap.Data)
+	}
+}
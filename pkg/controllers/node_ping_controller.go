@@ -7,7 +7,7 @@ import (
 	"time"
 
 	"k8s.io/apimachinery/pkg/util/wait"
-	"k8s.io/klog"
+	"k8s.io/klog/v2"
 
 	"github.com/clusterrouter-io/clusterrouter/pkg/utils/lock"
 	"golang.org/x/sync/singleflight"
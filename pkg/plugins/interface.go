@@ -2,6 +2,9 @@ package plugins
 
 import (
 	"context"
+	"io"
+	"time"
+
 	corev1 "k8s.io/api/core/v1"
 )
 
@@ -39,13 +42,13 @@ type PodLifecycleHandler interface {
 type PodProvider interface {
 	PodLifecycleHandler
 
-	/*	// GetContainerLogs retrieves the logs of a container by name from the provider.
-		GetContainerLogs(ctx context.Context, namespace, podName, containerName string, opts api.ContainerLogOpts) (io.ReadCloser, error)
-	*/
-	/*	// RunInContainer executes a command in a container in the pod, copying data
-		// between in/out/err and the container's stdin/stdout/stderr.
-		RunInContainer(ctx context.Context, namespace, podName, containerName string, cmd []string, attach api.AttachIO) error
-	*/
+	// GetContainerLogs retrieves the logs of a container by name from the provider.
+	GetContainerLogs(ctx context.Context, namespace, podName, containerName string, opts ContainerLogOpts) (io.ReadCloser, error)
+
+	// RunInContainer executes a command in a container in the pod, copying data
+	// between in/out/err and the container's stdin/stdout/stderr.
+	RunInContainer(ctx context.Context, namespace, podName, containerName string, cmd []string, attach AttachIO) error
+
 	/*	// AttachToContainer attaches to the executing process of a container in the pod, copying data
 		// between in/out/err and the container's stdin/stdout/stderr.
 		AttachToContainer(ctx context.Context, namespace, podName, containerName string, attach api.AttachIO) error
@@ -60,6 +63,32 @@ type PodProvider interface {
 		PortForward(ctx context.Context, namespace, pod string, port int32, stream io.ReadWriteCloser) error*/
 }
 
+// ContainerLogOpts are used to pass along options to be set on the container log stream.
+type ContainerLogOpts struct {
+	Tail         int
+	LimitBytes   int
+	Timestamps   bool
+	Follow       bool
+	Previous     bool
+	SinceSeconds int
+	SinceTime    time.Time
+}
+
+// AttachIO is used to pass in streams to attach to a container process
+type AttachIO interface {
+	Stdin() io.Reader
+	Stdout() io.WriteCloser
+	Stderr() io.WriteCloser
+	TTY() bool
+	Resize() <-chan TermSize
+}
+
+// TermSize is used to set the terminal size from attached clients.
+type TermSize struct {
+	Width  uint16
+	Height uint16
+}
+
 // Provider wraps the core provider type with an extra function needed to bootstrap the node
 type Provider interface {
 	PodProvider
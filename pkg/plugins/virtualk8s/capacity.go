@@ -0,0 +1,266 @@
+package virtualk8s
+
+import (
+	"sync"
+	"time"
+
+	"github.com/clusterrouter-io/clusterrouter/pkg/common"
+	"github.com/clusterrouter-io/clusterrouter/pkg/utils"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/utils/clock"
+)
+
+// NodeCapacity is the capacity of the virtual node, aggregated over the schedulable nodes of the client cluster
+type NodeCapacity struct {
+	// Schedulable are the client cluster nodes the capacity was computed over
+	Schedulable []*corev1.Node
+	// NotReady are the names of the nodes which are picked and schedulable, but left out for not being ready
+	NotReady []string
+	// Capacity is the gross sum of the capacity of the nodes
+	Capacity *common.Resource
+	// Allocatable is the capacity minus the reservations and the resources used by pods
+	Allocatable *common.Resource
+	// NodesAllocatable is the capacity minus the reservations, and Used are the resources used by pods
+	NodesAllocatable *common.Resource
+	Used             *common.Resource
+	// Pressure tells which resources are used beyond the pressure threshold
+	Pressure ResourcePressure
+}
+
+// ResourcePressure tells which resources of the client cluster are used beyond the pressure threshold, as a percentage
+// of the allocatable of the nodes
+type ResourcePressure struct {
+	Memory bool
+	Disk   bool
+}
+
+// setUsed sets the resources used by pods, and updates the allocatable and pressure accordingly. The allocatable is
+// the capacity left by the pods, also for resources under pressure, which are only reported by the node conditions.
+func (c *NodeCapacity) setUsed(used *common.Resource, threshold float64) {
+	c.Used = used
+	c.Pressure = ResourcePressure{
+		Memory: usageCrosses(used.Memory, c.NodesAllocatable.Memory, threshold),
+		Disk:   usageCrosses(used.EphemeralStorage, c.NodesAllocatable.EphemeralStorage, threshold),
+	}
+	c.Allocatable = c.NodesAllocatable.Clone()
+	c.Allocatable.SubClamped(used)
+}
+
+// usageCrosses returns true if used is at least threshold percent of allocatable. A threshold of 0 disables it.
+func usageCrosses(used, allocatable resource.Quantity, threshold float64) bool {
+	if threshold <= 0 || allocatable.IsZero() {
+		return false
+	}
+	return used.AsApproximateFloat64() >= allocatable.AsApproximateFloat64()*threshold/100
+}
+
+// usageHistory keeps the resources used by pods over a window of time, so the usage only drops once it stayed low for
+// the whole window. This keeps the allocatable from flapping when pods briefly vanish from the cache during churn.
+type usageHistory struct {
+	lock    sync.Mutex
+	window  time.Duration
+	samples []usageSample
+}
+
+type usageSample struct {
+	at   time.Time
+	used *common.Resource
+}
+
+// smooth records used, and returns the largest usage of every resource within the window
+func (h *usageHistory) smooth(now time.Time, used *common.Resource) *common.Resource {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.samples = append(h.samples, usageSample{at: now, used: used})
+	for len(h.samples) > 0 && now.Sub(h.samples[0].at) > h.window {
+		h.samples = h.samples[1:]
+	}
+	smoothed := used.Clone()
+	for _, s := range h.samples {
+		smoothed.Max(s.used)
+	}
+	return smoothed
+}
+
+// capacityCache holds the last NodeCapacity until it is older than ttl, or is invalidated by a change of the nodes or
+// of the resources used by pods. The snapshot is shared between callers, and must not be modified.
+type capacityCache struct {
+	lock       sync.Mutex
+	ttl        time.Duration
+	clock      clock.PassiveClock
+	snapshot   *NodeCapacity
+	computedAt time.Time
+}
+
+// get returns the cached snapshot, or calls compute if it is stale
+func (c *capacityCache) get(compute func() (*NodeCapacity, error)) (*NodeCapacity, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.snapshot != nil && c.clock.Since(c.computedAt) < c.ttl {
+		return c.snapshot, nil
+	}
+	snapshot, err := compute()
+	if err != nil {
+		return nil, err
+	}
+	c.snapshot = snapshot
+	c.computedAt = c.clock.Now()
+	return snapshot, nil
+}
+
+// invalidate drops the cached snapshot, so the next get recomputes it
+func (c *capacityCache) invalidate() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.snapshot = nil
+}
+
+// invalidatePodUsage drops the cached capacity if a pod event changed the resources used by pods, see
+// podUsageChanged. oldObj is nil for added pods, and newObj for deleted ones.
+func (v *VirtualK8S) invalidatePodUsage(oldObj, newObj interface{}) {
+	old, ok1 := oldObj.(*corev1.Pod)
+	new, ok2 := newObj.(*corev1.Pod)
+	// A deleted pod may come as a tombstone, whose pod is not known for sure
+	if oldObj != nil && !ok1 || newObj != nil && !ok2 || podUsageChanged(old, new, v.countBoundPods) {
+		v.capacityCache.invalidate()
+	}
+}
+
+// podUsageChanged returns true if the resources a pod uses changed from old to new, that is it started or stopped
+// using them, moved to another node, or its requests changed. Either may be nil for pods which were added or deleted.
+// Most status updates, like a pod becoming ready, change none of them, and leave the capacity as it is.
+func podUsageChanged(old, new *corev1.Pod, countBound bool) bool {
+	oldUses := old != nil && old.Spec.NodeName != "" && podUsesResources(old, countBound)
+	newUses := new != nil && new.Spec.NodeName != "" && podUsesResources(new, countBound)
+	if !oldUses || !newUses {
+		return oldUses != newUses
+	}
+	return old.Spec.NodeName != new.Spec.NodeName ||
+		!utils.GetRequestFromPod(old).Equal(utils.GetRequestFromPod(new))
+}
+
+// capacity returns the aggregated capacity of the client cluster, from the cache if it is fresh
+func (v *VirtualK8S) capacity() (*NodeCapacity, error) {
+	return v.capacityCache.get(v.aggregateCapacity)
+}
+
+// aggregateCapacity computes the capacity of the virtual node from the nodes and pods of the client cluster in the
+// cache.
+func (v *VirtualK8S) aggregateCapacity() (*NodeCapacity, error) {
+	nodes, err := v.clientCache.nodeLister.List(v.nodeSelector)
+	if err != nil {
+		return nil, err
+	}
+	// If the pods can not be listed, the allocatable is the one of the nodes alone
+	pods, _ := v.clientCache.podLister.List(labels.Everything())
+	opts := v.capacityOptions()
+	snapshot := computeNodeCapacity(nodes, pods, opts)
+	if v.usageHistory.window > 0 {
+		snapshot.setUsed(v.usageHistory.smooth(opts.Now, snapshot.Used), opts.PressureThreshold)
+	}
+	return snapshot, nil
+}
+
+// CapacityOptions are the options which decide how the nodes of the client cluster add up to the capacity of the
+// virtual node
+type CapacityOptions struct {
+	// Selector and ExcludeNodeKey pick the nodes making up the virtual node, a nil Selector picks every node
+	Selector       labels.Selector
+	ExcludeNodeKey string
+	// HeartbeatTimeout is how recent the last heartbeat of a node must be at Now for it to count as ready, 0 disables
+	// it
+	HeartbeatTimeout time.Duration
+	Now              time.Time
+	// Reservation is the reservation subtracted from the allocatable of every node, nil reserves nothing
+	Reservation *common.Reservation
+	// Overcommit are the ratios the capacity and allocatable of the nodes are multiplied with
+	Overcommit common.OvercommitRatios
+	// CountBoundPods counts pods bound to a node which did not report a phase yet as using resources
+	CountBoundPods bool
+	// PressureThreshold is the percentage of the allocatable memory or ephemeral storage which, once used, puts the
+	// virtual node under pressure, 0 disables it
+	PressureThreshold float64
+}
+
+// capacityOptions returns the capacity options the provider was configured with
+func (v *VirtualK8S) capacityOptions() CapacityOptions {
+	return CapacityOptions{
+		Selector:          v.nodeSelector,
+		ExcludeNodeKey:    v.excludeNodeKey,
+		HeartbeatTimeout:  v.heartbeatTimeout,
+		Reservation:       v.reservation,
+		Overcommit:        v.overcommit,
+		CountBoundPods:    v.countBoundPods,
+		PressureThreshold: v.pressureThreshold,
+		Now:               v.clock.Now(),
+	}
+}
+
+// computeNodeCapacity sums the capacity of the schedulable nodes, and subtracts the resources used by the pods running
+// on them from the allocatable. It is a pure function of its arguments, nodes and pods are not modified.
+func computeNodeCapacity(nodes []*corev1.Node, pods []*corev1.Pod, opts CapacityOptions) *NodeCapacity {
+	schedulable, notReady := opts.schedulable(nodes)
+	c := &NodeCapacity{
+		Schedulable:      schedulable,
+		NotReady:         notReady,
+		Capacity:         common.NewResource(),
+		NodesAllocatable: common.NewResource(),
+	}
+	for _, n := range schedulable {
+		c.Capacity.Add(opts.nodeCapacity(n))
+		c.NodesAllocatable.Add(opts.nodeAllocatable(n))
+	}
+	c.setUsed(getResourceFromPods(pods, schedulable, opts.CountBoundPods), opts.PressureThreshold)
+	return c
+}
+
+// schedulable returns the nodes which are included, schedulable and ready at the time of the options, and the names
+// of the included and schedulable nodes which are not ready
+func (o CapacityOptions) schedulable(nodes []*corev1.Node) ([]*corev1.Node, []string) {
+	schedulable := make([]*corev1.Node, 0, len(nodes))
+	var notReady []string
+	for _, n := range nodes {
+		if n.Spec.Unschedulable || !o.includes(n) {
+			continue
+		}
+		if !checkNodeStatusReady(n, o.HeartbeatTimeout, o.Now) {
+			notReady = append(notReady, n.Name)
+			continue
+		}
+		schedulable = append(schedulable, n)
+	}
+	return schedulable, notReady
+}
+
+// includes returns true if node is picked by the node selector, and not excluded by the exclusion label or annotation
+func (o CapacityOptions) includes(node *corev1.Node) bool {
+	if o.Selector != nil && !o.Selector.Matches(labels.Set(node.Labels)) {
+		return false
+	}
+	if o.ExcludeNodeKey == "" {
+		return true
+	}
+	return node.Labels[o.ExcludeNodeKey] != "true" && node.Annotations[o.ExcludeNodeKey] != "true"
+}
+
+// nodeCapacity returns the capacity a client cluster node contributes to the virtual node, that is its capacity
+// multiplied with the overcommit ratios, with extended resources rounded down to whole units.
+func (o CapacityOptions) nodeCapacity(node *corev1.Node) *common.Resource {
+	capacity := common.ConvertResource(node.Status.Capacity)
+	o.Overcommit.Apply(capacity)
+	capacity.FloorExtendedResources()
+	return capacity
+}
+
+// nodeAllocatable returns the capacity of a client cluster node which can be used by pods, that is its capacity minus
+// the resources reserved on it, multiplied with the overcommit ratios, with extended resources rounded down to whole
+// units. Since the reservation applies to every node, the total reservation grows with the number of nodes.
+func (o CapacityOptions) nodeAllocatable(node *corev1.Node) *common.Resource {
+	allocatable := common.ConvertResource(node.Status.Capacity)
+	allocatable.SubClamped(o.Reservation.For(node.Status.Capacity))
+	o.Overcommit.Apply(allocatable)
+	allocatable.FloorExtendedResources()
+	return allocatable
+}
@@ -0,0 +1,530 @@
+package virtualk8s
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/clusterrouter-io/clusterrouter/pkg/common"
+	corev1 "k8s.io/api/core/v1"
+	apiequality "k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	listersv1 "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	clocktesting "k8s.io/utils/clock/testing"
+)
+
+var testNow = time.Date(2022, 8, 1, 12, 0, 0, 0, time.UTC)
+
+// testNode returns a ready node with the given capacity, which last sent a heartbeat at testNow
+func testNode(name, cpu, memory string) *corev1.Node {
+	return &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Labels: map[string]string{}},
+		Status: corev1.NodeStatus{
+			Capacity: corev1.ResourceList{
+				corev1.ResourceCPU:    resource.MustParse(cpu),
+				corev1.ResourceMemory: resource.MustParse(memory),
+				corev1.ResourcePods:   resource.MustParse("110"),
+			},
+			Conditions: []corev1.NodeCondition{{
+				Type:              corev1.NodeReady,
+				Status:            corev1.ConditionTrue,
+				LastHeartbeatTime: metav1.NewTime(testNow),
+			}},
+		},
+	}
+}
+
+// testPodOn returns a pod on node in phase, requesting cpu and memory
+func testPodOn(node string, phase corev1.PodPhase, cpu, memory string) *corev1.Pod {
+	return &corev1.Pod{
+		Spec: corev1.PodSpec{
+			NodeName: node,
+			Containers: []corev1.Container{{
+				Resources: corev1.ResourceRequirements{Requests: corev1.ResourceList{
+					corev1.ResourceCPU:    resource.MustParse(cpu),
+					corev1.ResourceMemory: resource.MustParse(memory),
+				}},
+			}},
+		},
+		Status: corev1.PodStatus{Phase: phase},
+	}
+}
+
+// testResource returns a resource of cpu, memory and pods, empty strings are zero
+func testResource(cpu, memory, pods string) *common.Resource {
+	list := corev1.ResourceList{}
+	for name, q := range map[corev1.ResourceName]string{
+		corev1.ResourceCPU: cpu, corev1.ResourceMemory: memory, corev1.ResourcePods: pods} {
+		if q != "" {
+			list[name] = resource.MustParse(q)
+		}
+	}
+	return common.ConvertResource(list)
+}
+
+func withNode(node *corev1.Node, modify func(*corev1.Node)) *corev1.Node {
+	modify(node)
+	return node
+}
+
+func TestComputeNodeCapacity(t *testing.T) {
+	tests := []struct {
+		name            string
+		nodes           []*corev1.Node
+		pods            []*corev1.Pod
+		opts            CapacityOptions
+		wantSchedulable int
+		wantNotReady    []string
+		wantCapacity    *common.Resource
+		wantAllocatable *common.Resource
+		wantUsed        *common.Resource
+		wantPressure    ResourcePressure
+	}{
+		{
+			name:            "no nodes",
+			wantCapacity:    testResource("", "", ""),
+			wantAllocatable: testResource("", "", ""),
+			wantUsed:        testResource("", "", ""),
+		},
+		{
+			name:            "nodes are summed",
+			nodes:           []*corev1.Node{testNode("a", "4", "8Gi"), testNode("b", "2", "4Gi")},
+			wantSchedulable: 2,
+			wantCapacity:    testResource("6", "12Gi", "220"),
+			wantAllocatable: testResource("6", "12Gi", "220"),
+			wantUsed:        testResource("", "", ""),
+		},
+		{
+			name: "unschedulable and not ready nodes are skipped",
+			nodes: []*corev1.Node{
+				testNode("a", "4", "8Gi"),
+				withNode(testNode("b", "2", "4Gi"), func(n *corev1.Node) { n.Spec.Unschedulable = true }),
+				withNode(testNode("c", "2", "4Gi"), func(n *corev1.Node) {
+					n.Status.Conditions[0].Status = corev1.ConditionFalse
+				}),
+				withNode(testNode("d", "2", "4Gi"), func(n *corev1.Node) {
+					n.Status.Conditions = append(n.Status.Conditions, corev1.NodeCondition{
+						Type: corev1.NodeNetworkUnavailable, Status: corev1.ConditionTrue})
+				}),
+			},
+			wantSchedulable: 1,
+			wantNotReady:    []string{"c", "d"},
+			wantCapacity:    testResource("4", "8Gi", "110"),
+			wantAllocatable: testResource("4", "8Gi", "110"),
+			wantUsed:        testResource("", "", ""),
+		},
+		{
+			name: "stale heartbeats",
+			nodes: []*corev1.Node{
+				testNode("a", "4", "8Gi"),
+				withNode(testNode("b", "2", "4Gi"), func(n *corev1.Node) {
+					n.Status.Conditions[0].LastHeartbeatTime = metav1.NewTime(testNow.Add(-time.Hour))
+				}),
+			},
+			opts:            CapacityOptions{HeartbeatTimeout: time.Minute},
+			wantSchedulable: 1,
+			wantNotReady:    []string{"b"},
+			wantCapacity:    testResource("4", "8Gi", "110"),
+			wantAllocatable: testResource("4", "8Gi", "110"),
+			wantUsed:        testResource("", "", ""),
+		},
+		{
+			name: "selected and excluded nodes",
+			nodes: []*corev1.Node{
+				withNode(testNode("a", "4", "8Gi"), func(n *corev1.Node) { n.Labels["pool"] = "vk" }),
+				withNode(testNode("b", "2", "4Gi"), func(n *corev1.Node) {
+					n.Labels["pool"] = "vk"
+					n.Annotations = map[string]string{"exclude": "true"}
+				}),
+				testNode("c", "2", "4Gi"),
+			},
+			opts: CapacityOptions{
+				Selector:       labels.SelectorFromSet(labels.Set{"pool": "vk"}),
+				ExcludeNodeKey: "exclude",
+			},
+			wantSchedulable: 1,
+			wantCapacity:    testResource("4", "8Gi", "110"),
+			wantAllocatable: testResource("4", "8Gi", "110"),
+			wantUsed:        testResource("", "", ""),
+		},
+		{
+			name:  "reservation and overcommit",
+			nodes: []*corev1.Node{testNode("a", "4", "8Gi"), testNode("b", "4", "8Gi")},
+			opts: CapacityOptions{
+				Reservation: &common.Reservation{
+					Absolute: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("1")},
+				},
+				Overcommit: common.OvercommitRatios{corev1.ResourceCPU: 2},
+			},
+			wantSchedulable: 2,
+			wantCapacity:    testResource("16", "16Gi", "220"),
+			wantAllocatable: testResource("12", "16Gi", "220"),
+			wantUsed:        testResource("", "", ""),
+		},
+		{
+			name: "pods using resources",
+			nodes: []*corev1.Node{
+				testNode("a", "4", "8Gi"),
+				withNode(testNode("b", "4", "8Gi"), func(n *corev1.Node) { n.Spec.Unschedulable = true }),
+			},
+			pods: []*corev1.Pod{
+				testPodOn("a", corev1.PodRunning, "1", "1Gi"),
+				testPodOn("a", corev1.PodPending, "500m", "1Gi"),
+				testPodOn("a", corev1.PodSucceeded, "1", "1Gi"),
+				testPodOn("a", "", "1", "1Gi"),
+				testPodOn("b", corev1.PodRunning, "1", "1Gi"),
+				testPodOn("", corev1.PodPending, "1", "1Gi"),
+			},
+			wantSchedulable: 1,
+			wantCapacity:    testResource("4", "8Gi", "110"),
+			wantAllocatable: testResource("2500m", "6Gi", "108"),
+			wantUsed:        testResource("1500m", "2Gi", "2"),
+		},
+		{
+			name:            "bound pods",
+			nodes:           []*corev1.Node{testNode("a", "4", "8Gi")},
+			pods:            []*corev1.Pod{testPodOn("a", "", "1", "1Gi")},
+			opts:            CapacityOptions{CountBoundPods: true},
+			wantSchedulable: 1,
+			wantCapacity:    testResource("4", "8Gi", "110"),
+			wantAllocatable: testResource("3", "7Gi", "109"),
+			wantUsed:        testResource("1", "1Gi", "1"),
+		},
+		{
+			name:            "usage below the pressure threshold",
+			nodes:           []*corev1.Node{testNode("a", "4", "8Gi")},
+			pods:            []*corev1.Pod{testPodOn("a", corev1.PodRunning, "1", "6Gi")},
+			opts:            CapacityOptions{PressureThreshold: 80},
+			wantSchedulable: 1,
+			wantCapacity:    testResource("4", "8Gi", "110"),
+			wantAllocatable: testResource("3", "2Gi", "109"),
+			wantUsed:        testResource("1", "6Gi", "1"),
+		},
+		{
+			name:            "usage beyond the pressure threshold",
+			nodes:           []*corev1.Node{testNode("a", "4", "8Gi")},
+			pods:            []*corev1.Pod{testPodOn("a", corev1.PodRunning, "1", "7Gi")},
+			opts:            CapacityOptions{PressureThreshold: 80},
+			wantSchedulable: 1,
+			wantCapacity:    testResource("4", "8Gi", "110"),
+			wantAllocatable: testResource("3", "1Gi", "109"),
+			wantUsed:        testResource("1", "7Gi", "1"),
+			wantPressure:    ResourcePressure{Memory: true},
+		},
+		{
+			name:            "usage at the pressure threshold",
+			nodes:           []*corev1.Node{testNode("a", "4", "8Gi")},
+			pods:            []*corev1.Pod{testPodOn("a", corev1.PodRunning, "1", "6Gi")},
+			opts:            CapacityOptions{PressureThreshold: 75},
+			wantSchedulable: 1,
+			wantCapacity:    testResource("4", "8Gi", "110"),
+			wantAllocatable: testResource("3", "2Gi", "109"),
+			wantUsed:        testResource("1", "6Gi", "1"),
+			wantPressure:    ResourcePressure{Memory: true},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := tt.opts
+			opts.Now = testNow
+			got := computeNodeCapacity(tt.nodes, tt.pods, opts)
+			if len(got.Schedulable) != tt.wantSchedulable {
+				t.Errorf("expected %d schedulable nodes, got %d", tt.wantSchedulable, len(got.Schedulable))
+			}
+			if !reflect.DeepEqual(got.NotReady, tt.wantNotReady) {
+				t.Errorf("expected the nodes %v not to be ready, got %v", tt.wantNotReady, got.NotReady)
+			}
+			if !got.Capacity.Equal(tt.wantCapacity) {
+				t.Errorf("expected capacity %v, got %v", tt.wantCapacity, got.Capacity)
+			}
+			if !got.Allocatable.Equal(tt.wantAllocatable) {
+				t.Errorf("expected allocatable %v, got %v", tt.wantAllocatable, got.Allocatable)
+			}
+			if !got.Used.Equal(tt.wantUsed) {
+				t.Errorf("expected used %v, got %v", tt.wantUsed, got.Used)
+			}
+			if got.Pressure != tt.wantPressure {
+				t.Errorf("expected pressure %+v, got %+v", tt.wantPressure, got.Pressure)
+			}
+		})
+	}
+}
+
+func TestComputeNodeCapacityDoesNotModifyArguments(t *testing.T) {
+	nodes := []*corev1.Node{testNode("a", "4", "8Gi")}
+	pods := []*corev1.Pod{testPodOn("a", corev1.PodRunning, "1", "1Gi")}
+	nodesCopy := []*corev1.Node{nodes[0].DeepCopy()}
+	podsCopy := []*corev1.Pod{pods[0].DeepCopy()}
+	opts := CapacityOptions{
+		Reservation: &common.Reservation{Percent: map[corev1.ResourceName]float64{corev1.ResourceCPU: 10}},
+		Overcommit:  common.OvercommitRatios{corev1.ResourceCPU: 2},
+		Now:         testNow,
+	}
+	first := computeNodeCapacity(nodes, pods, opts)
+	second := computeNodeCapacity(nodes, pods, opts)
+	if !first.Allocatable.Equal(second.Allocatable) || !first.Capacity.Equal(second.Capacity) {
+		t.Fatalf("expected the same result for the same arguments, got %v and %v", first.Allocatable,
+			second.Allocatable)
+	}
+	if !apiequality.Semantic.DeepEqual(nodes, nodesCopy) || !apiequality.Semantic.DeepEqual(pods, podsCopy) {
+		t.Fatal("expected the nodes and pods not to be modified")
+	}
+}
+
+// countingNodeLister counts how often the nodes are listed, that is how often the capacity is computed
+type countingNodeLister struct {
+	listersv1.NodeLister
+	lists int
+}
+
+func (l *countingNodeLister) List(selector labels.Selector) ([]*corev1.Node, error) {
+	l.lists++
+	return l.NodeLister.List(selector)
+}
+
+func TestCapacityCache(t *testing.T) {
+	nodeIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	if err := nodeIndexer.Add(testNode("a", "4", "8Gi")); err != nil {
+		t.Fatal(err)
+	}
+	podIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	nodes := &countingNodeLister{NodeLister: listersv1.NewNodeLister(nodeIndexer)}
+	fakeClock := clocktesting.NewFakeClock(testNow)
+	v := &VirtualK8S{
+		nodeSelector: labels.Everything(),
+		providerNode: &common.ProviderNode{},
+		clock:        fakeClock,
+		clientCache:  clientCache{nodeLister: nodes, podLister: listersv1.NewPodLister(podIndexer)},
+	}
+	v.capacityCache.ttl = time.Minute
+	v.capacityCache.clock = fakeClock
+
+	expectLists := func(want int) {
+		t.Helper()
+		if _, err := v.capacity(); err != nil {
+			t.Fatal(err)
+		}
+		if nodes.lists != want {
+			t.Fatalf("expected the capacity to be computed %d times, got %d", want, nodes.lists)
+		}
+	}
+	expectLists(1)
+	expectLists(1)
+
+	pending := testPodOn("a", corev1.PodPending, "1", "1Gi")
+	v.addPod(pending)
+	expectLists(2)
+
+	// Pods becoming ready use the same resources as before
+	ready := pending.DeepCopy()
+	ready.Status.Conditions = []corev1.PodCondition{{Type: corev1.PodReady, Status: corev1.ConditionTrue}}
+	v.updatePod(pending, ready)
+	expectLists(2)
+	running := ready.DeepCopy()
+	running.Status.Phase = corev1.PodRunning
+	v.updatePod(ready, running)
+	expectLists(2)
+
+	succeeded := running.DeepCopy()
+	succeeded.Status.Phase = corev1.PodSucceeded
+	v.updatePod(running, succeeded)
+	expectLists(3)
+	v.deletePod(succeeded)
+	expectLists(3)
+	v.deletePod(cache.DeletedFinalStateUnknown{Key: "default/pod", Obj: succeeded})
+	expectLists(4)
+
+	fakeClock.Step(59 * time.Second)
+	expectLists(4)
+	fakeClock.Step(time.Second)
+	expectLists(5)
+}
+
+func TestPodUsageChanged(t *testing.T) {
+	running := testPodOn("a", corev1.PodRunning, "1", "1Gi")
+	withPod := func(modify func(*corev1.Pod)) *corev1.Pod {
+		pod := running.DeepCopy()
+		modify(pod)
+		return pod
+	}
+	tests := []struct {
+		name       string
+		old, new   *corev1.Pod
+		countBound bool
+		want       bool
+	}{
+		{name: "added running", new: running, want: true},
+		{name: "added unbound", new: withPod(func(p *corev1.Pod) { p.Spec.NodeName = "" })},
+		{name: "added without phase", new: withPod(func(p *corev1.Pod) { p.Status.Phase = "" })},
+		{name: "bound counted", new: withPod(func(p *corev1.Pod) { p.Status.Phase = "" }), countBound: true,
+			want: true},
+		{name: "deleted running", old: running, want: true},
+		{name: "deleted succeeded", old: withPod(func(p *corev1.Pod) { p.Status.Phase = corev1.PodSucceeded })},
+		{name: "status update", old: running, new: withPod(func(p *corev1.Pod) { p.Status.PodIP = "10.0.0.1" })},
+		{name: "finished", old: running, new: withPod(func(p *corev1.Pod) { p.Status.Phase = corev1.PodFailed }),
+			want: true},
+		{name: "moved", old: running, new: withPod(func(p *corev1.Pod) { p.Spec.NodeName = "b" }), want: true},
+		{name: "resized", old: running, new: withPod(func(p *corev1.Pod) {
+			p.Spec.Containers[0].Resources.Requests[corev1.ResourceCPU] = resource.MustParse("2")
+		}), want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := podUsageChanged(tt.old, tt.new, tt.countBound); got != tt.want {
+				t.Fatalf("expected %t, got %t", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestUsageCrosses(t *testing.T) {
+	tests := []struct {
+		used, allocatable string
+		threshold         float64
+		want              bool
+	}{
+		{used: "6Gi", allocatable: "8Gi", threshold: 75, want: true},
+		{used: "6Gi", allocatable: "8Gi", threshold: 76},
+		{used: "6143Mi", allocatable: "8Gi", threshold: 75},
+		{used: "8Gi", allocatable: "8Gi", threshold: 100, want: true},
+		{used: "8Gi", allocatable: "8Gi"},
+		{used: "1", allocatable: "0", threshold: 50},
+	}
+	for _, tt := range tests {
+		got := usageCrosses(resource.MustParse(tt.used), resource.MustParse(tt.allocatable), tt.threshold)
+		if got != tt.want {
+			t.Errorf("usage %s of %s at threshold %v: expected %t, got %t", tt.used, tt.allocatable, tt.threshold,
+				tt.want, got)
+		}
+	}
+}
+
+func TestComputeNodeCapacitySkipsPodsOfOtherNodes(t *testing.T) {
+	nodes := []*corev1.Node{
+		testNode("a", "4", "8Gi"),
+		withNode(testNode("cordoned", "4", "8Gi"), func(n *corev1.Node) { n.Spec.Unschedulable = true }),
+	}
+	pods := []*corev1.Pod{
+		testPodOn("a", corev1.PodRunning, "1", "1Gi"),
+		testPodOn("cordoned", corev1.PodRunning, "2", "2Gi"),
+		testPodOn("deleted", corev1.PodRunning, "2", "2Gi"),
+	}
+	snapshot := computeNodeCapacity(nodes, pods, CapacityOptions{})
+	if !snapshot.Used.Equal(testResource("1", "1Gi", "1")) {
+		t.Fatalf("expected only the pod on node a to be counted, got %s", snapshot.Used)
+	}
+	// getResourceFromPods skips pods whose node is not in the set, whether it is excluded or no longer exists
+	if used := getResourceFromPods(pods, nodes[:1], false); !used.Equal(testResource("1", "1Gi", "1")) {
+		t.Fatalf("expected only the pod on node a to be counted, got %s", used)
+	}
+}
+
+func TestComputeNodeCapacitySkipsTerminatedPods(t *testing.T) {
+	withStates := func(states ...corev1.ContainerState) *corev1.Pod {
+		pod := testPodOn("a", corev1.PodRunning, "1", "1Gi")
+		for _, state := range states {
+			pod.Status.ContainerStatuses = append(pod.Status.ContainerStatuses, corev1.ContainerStatus{State: state})
+		}
+		return pod
+	}
+	terminated := corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{ExitCode: 0}}
+	running := corev1.ContainerState{Running: &corev1.ContainerStateRunning{}}
+	pods := []*corev1.Pod{
+		// Still running according to its phase, but all of its containers terminated
+		withStates(terminated, terminated),
+		withStates(terminated, running),
+		withStates(),
+	}
+	snapshot := computeNodeCapacity([]*corev1.Node{testNode("a", "4", "8Gi")}, pods, CapacityOptions{})
+	if !snapshot.Used.Equal(testResource("2", "2Gi", "2")) {
+		t.Fatalf("expected the pod whose containers all terminated not to be counted, got %s", snapshot.Used)
+	}
+}
+
+func TestComputeNodeCapacityCountsBoundPods(t *testing.T) {
+	tests := []struct {
+		name           string
+		countBoundPods bool
+		expected       *common.Resource
+	}{
+		{name: "bound pods without a phase are not counted", expected: testResource("1", "1Gi", "1")},
+		{name: "bound pods without a phase are counted", countBoundPods: true, expected: testResource("3", "3Gi", "2")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pods := []*corev1.Pod{
+				testPodOn("a", corev1.PodRunning, "1", "1Gi"),
+				// Just bound to the node, the kubelet did not report a phase yet
+				testPodOn("a", "", "2", "2Gi"),
+				// Not bound to a node yet
+				testPodOn("", "", "4", "4Gi"),
+			}
+			opts := CapacityOptions{CountBoundPods: tt.countBoundPods}
+			snapshot := computeNodeCapacity([]*corev1.Node{testNode("a", "8", "16Gi")}, pods, opts)
+			if !snapshot.Used.Equal(tt.expected) {
+				t.Fatalf("expected %s to be used, got %s", tt.expected, snapshot.Used)
+			}
+		})
+	}
+}
+
+func TestAggregateCapacityHysteresis(t *testing.T) {
+	tests := []struct {
+		name   string
+		window time.Duration
+		// expected are the resources used after each of the snapshots
+		expected []*common.Resource
+	}{
+		{
+			name: "usage follows every snapshot without a window",
+			expected: []*common.Resource{
+				testResource("2", "2Gi", "2"), testResource("1", "1Gi", "1"), testResource("1", "1Gi", "1"),
+			},
+		},
+		{
+			name:   "usage drops once the window passed",
+			window: time.Minute,
+			expected: []*common.Resource{
+				testResource("2", "2Gi", "2"), testResource("2", "2Gi", "2"), testResource("1", "1Gi", "1"),
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := newConfigureTestProvider(t, testNode("a", "4", "8Gi"))
+			v.usageHistory.window = tt.window
+			fakeClock := v.clock.(*clocktesting.FakeClock)
+			running := func() *corev1.Pod { return testPodOn("a", corev1.PodRunning, "1", "1Gi") }
+
+			// A pod briefly vanishes from the cache, and stays gone after the window passed
+			snapshots := []struct {
+				pods []*corev1.Pod
+				step time.Duration
+			}{
+				{pods: []*corev1.Pod{running(), running()}},
+				{pods: []*corev1.Pod{running()}, step: time.Second},
+				{pods: []*corev1.Pod{running()}, step: time.Minute},
+			}
+			for i, s := range snapshots {
+				fakeClock.Step(s.step)
+				setTestPods(t, v, s.pods...)
+				snapshot, err := v.aggregateCapacity()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !snapshot.Used.Equal(tt.expected[i]) {
+					t.Fatalf("expected %s to be used after snapshot %d, got %s", tt.expected[i], i, snapshot.Used)
+				}
+				allocatable := testResource("4", "8Gi", "110")
+				allocatable.Sub(tt.expected[i])
+				if !snapshot.Allocatable.Equal(allocatable) {
+					t.Fatalf("expected %s to be allocatable after snapshot %d, got %s", allocatable, i,
+						snapshot.Allocatable)
+				}
+			}
+		})
+	}
+}
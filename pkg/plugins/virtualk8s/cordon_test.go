@@ -0,0 +1,53 @@
+package virtualk8s
+
+import (
+	"context"
+	"testing"
+
+	"github.com/clusterrouter-io/clusterrouter/pkg/common"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestCordon(t *testing.T) {
+	node := &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "vnode"}}
+	master := fake.NewSimpleClientset(node.DeepCopy())
+	// An unbuffered channel nobody reads from, Cordon must not block on it
+	v := &VirtualK8S{
+		master:       master,
+		nodeName:     "vnode",
+		providerNode: &common.ProviderNode{Node: node.DeepCopy()},
+		configured:   true,
+		updatedNode:  make(chan *corev1.Node),
+	}
+
+	for _, unschedulable := range []bool{true, false} {
+		var err error
+		if unschedulable {
+			err = v.Cordon(context.Background())
+		} else {
+			err = v.Uncordon(context.Background())
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := master.CoreV1().Nodes().Get(context.Background(), "vnode", metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Spec.Unschedulable != unschedulable {
+			t.Fatalf("expected the master node unschedulable to be %t", unschedulable)
+		}
+		if v.providerNode.Spec.Unschedulable != unschedulable {
+			t.Fatalf("expected the provider node unschedulable to be %t", unschedulable)
+		}
+	}
+}
+
+func TestCordonUnconfigured(t *testing.T) {
+	v := &VirtualK8S{master: fake.NewSimpleClientset(), nodeName: "vnode", providerNode: &common.ProviderNode{}}
+	if err := v.Cordon(context.Background()); err == nil {
+		t.Fatal("expected cordoning a node which is not configured yet to fail")
+	}
+}
@@ -0,0 +1,50 @@
+package virtualk8s
+
+import (
+	"encoding/json"
+	"net/http"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// nodeDebugState is the state of the virtual node served by DebugHandler
+type nodeDebugState struct {
+	Name          string                 `json:"name"`
+	Configured    bool                   `json:"configured"`
+	Unschedulable bool                   `json:"unschedulable"`
+	Capacity      corev1.ResourceList    `json:"capacity,omitempty"`
+	Allocatable   corev1.ResourceList    `json:"allocatable,omitempty"`
+	Conditions    []corev1.NodeCondition `json:"conditions,omitempty"`
+	// ClientPingError is the error of the last ping of the client cluster, it is empty if the ping succeeded
+	ClientPingError string `json:"clientPingError,omitempty"`
+}
+
+// DebugHandler returns a read-only http.Handler serving the capacity, allocatable and conditions currently advertised
+// for the virtual node as JSON. It is not served by the provider on its own, consumers can mount it on their debug
+// endpoints.
+func (v *VirtualK8S) DebugHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		state := nodeDebugState{
+			Name: v.nodeName,
+		}
+		if err := v.clientPingError(); err != nil {
+			state.ClientPingError = err.Error()
+		}
+		if node := v.configuredNode(); node != nil {
+			state.Configured = true
+			state.Unschedulable = node.Spec.Unschedulable
+			state.Capacity = node.Status.Capacity
+			state.Allocatable = node.Status.Allocatable
+			state.Conditions = node.Status.Conditions
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(state)
+	})
+}
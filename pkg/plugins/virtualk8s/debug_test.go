@@ -0,0 +1,76 @@
+package virtualk8s
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// getNodeDebugState gets the state served by the debug handler of v
+func getNodeDebugState(t *testing.T, v *VirtualK8S) nodeDebugState {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	v.DebugHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("expected a JSON response, got %d of %s", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	var state nodeDebugState
+	if err := json.NewDecoder(rec.Body).Decode(&state); err != nil {
+		t.Fatal(err)
+	}
+	return state
+}
+
+func TestDebugHandler(t *testing.T) {
+	v := newConfigureTestProvider(t, testNode("a", "4", "8Gi"))
+	v.nodeName = "vnode"
+	v.setClientPingError(errors.New("connection refused"))
+
+	// Nothing is advertised before the node is configured
+	state := getNodeDebugState(t, v)
+	if state.Name != "vnode" || state.Configured || state.Capacity != nil {
+		t.Fatalf("expected the unconfigured node vnode, got %+v", state)
+	}
+
+	v.providerNode.Lock()
+	v.providerNode.Node = &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "vnode"},
+		Spec:       corev1.NodeSpec{Unschedulable: true},
+		Status: corev1.NodeStatus{
+			Capacity:    corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("4")},
+			Allocatable: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("3")},
+			Conditions:  []corev1.NodeCondition{{Type: corev1.NodeReady, Status: corev1.ConditionTrue}},
+		},
+	}
+	v.configured = true
+	v.providerNode.Unlock()
+
+	state = getNodeDebugState(t, v)
+	if !state.Configured || !state.Unschedulable {
+		t.Fatalf("expected the configured, unschedulable node, got %+v", state)
+	}
+	if q := state.Capacity[corev1.ResourceCPU]; !q.Equal(resource.MustParse("4")) {
+		t.Fatalf("expected a capacity of 4 cpu, got %v", state.Capacity)
+	}
+	if q := state.Allocatable[corev1.ResourceCPU]; !q.Equal(resource.MustParse("3")) {
+		t.Fatalf("expected 3 allocatable cpu, got %v", state.Allocatable)
+	}
+	if len(state.Conditions) != 1 || state.Conditions[0].Type != corev1.NodeReady {
+		t.Fatalf("expected the ready condition, got %v", state.Conditions)
+	}
+	if state.ClientPingError != "connection refused" {
+		t.Fatalf("expected the error of the last ping, got %q", state.ClientPingError)
+	}
+
+	rec := httptest.NewRecorder()
+	v.DebugHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodPut, "/", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("expected the handler to be read-only, got %d", rec.Code)
+	}
+}
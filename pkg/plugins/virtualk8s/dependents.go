@@ -0,0 +1,164 @@
+package virtualk8s
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/clusterrouter-io/clusterrouter/pkg/controllers"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/klog/v2"
+)
+
+// podDependents are the names of the configmaps and secrets of a namespace of the client cluster which deleted pods
+// depended on
+type podDependents struct {
+	configMaps map[string]bool
+	secrets    map[string]bool
+}
+
+// add adds the configmaps and secrets of other to d
+func (d podDependents) add(other podDependents) {
+	for name := range other.configMaps {
+		d.configMaps[name] = true
+	}
+	for name := range other.secrets {
+		d.secrets[name] = true
+	}
+}
+
+// newPodDependents returns the configmaps and secrets pod depends on
+func newPodDependents(pod *corev1.Pod) podDependents {
+	d := podDependents{configMaps: map[string]bool{}, secrets: map[string]bool{}}
+	for _, name := range podConfigMaps(pod) {
+		d.configMaps[name] = true
+	}
+	for _, name := range podSecrets(pod) {
+		d.secrets[name] = true
+	}
+	return d
+}
+
+// enqueueDependentsCleanup queues the configmaps and secrets copied into the client cluster for the deleted client
+// cluster pod for cleanup. They are cleaned up per namespace, so when many pods are deleted at once the dependents
+// still in use are looked up once for all of them rather than once per pod.
+func (v *VirtualK8S) enqueueDependentsCleanup(pod *corev1.Pod) {
+	if _, ok := v.namespaces.ToMaster(pod.Namespace); !ok {
+		return
+	}
+	v.addPendingDependents(pod.Namespace, newPodDependents(pod))
+	if err := v.dependentsQueue.EnqueueWithoutRateLimit(context.Background(), pod.Namespace); err != nil {
+		klog.Errorf("Could not queue the cleanup of the dependents of pod %s/%s: %v", pod.Namespace, pod.Name, err)
+	}
+}
+
+// addPendingDependents adds dependents to the ones of namespace waiting to be cleaned up
+func (v *VirtualK8S) addPendingDependents(namespace string, dependents podDependents) {
+	v.dependentsLock.Lock()
+	defer v.dependentsLock.Unlock()
+	if v.pendingDependents == nil {
+		v.pendingDependents = map[string]podDependents{}
+	}
+	pending, ok := v.pendingDependents[namespace]
+	if !ok {
+		pending = podDependents{configMaps: map[string]bool{}, secrets: map[string]bool{}}
+		v.pendingDependents[namespace] = pending
+	}
+	pending.add(dependents)
+}
+
+// cleanupDependents deletes the configmaps and secrets copied into the client cluster namespace for the pods deleted
+// from it, once no other pod depends on them. Objects which were not copied from the master cluster are left alone. It
+// is the handler of the dependents queue, dependents which could not be deleted are kept for the retry.
+func (v *VirtualK8S) cleanupDependents(ctx context.Context, namespace string) error {
+	masterNamespace, ok := v.namespaces.ToMaster(namespace)
+	if !ok {
+		return nil
+	}
+	v.dependentsLock.Lock()
+	pending, ok := v.pendingDependents[namespace]
+	delete(v.pendingDependents, namespace)
+	v.dependentsLock.Unlock()
+	if !ok {
+		return nil
+	}
+
+	configMapsInUse, secretsInUse, err := v.dependentsInUse(masterNamespace)
+	if err != nil {
+		v.addPendingDependents(namespace, pending)
+		return fmt.Errorf("could not check the dependents still in use in namespace %s: %v", namespace, err)
+	}
+
+	failed := podDependents{configMaps: map[string]bool{}, secrets: map[string]bool{}}
+	for name := range pending.configMaps {
+		if configMapsInUse[name] {
+			continue
+		}
+		cm, err := v.clientCache.cmLister.ConfigMaps(namespace).Get(name)
+		if err != nil || !controllers.IsObjectGlobal(&cm.ObjectMeta) {
+			continue
+		}
+		err = v.client.CoreV1().ConfigMaps(namespace).Delete(ctx, name, metav1.DeleteOptions{
+			Preconditions: metav1.NewUIDPreconditions(string(cm.UID)),
+		})
+		if err != nil && !errors.IsNotFound(err) {
+			klog.Errorf("Failed to delete configmap %s/%s no longer in use: %v", namespace, name, err)
+			failed.configMaps[name] = true
+			continue
+		}
+		klog.V(3).Infof("Deleted configmap %s/%s no longer in use", namespace, name)
+	}
+
+	for name := range pending.secrets {
+		if secretsInUse[name] {
+			continue
+		}
+		secret, err := v.clientCache.secretLister.Secrets(namespace).Get(name)
+		if err != nil || !controllers.IsObjectGlobal(&secret.ObjectMeta) {
+			continue
+		}
+		err = v.client.CoreV1().Secrets(namespace).Delete(ctx, name, metav1.DeleteOptions{
+			Preconditions: metav1.NewUIDPreconditions(string(secret.UID)),
+		})
+		if err != nil && !errors.IsNotFound(err) {
+			klog.Errorf("Failed to delete secret %s/%s no longer in use: %v", namespace, name, err)
+			failed.secrets[name] = true
+			continue
+		}
+		klog.V(3).Infof("Deleted secret %s/%s no longer in use", namespace, name)
+	}
+
+	if n := len(failed.configMaps) + len(failed.secrets); n > 0 {
+		v.addPendingDependents(namespace, failed)
+		return fmt.Errorf("could not delete %d dependents no longer in use in namespace %s", n, namespace)
+	}
+	return nil
+}
+
+// dependentsInUse returns the names of the configmaps and secrets of namespace in the master cluster which pods still
+// depend on. Both the pods in the client cluster, and the pods of the virtual node in the master cluster which are not
+// being deleted are taken into account, so the dependents of pods which are just being created are kept as well.
+func (v *VirtualK8S) dependentsInUse(namespace string) (map[string]bool, map[string]bool, error) {
+	pods, err := v.clientCache.podLister.Pods(v.namespaces.ToClient(namespace)).List(labels.Everything())
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, pod := range v.rm.GetPods() {
+		if pod.Namespace == namespace && pod.DeletionTimestamp == nil {
+			pods = append(pods, pod)
+		}
+	}
+
+	configMaps, secrets := map[string]bool{}, map[string]bool{}
+	for _, pod := range pods {
+		for _, name := range podConfigMaps(pod) {
+			configMaps[name] = true
+		}
+		for _, name := range podSecrets(pod) {
+			secrets[name] = true
+		}
+	}
+	return configMaps, secrets, nil
+}
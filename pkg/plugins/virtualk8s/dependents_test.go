@@ -0,0 +1,134 @@
+package virtualk8s
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/clusterrouter-io/clusterrouter/pkg/controllers"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	listersv1 "k8s.io/client-go/listers/core/v1"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// podWithSecrets returns a pod named name in namespace mounting secrets
+func podWithSecrets(namespace, name string, secrets ...string) *corev1.Pod {
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name}}
+	for _, secret := range secrets {
+		pod.Spec.Volumes = append(pod.Spec.Volumes, corev1.Volume{
+			Name:         secret,
+			VolumeSource: corev1.VolumeSource{Secret: &corev1.SecretVolumeSource{SecretName: secret}},
+		})
+	}
+	return pod
+}
+
+// clientSecret returns a secret of the client cluster, which is a copy of a master cluster secret if global is set
+func clientSecret(name string, global bool) *corev1.Secret {
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "vk-default", Name: name, UID: types.UID("uid-" + name)},
+	}
+	if global {
+		controllers.SetObjectGlobal(&secret.ObjectMeta)
+	}
+	return secret
+}
+
+func TestCleanupDependents(t *testing.T) {
+	secrets := []runtime.Object{
+		clientSecret("unused", true),
+		clientSecret("used-by-client-pod", true),
+		clientSecret("used-by-new-pod", true),
+		clientSecret("not-copied", false),
+	}
+	deleted := podWithSecrets("vk-default", "deleted", "unused", "used-by-client-pod", "used-by-new-pod",
+		"not-copied")
+	other := podWithSecrets("vk-default", "other", "used-by-client-pod")
+	// The new pod is not created in the client cluster yet, while the pod being deleted in the master cluster does not
+	// keep its secrets
+	newPod := podWithSecrets("default", "new", "used-by-new-pod")
+	deleting := podWithSecrets("default", "deleting", "unused")
+	deleting.DeletionTimestamp = &metav1.Time{}
+
+	v, client := newPodTestProvider(t, []runtime.Object{newPod, deleting}, secrets...)
+	v.clientCache.podLister = listersv1.NewPodLister(newIndexer(t, other))
+	v.clientCache.secretLister = listersv1.NewSecretLister(newIndexer(t, secrets...))
+	v.addPendingDependents(deleted.Namespace, newPodDependents(deleted))
+	if err := v.cleanupDependents(context.Background(), deleted.Namespace); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, secret := range secrets {
+		name := secret.(*corev1.Secret).Name
+		_, err := client.CoreV1().Secrets("vk-default").Get(context.Background(), name, metav1.GetOptions{})
+		if expectDeleted := name == "unused"; errors.IsNotFound(err) != expectDeleted {
+			t.Fatalf("expected secret %s to be deleted %v, got %v", name, expectDeleted, err)
+		}
+	}
+}
+
+func TestCleanupDependentsUnmappedNamespace(t *testing.T) {
+	secret := clientSecret("unused", true)
+	secret.Namespace = "default"
+	v, client := newPodTestProvider(t, nil, secret)
+	v.clientCache.secretLister = listersv1.NewSecretLister(newIndexer(t, secret))
+	v.enqueueDependentsCleanup(podWithSecrets("default", "deleted", "unused"))
+	if err := v.cleanupDependents(context.Background(), "default"); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(client.Actions()); n != 0 {
+		t.Fatalf("expected no requests for pods in namespaces not mapped from the master cluster, got %d", n)
+	}
+}
+
+func TestCleanupDependentsOfManyPods(t *testing.T) {
+	secrets := []runtime.Object{clientSecret("first", true), clientSecret("second", true)}
+	v, client := newPodTestProvider(t, nil, secrets...)
+	v.clientCache.secretLister = listersv1.NewSecretLister(newIndexer(t, secrets...))
+	v.enqueueDependentsCleanup(podWithSecrets("vk-default", "first", "first"))
+	v.enqueueDependentsCleanup(podWithSecrets("vk-default", "second", "first", "second"))
+	if n := v.dependentsQueue.Len(); n != 1 {
+		t.Fatalf("expected the pods of a namespace to be cleaned up at once, got %d keys queued", n)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go v.dependentsQueue.Run(ctx, 1)
+	err := wait.PollImmediate(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+		list, err := client.CoreV1().Secrets("vk-default").List(ctx, metav1.ListOptions{})
+		return err == nil && len(list.Items) == 0, err
+	})
+	if err != nil {
+		t.Fatalf("expected the secrets of both pods to be deleted, got %v", err)
+	}
+}
+
+func TestCleanupDependentsRetriesFailures(t *testing.T) {
+	secret := clientSecret("unused", true)
+	v, client := newPodTestProvider(t, nil, secret)
+	v.clientCache.secretLister = listersv1.NewSecretLister(newIndexer(t, secret))
+	client.PrependReactor("delete", "secrets", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, errors.NewInternalError(fmt.Errorf("unavailable"))
+	})
+	v.addPendingDependents("vk-default", newPodDependents(podWithSecrets("vk-default", "deleted", "unused")))
+	if err := v.cleanupDependents(context.Background(), "vk-default"); err == nil {
+		t.Fatal("expected an error to retry the cleanup")
+	}
+	if pending := v.pendingDependents["vk-default"]; !pending.secrets["unused"] {
+		t.Fatalf("expected the secret which could not be deleted to be kept for the retry, got %v", pending)
+	}
+
+	client.ReactionChain = client.ReactionChain[1:]
+	if err := v.cleanupDependents(context.Background(), "vk-default"); err != nil {
+		t.Fatalf("expected the retry to succeed, got %v", err)
+	}
+	if _, ok := v.pendingDependents["vk-default"]; ok {
+		t.Fatal("expected no dependents left pending after the retry")
+	}
+}
@@ -0,0 +1,139 @@
+package virtualk8s
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/clusterrouter-io/clusterrouter/pkg/utils"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/types"
+	informerv1 "k8s.io/client-go/informers/core/v1"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/klog/v2"
+)
+
+// eventReflector re-emits the events of virtual pods in the client cluster on the pods of the master cluster, so they
+// show up when describing the pods there
+type eventReflector struct {
+	v        *VirtualK8S
+	recorder record.EventRecorder
+	// lock protects seen
+	lock sync.Mutex
+	// seen holds the count of every reflected event, so events are only reflected again once they recur
+	seen map[types.UID]int32
+	// started is when the reflector started, the events last seen before were reflected by a previous run and are not
+	// reflected again unless they recur
+	started time.Time
+}
+
+// runEventReflector watches the pod events of the client cluster until ctx is done, and reflects the events of virtual
+// pods onto the master cluster
+func (v *VirtualK8S) runEventReflector(ctx context.Context) {
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: v.master.CoreV1().Events(corev1.NamespaceAll)})
+	r := &eventReflector{
+		v:        v,
+		recorder: broadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: "cluster-router", Host: v.nodeName}),
+		seen:     map[types.UID]int32{},
+		// Timestamps of events are only precise to the second, so events of the second the reflector started in are
+		// reflected rather than lost
+		started: v.clock.Now().Truncate(time.Second),
+	}
+
+	eventInformer := informerv1.NewFilteredEventInformer(v.client, corev1.NamespaceAll, 0, cache.Indexers{},
+		func(options *metav1.ListOptions) {
+			options.FieldSelector = fields.OneTermEqualSelector("involvedObject.kind", "Pod").String()
+		})
+	eventInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			if event, ok := obj.(*corev1.Event); ok {
+				r.reflect(event)
+			}
+		},
+		UpdateFunc: func(_, newObj interface{}) {
+			if event, ok := newObj.(*corev1.Event); ok {
+				r.reflect(event)
+			}
+		},
+		DeleteFunc: func(obj interface{}) {
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			if event, ok := obj.(*corev1.Event); ok {
+				r.forget(event)
+			}
+		},
+	})
+
+	go func() {
+		eventInformer.Run(ctx.Done())
+		broadcaster.Shutdown()
+	}()
+}
+
+// reflect records event on the master cluster pod, if it is about a virtual pod and has not been reflected before
+func (r *eventReflector) reflect(event *corev1.Event) {
+	ref := event.InvolvedObject
+	namespace, ok := r.v.namespaces.ToMaster(ref.Namespace)
+	if !ok {
+		return
+	}
+	clientPod, err := r.v.clientCache.podLister.Pods(ref.Namespace).Get(ref.Name)
+	if err != nil || !utils.IsVirtualPod(clientPod) {
+		return
+	}
+	pod, err := r.v.rm.GetPod(ref.Name, namespace)
+	if err != nil {
+		return
+	}
+
+	count := event.Count
+	if event.Series != nil {
+		count = event.Series.Count
+	}
+	r.lock.Lock()
+	if last, ok := r.seen[event.UID]; ok && last >= count {
+		r.lock.Unlock()
+		return
+	}
+	r.seen[event.UID] = count
+	r.lock.Unlock()
+	if lastSeen := eventLastSeen(event); !lastSeen.IsZero() && lastSeen.Before(r.started) {
+		return
+	}
+
+	klog.V(4).Infof("Reflecting event %s of pod %s/%s", event.Reason, namespace, pod.Name)
+	r.recorder.Event(&corev1.ObjectReference{
+		Kind:            "Pod",
+		APIVersion:      "v1",
+		Namespace:       pod.Namespace,
+		Name:            pod.Name,
+		UID:             pod.UID,
+		ResourceVersion: pod.ResourceVersion,
+		FieldPath:       ref.FieldPath,
+	}, event.Type, event.Reason, event.Message)
+}
+
+// eventLastSeen returns when event last occurred, or the zero time if it is not known
+func eventLastSeen(event *corev1.Event) time.Time {
+	if event.Series != nil && !event.Series.LastObservedTime.IsZero() {
+		return event.Series.LastObservedTime.Time
+	}
+	if !event.LastTimestamp.IsZero() {
+		return event.LastTimestamp.Time
+	}
+	return event.EventTime.Time
+}
+
+// forget drops the count of event once it is deleted from the client cluster
+func (r *eventReflector) forget(event *corev1.Event) {
+	r.lock.Lock()
+	delete(r.seen, event.UID)
+	r.lock.Unlock()
+}
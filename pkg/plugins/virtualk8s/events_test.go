@@ -0,0 +1,222 @@
+package virtualk8s
+
+import (
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	listersv1 "k8s.io/client-go/listers/core/v1"
+)
+
+// recordedEvent is an event recorded by eventRecorder
+type recordedEvent struct {
+	ref                        *corev1.ObjectReference
+	eventType, reason, message string
+}
+
+// eventRecorder records the events of pods
+type eventRecorder struct {
+	events []recordedEvent
+}
+
+func (r *eventRecorder) Event(object runtime.Object, eventType, reason, message string) {
+	r.events = append(r.events, recordedEvent{ref: object.(*corev1.ObjectReference), eventType: eventType,
+		reason: reason, message: message})
+}
+
+func (r *eventRecorder) Eventf(object runtime.Object, eventType, reason, messageFmt string, args ...interface{}) {
+	panic("not implemented")
+}
+
+func (r *eventRecorder) AnnotatedEventf(object runtime.Object, annotations map[string]string, eventType, reason,
+	messageFmt string, args ...interface{}) {
+	panic("not implemented")
+}
+
+// newTestEventReflector returns a reflector of the events of the client cluster pods clientPods onto the master
+// cluster pods masterPods
+func newTestEventReflector(t *testing.T, masterPods []runtime.Object, clientPods ...runtime.Object) (*eventReflector,
+	*eventRecorder) {
+	t.Helper()
+	v, _ := newPodTestProvider(t, masterPods)
+	v.clientCache.podLister = listersv1.NewPodLister(newIndexer(t, clientPods...))
+	recorder := &eventRecorder{}
+	return &eventReflector{v: v, recorder: recorder, seen: map[types.UID]int32{}}, recorder
+}
+
+// testEvent returns an event of the client cluster about the container of testClientPod
+func testEvent(uid types.UID, count int32) *corev1.Event {
+	return &corev1.Event{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "vk-default", Name: "pod.event", UID: uid},
+		InvolvedObject: corev1.ObjectReference{
+			Kind:      "Pod",
+			Namespace: "vk-default",
+			Name:      "pod",
+			UID:       "client-uid",
+			FieldPath: "spec.containers{c}",
+		},
+		Type:    corev1.EventTypeWarning,
+		Reason:  "Failed",
+		Message: "Failed to pull image",
+		Count:   count,
+	}
+}
+
+func TestReflectEvent(t *testing.T) {
+	masterPod := testPod()
+	masterPod.UID = "master-uid"
+	masterPod.ResourceVersion = "7"
+	r, recorder := newTestEventReflector(t, []runtime.Object{masterPod}, testClientPod())
+
+	r.reflect(testEvent("event", 1))
+	if len(recorder.events) != 1 {
+		t.Fatalf("expected 1 event, got %d", len(recorder.events))
+	}
+	event := recorder.events[0]
+	expectedRef := corev1.ObjectReference{
+		Kind:            "Pod",
+		APIVersion:      "v1",
+		Namespace:       "default",
+		Name:            "pod",
+		UID:             "master-uid",
+		ResourceVersion: "7",
+		FieldPath:       "spec.containers{c}",
+	}
+	if *event.ref != expectedRef {
+		t.Fatalf("expected the event to refer to %+v, got %+v", expectedRef, *event.ref)
+	}
+	if event.eventType != corev1.EventTypeWarning || event.reason != "Failed" ||
+		event.message != "Failed to pull image" {
+		t.Fatalf("expected the warning of the client cluster, got %+v", event)
+	}
+}
+
+func TestReflectEventDeduplicates(t *testing.T) {
+	r, recorder := newTestEventReflector(t, []runtime.Object{testPod()}, testClientPod())
+
+	r.reflect(testEvent("event", 1))
+	r.reflect(testEvent("event", 1))
+	if len(recorder.events) != 1 {
+		t.Fatalf("expected an event seen before not to be reflected again, got %d events", len(recorder.events))
+	}
+	r.reflect(testEvent("event", 2))
+	if len(recorder.events) != 2 {
+		t.Fatalf("expected a recurring event to be reflected again, got %d events", len(recorder.events))
+	}
+	series := testEvent("event", 0)
+	series.Series = &corev1.EventSeries{Count: 2}
+	r.reflect(series)
+	if len(recorder.events) != 2 {
+		t.Fatalf("expected the count of the series to be used, got %d events", len(recorder.events))
+	}
+
+	r.forget(testEvent("event", 2))
+	r.reflect(testEvent("event", 1))
+	if len(recorder.events) != 3 {
+		t.Fatalf("expected an event to be reflected after it was deleted and recreated, got %d events",
+			len(recorder.events))
+	}
+}
+
+func TestReflectEventBeforeStart(t *testing.T) {
+	r, recorder := newTestEventReflector(t, []runtime.Object{testPod()}, testClientPod())
+	r.started = testNow
+
+	tests := []struct {
+		name      string
+		event     func() *corev1.Event
+		reflected bool
+	}{
+		{
+			name: "last timestamp before start",
+			event: func() *corev1.Event {
+				event := testEvent("before", 1)
+				event.LastTimestamp = metav1.NewTime(testNow.Add(-time.Minute))
+				return event
+			},
+		},
+		{
+			name: "series observed before start",
+			event: func() *corev1.Event {
+				event := testEvent("series-before", 0)
+				event.Series = &corev1.EventSeries{
+					Count:            2,
+					LastObservedTime: metav1.NewMicroTime(testNow.Add(-time.Second)),
+				}
+				return event
+			},
+		},
+		{
+			name: "event time before start",
+			event: func() *corev1.Event {
+				event := testEvent("event-time-before", 0)
+				event.EventTime = metav1.NewMicroTime(testNow.Add(-time.Second))
+				return event
+			},
+		},
+		{
+			name: "last timestamp at start",
+			event: func() *corev1.Event {
+				event := testEvent("at-start", 1)
+				event.LastTimestamp = metav1.NewTime(testNow)
+				return event
+			},
+			reflected: true,
+		},
+		{
+			name: "recurred after start",
+			event: func() *corev1.Event {
+				event := testEvent("before", 2)
+				event.LastTimestamp = metav1.NewTime(testNow.Add(time.Minute))
+				return event
+			},
+			reflected: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := len(recorder.events)
+			r.reflect(tt.event())
+			if reflected := len(recorder.events) > before; reflected != tt.reflected {
+				t.Fatalf("expected the event to be reflected %v, got %v", tt.reflected, reflected)
+			}
+		})
+	}
+
+}
+
+func TestReflectEventIgnored(t *testing.T) {
+	notVirtual := testClientPod()
+	notVirtual.Name = "not-virtual"
+	notVirtual.Labels = nil
+	unmapped := testClientPod()
+	unmapped.Namespace = "default"
+	noMaster := testClientPod()
+	noMaster.Name = "no-master"
+	r, recorder := newTestEventReflector(t, []runtime.Object{testPod()}, notVirtual, unmapped, noMaster)
+
+	tests := []struct {
+		name      string
+		namespace string
+		pod       string
+	}{
+		{name: "not virtual", namespace: "vk-default", pod: "not-virtual"},
+		{name: "unmapped namespace", namespace: "default", pod: "pod"},
+		{name: "no client pod", namespace: "vk-default", pod: "missing"},
+		{name: "no master pod", namespace: "vk-default", pod: "no-master"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			event := testEvent(types.UID(tt.name), 1)
+			event.InvolvedObject.Namespace = tt.namespace
+			event.InvolvedObject.Name = tt.pod
+			r.reflect(event)
+			if len(recorder.events) != 0 {
+				t.Fatalf("expected the event not to be reflected, got %+v", recorder.events)
+			}
+		})
+	}
+}
@@ -1,15 +1,28 @@
 package virtualk8s
 
 import (
+	"fmt"
+	"os"
 	"strings"
+	"time"
 
 	corev1 "k8s.io/api/core/v1"
-	"k8s.io/klog"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/yaml"
 )
 
 // getSecrets filters the volumes of a pod to get only the secret volumes,
 // excluding the serviceaccount token secret which is automatically added by kuberentes.
+// Secrets referred to by the environment of containers and image pull secrets are included as well.
 func getSecrets(pod *corev1.Pod) []string {
+	secretNames := podSecrets(pod)
+	klog.Infof("pod %s depends on secrets %s", pod.Name, secretNames)
+	return secretNames
+}
+
+// podSecrets returns the names of the secrets pod depends on, without duplicates
+func podSecrets(pod *corev1.Pod) []string {
 	secretNames := []string{}
 	for _, v := range pod.Spec.Volumes {
 		switch {
@@ -17,42 +30,96 @@ func getSecrets(pod *corev1.Pod) []string {
 			if strings.HasPrefix(v.Name, "default-token") {
 				continue
 			}
-			klog.Infof("pod %s depends on secret %s", pod.Name, v.Secret.SecretName)
 			secretNames = append(secretNames, v.Secret.SecretName)
-
-		case v.CephFS != nil:
-			klog.Infof("pod %s depends on secret %s", pod.Name, v.CephFS.SecretRef.Name)
+		case v.CephFS != nil && v.CephFS.SecretRef != nil:
 			secretNames = append(secretNames, v.CephFS.SecretRef.Name)
-		case v.Cinder != nil:
-			klog.Infof("pod %s depends on secret %s", pod.Name, v.Cinder.SecretRef.Name)
+		case v.Cinder != nil && v.Cinder.SecretRef != nil:
 			secretNames = append(secretNames, v.Cinder.SecretRef.Name)
-		case v.RBD != nil:
-			klog.Infof("pod %s depends on secret %s", pod.Name, v.RBD.SecretRef.Name)
+		case v.RBD != nil && v.RBD.SecretRef != nil:
 			secretNames = append(secretNames, v.RBD.SecretRef.Name)
-		default:
-			klog.Warning("Skip other type volumes")
+		case v.Projected != nil:
+			for _, src := range v.Projected.Sources {
+				if src.Secret != nil {
+					secretNames = append(secretNames, src.Secret.Name)
+				}
+			}
 		}
 	}
-	if pod.Spec.ImagePullSecrets != nil {
-		for _, s := range pod.Spec.ImagePullSecrets {
-			secretNames = append(secretNames, s.Name)
+	for _, s := range pod.Spec.ImagePullSecrets {
+		secretNames = append(secretNames, s.Name)
+	}
+	for _, c := range podContainers(pod) {
+		for _, from := range c.EnvFrom {
+			if from.SecretRef != nil {
+				secretNames = append(secretNames, from.SecretRef.Name)
+			}
+		}
+		for _, env := range c.Env {
+			if env.ValueFrom != nil && env.ValueFrom.SecretKeyRef != nil {
+				secretNames = append(secretNames, env.ValueFrom.SecretKeyRef.Name)
+			}
 		}
 	}
-	klog.Infof("pod %s depends on secrets %s", pod.Name, secretNames)
-	return secretNames
+	return uniqueNames(secretNames)
 }
 
 // getConfigmaps filters the volumes of a pod to get only the configmap volumes,
+// Configmaps referred to by the environment of containers are included as well.
 func getConfigmaps(pod *corev1.Pod) []string {
+	cmNames := podConfigMaps(pod)
+	klog.Infof("pod %s depends on configMap %s", pod.Name, cmNames)
+	return cmNames
+}
+
+// podConfigMaps returns the names of the configmaps pod depends on, without duplicates
+func podConfigMaps(pod *corev1.Pod) []string {
 	cmNames := []string{}
 	for _, v := range pod.Spec.Volumes {
-		if v.ConfigMap == nil {
+		switch {
+		case v.ConfigMap != nil:
+			cmNames = append(cmNames, v.ConfigMap.Name)
+		case v.Projected != nil:
+			for _, src := range v.Projected.Sources {
+				if src.ConfigMap != nil {
+					cmNames = append(cmNames, src.ConfigMap.Name)
+				}
+			}
+		}
+	}
+	for _, c := range podContainers(pod) {
+		for _, from := range c.EnvFrom {
+			if from.ConfigMapRef != nil {
+				cmNames = append(cmNames, from.ConfigMapRef.Name)
+			}
+		}
+		for _, env := range c.Env {
+			if env.ValueFrom != nil && env.ValueFrom.ConfigMapKeyRef != nil {
+				cmNames = append(cmNames, env.ValueFrom.ConfigMapKeyRef.Name)
+			}
+		}
+	}
+	return uniqueNames(cmNames)
+}
+
+// podContainers returns the init containers and containers of pod
+func podContainers(pod *corev1.Pod) []corev1.Container {
+	containers := make([]corev1.Container, 0, len(pod.Spec.InitContainers)+len(pod.Spec.Containers))
+	containers = append(containers, pod.Spec.InitContainers...)
+	return append(containers, pod.Spec.Containers...)
+}
+
+// uniqueNames returns names without empty and duplicate entries, keeping their order
+func uniqueNames(names []string) []string {
+	seen := make(map[string]bool, len(names))
+	unique := names[:0]
+	for _, name := range names {
+		if name == "" || seen[name] {
 			continue
 		}
-		cmNames = append(cmNames, v.ConfigMap.Name)
+		seen[name] = true
+		unique = append(unique, name)
 	}
-	klog.Infof("pod %s depends on configMap %s", pod.Name, cmNames)
-	return cmNames
+	return unique
 }
 
 // getPVCs filters the volumes of a pod to get only the pvc,
@@ -68,20 +135,32 @@ func getPVCs(pod *corev1.Pod) []string {
 	return cmNames
 }
 
-func checkNodeStatusReady(node *corev1.Node) bool {
+// checkNodeStatusReady returns true if node is ready and its network is available. If heartbeatTimeout is set, the
+// last heartbeat of the ready condition must also be more recent than heartbeatTimeout at now.
+func checkNodeStatusReady(node *corev1.Node, heartbeatTimeout time.Duration, now time.Time) bool {
+	ready := false
 	for _, condition := range node.Status.Conditions {
-		if condition.Type != corev1.NodeReady {
-			continue
-		}
-		if condition.Status == corev1.ConditionTrue {
-			return true
+		switch condition.Type {
+		case corev1.NodeReady:
+			if condition.Status != corev1.ConditionTrue {
+				return false
+			}
+			if heartbeatTimeout > 0 && now.Sub(condition.LastHeartbeatTime.Time) > heartbeatTimeout {
+				return false
+			}
+			ready = true
+		case corev1.NodeNetworkUnavailable:
+			if condition.Status == corev1.ConditionTrue {
+				return false
+			}
 		}
 	}
-	return false
+	return ready
 }
 
-func compareNodeStatusReady(old, new *corev1.Node) (bool, bool) {
-	return checkNodeStatusReady(old), checkNodeStatusReady(new)
+// compareNodeStatusReady returns whether old and new are ready, checking their heartbeats at now
+func compareNodeStatusReady(old, new *corev1.Node, heartbeatTimeout time.Duration, now time.Time) (bool, bool) {
+	return checkNodeStatusReady(old, heartbeatTimeout, now), checkNodeStatusReady(new, heartbeatTimeout, now)
 }
 
 func podStopped(pod *corev1.Pod) bool {
@@ -89,6 +168,64 @@ func podStopped(pod *corev1.Pod) bool {
 		RestartPolicy == corev1.RestartPolicyNever
 }
 
+// containersTerminated returns true if all containers of the pod have terminated, which may be the case before the
+// phase of the pod has been updated.
+func containersTerminated(pod *corev1.Pod) bool {
+	if len(pod.Status.ContainerStatuses) == 0 {
+		return false
+	}
+	for _, status := range pod.Status.ContainerStatuses {
+		if status.State.Terminated == nil {
+			return false
+		}
+	}
+	return true
+}
+
+// loadNodeLabels reads the labels of the virtual node from a YAML or JSON file holding a map of label keys to values.
+// Labels with a key under the kubernetes.io or k8s.io namespaces are reserved, since they are managed by the virtual
+// kubelet or kubernetes itself, and skipped.
+func loadNodeLabels(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read node labels file: %v", err)
+	}
+	var fileLabels map[string]string
+	if err := yaml.Unmarshal(data, &fileLabels); err != nil {
+		return nil, fmt.Errorf("could not parse node labels file %s: %v", path, err)
+	}
+	nodeLabels := make(map[string]string, len(fileLabels))
+	for key, value := range fileLabels {
+		if errs := validation.IsQualifiedName(key); len(errs) > 0 {
+			return nil, fmt.Errorf("invalid node label key %q: %s", key, strings.Join(errs, "; "))
+		}
+		if errs := validation.IsValidLabelValue(value); len(errs) > 0 {
+			return nil, fmt.Errorf("invalid value %q of node label %s: %s", value, key, strings.Join(errs, "; "))
+		}
+		if reservedLabelKey(key) {
+			klog.Warningf("Skipping reserved node label %s from %s", key, path)
+			continue
+		}
+		nodeLabels[key] = value
+	}
+	return nodeLabels, nil
+}
+
+// reservedLabelKey returns true if key is in the kubernetes.io or k8s.io namespace
+func reservedLabelKey(key string) bool {
+	i := strings.Index(key, "/")
+	if i < 0 {
+		return false
+	}
+	prefix := key[:i]
+	for _, reserved := range []string{"kubernetes.io", "k8s.io"} {
+		if prefix == reserved || strings.HasSuffix(prefix, "."+reserved) {
+			return true
+		}
+	}
+	return false
+}
+
 // nodeCustomLabel adds an additional node label.
 // The label can be any customised meaningful label specified from user.
 func nodeCustomLabel(node *corev1.Node, label string) {
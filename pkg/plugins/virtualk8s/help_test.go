@@ -0,0 +1,181 @@
+package virtualk8s
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/clusterrouter-io/clusterrouter/pkg/common"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestCheckNodeStatusReady(t *testing.T) {
+	networkUnavailable := func(status corev1.ConditionStatus) func(*corev1.Node) {
+		return func(n *corev1.Node) {
+			n.Status.Conditions = append(n.Status.Conditions, corev1.NodeCondition{
+				Type:   corev1.NodeNetworkUnavailable,
+				Status: status,
+			})
+		}
+	}
+	heartbeat := func(age time.Duration) func(*corev1.Node) {
+		return func(n *corev1.Node) {
+			n.Status.Conditions[0].LastHeartbeatTime = metav1.NewTime(testNow.Add(-age))
+		}
+	}
+	tests := []struct {
+		name             string
+		node             *corev1.Node
+		heartbeatTimeout time.Duration
+		expected         bool
+	}{
+		{name: "ready", node: testNode("a", "4", "8Gi"), expected: true},
+		{
+			name: "not ready",
+			node: withNode(testNode("a", "4", "8Gi"), func(n *corev1.Node) {
+				n.Status.Conditions[0].Status = corev1.ConditionFalse
+			}),
+		},
+		{
+			name: "no ready condition",
+			node: withNode(testNode("a", "4", "8Gi"), func(n *corev1.Node) { n.Status.Conditions = nil }),
+		},
+		{
+			name: "network unavailable",
+			node: withNode(testNode("a", "4", "8Gi"), networkUnavailable(corev1.ConditionTrue)),
+		},
+		{
+			name:     "network available",
+			node:     withNode(testNode("a", "4", "8Gi"), networkUnavailable(corev1.ConditionFalse)),
+			expected: true,
+		},
+		{
+			name:             "stale heartbeat",
+			node:             withNode(testNode("a", "4", "8Gi"), heartbeat(2*time.Minute)),
+			heartbeatTimeout: time.Minute,
+		},
+		{
+			name:             "recent heartbeat",
+			node:             withNode(testNode("a", "4", "8Gi"), heartbeat(30*time.Second)),
+			heartbeatTimeout: time.Minute,
+			expected:         true,
+		},
+		{
+			name:     "stale heartbeat without timeout",
+			node:     withNode(testNode("a", "4", "8Gi"), heartbeat(time.Hour)),
+			expected: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if ready := checkNodeStatusReady(tt.node, tt.heartbeatTimeout, testNow); ready != tt.expected {
+				t.Fatalf("expected ready %v, got %v", tt.expected, ready)
+			}
+		})
+	}
+}
+
+func TestUpdateVKCapacityFromNodeHeartbeat(t *testing.T) {
+	v := newConfigureTestProvider(t)
+	v.heartbeatTimeout = time.Minute
+	v.providerNode.Node = &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "vnode"}}
+
+	// The node becomes ready with a heartbeat which is recent according to the clock of the provider
+	old := withNode(testNode("a", "4", "8Gi"), func(n *corev1.Node) {
+		n.Status.Conditions[0].LastHeartbeatTime = metav1.NewTime(testNow.Add(-time.Hour))
+	})
+	v.updateVKCapacityFromNode(old, testNode("a", "4", "8Gi"))
+	capacity := common.ConvertResource(v.providerNode.Status.Capacity)
+	if want := testResource("4", "8Gi", "110"); !capacity.Equal(want) {
+		t.Fatalf("expected the capacity of the node to be added, got %s", capacity)
+	}
+}
+
+func TestConfigureNodeSkipsNotReadyNodes(t *testing.T) {
+	v := newConfigureTestProvider(t,
+		testNode("a", "4", "8Gi"),
+		withNode(testNode("stale", "4", "8Gi"), func(n *corev1.Node) {
+			n.Status.Conditions[0].LastHeartbeatTime = metav1.NewTime(testNow.Add(-5 * time.Minute))
+		}),
+		withNode(testNode("network-unavailable", "4", "8Gi"), func(n *corev1.Node) {
+			n.Status.Conditions = append(n.Status.Conditions, corev1.NodeCondition{
+				Type:   corev1.NodeNetworkUnavailable,
+				Status: corev1.ConditionTrue,
+			})
+		}))
+	setTestPods(t, v, testPodOn("stale", corev1.PodRunning, "1", "1Gi"))
+	v.heartbeatTimeout = time.Minute
+
+	node := configureTestNode(v)
+	if !common.ConvertResource(node.Status.Capacity).Equal(testResource("4", "8Gi", "110")) {
+		t.Fatalf("expected only the capacity of the ready node, got %v", node.Status.Capacity)
+	}
+	if !common.ConvertResource(node.Status.Allocatable).Equal(testResource("4", "8Gi", "110")) {
+		t.Fatalf("expected the pods of nodes which are not ready not to be counted, got %v", node.Status.Allocatable)
+	}
+}
+
+func TestLoadNodeLabels(t *testing.T) {
+	tests := []struct {
+		name     string
+		file     string
+		expected map[string]string
+		wantErr  bool
+	}{
+		{
+			name: "yaml",
+			file: "team: storage\nexample.com/tier: gold\nnode-role.kubernetes.io/worker: \"\"\n" +
+				"kubernetes.io/hostname: vk\n",
+			expected: map[string]string{"team": "storage", "example.com/tier": "gold"},
+		},
+		{
+			name:     "json",
+			file:     `{"team": "storage", "k8s.io/reserved": "true", "empty": ""}`,
+			expected: map[string]string{"team": "storage", "empty": ""},
+		},
+		{name: "invalid key", file: "bad key: value\n", wantErr: true},
+		{name: "invalid value", file: "team: not a valid value\n", wantErr: true},
+		{name: "not a map", file: "- team\n", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "labels")
+			if err := os.WriteFile(path, []byte(tt.file), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			labels, err := loadNodeLabels(path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("expected error %t, got %v", tt.wantErr, err)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(labels, tt.expected) {
+				t.Fatalf("expected the labels %v, got %v", tt.expected, labels)
+			}
+		})
+	}
+	if _, err := loadNodeLabels(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Fatal("expected an error for a missing labels file")
+	}
+}
+
+func TestConfigureNodeLabelsFromFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "labels.yaml")
+	if err := os.WriteFile(path, []byte("team: storage\nexample.com/tier: gold\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	nodeLabels, err := loadNodeLabels(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := newConfigureTestProvider(t, testNode("a", "4", "8Gi"))
+	v.nodeLabels = nodeLabels
+
+	node := configureTestNode(v)
+	for key, want := range map[string]string{"team": "storage", "example.com/tier": "gold"} {
+		if got, ok := node.Labels[key]; !ok || got != want {
+			t.Fatalf("expected the node label %s=%s, got %v", key, want, node.Labels)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package virtualk8s
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	metricsNamespace = "clusterrouter"
+
+	pingClusterMaster = "master"
+	pingClusterClient = "client"
+)
+
+// pingMetrics holds the prometheus metrics of the pings of the master and client cluster
+type pingMetrics struct {
+	total    *prometheus.CounterVec
+	duration *prometheus.HistogramVec
+}
+
+func newPingMetrics() *pingMetrics {
+	return &pingMetrics{
+		total: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "ping_total",
+			Help:      "Total number of pings of the master and client apiservers, by cluster and result.",
+		}, []string{"cluster", "result"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "ping_duration_seconds",
+			Help:      "How long in seconds a ping of the master or client apiserver takes, including retries.",
+			Buckets:   prometheus.ExponentialBuckets(0.005, 2, 12),
+		}, []string{"cluster"}),
+	}
+}
+
+// observe records a ping of cluster which started at start and failed with err
+func (m *pingMetrics) observe(cluster string, start time.Time, err error) {
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	m.total.WithLabelValues(cluster, result).Inc()
+	m.duration.WithLabelValues(cluster).Observe(time.Since(start).Seconds())
+}
+
+// MetricsCollector returns a prometheus.Collector reporting the number of pings of the master and client apiservers by
+// result, and their latency.
+//
+// Registration is left to the caller, the provider does not register any metrics on its own.
+func (v *VirtualK8S) MetricsCollector() prometheus.Collector {
+	return &metricsCollector{m: v.pingMetrics}
+}
+
+// metricsCollector implements prometheus.Collector for a VirtualK8S
+type metricsCollector struct {
+	m *pingMetrics
+}
+
+var _ prometheus.Collector = &metricsCollector{}
+
+// Describe implements prometheus.Collector
+func (c *metricsCollector) Describe(ch chan<- *prometheus.Desc) {
+	c.m.total.Describe(ch)
+	c.m.duration.Describe(ch)
+}
+
+// Collect implements prometheus.Collector
+func (c *metricsCollector) Collect(ch chan<- prometheus.Metric) {
+	c.m.total.Collect(ch)
+	c.m.duration.Collect(ch)
+}
@@ -0,0 +1,122 @@
+package virtualk8s
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// failingDiscovery returns a fake client whose server version requests fail
+func failingDiscovery() *fake.Clientset {
+	client := fake.NewSimpleClientset()
+	client.PrependReactor("get", "version", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, errors.New("connection refused")
+	})
+	return client
+}
+
+// gatherPingMetrics returns the ping_total counters of reg by cluster and result, and the number of observed ping
+// durations by cluster
+func gatherPingMetrics(t *testing.T, reg *prometheus.Registry) (map[[2]string]float64, map[string]uint64) {
+	t.Helper()
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	labelValue := func(m *dto.Metric, name string) string {
+		for _, label := range m.GetLabel() {
+			if label.GetName() == name {
+				return label.GetValue()
+			}
+		}
+		return ""
+	}
+	totals := map[[2]string]float64{}
+	durations := map[string]uint64{}
+	for _, family := range families {
+		for _, m := range family.GetMetric() {
+			switch family.GetName() {
+			case "clusterrouter_ping_total":
+				totals[[2]string{labelValue(m, "cluster"), labelValue(m, "result")}] = m.GetCounter().GetValue()
+			case "clusterrouter_ping_duration_seconds":
+				durations[labelValue(m, "cluster")] = m.GetHistogram().GetSampleCount()
+			}
+		}
+	}
+	return totals, durations
+}
+
+func TestPingMetrics(t *testing.T) {
+	tests := []struct {
+		name      string
+		master    *fake.Clientset
+		client    *fake.Clientset
+		wantErr   bool
+		totals    map[[2]string]float64
+		durations map[string]uint64
+	}{
+		{
+			name:      "both clusters reachable",
+			master:    fake.NewSimpleClientset(),
+			client:    fake.NewSimpleClientset(),
+			totals:    map[[2]string]float64{{"master", "success"}: 1, {"client", "success"}: 1},
+			durations: map[string]uint64{"master": 1, "client": 1},
+		},
+		{
+			name:      "client cluster unreachable",
+			master:    fake.NewSimpleClientset(),
+			client:    failingDiscovery(),
+			totals:    map[[2]string]float64{{"master", "success"}: 1, {"client", "failure"}: 1},
+			durations: map[string]uint64{"master": 1, "client": 1},
+		},
+		{
+			// The client cluster is not pinged once the master cluster is unreachable
+			name:      "master cluster unreachable",
+			master:    failingDiscovery(),
+			client:    fake.NewSimpleClientset(),
+			wantErr:   true,
+			totals:    map[[2]string]float64{{"master", "failure"}: 1},
+			durations: map[string]uint64{"master": 1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := newConfigureTestProvider(t, testNode("a", "4", "8Gi"))
+			v.master, v.client = tt.master, tt.client
+			v.pingTimeout = time.Second
+			v.pingMetrics = newPingMetrics()
+			v.updatedNode = make(chan *corev1.Node, 1)
+			reg := prometheus.NewPedanticRegistry()
+			reg.MustRegister(v.MetricsCollector())
+
+			if err := v.Ping(context.Background()); (err != nil) != tt.wantErr {
+				t.Fatalf("expected error %t, got %v", tt.wantErr, err)
+			}
+			totals, durations := gatherPingMetrics(t, reg)
+			if len(totals) != len(tt.totals) {
+				t.Fatalf("expected the ping counters %v, got %v", tt.totals, totals)
+			}
+			for labels, want := range tt.totals {
+				if got := totals[labels]; got != want {
+					t.Fatalf("expected the ping counters %v, got %v", tt.totals, totals)
+				}
+			}
+			if len(durations) != len(tt.durations) {
+				t.Fatalf("expected the observed ping durations %v, got %v", tt.durations, durations)
+			}
+			for cluster, want := range tt.durations {
+				if got := durations[cluster]; got != want {
+					t.Fatalf("expected the observed ping durations %v, got %v", tt.durations, durations)
+				}
+			}
+		})
+	}
+}
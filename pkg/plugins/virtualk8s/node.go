@@ -2,77 +2,334 @@ package virtualk8s
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/clusterrouter-io/clusterrouter/pkg/utils"
+	"net"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/clusterrouter-io/clusterrouter/pkg/common"
 	corev1 "k8s.io/api/core/v1"
+	apiequality "k8s.io/apimachinery/pkg/api/equality"
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/fields"
 	"k8s.io/apimachinery/pkg/labels"
-	"k8s.io/klog"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/version"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/pager"
+	"k8s.io/klog/v2"
 )
 
+const (
+	// pingAttempts is the number of times the apiservers are tried before a ping is considered failed
+	pingAttempts = 3
+	// pingBackoff is the delay before the first retry of a failed ping, it doubles with every retry
+	pingBackoff = 200 * time.Millisecond
+	// providerIDPageSize is the number of nodes listed at once when checking the provider ID is unique
+	providerIDPageSize = 500
+)
+
+// errProviderIDUsed stops listing the nodes once one using the provider ID was found
+var errProviderIDUsed = errors.New("provider ID already used")
+
 // ConfigureNode enables a provider to configure the node object that
 // will be used for Kubernetes.
 func (v *VirtualK8S) ConfigureNode(ctx context.Context, node *corev1.Node) {
-	nodes, err := v.clientCache.nodeLister.List(labels.Everything())
+	snapshot, err := v.capacity()
 	if err != nil {
 		return
 	}
+	schedulable := snapshot.Schedulable
+	for _, name := range snapshot.NotReady {
+		klog.Infof("Node %v not ready", name)
+	}
 
-	nodeResource := common.NewResource()
-
-	for _, n := range nodes {
-		if n.Spec.Unschedulable {
-			continue
-		}
-		if !checkNodeStatusReady(n) {
-			klog.Infof("Node %v not ready", node.Name)
-			continue
-		}
-		nc := common.ConvertResource(n.Status.Capacity)
-		nodeResource.Add(nc)
-	}
-	podResource := v.getResourceFromPods()
-	nodeResource.Sub(podResource)
-	nodeResource.SetCapacityToNode(node)
-	node.Status.NodeInfo.KubeletVersion = v.version
-	node.Status.NodeInfo.OperatingSystem = "linux"
-	node.Status.NodeInfo.Architecture = "amd64"
-	node.ObjectMeta.Labels[corev1.LabelArchStable] = "amd64"
-	node.ObjectMeta.Labels[corev1.LabelOSStable] = "linux"
-	node.ObjectMeta.Labels[utils.LabelOSBeta] = "linux"
+	// Capacity is the gross sum of the client nodes, while allocatable excludes the reservations and the resources
+	// already used by pods of the client cluster.
+	snapshot.Capacity.SetCapacityToNode(node)
+	snapshot.Allocatable.SetAllocatableToNode(node)
+	node.Status.NodeInfo.KubeletVersion = v.kubeletVersion()
+	node.Status.NodeInfo.OperatingSystem = v.operatingSystem
+	node.Status.NodeInfo.Architecture = v.architecture
+	node.ObjectMeta.Labels[corev1.LabelArchStable] = v.architecture
+	node.ObjectMeta.Labels[corev1.LabelOSStable] = v.operatingSystem
+	node.ObjectMeta.Labels[utils.LabelOSBeta] = v.operatingSystem
+	setTopologyLabel(node, corev1.LabelTopologyRegion, v.region, schedulable)
+	setTopologyLabel(node, corev1.LabelTopologyZone, v.zone, schedulable)
+	for key, value := range v.nodeLabels {
+		node.ObjectMeta.Labels[key] = value
+	}
 	if label := os.Getenv("VKUBELET_NODE_LABEL"); label != "" {
 		nodeCustomLabel(node, label)
 	}
-	node.Status.Addresses = []corev1.NodeAddress{{Type: corev1.NodeInternalIP, Address: os.Getenv("VKUBELET_POD_IP")}}
-	if externalIP := os.Getenv("VKUBELET_EXTERNAL_POD_IP"); externalIP != "" {
-		node.Status.Addresses = append(node.Status.Addresses, corev1.NodeAddress{Type: corev1.NodeExternalIP, Address: externalIP})
+	node.Status.Addresses = nodeAddresses(os.Getenv("VKUBELET_POD_IP"), os.Getenv("VKUBELET_EXTERNAL_POD_IP"),
+		os.Getenv("VKUBELET_NODE_HOSTNAME"))
+	node.Spec.Taints = mergeTaints(node.Spec.Taints, v.nodeTaints)
+	if v.propagateTaints {
+		node.Spec.Taints = mergeTaints(node.Spec.Taints, commonTaints(schedulable))
 	}
-	node.Status.Conditions = nodeConditions()
+	node.Status.Conditions = nodeConditions(schedulable, snapshot.Pressure, v.clientPingError())
 	node.Status.DaemonEndpoints = v.nodeDaemonEndpoints()
+	if v.providerID != "" {
+		node.Spec.ProviderID = v.providerID
+	}
+	v.providerNode.Lock()
 	v.providerNode.Node = node
 	v.configured = true
+	v.providerNode.Unlock()
 	return
 }
 
+// isConfigured returns true once ConfigureNode has been called
+func (v *VirtualK8S) isConfigured() bool {
+	v.providerNode.Lock()
+	defer v.providerNode.Unlock()
+	return v.configured
+}
+
+// configuredNode returns a copy of the node, or nil if ConfigureNode has not been called yet. Both are read under the
+// lock of the provider node, which ConfigureNode and the status updates write them under.
+func (v *VirtualK8S) configuredNode() *corev1.Node {
+	v.providerNode.Lock()
+	defer v.providerNode.Unlock()
+	if !v.configured || v.providerNode.Node == nil {
+		return nil
+	}
+	return v.providerNode.Node.DeepCopy()
+}
+
+// checkProviderIDUnique returns an error if a node of the master cluster other than nodeName already has the configured
+// provider ID. The nodes are listed in pages, since the apiserver cannot select them by provider ID, and the master
+// cluster may have a lot of them. It is called once at startup.
+func (v *VirtualK8S) checkProviderIDUnique(ctx context.Context, nodeName string) error {
+	p := pager.New(func(ctx context.Context, opts metav1.ListOptions) (runtime.Object, error) {
+		return v.master.CoreV1().Nodes().List(ctx, opts)
+	})
+	p.PageSize = providerIDPageSize
+	var used string
+	err := p.EachListItem(ctx, metav1.ListOptions{}, func(obj runtime.Object) error {
+		n := obj.(*corev1.Node)
+		if n.Name != nodeName && n.Spec.ProviderID == v.providerID {
+			used = n.Name
+			return errProviderIDUsed
+		}
+		return nil
+	})
+	if used != "" {
+		return fmt.Errorf("provider ID %s is already used by node %s", v.providerID, used)
+	}
+	if err != nil {
+		return fmt.Errorf("could not list nodes of the master cluster: %v", err)
+	}
+	return nil
+}
+
+// validProviderID returns true if id is of the form <scheme>://<id>
+func validProviderID(id string) bool {
+	parts := strings.SplitN(id, "://", 2)
+	return len(parts) == 2 && parts[0] != "" && parts[1] != ""
+}
+
+// nodeCapacity returns the capacity a client cluster node contributes to the virtual node, see
+// CapacityOptions.nodeCapacity
+func (v *VirtualK8S) nodeCapacity(node *corev1.Node) *common.Resource {
+	return v.capacityOptions().nodeCapacity(node)
+}
+
+// nodeAllocatable returns the capacity of a client cluster node which can be used by pods, see
+// CapacityOptions.nodeAllocatable
+func (v *VirtualK8S) nodeAllocatable(node *corev1.Node) *common.Resource {
+	return v.capacityOptions().nodeAllocatable(node)
+}
+
 // Ping tries to connect to client cluster
 // implement node.NodeProvider
+//
+// Only a failure to reach the master fails the ping, since the node status can not be updated without it. If the client
+// cluster can not be reached, the virtual node is reported as not ready instead.
 func (v *VirtualK8S) Ping(ctx context.Context) error {
-	// If node or master ping fail, we should it as a failed ping
-	_, err := v.master.Discovery().ServerVersion()
+	start := time.Now()
+	_, err := v.pingWithRetry(ctx, v.master)
+	v.pingMetrics.observe(pingClusterMaster, start, err)
 	if err != nil {
 		klog.Error("Failed ping")
 		return fmt.Errorf("could not list master apiserver statuses: %v", err)
 	}
-	_, err = v.client.Discovery().ServerVersion()
+	start = time.Now()
+	info, err := v.pingWithRetry(ctx, v.client)
+	v.pingMetrics.observe(pingClusterClient, start, err)
+	if err == nil {
+		v.setClientVersion(info.GitVersion)
+	} else {
+		klog.Errorf("Failed ping client cluster: %v", err)
+		err = fmt.Errorf("could not list client apiserver statuses: %v", err)
+	}
+	v.setClientPingError(err)
+	v.refreshNodeConditions()
+	return nil
+}
+
+// pingWithRetry gets the server version of the apiserver behind client. Every attempt is bounded by the ping timeout,
+// and a failed attempt is retried with backoff, so a single transient failure does not fail the ping.
+func (v *VirtualK8S) pingWithRetry(ctx context.Context, client kubernetes.Interface) (*version.Info, error) {
+	backoff := pingBackoff
+	var err error
+	for attempt := 0; attempt < pingAttempts; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+		}
+		var info *version.Info
+		if info, err = pingOnce(ctx, client, v.pingTimeout); err == nil {
+			return info, nil
+		}
+		klog.V(4).Infof("Ping attempt %d failed: %v", attempt+1, err)
+	}
+	return nil, err
+}
+
+// pingOnce gets the server version of the apiserver behind client, giving up after timeout. The request is bound to
+// the timeout, so it is aborted rather than left running against an apiserver which does not respond.
+func pingOnce(ctx context.Context, client kubernetes.Interface, timeout time.Duration) (*version.Info, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	restClient := client.Discovery().RESTClient()
+	if restClient == nil {
+		// Fake discovery clients have no REST client, and answer right away
+		return client.Discovery().ServerVersion()
+	}
+	body, err := restClient.Get().AbsPath("/version").Do(ctx).Raw()
 	if err != nil {
-		klog.Error("Failed ping")
-		return fmt.Errorf("could not list client apiserver statuses: %v", err)
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, fmt.Errorf("ping timed out after %v: %v", timeout, err)
+		}
+		return nil, err
+	}
+	var info version.Info
+	if err := json.Unmarshal(body, &info); err != nil {
+		return nil, fmt.Errorf("unable to parse the server version: %v", err)
+	}
+	return &info, nil
+}
+
+// kubeletVersion returns the version of the client cluster, as of the last successful ping
+func (v *VirtualK8S) kubeletVersion() string {
+	v.pingLock.Lock()
+	defer v.pingLock.Unlock()
+	return v.version
+}
+
+func (v *VirtualK8S) setClientVersion(gitVersion string) {
+	if gitVersion == "" {
+		return
+	}
+	v.pingLock.Lock()
+	defer v.pingLock.Unlock()
+	v.version = gitVersion
+}
+
+func (v *VirtualK8S) clientPingError() error {
+	v.pingLock.Lock()
+	defer v.pingLock.Unlock()
+	return v.clientPingErr
+}
+
+func (v *VirtualK8S) setClientPingError(err error) {
+	v.pingLock.Lock()
+	defer v.pingLock.Unlock()
+	v.clientPingErr = err
+}
+
+// refreshNodeConditions recomputes the conditions of the virtual node, and notifies the new node status if any of them
+// changed. While resources are under pressure, or when the pressure changes, the allocatable is reset to the one of the
+// capacity snapshot, so the capacity left by pods is reported accurately while the node is pressured.
+func (v *VirtualK8S) refreshNodeConditions() {
+	if v.configuredNode() == nil {
+		return
+	}
+	snapshot, err := v.capacity()
+	if err != nil {
+		return
+	}
+	conditions := nodeConditions(snapshot.Schedulable, snapshot.Pressure, v.clientPingError())
+
+	v.providerNode.Lock()
+	changed := conditionsChanged(v.providerNode.Status.Conditions, conditions)
+	if v.pressureThreshold > 0 && (changed || snapshot.Pressure != ResourcePressure{}) {
+		allocatable := snapshot.Allocatable.ResourceList()
+		if !apiequality.Semantic.DeepEqual(v.providerNode.Status.Allocatable, allocatable) {
+			v.providerNode.Status.Allocatable = allocatable
+			changed = true
+		}
+	}
+	if !changed {
+		v.providerNode.Unlock()
+		return
+	}
+	v.providerNode.Status.Conditions = conditions
+	node := v.providerNode.Node.DeepCopy()
+	v.providerNode.Unlock()
+	v.notifyNodeUpdate(node)
+}
+
+// notifyNodeUpdate queues node to be reported by NotifyNodeStatus without blocking. Every update is a full copy of the
+// node, so if the buffer is full because nothing consumes it, the oldest update is dropped in favor of node.
+func (v *VirtualK8S) notifyNodeUpdate(node *corev1.Node) {
+	select {
+	case v.updatedNode <- node:
+		return
+	default:
+	}
+	select {
+	case <-v.updatedNode:
+	default:
+	}
+	select {
+	case v.updatedNode <- node:
+	default:
+		klog.Warningf("Dropping status update of node %s, nothing is reporting the node status", node.Name)
+	}
+}
+
+// Cordon marks the virtual node as unschedulable, so no new pods are placed on it, while pods already running on it
+// keep running and the capacity is still reported as before. The node of the master cluster is patched directly, as
+// only the status of the node is updated from the provider.
+func (v *VirtualK8S) Cordon(ctx context.Context) error {
+	return v.setUnschedulable(ctx, true)
+}
+
+// Uncordon marks the virtual node as schedulable again after Cordon
+func (v *VirtualK8S) Uncordon(ctx context.Context) error {
+	return v.setUnschedulable(ctx, false)
+}
+
+func (v *VirtualK8S) setUnschedulable(ctx context.Context, unschedulable bool) error {
+	if v.configuredNode() == nil {
+		return fmt.Errorf("node %s has not been configured yet", v.nodeName)
 	}
+	patch := []byte(fmt.Sprintf(`{"spec":{"unschedulable":%t}}`, unschedulable))
+	_, err := v.master.CoreV1().Nodes().Patch(ctx, v.nodeName, types.StrategicMergePatchType, patch,
+		metav1.PatchOptions{})
+	if err != nil {
+		return fmt.Errorf("could not set node %s unschedulable to %t: %v", v.nodeName, unschedulable, err)
+	}
+
+	v.providerNode.Lock()
+	v.providerNode.Spec.Unschedulable = unschedulable
+	node := v.providerNode.Node.DeepCopy()
+	v.providerNode.Unlock()
+	klog.Infof("Set node %s unschedulable to %t", v.nodeName, unschedulable)
+	v.notifyNodeUpdate(node)
 	return nil
 }
 
@@ -83,14 +340,36 @@ func (v *VirtualK8S) Ping(ctx context.Context) error {
 // the status.
 //
 // NotifyNodeStatus should not block callers.
+//
+// If a node status interval is configured, the current status is also reported on every tick, so the node is kept
+// fresh even if nothing changes in the client cluster. Updates which do not change the reported status are dropped,
+// see nodeStatusChanged.
 func (v *VirtualK8S) NotifyNodeStatus(ctx context.Context, f func(*corev1.Node)) {
 	klog.Info("Called NotifyNodeStatus")
 	go func() {
+		var tick <-chan time.Time
+		if v.nodeStatusInterval > 0 {
+			ticker := v.clock.NewTicker(v.nodeStatusInterval)
+			defer ticker.Stop()
+			tick = ticker.C()
+		}
+		var last *corev1.Node
 		for {
 			select {
 			case node := <-v.updatedNode:
 				//klog.Infof("Enqueue updated node %v", node.Name)
+				if !nodeStatusChanged(last, node) {
+					continue
+				}
+				last = node
 				f(node)
+			case <-tick:
+				node := v.configuredNode()
+				if node == nil {
+					continue
+				}
+				last = node
+				f(last)
 			case <-v.stopCh:
 				return
 			case <-ctx.Done():
@@ -100,6 +379,64 @@ func (v *VirtualK8S) NotifyNodeStatus(ctx context.Context, f func(*corev1.Node))
 	}()
 }
 
+// setTopologyLabel sets the topology label key on node to value. If value is empty, the value all of nodes share for the
+// label is used, and the label is omitted if they do not agree.
+func setTopologyLabel(node *corev1.Node, key, value string, nodes []*corev1.Node) {
+	if value == "" {
+		value = sharedLabelValue(nodes, key)
+	}
+	if value == "" {
+		return
+	}
+	node.ObjectMeta.Labels[key] = value
+}
+
+// sharedLabelValue returns the value of the label key if all nodes have the same value for it, or an empty string
+func sharedLabelValue(nodes []*corev1.Node, key string) string {
+	var value string
+	for i, n := range nodes {
+		v := n.Labels[key]
+		if v == "" || i > 0 && v != value {
+			return ""
+		}
+		value = v
+	}
+	return value
+}
+
+// nodeAddresses builds the addresses of the node. internalIPs and externalIPs are comma separated lists of IPv4 and
+// IPv6 addresses, so dual-stack nodes can report one address of each family. Invalid addresses are skipped.
+func nodeAddresses(internalIPs, externalIPs, hostname string) []corev1.NodeAddress {
+	addresses := make([]corev1.NodeAddress, 0)
+	addresses = appendIPAddresses(addresses, corev1.NodeInternalIP, internalIPs)
+	addresses = appendIPAddresses(addresses, corev1.NodeExternalIP, externalIPs)
+	if hostname = strings.TrimSpace(hostname); hostname != "" {
+		addresses = append(addresses, corev1.NodeAddress{Type: corev1.NodeHostName, Address: hostname})
+	}
+	return addresses
+}
+
+func appendIPAddresses(addresses []corev1.NodeAddress, addressType corev1.NodeAddressType, ips string) []corev1.NodeAddress {
+	for _, ip := range strings.Split(ips, ",") {
+		ip = strings.TrimSpace(ip)
+		if ip == "" {
+			continue
+		}
+		parsed := net.ParseIP(ip)
+		if parsed == nil {
+			klog.Warningf("Skipping invalid %s address %q", addressType, ip)
+			continue
+		}
+		family := "IPv6"
+		if parsed.To4() != nil {
+			family = "IPv4"
+		}
+		klog.V(4).Infof("Adding %s %s address %s", family, addressType, parsed)
+		addresses = append(addresses, corev1.NodeAddress{Type: addressType, Address: parsed.String()})
+	}
+	return addresses
+}
+
 // nodeDaemonEndpoints returns NodeDaemonEndpoints for the node status
 // within Kubernetes.
 func (v *VirtualK8S) nodeDaemonEndpoints() corev1.NodeDaemonEndpoints {
@@ -110,91 +447,225 @@ func (v *VirtualK8S) nodeDaemonEndpoints() corev1.NodeDaemonEndpoints {
 	}
 }
 
-// getResourceFromPods summary the resource already used by pods.
-func (v *VirtualK8S) getResourceFromPods() *common.Resource {
+// getResourceFromPods summary the resource already used by pods running on nodes. It is computed over the same nodes
+// as the capacity, so pods on nodes which are not counted, or no longer exist, are skipped. If countBound is set, pods
+// bound to one of nodes which did not report a phase yet are counted as well.
+func getResourceFromPods(pods []*corev1.Pod, nodes []*corev1.Node, countBound bool) *common.Resource {
 	podResource := common.NewResource()
-	pods, err := v.clientCache.podLister.List(labels.Everything())
-	if err != nil {
-		return podResource
+	nodeNames := make(map[string]struct{}, len(nodes))
+	for _, n := range nodes {
+		nodeNames[n.Name] = struct{}{}
 	}
 	for _, pod := range pods {
-		if pod.Status.Phase == corev1.PodPending && pod.Spec.NodeName != "" ||
-			pod.Status.Phase == corev1.PodRunning {
-			nodeName := pod.Spec.NodeName
-			node, err := v.clientCache.nodeLister.Get(nodeName)
-			if err != nil {
-				klog.Infof("get node %v failed err: %v", nodeName, err)
-				continue
-			}
-			if node.Spec.Unschedulable || !checkNodeStatusReady(node) {
-				continue
-			}
-			res := utils.GetRequestFromPod(pod)
-			res.Pods = resource.MustParse("1")
-			podResource.Add(res)
+		if pod.Spec.NodeName == "" {
+			continue
+		}
+		if _, ok := nodeNames[pod.Spec.NodeName]; !ok {
+			continue
 		}
+		if !podUsesResources(pod, countBound) {
+			continue
+		}
+		res := utils.GetRequestFromPod(pod)
+		res.Pods = resource.MustParse("1")
+		podResource.Add(res)
 	}
 	return podResource
 }
 
-// getResourceFromPodsByNodeName summary the resource already used by pods according to nodeName
+// getResourceFromPodsByNodeName summary the resource already used by pods according to nodeName. The pods are taken
+// from the cache of the client cluster like for the capacity, virtual pods are not counted.
 func (v *VirtualK8S) getResourceFromPodsByNodeName(nodeName string) *common.Resource {
-	podResource := common.NewResource()
-	fieldSelector, err := fields.ParseSelector("spec.nodeName=" + nodeName)
-	pods, err := v.client.CoreV1().Pods(corev1.NamespaceAll).List(context.TODO(),
-		metav1.ListOptions{
-			FieldSelector: fieldSelector.String(),
-		})
+	pods, err := v.clientCache.podLister.List(labels.Everything())
 	if err != nil {
-		return podResource
+		return common.NewResource()
 	}
-	for _, pod := range pods.Items {
-		if utils.IsVirtualPod(&pod) {
+	return resourceFromPodsOnNode(pods, nodeName, v.countBoundPods)
+}
+
+// resourceFromPodsOnNode summary the resource used by the pods bound to nodeName, skipping virtual pods. If countBound
+// is set, pods which did not report a phase yet are counted as well.
+func resourceFromPodsOnNode(pods []*corev1.Pod, nodeName string, countBound bool) *common.Resource {
+	podResource := common.NewResource()
+	for _, pod := range pods {
+		if pod.Spec.NodeName != nodeName || utils.IsVirtualPod(pod) || !podUsesResources(pod, countBound) {
 			continue
 		}
-		if pod.Status.Phase == corev1.PodPending ||
-			pod.Status.Phase == corev1.PodRunning {
-			res := utils.GetRequestFromPod(&pod)
-			res.Pods = resource.MustParse("1")
-			podResource.Add(res)
-		}
+		res := utils.GetRequestFromPod(pod)
+		res.Pods = resource.MustParse("1")
+		podResource.Add(res)
 	}
 	return podResource
 }
 
-func nodeConditions() []corev1.NodeCondition {
-	return []corev1.NodeCondition{
-		{
-			Type:               "Ready",
-			Status:             corev1.ConditionTrue,
-			LastHeartbeatTime:  metav1.Now(),
-			LastTransitionTime: metav1.Now(),
-			Reason:             "KubeletReady",
-			Message:            "kubelet is posting ready status",
-		},
-		{
-			Type:               "MemoryPressure",
-			Status:             corev1.ConditionFalse,
-			LastHeartbeatTime:  metav1.Now(),
-			LastTransitionTime: metav1.Now(),
-			Reason:             "KubeletHasSufficientMemory",
-			Message:            "kubelet has sufficient memory available",
-		},
-		{
-			Type:               "DiskPressure",
-			Status:             corev1.ConditionFalse,
-			LastHeartbeatTime:  metav1.Now(),
-			LastTransitionTime: metav1.Now(),
-			Reason:             "KubeletHasNoDiskPressure",
-			Message:            "kubelet has no disk pressure",
-		},
-		{
-			Type:               "PIDPressure",
-			Status:             corev1.ConditionFalse,
-			LastHeartbeatTime:  metav1.Now(),
-			LastTransitionTime: metav1.Now(),
-			Reason:             "KubeletHasSufficientPID",
-			Message:            "kubelet has sufficient PID available",
-		},
+// podUsesResources returns true if the pod is pending or running, and its containers did not terminate. If countBound
+// is set, pods which did not report a phase yet are counted as well.
+func podUsesResources(pod *corev1.Pod, countBound bool) bool {
+	if containersTerminated(pod) {
+		return false
+	}
+	return pod.Status.Phase == corev1.PodPending || pod.Status.Phase == corev1.PodRunning ||
+		countBound && pod.Status.Phase == ""
+}
+
+// commonTaints returns the taints carried by every one of nodes. Taints managed by the node lifecycle controller are
+// skipped, as the upper cluster manages those for the virtual node itself.
+func commonTaints(nodes []*corev1.Node) []corev1.Taint {
+	if len(nodes) == 0 {
+		return nil
+	}
+	var taints []corev1.Taint
+	for i := range nodes[0].Spec.Taints {
+		taint := &nodes[0].Spec.Taints[i]
+		if strings.HasPrefix(taint.Key, "node.kubernetes.io/") {
+			continue
+		}
+		shared := true
+		for _, n := range nodes[1:] {
+			if !hasTaint(n.Spec.Taints, taint) {
+				shared = false
+				break
+			}
+		}
+		if shared {
+			taints = append(taints, corev1.Taint{Key: taint.Key, Value: taint.Value, Effect: taint.Effect})
+		}
+	}
+	return taints
+}
+
+// mergeTaints appends the taints of toAdd which are not in taints yet
+func mergeTaints(taints, toAdd []corev1.Taint) []corev1.Taint {
+	for i := range toAdd {
+		if !hasTaint(taints, &toAdd[i]) {
+			taints = append(taints, toAdd[i])
+		}
+	}
+	return taints
+}
+
+func hasTaint(taints []corev1.Taint, taint *corev1.Taint) bool {
+	for i := range taints {
+		if taints[i].Key == taint.Key && taints[i].Value == taint.Value && taints[i].Effect == taint.Effect {
+			return true
+		}
+	}
+	return false
+}
+
+// nodeConditions computes the conditions of the virtual node from the schedulable nodes of the client cluster. A
+// pressure condition is reported once all of them report it, or the aggregated usage of the resource crossed the
+// pressure threshold. The node is not ready if the client cluster can not be reached, or has no schedulable nodes.
+func nodeConditions(nodes []*corev1.Node, pressure ResourcePressure, pingErr error) []corev1.NodeCondition {
+	ready := corev1.NodeCondition{
+		Type:    corev1.NodeReady,
+		Status:  corev1.ConditionTrue,
+		Reason:  "KubeletReady",
+		Message: "kubelet is posting ready status",
+	}
+	switch {
+	case pingErr != nil:
+		ready.Status = corev1.ConditionFalse
+		ready.Reason = "ClientClusterUnreachable"
+		ready.Message = pingErr.Error()
+	case len(nodes) == 0:
+		ready.Status = corev1.ConditionFalse
+		ready.Reason = "NoSchedulableNodes"
+		ready.Message = "client cluster has no schedulable ready nodes"
+	}
+
+	conditions := []corev1.NodeCondition{
+		ready,
+		aggregatedPressure(pressureCondition(nodes, corev1.NodeMemoryPressure,
+			"KubeletHasSufficientMemory", "kubelet has sufficient memory available",
+			"KubeletHasInsufficientMemory", "all client cluster nodes have insufficient memory available"),
+			pressure.Memory, "memory used by pods of the client cluster crossed the pressure threshold"),
+		aggregatedPressure(pressureCondition(nodes, corev1.NodeDiskPressure,
+			"KubeletHasNoDiskPressure", "kubelet has no disk pressure",
+			"KubeletHasDiskPressure", "all client cluster nodes have disk pressure"),
+			pressure.Disk, "ephemeral storage used by pods of the client cluster crossed the pressure threshold"),
+		pressureCondition(nodes, corev1.NodePIDPressure,
+			"KubeletHasSufficientPID", "kubelet has sufficient PID available",
+			"KubeletHasInsufficientPID", "all client cluster nodes have insufficient PID available"),
+	}
+	now := metav1.Now()
+	for i := range conditions {
+		conditions[i].LastHeartbeatTime = now
+		conditions[i].LastTransitionTime = now
+	}
+	return conditions
+}
+
+// pressureCondition returns a condition of conditionType, which is true if all nodes report it
+func pressureCondition(nodes []*corev1.Node, conditionType corev1.NodeConditionType,
+	falseReason, falseMessage, trueReason, trueMessage string) corev1.NodeCondition {
+	pressured := len(nodes) > 0
+	for _, n := range nodes {
+		if !hasCondition(n, conditionType) {
+			pressured = false
+			break
+		}
+	}
+	if pressured {
+		return corev1.NodeCondition{
+			Type:    conditionType,
+			Status:  corev1.ConditionTrue,
+			Reason:  trueReason,
+			Message: trueMessage,
+		}
+	}
+	return corev1.NodeCondition{
+		Type:    conditionType,
+		Status:  corev1.ConditionFalse,
+		Reason:  falseReason,
+		Message: falseMessage,
+	}
+}
+
+// aggregatedPressure sets condition to true with message if pressured, and the nodes do not report it already
+func aggregatedPressure(condition corev1.NodeCondition, pressured bool, message string) corev1.NodeCondition {
+	if !pressured || condition.Status == corev1.ConditionTrue {
+		return condition
+	}
+	condition.Status = corev1.ConditionTrue
+	condition.Reason = "ClientClusterUnderPressure"
+	condition.Message = message
+	return condition
+}
+
+func hasCondition(node *corev1.Node, conditionType corev1.NodeConditionType) bool {
+	for _, condition := range node.Status.Conditions {
+		if condition.Type == conditionType {
+			return condition.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// nodeStatusChanged returns true if updated reports a different capacity, allocatable, conditions, addresses, taints or
+// schedulability than last, the node reported before. Heartbeat and transition times of the conditions are ignored.
+func nodeStatusChanged(last, updated *corev1.Node) bool {
+	if last == nil {
+		return true
+	}
+	return !apiequality.Semantic.DeepEqual(last.Status.Capacity, updated.Status.Capacity) ||
+		!apiequality.Semantic.DeepEqual(last.Status.Allocatable, updated.Status.Allocatable) ||
+		!apiequality.Semantic.DeepEqual(last.Status.Addresses, updated.Status.Addresses) ||
+		!apiequality.Semantic.DeepEqual(last.Spec.Taints, updated.Spec.Taints) ||
+		last.Spec.Unschedulable != updated.Spec.Unschedulable ||
+		conditionsChanged(last.Status.Conditions, updated.Status.Conditions)
+}
+
+// conditionsChanged returns true if the status of any of the conditions in updated differs from current
+func conditionsChanged(current, updated []corev1.NodeCondition) bool {
+	if len(current) != len(updated) {
+		return true
+	}
+	for i := range updated {
+		if current[i].Type != updated[i].Type || current[i].Status != updated[i].Status ||
+			current[i].Reason != updated[i].Reason {
+			return true
+		}
 	}
+	return false
 }
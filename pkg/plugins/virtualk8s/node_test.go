@@ -0,0 +1,750 @@
+package virtualk8s
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/clusterrouter-io/clusterrouter/pkg/common"
+	"github.com/clusterrouter-io/clusterrouter/pkg/utils"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/version"
+	fakediscovery "k8s.io/client-go/discovery/fake"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+	listersv1 "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+	clocktesting "k8s.io/utils/clock/testing"
+)
+
+func newTestClient(t *testing.T, handler http.HandlerFunc) kubernetes.Interface {
+	t.Helper()
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	client, err := kubernetes.NewForConfig(&rest.Config{Host: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+func TestPingOnce(t *testing.T) {
+	client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/version" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"major":"1","minor":"24","gitVersion":"v1.24.3"}`))
+	})
+	info, err := pingOnce(context.Background(), client, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.GitVersion != "v1.24.3" {
+		t.Fatalf("expected version v1.24.3, got %q", info.GitVersion)
+	}
+}
+
+func TestPingOnceTimeoutAbortsRequest(t *testing.T) {
+	aborted := make(chan struct{})
+	client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		// A hung apiserver, which only stops once the client gives up on the request
+		<-r.Context().Done()
+		close(aborted)
+	})
+	start := time.Now()
+	if _, err := pingOnce(context.Background(), client, 20*time.Millisecond); err == nil {
+		t.Fatal("expected the ping to time out")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("ping took %v, expected it to give up after the timeout", elapsed)
+	}
+	select {
+	case <-aborted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the request was left running after the ping timed out")
+	}
+}
+
+func TestPingWithRetry(t *testing.T) {
+	tests := []struct {
+		name      string
+		failures  int32
+		wantErr   bool
+		wantCalls int32
+	}{
+		{name: "transient failure", failures: 1, wantCalls: 2},
+		{name: "down", failures: pingAttempts, wantErr: true, wantCalls: pingAttempts},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls int32
+			client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+				if atomic.AddInt32(&calls, 1) <= tt.failures {
+					w.WriteHeader(http.StatusServiceUnavailable)
+					return
+				}
+				w.Header().Set("Content-Type", "application/json")
+				w.Write([]byte(`{"major":"1","minor":"24","gitVersion":"v1.24.3"}`))
+			})
+			v := &VirtualK8S{pingTimeout: time.Second}
+			_, err := v.pingWithRetry(context.Background(), client)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("expected error %t, got %v", tt.wantErr, err)
+			}
+			if n := atomic.LoadInt32(&calls); n != tt.wantCalls {
+				t.Fatalf("expected %d attempts, got %d", tt.wantCalls, n)
+			}
+		})
+	}
+}
+
+func TestNotifyNodeUpdateDoesNotBlock(t *testing.T) {
+	v := &VirtualK8S{updatedNode: make(chan *corev1.Node, 2)}
+	for _, name := range []string{"a", "b", "c", "d"} {
+		v.notifyNodeUpdate(&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: name}})
+	}
+	// Nothing consumes the updates, the newest ones are kept
+	for _, want := range []string{"c", "d"} {
+		if got := (<-v.updatedNode).Name; got != want {
+			t.Fatalf("expected update %q, got %q", want, got)
+		}
+	}
+}
+
+func TestNotifyNodeStatusInterval(t *testing.T) {
+	fakeClock := clocktesting.NewFakeClock(time.Now())
+	v := &VirtualK8S{
+		updatedNode:        make(chan *corev1.Node),
+		providerNode:       &common.ProviderNode{},
+		nodeStatusInterval: time.Minute,
+		clock:              fakeClock,
+		stopCh:             make(chan struct{}),
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	reported := make(chan *corev1.Node, 1)
+	v.NotifyNodeStatus(ctx, func(node *corev1.Node) { reported <- node })
+	for !fakeClock.HasWaiters() {
+		time.Sleep(time.Millisecond)
+	}
+
+	// Nothing is reported on ticks until the node is configured
+	fakeClock.Step(time.Minute)
+	select {
+	case node := <-reported:
+		t.Fatalf("unexpected report of unconfigured node %v", node)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	v.providerNode.Lock()
+	v.providerNode.Node = &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "vk"}}
+	v.configured = true
+	v.providerNode.Unlock()
+	fakeClock.Step(time.Minute)
+	select {
+	case node := <-reported:
+		if node.Name != "vk" {
+			t.Fatalf("expected node vk to be reported, got %q", node.Name)
+		}
+		if node == v.providerNode.Node {
+			t.Fatal("expected a copy of the node to be reported")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("node was not reported on the tick")
+	}
+}
+
+func TestNotifyNodeStatusDeduplicates(t *testing.T) {
+	v := &VirtualK8S{updatedNode: make(chan *corev1.Node), stopCh: make(chan struct{})}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	reported := make(chan *corev1.Node, 3)
+	v.NotifyNodeStatus(ctx, func(node *corev1.Node) { reported <- node })
+
+	node := &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "vk"},
+		Status: corev1.NodeStatus{
+			Capacity: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("4")},
+			Conditions: []corev1.NodeCondition{{
+				Type:              corev1.NodeReady,
+				Status:            corev1.ConditionTrue,
+				LastHeartbeatTime: metav1.NewTime(time.Now()),
+			}},
+		},
+	}
+	// Only the heartbeat changes, which does not change the reported status
+	heartbeat := node.DeepCopy()
+	heartbeat.Status.Conditions[0].LastHeartbeatTime = metav1.NewTime(time.Now().Add(time.Minute))
+	resized := node.DeepCopy()
+	resized.Status.Capacity[corev1.ResourceCPU] = resource.MustParse("8")
+	for _, update := range []*corev1.Node{node, node.DeepCopy(), heartbeat, resized} {
+		v.updatedNode <- update
+	}
+
+	for _, want := range []*corev1.Node{node, resized} {
+		select {
+		case got := <-reported:
+			if got != want {
+				t.Fatalf("expected node with capacity %v to be reported, got %v", want.Status.Capacity,
+					got.Status.Capacity)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("node status was not reported")
+		}
+	}
+	select {
+	case got := <-reported:
+		t.Fatalf("unexpected report of unchanged node status %v", got.Status)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestCheckProviderIDUnique(t *testing.T) {
+	node := func(name, providerID string) *corev1.Node {
+		return &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: name}, Spec: corev1.NodeSpec{ProviderID: providerID}}
+	}
+	tests := []struct {
+		name    string
+		nodes   []runtime.Object
+		wantErr bool
+	}{
+		{name: "no nodes"},
+		{name: "other provider IDs", nodes: []runtime.Object{node("a", "kind://a"), node("b", "")}},
+		{name: "own node", nodes: []runtime.Object{node("vnode", "clusterrouter://c1")}},
+		{name: "used", nodes: []runtime.Object{node("a", "kind://a"), node("b", "clusterrouter://c1")}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := &VirtualK8S{master: fake.NewSimpleClientset(tt.nodes...), providerID: "clusterrouter://c1"}
+			err := v.checkProviderIDUnique(context.Background(), "vnode")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("expected error %t, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+// newConfigureTestProvider returns a provider whose client cluster has nodes, and no pods
+func newConfigureTestProvider(t *testing.T, nodes ...*corev1.Node) *VirtualK8S {
+	t.Helper()
+	nodeIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	for _, node := range nodes {
+		if err := nodeIndexer.Add(node); err != nil {
+			t.Fatal(err)
+		}
+	}
+	podIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	fakeClock := clocktesting.NewFakeClock(testNow)
+	v := &VirtualK8S{
+		nodeSelector:    labels.Everything(),
+		providerNode:    &common.ProviderNode{},
+		operatingSystem: "linux",
+		architecture:    "amd64",
+		clock:           fakeClock,
+		clientCache: clientCache{
+			nodeLister: listersv1.NewNodeLister(nodeIndexer),
+			podLister:  listersv1.NewPodLister(podIndexer),
+		},
+	}
+	v.capacityCache.clock = fakeClock
+	return v
+}
+
+// configureTestNode calls ConfigureNode of v on a new node, and returns it
+func configureTestNode(v *VirtualK8S) *corev1.Node {
+	node := &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "vnode", Labels: map[string]string{}}}
+	v.ConfigureNode(context.Background(), node)
+	return node
+}
+
+func TestConfigureNodePlatform(t *testing.T) {
+	v := newConfigureTestProvider(t, testNode("a", "4", "8Gi"))
+	v.operatingSystem = "windows"
+	v.architecture = "arm64"
+	node := configureTestNode(v)
+	if info := node.Status.NodeInfo; info.OperatingSystem != "windows" || info.Architecture != "arm64" {
+		t.Fatalf("expected node info of windows/arm64, got %s/%s", info.OperatingSystem, info.Architecture)
+	}
+	for key, want := range map[string]string{
+		corev1.LabelArchStable: "arm64",
+		corev1.LabelOSStable:   "windows",
+		utils.LabelOSBeta:      "windows",
+	} {
+		if got := node.Labels[key]; got != want {
+			t.Fatalf("expected label %s to be %q, got %q", key, want, got)
+		}
+	}
+}
+
+func TestConfigureNodeExtendedResources(t *testing.T) {
+	gpuNode := func(name, gpus string) *corev1.Node {
+		return withNode(testNode(name, "4", "8Gi"), func(n *corev1.Node) {
+			n.Status.Capacity["nvidia.com/gpu"] = resource.MustParse(gpus)
+		})
+	}
+	v := newConfigureTestProvider(t, gpuNode("a", "2"), gpuNode("b", "4"), testNode("c", "4", "8Gi"))
+	node := configureTestNode(v)
+	for _, list := range []corev1.ResourceList{node.Status.Capacity, node.Status.Allocatable} {
+		if got := list["nvidia.com/gpu"]; !got.Equal(resource.MustParse("6")) {
+			t.Fatalf("expected the virtual node to advertise 6 GPUs, got %s", got.String())
+		}
+	}
+}
+
+func TestConfigureNodeTaints(t *testing.T) {
+	gpu := corev1.Taint{Key: "nvidia.com/gpu", Value: "present", Effect: corev1.TaintEffectNoSchedule}
+	spot := corev1.Taint{Key: "spot", Effect: corev1.TaintEffectPreferNoSchedule}
+	configured := corev1.Taint{Key: "clusterrouter.io/virtual", Effect: corev1.TaintEffectNoSchedule}
+	tainted := func(name string, taints ...corev1.Taint) *corev1.Node {
+		return withNode(testNode(name, "4", "8Gi"), func(n *corev1.Node) {
+			n.Spec.Taints = append(taints, corev1.Taint{Key: corev1.TaintNodeUnreachable,
+				Effect: corev1.TaintEffectNoSchedule})
+		})
+	}
+	v := newConfigureTestProvider(t, tainted("a", gpu, spot), tainted("b", gpu))
+	v.nodeTaints = []corev1.Taint{configured}
+
+	if taints := configureTestNode(v).Spec.Taints; !reflect.DeepEqual(taints, []corev1.Taint{configured}) {
+		t.Fatalf("expected only the configured taint without propagation, got %v", taints)
+	}
+	// Only the taints shared by all nodes are propagated, not those managed by the node lifecycle controller
+	v.propagateTaints = true
+	if taints := configureTestNode(v).Spec.Taints; !reflect.DeepEqual(taints, []corev1.Taint{configured, gpu}) {
+		t.Fatalf("expected the configured and the shared taint, got %v", taints)
+	}
+}
+
+func TestNodeConditions(t *testing.T) {
+	pressured := func(name string, types ...corev1.NodeConditionType) *corev1.Node {
+		return withNode(testNode(name, "4", "8Gi"), func(n *corev1.Node) {
+			for _, conditionType := range types {
+				n.Status.Conditions = append(n.Status.Conditions, corev1.NodeCondition{
+					Type: conditionType, Status: corev1.ConditionTrue})
+			}
+		})
+	}
+	tests := []struct {
+		name     string
+		nodes    []*corev1.Node
+		pressure ResourcePressure
+		pingErr  error
+		// want is the reason of every condition which is true
+		want map[corev1.NodeConditionType]string
+	}{
+		{
+			name:  "healthy",
+			nodes: []*corev1.Node{pressured("a"), pressured("b")},
+			want:  map[corev1.NodeConditionType]string{corev1.NodeReady: "KubeletReady"},
+		},
+		{
+			name: "all nodes under memory pressure",
+			nodes: []*corev1.Node{
+				pressured("a", corev1.NodeMemoryPressure, corev1.NodePIDPressure),
+				pressured("b", corev1.NodeMemoryPressure),
+			},
+			want: map[corev1.NodeConditionType]string{
+				corev1.NodeReady:          "KubeletReady",
+				corev1.NodeMemoryPressure: "KubeletHasInsufficientMemory",
+			},
+		},
+		{
+			name:     "aggregated usage crossed the threshold",
+			nodes:    []*corev1.Node{pressured("a"), pressured("b", corev1.NodeDiskPressure)},
+			pressure: ResourcePressure{Disk: true},
+			want: map[corev1.NodeConditionType]string{
+				corev1.NodeReady:        "KubeletReady",
+				corev1.NodeDiskPressure: "ClientClusterUnderPressure",
+			},
+		},
+		{
+			name: "no schedulable nodes",
+			want: map[corev1.NodeConditionType]string{},
+		},
+		{
+			name:    "unreachable",
+			nodes:   []*corev1.Node{pressured("a")},
+			pingErr: errors.New("connection refused"),
+			want:    map[corev1.NodeConditionType]string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conditions := nodeConditions(tt.nodes, tt.pressure, tt.pingErr)
+			if len(conditions) != 4 {
+				t.Fatalf("expected 4 conditions, got %v", conditions)
+			}
+			for _, condition := range conditions {
+				reason, wantTrue := tt.want[condition.Type]
+				if (condition.Status == corev1.ConditionTrue) != wantTrue {
+					t.Fatalf("expected %s to be true: %t, got %s", condition.Type, wantTrue, condition.Status)
+				}
+				if wantTrue && condition.Reason != reason {
+					t.Fatalf("expected %s to have reason %s, got %s", condition.Type, reason, condition.Reason)
+				}
+			}
+		})
+	}
+}
+
+func TestConfigureNodeUnreachable(t *testing.T) {
+	v := newConfigureTestProvider(t, testNode("a", "4", "8Gi"))
+	v.setClientPingError(errors.New("connection refused"))
+	node := configureTestNode(v)
+	ready := node.Status.Conditions[0]
+	if ready.Type != corev1.NodeReady || ready.Status != corev1.ConditionFalse ||
+		ready.Reason != "ClientClusterUnreachable" {
+		t.Fatalf("expected the node not to be ready while the client cluster is unreachable, got %+v", ready)
+	}
+
+	v.setClientPingError(nil)
+	if ready := configureTestNode(v).Status.Conditions[0]; ready.Status != corev1.ConditionTrue {
+		t.Fatalf("expected the node to be ready once the client cluster is reachable, got %+v", ready)
+	}
+}
+
+// setTestPods replaces the pods of the client cluster of v with pods
+func setTestPods(t *testing.T, v *VirtualK8S, pods ...*corev1.Pod) {
+	t.Helper()
+	podIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	for i, pod := range pods {
+		pod.Name = fmt.Sprintf("pod-%d", i)
+		if err := podIndexer.Add(pod); err != nil {
+			t.Fatal(err)
+		}
+	}
+	v.clientCache.podLister = listersv1.NewPodLister(podIndexer)
+}
+
+func TestConfigureNodeSelector(t *testing.T) {
+	inPool := func(node *corev1.Node, pool string) *corev1.Node {
+		node.Labels["node-pool"] = pool
+		return node
+	}
+	v := newConfigureTestProvider(t,
+		inPool(testNode("batch-1", "4", "8Gi"), "batch"),
+		inPool(testNode("batch-2", "4", "8Gi"), "batch"),
+		inPool(testNode("web-1", "16", "64Gi"), "web"))
+	setTestPods(t, v,
+		testPodOn("batch-1", corev1.PodRunning, "1", "1Gi"),
+		testPodOn("web-1", corev1.PodRunning, "8", "32Gi"))
+	v.nodeSelector = labels.SelectorFromSet(labels.Set{"node-pool": "batch"})
+
+	node := configureTestNode(v)
+	// Both the capacity and the usage are computed over the batch pool alone
+	if !common.ConvertResource(node.Status.Capacity).Equal(testResource("8", "16Gi", "220")) {
+		t.Fatalf("expected the capacity of the batch pool, got %v", node.Status.Capacity)
+	}
+	if !common.ConvertResource(node.Status.Allocatable).Equal(testResource("7", "15Gi", "219")) {
+		t.Fatalf("expected the allocatable of the batch pool, got %v", node.Status.Allocatable)
+	}
+}
+
+func TestConfigureNodeExclusion(t *testing.T) {
+	const key = "clusterrouter.io/exclude"
+	v := newConfigureTestProvider(t,
+		withNode(testNode("labeled", "4", "8Gi"), func(n *corev1.Node) { n.Labels[key] = "true" }),
+		withNode(testNode("annotated", "4", "8Gi"), func(n *corev1.Node) {
+			n.Annotations = map[string]string{key: "true"}
+		}),
+		withNode(testNode("not-excluded", "4", "8Gi"), func(n *corev1.Node) { n.Labels[key] = "false" }),
+		testNode("a", "4", "8Gi"))
+	setTestPods(t, v,
+		testPodOn("labeled", corev1.PodRunning, "2", "4Gi"),
+		testPodOn("annotated", corev1.PodRunning, "2", "4Gi"),
+		testPodOn("a", corev1.PodRunning, "1", "1Gi"))
+	v.excludeNodeKey = key
+
+	node := configureTestNode(v)
+	// Neither the capacity of the excluded nodes nor the usage of their pods is counted
+	if !common.ConvertResource(node.Status.Capacity).Equal(testResource("8", "16Gi", "220")) {
+		t.Fatalf("expected the capacity of the nodes which are not excluded, got %v", node.Status.Capacity)
+	}
+	if !common.ConvertResource(node.Status.Allocatable).Equal(testResource("7", "15Gi", "219")) {
+		t.Fatalf("expected the allocatable of the nodes which are not excluded, got %v", node.Status.Allocatable)
+	}
+	for name, expected := range map[string]bool{"labeled": false, "annotated": false, "not-excluded": true, "a": true} {
+		if selected := v.nodeSelected(name); selected != expected {
+			t.Fatalf("expected node %s to be selected %v, got %v", name, expected, selected)
+		}
+	}
+}
+
+func TestConfigureNodeReservation(t *testing.T) {
+	v := newConfigureTestProvider(t, testNode("a", "4", "8Gi"), testNode("b", "4", "8Gi"))
+	setTestPods(t, v, testPodOn("a", corev1.PodRunning, "1", "2Gi"))
+	reservation, err := common.ParseReservation("cpu=500m,memory=25%")
+	if err != nil {
+		t.Fatal(err)
+	}
+	v.reservation = reservation
+
+	node := configureTestNode(v)
+	// The reservation applies to every node, 2 nodes reserve 1 cpu and 4Gi of memory
+	if !common.ConvertResource(node.Status.Capacity).Equal(testResource("8", "16Gi", "220")) {
+		t.Fatalf("expected the capacity to be the sum of the nodes, got %v", node.Status.Capacity)
+	}
+	if !common.ConvertResource(node.Status.Allocatable).Equal(testResource("6", "10Gi", "219")) {
+		t.Fatalf("expected the allocatable to exclude usage and reservation, got %v", node.Status.Allocatable)
+	}
+}
+
+func TestConfigureNodeOvercommit(t *testing.T) {
+	v := newConfigureTestProvider(t, testNode("a", "4", "8Gi"))
+	v.overcommit = common.OvercommitRatios{corev1.ResourceCPU: 2, corev1.ResourceMemory: 1}
+	node := configureTestNode(v)
+	for _, list := range []corev1.ResourceList{node.Status.Capacity, node.Status.Allocatable} {
+		if !common.ConvertResource(list).Equal(testResource("8", "8Gi", "110")) {
+			t.Fatalf("expected the cpu to be doubled and the memory to be left as is, got %v", list)
+		}
+	}
+}
+
+func TestConfigureNodeAllocatable(t *testing.T) {
+	v := newConfigureTestProvider(t, testNode("a", "4", "8Gi"), testNode("b", "2", "4Gi"))
+	setTestPods(t, v, testPodOn("b", corev1.PodRunning, "500m", "1Gi"))
+	reservation, err := common.ParseReservation("cpu=250m,memory=512Mi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	v.reservation = reservation
+
+	node := configureTestNode(v)
+	capacity, allocatable := node.Status.Capacity, node.Status.Allocatable
+	if len(capacity) == 0 || len(allocatable) == 0 {
+		t.Fatalf("expected both the capacity and the allocatable to be set, got %v and %v", capacity, allocatable)
+	}
+	if !common.ConvertResource(allocatable).LessThanOrEqual(common.ConvertResource(capacity)) {
+		t.Fatalf("expected the allocatable %v to fit into the capacity %v", allocatable, capacity)
+	}
+	if !common.ConvertResource(capacity).Equal(testResource("6", "12Gi", "220")) {
+		t.Fatalf("expected the capacity to be the gross sum of the nodes, got %v", capacity)
+	}
+	if !common.ConvertResource(allocatable).Equal(testResource("5", "10Gi", "219")) {
+		t.Fatalf("expected the allocatable to exclude reservations and usage, got %v", allocatable)
+	}
+}
+
+func TestNodeAddresses(t *testing.T) {
+	tests := []struct {
+		name                   string
+		internal, external, hn string
+		want                   []corev1.NodeAddress
+	}{
+		{name: "none", want: []corev1.NodeAddress{}},
+		{
+			name:     "dual stack",
+			internal: "10.0.0.1, fd00::0001",
+			external: "203.0.113.7",
+			hn:       "vnode.example.com",
+			want: []corev1.NodeAddress{
+				{Type: corev1.NodeInternalIP, Address: "10.0.0.1"},
+				{Type: corev1.NodeInternalIP, Address: "fd00::1"},
+				{Type: corev1.NodeExternalIP, Address: "203.0.113.7"},
+				{Type: corev1.NodeHostName, Address: "vnode.example.com"},
+			},
+		},
+		{
+			name:     "invalid addresses are skipped",
+			internal: "10.0.0.1,not-an-ip,,",
+			want:     []corev1.NodeAddress{{Type: corev1.NodeInternalIP, Address: "10.0.0.1"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := nodeAddresses(tt.internal, tt.external, tt.hn); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("expected addresses %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestConfigureNodeAddresses(t *testing.T) {
+	t.Setenv("VKUBELET_POD_IP", "10.0.0.1,fd00::1")
+	t.Setenv("VKUBELET_EXTERNAL_POD_IP", "")
+	t.Setenv("VKUBELET_NODE_HOSTNAME", "vnode")
+	node := configureTestNode(newConfigureTestProvider(t, testNode("a", "4", "8Gi")))
+	want := []corev1.NodeAddress{
+		{Type: corev1.NodeInternalIP, Address: "10.0.0.1"},
+		{Type: corev1.NodeInternalIP, Address: "fd00::1"},
+		{Type: corev1.NodeHostName, Address: "vnode"},
+	}
+	if !reflect.DeepEqual(node.Status.Addresses, want) {
+		t.Fatalf("expected addresses %v, got %v", want, node.Status.Addresses)
+	}
+}
+
+func TestPingUpdatesKubeletVersion(t *testing.T) {
+	v := newConfigureTestProvider(t, testNode("a", "4", "8Gi"))
+	client := fake.NewSimpleClientset()
+	client.Discovery().(*fakediscovery.FakeDiscovery).FakedServerVersion = &version.Info{GitVersion: "v1.24.3"}
+	v.master, v.client = fake.NewSimpleClientset(), client
+	v.version = "v1.22.0"
+	v.pingTimeout = time.Second
+	v.pingMetrics = newPingMetrics()
+	v.updatedNode = make(chan *corev1.Node, 1)
+
+	if got := configureTestNode(v).Status.NodeInfo.KubeletVersion; got != "v1.22.0" {
+		t.Fatalf("expected the version known at startup before a ping, got %q", got)
+	}
+	if err := v.Ping(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := configureTestNode(v).Status.NodeInfo.KubeletVersion; got != "v1.24.3" {
+		t.Fatalf("expected the version of the client cluster, got %q", got)
+	}
+}
+
+func TestConfigureNodeTopologyLabels(t *testing.T) {
+	inZone := func(name, region, zone string) *corev1.Node {
+		node := testNode(name, "4", "8Gi")
+		node.Labels[corev1.LabelTopologyRegion] = region
+		node.Labels[corev1.LabelTopologyZone] = zone
+		return node
+	}
+	tests := []struct {
+		name         string
+		nodes        []*corev1.Node
+		region, zone string
+		want         map[string]string
+	}{
+		{
+			name:   "configured",
+			nodes:  []*corev1.Node{inZone("a", "eu-west", "eu-west-1a")},
+			region: "us-east",
+			zone:   "us-east-1b",
+			want:   map[string]string{corev1.LabelTopologyRegion: "us-east", corev1.LabelTopologyZone: "us-east-1b"},
+		},
+		{
+			name:  "shared by the nodes",
+			nodes: []*corev1.Node{inZone("a", "eu-west", "eu-west-1a"), inZone("b", "eu-west", "eu-west-1b")},
+			want:  map[string]string{corev1.LabelTopologyRegion: "eu-west"},
+		},
+		{
+			name:  "not configured",
+			nodes: []*corev1.Node{testNode("a", "4", "8Gi")},
+			want:  map[string]string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := newConfigureTestProvider(t, tt.nodes...)
+			v.region, v.zone = tt.region, tt.zone
+			node := configureTestNode(v)
+			for _, key := range []string{corev1.LabelTopologyRegion, corev1.LabelTopologyZone} {
+				got, ok := node.Labels[key]
+				if want, wantOK := tt.want[key]; ok != wantOK || got != want {
+					t.Fatalf("expected label %s to be %q, got %q (present %t)", key, want, got, ok)
+				}
+			}
+		})
+	}
+}
+
+func TestConfigureNodeEphemeralStorage(t *testing.T) {
+	v := newConfigureTestProvider(t, withNode(testNode("a", "4", "8Gi"), func(n *corev1.Node) {
+		n.Status.Capacity[corev1.ResourceEphemeralStorage] = resource.MustParse("100Gi")
+		n.Status.Capacity["hugepages-2Mi"] = resource.MustParse("1Gi")
+	}))
+	pod := testPodOn("a", corev1.PodRunning, "1", "1Gi")
+	pod.Spec.Containers[0].Resources.Requests[corev1.ResourceEphemeralStorage] = resource.MustParse("30Gi")
+	pod.Spec.Containers[0].Resources.Requests["hugepages-2Mi"] = resource.MustParse("256Mi")
+	setTestPods(t, v, pod)
+
+	node := configureTestNode(v)
+	for name, want := range map[corev1.ResourceName][2]string{
+		corev1.ResourceEphemeralStorage: {"100Gi", "70Gi"},
+		"hugepages-2Mi":                 {"1Gi", "768Mi"},
+	} {
+		if got := node.Status.Capacity[name]; !got.Equal(resource.MustParse(want[0])) {
+			t.Fatalf("expected a capacity of %s %s, got %s", want[0], name, got.String())
+		}
+		if got := node.Status.Allocatable[name]; !got.Equal(resource.MustParse(want[1])) {
+			t.Fatalf("expected %s %s to be left, got %s", want[1], name, got.String())
+		}
+	}
+}
+
+func TestConfigureNodeHugepages(t *testing.T) {
+	v := newConfigureTestProvider(t,
+		withNode(testNode("a", "4", "8Gi"), func(n *corev1.Node) {
+			n.Status.Capacity["hugepages-2048Ki"] = resource.MustParse("1Gi")
+		}),
+		withNode(testNode("b", "4", "8Gi"), func(n *corev1.Node) {
+			n.Status.Capacity["hugepages-2Mi"] = resource.MustParse("512Mi")
+			n.Status.Capacity["hugepages-1Gi"] = resource.MustParse("2Gi")
+		}))
+
+	node := configureTestNode(v)
+	// Every page size is advertised on its own, however the client nodes spell it
+	for name, want := range map[corev1.ResourceName]string{
+		"hugepages-2Mi": "1536Mi",
+		"hugepages-1Gi": "2Gi",
+	} {
+		if got := node.Status.Capacity[name]; !got.Equal(resource.MustParse(want)) {
+			t.Fatalf("expected a capacity of %s %s, got %s", want, name, got.String())
+		}
+	}
+	if got, ok := node.Status.Capacity["hugepages-2048Ki"]; ok {
+		t.Fatalf("expected the 2Mi pages to be advertised once, got %s of hugepages-2048Ki", got.String())
+	}
+}
+
+func TestGetResourceFromPodsByNodeName(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	v := newConfigureTestProvider(t, testNode("a", "4", "8Gi"), testNode("b", "4", "8Gi"))
+	v.client = client
+	virtualPod := testPodOn("a", corev1.PodRunning, "2", "2Gi")
+	virtualPod.Labels = map[string]string{utils.VirtualPodLabel: "true"}
+	setTestPods(t, v,
+		testPodOn("a", corev1.PodRunning, "1", "1Gi"),
+		testPodOn("a", corev1.PodPending, "500m", "512Mi"),
+		testPodOn("a", corev1.PodSucceeded, "1", "1Gi"),
+		testPodOn("b", corev1.PodRunning, "1", "1Gi"),
+		virtualPod,
+	)
+
+	if used := v.getResourceFromPodsByNodeName("a"); !used.Equal(testResource("1500m", "1536Mi", "2")) {
+		t.Fatalf("expected the running and pending pods of node a to be counted, got %s", used)
+	}
+	if used := v.getResourceFromPodsByNodeName("missing"); !used.Equal(common.NewResource()) {
+		t.Fatalf("expected nothing to be used on a node without pods, got %s", used)
+	}
+	// The pods are taken from the cache, not listed from the client cluster
+	if actions := client.Actions(); len(actions) != 0 {
+		t.Fatalf("expected no calls to the client cluster, got %v", actions)
+	}
+}
+
+func TestClientPodAddDeleteRestoresAllocatable(t *testing.T) {
+	v := newConfigureTestProvider(t, testNode("a", "4", "8Gi"))
+	v.updatedNode = make(chan *corev1.Node, 1)
+	v.configured = true
+	allocatable := testResource("1", "1Gi", "1").ResourceList()
+	v.providerNode.Node = &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "vnode"},
+		Status:     corev1.NodeStatus{Allocatable: allocatable.DeepCopy()},
+	}
+
+	// The pod uses more than is left, which must not be lost once it goes away again
+	pod := testPodOn("a", corev1.PodRunning, "2", "2Gi")
+	pod.Name = "pod"
+	v.addPod(pod)
+	v.deletePod(pod)
+	got := common.ConvertResource(v.providerNode.Status.Allocatable)
+	if want := common.ConvertResource(allocatable); !got.Equal(want) {
+		t.Fatalf("expected the allocatable to return to %s, got %s", want, got)
+	}
+}
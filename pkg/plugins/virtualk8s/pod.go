@@ -7,12 +7,15 @@ import (
 	"github.com/clusterrouter-io/clusterrouter/pkg/plugins"
 	"github.com/clusterrouter-io/clusterrouter/pkg/utils"
 	"github.com/clusterrouter-io/clusterrouter/pkg/utils/errdefs"
+	"io"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/util/wait"
-	"k8s.io/klog"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/remotecommand"
+	"k8s.io/klog/v2"
 	"reflect"
 	"strings"
 	"time"
@@ -26,27 +29,32 @@ const RooTCAConfigMapName = "kube-root-ca.crt"
 const SATokenPrefix = "kube-api-access"
 const MasterRooTCAName = "master-root-ca.crt"
 
+// notifyPodsDelay is how long NotifyPods waits before passing on pod updates, so the pods are known to the caller
+const notifyPodsDelay = 10 * time.Second
+
 // CreatePod takes a Kubernetes Pod and deploys it within the provider.
 func (v *VirtualK8S) CreatePod(ctx context.Context, pod *corev1.Pod) error {
 	if pod.Namespace == "kube-system" {
 		return nil
 	}
 	basicPod := utils.TrimPod(pod, v.ignoreLabels)
+	basicPod.Namespace = v.namespaces.ToClient(pod.Namespace)
+	v.rewriteScheduling(basicPod)
 	klog.V(3).Infof("Creating pod %v/%+v", pod.Namespace, pod.Name)
-	if _, err := v.clientCache.nsLister.Get(pod.Namespace); err != nil {
+	if _, err := v.clientCache.nsLister.Get(basicPod.Namespace); err != nil {
 		if !errors.IsNotFound(err) {
 			return err
 		}
-		klog.Infof("Namespace %s does not exist for pod %s, creating it", pod.Namespace, pod.Name)
+		klog.Infof("Namespace %s does not exist for pod %s, creating it", basicPod.Namespace, pod.Name)
 		ns := &corev1.Namespace{
 			ObjectMeta: metav1.ObjectMeta{
-				Name: pod.Namespace,
+				Name: basicPod.Namespace,
 			},
 		}
 		if _, createErr := v.client.CoreV1().Namespaces().Create(ctx, ns,
-			metav1.CreateOptions{}); createErr != nil && errors.IsAlreadyExists(createErr) {
-			klog.Infof("Namespace %s create failed error: %v", pod.Namespace, createErr)
-			return err
+			metav1.CreateOptions{}); createErr != nil && !errors.IsAlreadyExists(createErr) {
+			klog.Infof("Namespace %s create failed error: %v", basicPod.Namespace, createErr)
+			return createErr
 		}
 	}
 	secretNames := getSecrets(pod)
@@ -82,7 +90,11 @@ func (v *VirtualK8S) CreatePod(ctx context.Context, pod *corev1.Pod) error {
 	v.convertAuth(ctx, pod)
 
 	klog.V(6).Infof("Creating pod %+v", pod)
-	_, err = v.client.CoreV1().Pods(pod.Namespace).Create(ctx, basicPod, metav1.CreateOptions{})
+	_, err = v.client.CoreV1().Pods(basicPod.Namespace).Create(ctx, basicPod, metav1.CreateOptions{})
+	if errors.IsAlreadyExists(err) {
+		klog.V(3).Infof("Pod %v/%+v already exists", pod.Namespace, pod.Name)
+		return nil
+	}
 	if err != nil {
 		return fmt.Errorf("could not create pod: %v", err)
 	}
@@ -90,6 +102,45 @@ func (v *VirtualK8S) CreatePod(ctx context.Context, pod *corev1.Pod) error {
 	return nil
 }
 
+// ValidatePod checks that the pod could be created in the client cluster by CreatePod, without creating anything. The
+// pod is translated like CreatePod does, and created with dry run, so the validation and admission errors of the
+// client cluster are returned. Dependents such as secrets and configmaps are not checked. If the namespace of the pod
+// does not exist in the client cluster yet, the pod cannot be validated, since the client cluster rejects pods in
+// missing namespaces even with dry run. Only the creation of the namespace is validated then, and a NotFound error is
+// returned, so callers cannot mistake the pod for a valid one.
+func (v *VirtualK8S) ValidatePod(ctx context.Context, pod *corev1.Pod) error {
+	if pod.Namespace == "kube-system" {
+		return nil
+	}
+	basicPod := utils.TrimPod(pod, v.ignoreLabels)
+	basicPod.Namespace = v.namespaces.ToClient(pod.Namespace)
+	v.rewriteScheduling(basicPod)
+	dryRun := []string{metav1.DryRunAll}
+	if _, err := v.clientCache.nsLister.Get(basicPod.Namespace); err != nil {
+		if !errors.IsNotFound(err) {
+			return err
+		}
+		ns := &corev1.Namespace{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: basicPod.Namespace,
+			},
+		}
+		_, err = v.client.CoreV1().Namespaces().Create(ctx, ns, metav1.CreateOptions{DryRun: dryRun})
+		if err != nil && !errors.IsAlreadyExists(err) {
+			return fmt.Errorf("namespace %s could not be created: %w", basicPod.Namespace, err)
+		}
+		return errdefs.NotFoundf("namespace %s of pod %s does not exist in the client cluster yet, the pod cannot be "+
+			"validated until CreatePod creates it", basicPod.Namespace, pod.Name)
+	}
+	_, err := v.client.CoreV1().Pods(basicPod.Namespace).Create(ctx, basicPod, metav1.CreateOptions{DryRun: dryRun})
+	// A pod which already exists was created by CreatePod before, so it passed validation then. CreatePod treats it
+	// as created too, rather than failing.
+	if err != nil && !errors.IsAlreadyExists(err) {
+		return fmt.Errorf("pod could not be created: %w", err)
+	}
+	return nil
+}
+
 // UpdatePod takes a Kubernetes Pod and updates it within the provider.
 func (v *VirtualK8S) UpdatePod(ctx context.Context, pod *corev1.Pod) error {
 	if pod.Namespace == "kube-system" {
@@ -115,7 +166,8 @@ func (v *VirtualK8S) UpdatePod(ctx context.Context, pod *corev1.Pod) error {
 		reflect.DeepEqual(currentPod.Labels, podCopy.Labels) {
 		return nil
 	}
-	_, err = v.client.CoreV1().Pods(pod.Namespace).Update(ctx, podCopy, metav1.UpdateOptions{})
+	podCopy.Namespace = v.namespaces.ToClient(pod.Namespace)
+	_, err = v.client.CoreV1().Pods(podCopy.Namespace).Update(ctx, podCopy, metav1.UpdateOptions{})
 	if err != nil {
 		return fmt.Errorf("could not update pod: %v", err)
 	}
@@ -130,19 +182,28 @@ func (v *VirtualK8S) DeletePod(ctx context.Context, pod *corev1.Pod) error {
 	}
 	klog.V(3).Infof("Deleting pod %v/%+v", pod.Namespace, pod.Name)
 
-	if !utils.IsVirtualPod(pod) {
-		klog.Info("Pod is not create by vk, ignore")
-		return nil
+	// The pod passed in is the one of the master cluster, the label marking virtual pods is only set on the pod
+	// backing it in the client cluster.
+	backingPod, err := v.getVirtualPod(ctx, pod.Namespace, pod.Name)
+	if err != nil {
+		if errdefs.IsNotFound(err) {
+			klog.Infof("Tried to delete pod %s/%s, but it is not backed by a pod in the cluster",
+				pod.Namespace, pod.Name)
+			return nil
+		}
+		return err
 	}
 
 	opts := &metav1.DeleteOptions{
 		GracePeriodSeconds: new(int64), // 0
+		// Make sure a pod recreated under the same name in the meantime is not deleted.
+		Preconditions: metav1.NewUIDPreconditions(string(backingPod.UID)),
 	}
 	if pod.DeletionGracePeriodSeconds != nil {
 		opts.GracePeriodSeconds = pod.DeletionGracePeriodSeconds
 	}
 
-	err := v.client.CoreV1().Pods(pod.Namespace).Delete(ctx, pod.Name, *opts)
+	err = v.client.CoreV1().Pods(backingPod.Namespace).Delete(ctx, backingPod.Name, *opts)
 	if err != nil {
 		if errors.IsNotFound(err) {
 			klog.Infof("Tried to delete pod %s/%s, but it did not exist in the cluster", pod.Namespace, pod.Name)
@@ -159,17 +220,20 @@ func (v *VirtualK8S) DeletePod(ctx context.Context, pod *corev1.Pod) error {
 // concurrently outside of the calling goroutine. Therefore it is recommended
 // to return a version after DeepCopy.
 func (v *VirtualK8S) GetPod(ctx context.Context, namespace string, name string) (*corev1.Pod, error) {
-	pod, err := v.clientCache.podLister.Pods(namespace).Get(name)
+	pod, err := v.getVirtualPod(ctx, namespace, name)
 	if err != nil {
-		klog.Error(err)
-		if errors.IsNotFound(err) {
-			return nil, errdefs.AsNotFound(err)
-		}
-		return nil, fmt.Errorf("could not get pod %s/%s: %v", namespace, name, err)
+		return nil, err
 	}
+	return toMasterPod(pod, namespace), nil
+}
+
+// toMasterPod translates a virtual pod of the client cluster back to its representation in the master cluster, that is
+// a copy in the master cluster namespace with the labels which were tripped when creating it recovered.
+func toMasterPod(pod *corev1.Pod, namespace string) *corev1.Pod {
 	podCopy := pod.DeepCopy()
+	podCopy.Namespace = namespace
 	utils.RecoverLabels(podCopy.Labels, podCopy.Annotations)
-	return podCopy, nil
+	return podCopy
 }
 
 // GetPodStatus retrieves the status of a pod by name from the provider.
@@ -177,17 +241,55 @@ func (v *VirtualK8S) GetPod(ctx context.Context, namespace string, name string)
 // concurrently outside of the calling goroutine. Therefore it is recommended
 // to return a version after DeepCopy.
 func (v *VirtualK8S) GetPodStatus(ctx context.Context, namespace string, name string) (*corev1.PodStatus, error) {
-	pod, err := v.clientCache.podLister.Pods(namespace).Get(name)
+	pod, err := v.getVirtualPod(ctx, namespace, name)
+	if err != nil {
+		return nil, err
+	}
+	status := pod.Status.DeepCopy()
+	v.translateContainerStatuses(namespace, name, status)
+	return status, nil
+}
+
+// translateContainerStatuses maps the container statuses in status of the pod backing a pod of the master cluster onto
+// the containers of the master pod. status is left as is if the master pod is not known.
+func (v *VirtualK8S) translateContainerStatuses(namespace, name string, status *corev1.PodStatus) {
+	masterPod, err := v.rm.GetPod(name, namespace)
+	if err != nil {
+		return
+	}
+	utils.TranslateContainerStatuses(masterPod, status)
+}
+
+// getVirtualPod returns the pod backing a virtual pod of the master cluster namespace in the client cluster. It is read
+// from the cache, and from the client cluster directly if the cache has not seen it yet, e.g. right after it was
+// created. Pods in the client cluster which were not created by the virtual kubelet are reported as not found. The
+// returned pod must not be modified.
+func (v *VirtualK8S) getVirtualPod(ctx context.Context, namespace string, name string) (*corev1.Pod, error) {
+	clientNamespace := v.namespaces.ToClient(namespace)
+	pod, err := v.clientCache.podLister.Pods(clientNamespace).Get(name)
+	if errors.IsNotFound(err) {
+		pod, err = v.client.CoreV1().Pods(clientNamespace).Get(ctx, name, metav1.GetOptions{})
+	}
 	if err != nil {
+		if errors.IsNotFound(err) {
+			return nil, errdefs.AsNotFound(err)
+		}
+		klog.Error(err)
 		return nil, fmt.Errorf("could not get pod %s/%s: %v", namespace, name, err)
 	}
-	return pod.Status.DeepCopy(), nil
+	if !utils.IsVirtualPod(pod) {
+		return nil, errdefs.NotFoundf("pod %s/%s is not created by the virtual kubelet", namespace, name)
+	}
+	return pod, nil
 }
 
 // GetPods retrieves a list of all pods running on the provider (can be cached).
 // The Pods returned are expected to be immutable, and may be accessed
 // concurrently outside of the calling goroutine. Therefore it is recommended
 // to return a version after DeepCopy.
+//
+// Only virtual pods are returned, translated like GetPod does. Pods in namespaces which are not mapped from the master
+// cluster are skipped.
 func (v *VirtualK8S) GetPods(_ context.Context) ([]*corev1.Pod, error) {
 	set := labels.Set{utils.VirtualPodLabel: "true"}
 	pods, err := v.clientCache.podLister.List(labels.SelectorFromSet(set))
@@ -200,101 +302,109 @@ func (v *VirtualK8S) GetPods(_ context.Context) ([]*corev1.Pod, error) {
 		if !utils.IsVirtualPod(p) {
 			continue
 		}
-		podCopy := p.DeepCopy()
-		utils.RecoverLabels(podCopy.Labels, podCopy.Annotations)
-		podRefs = append(podRefs, podCopy)
+		namespace, ok := v.namespaces.ToMaster(p.Namespace)
+		if !ok {
+			continue
+		}
+		podRefs = append(podRefs, toMasterPod(p, namespace))
 	}
 
 	return podRefs, nil
 }
 
-/*
 // GetContainerLogs retrieves the logs of a container by name from the provider.
 func (v *VirtualK8S) GetContainerLogs(ctx context.Context, namespace string,
-	podName string, containerName string, opts ContainerLogOpts) (io.ReadCloser, error) {
-		tailLine := int64(opts.Tail)
+	podName string, containerName string, opts plugins.ContainerLogOpts) (io.ReadCloser, error) {
+	pod, err := v.getVirtualPod(ctx, namespace, podName)
+	if err != nil {
+		return nil, err
+	}
+	logs := v.client.CoreV1().Pods(pod.Namespace).GetLogs(pod.Name, containerLogOptions(containerName, opts))
+	stream, err := logs.Stream(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("could not get stream from logs request: %v", err)
+	}
+	return stream, nil
+}
+
+// containerLogOptions translates opts into the options of a log request for container
+func containerLogOptions(container string, opts plugins.ContainerLogOpts) *corev1.PodLogOptions {
+	options := &corev1.PodLogOptions{
+		Container:  container,
+		Timestamps: opts.Timestamps,
+		Follow:     opts.Follow,
+		Previous:   opts.Previous,
+	}
+	if opts.Tail > 0 {
+		tailLines := int64(opts.Tail)
+		options.TailLines = &tailLines
+	}
+	if opts.LimitBytes > 0 {
 		limitBytes := int64(opts.LimitBytes)
-		sinceSeconds := opts.SinceSeconds
-		options := &corev1.PodLogOptions{
-			Container:  containerName,
-			Timestamps: opts.Timestamps,
-			Follow:     opts.Follow,
-		}
-		if tailLine != 0 {
-			options.TailLines = &tailLine
-		}
-		if limitBytes != 0 {
-			options.LimitBytes = &limitBytes
-		}
-		if !opts.SinceTime.IsZero() {
-			*options.SinceTime = metav1.Time{Time: opts.SinceTime}
-		}
-		if sinceSeconds != 0 {
-			*options.SinceSeconds = int64(sinceSeconds)
-		}
-		if opts.Previous {
-			options.Previous = opts.Previous
-		}
-		if opts.Follow {
-			options.Follow = opts.Follow
+		options.LimitBytes = &limitBytes
+	}
+	// The API server rejects requests which set both, sinceTime takes precedence as it is the more precise one.
+	if !opts.SinceTime.IsZero() {
+		options.SinceTime = &metav1.Time{Time: opts.SinceTime}
+	} else if opts.SinceSeconds > 0 {
+		sinceSeconds := int64(opts.SinceSeconds)
+		options.SinceSeconds = &sinceSeconds
+	}
+	return options
+}
+
+// RunInContainer executes a command in a container in the pod, copying data
+// between in/out/err and the container's stdin/stdout/stderr.
+func (v *VirtualK8S) RunInContainer(ctx context.Context, namespace string, podName string, containerName string,
+	cmd []string, attach plugins.AttachIO) error {
+	defer func() {
+		if attach.Stdout() != nil {
+			attach.Stdout().Close()
 		}
-		logs := v.client.CoreV1().Pods(namespace).GetLogs(podName, options)
-		stream, err := logs.Stream(ctx)
-		if err != nil {
-			return nil, fmt.Errorf("could not get stream from logs request: %v", err)
+		if attach.Stderr() != nil {
+			attach.Stderr().Close()
 		}
-return nil, nil
-}
-*/
-/*
-   // RunInContainer executes a command in a container in the pod, copying data
-   // between in/out/err and the container's stdin/stdout/stderr.
-   func (v *VirtualK8S) RunInContainer(ctx context.Context, namespace string, podName string, containerName string, cmd []string, attach api.AttachIO) error {
-   		defer func() {
-   			if attach.Stdout() != nil {
-   				attach.Stdout().Close()
-   			}
-   			if attach.Stderr() != nil {
-   				attach.Stderr().Close()
-   			}
-   		}()
-   		req := v.client.CoreV1().RESTClient().
-   			Post().
-   			Namespace(namespace).
-   			Resource("pods").
-   			Name(podName).
-   			SubResource("exec").
-   			Timeout(0).
-   			VersionedParams(&corev1.PodExecOptions{
-   				Container: containerName,
-   				Command:   cmd,
-   				Stdin:     attach.Stdin() != nil,
-   				Stdout:    attach.Stdout() != nil,
-   				Stderr:    attach.Stderr() != nil,
-   				TTY:       attach.TTY(),
-   			}, scheme.ParameterCodec)
-
-   		exec, err := remotecommand.NewSPDYExecutor(v.config, "POST", req.URL())
-   		if err != nil {
-   			return fmt.Errorf("could not make remote command: %v", err)
-   		}
-
-   		ts := &termSize{attach: attach}
-
-   		err = exec.Stream(remotecommand.StreamOptions{
-   			Stdin:             attach.Stdin(),
-   			Stdout:            attach.Stdout(),
-   			Stderr:            attach.Stderr(),
-   			Tty:               attach.TTY(),
-   			TerminalSizeQueue: ts,
-   		})
-   		if err != nil {
-   			return err
-   		}
-
-return nil
+	}()
+
+	pod, err := v.getVirtualPod(ctx, namespace, podName)
+	if err != nil {
+		return err
+	}
+
+	req := v.client.CoreV1().RESTClient().
+		Post().
+		Namespace(pod.Namespace).
+		Resource("pods").
+		Name(pod.Name).
+		SubResource("exec").
+		Timeout(0).
+		VersionedParams(&corev1.PodExecOptions{
+			Container: containerName,
+			Command:   cmd,
+			Stdin:     attach.Stdin() != nil,
+			Stdout:    attach.Stdout() != nil,
+			// With a TTY, stderr is merged into stdout by the container runtime.
+			Stderr: attach.Stderr() != nil && !attach.TTY(),
+			TTY:    attach.TTY(),
+		}, scheme.ParameterCodec)
+
+	exec, err := v.newExecutor(v.config, "POST", req.URL())
+	if err != nil {
+		return fmt.Errorf("could not make remote command: %v", err)
+	}
+
+	streamOpts := remotecommand.StreamOptions{
+		Stdin:  attach.Stdin(),
+		Stdout: attach.Stdout(),
+		Tty:    attach.TTY(),
+	}
+	if attach.TTY() {
+		streamOpts.TerminalSizeQueue = &termSize{ctx: ctx, attach: attach}
+	} else {
+		streamOpts.Stderr = attach.Stderr()
+	}
+	return exec.StreamWithContext(ctx, streamOpts)
 }
-*/
 
 // NotifyPods instructs the notifier to call the passed in function when
 // the pod status changes. It should be called when a pod's status changes.
@@ -306,15 +416,29 @@ return nil
 // NotifyPods will not block callers.
 func (v *VirtualK8S) NotifyPods(ctx context.Context, f func(*corev1.Pod)) {
 	klog.Info("Called NotifyPods")
+	// The dependents of deleted pods are cleaned up for as long as pods are reported
+	go v.dependentsQueue.Run(ctx, 1)
 	go func() {
 		// to make sure pods have been add to known pods
-		time.Sleep(10 * time.Second)
+		select {
+		case <-v.clock.After(notifyPodsDelay):
+		case <-v.stopCh:
+			return
+		case <-ctx.Done():
+			return
+		}
 		for {
 			select {
 			case pod := <-v.updatedPod:
+				namespace, ok := v.namespaces.ToMaster(pod.Namespace)
+				if !ok {
+					continue
+				}
 				klog.V(4).Infof("Enqueue updated pod %v", pod.Name)
+				pod.Namespace = namespace
 				// need trim pod, e.g. UID
 				utils.RecoverLabels(pod.Labels, pod.Annotations)
+				v.translateContainerStatuses(pod.Namespace, pod.Name, &pod.Status)
 				f(pod)
 			case <-v.stopCh:
 				return
@@ -327,8 +451,9 @@ func (v *VirtualK8S) NotifyPods(ctx context.Context, f func(*corev1.Pod)) {
 
 // createSecrets takes a Kubernetes Pod and deploys it within the provider.
 func (v *VirtualK8S) createSecrets(ctx context.Context, secrets []string, ns string) error {
+	clientNamespace := v.namespaces.ToClient(ns)
 	for _, secretName := range secrets {
-		_, err := v.clientCache.secretLister.Secrets(ns).Get(secretName)
+		_, err := v.clientCache.secretLister.Secrets(clientNamespace).Get(secretName)
 		if err == nil {
 			continue
 		}
@@ -340,7 +465,9 @@ func (v *VirtualK8S) createSecrets(ctx context.Context, secrets []string, ns str
 		if err != nil {
 			return err
 		}
+		secret = secret.DeepCopy()
 		utils.TrimObjectMeta(&secret.ObjectMeta)
+		secret.Namespace = clientNamespace
 		// skip service account secret
 		if secret.Type == corev1.SecretTypeServiceAccountToken {
 			if err := v.createServiceAccount(ctx, secret); err != nil {
@@ -349,7 +476,7 @@ func (v *VirtualK8S) createSecrets(ctx context.Context, secrets []string, ns str
 			}
 		}
 		controllers.SetObjectGlobal(&secret.ObjectMeta)
-		_, err = v.client.CoreV1().Secrets(ns).Create(ctx, secret, metav1.CreateOptions{})
+		_, err = v.client.CoreV1().Secrets(clientNamespace).Create(ctx, secret, metav1.CreateOptions{})
 		if err != nil {
 			if errors.IsAlreadyExists(err) {
 				continue
@@ -420,8 +547,9 @@ func (v *VirtualK8S) createServiceAccount(ctx context.Context, secret *corev1.Se
 
 // createConfigMaps a Kubernetes Pod and deploys it within the provider.
 func (v *VirtualK8S) createConfigMaps(ctx context.Context, configmaps []string, ns string) error {
+	clientNamespace := v.namespaces.ToClient(ns)
 	for _, cm := range configmaps {
-		_, err := v.clientCache.cmLister.ConfigMaps(ns).Get(cm)
+		_, err := v.clientCache.cmLister.ConfigMaps(clientNamespace).Get(cm)
 		if err == nil {
 			continue
 		}
@@ -430,10 +558,12 @@ func (v *VirtualK8S) createConfigMaps(ctx context.Context, configmaps []string,
 			if err != nil {
 				return fmt.Errorf("find comfigmap %v error %v", cm, err)
 			}
+			configMap = configMap.DeepCopy()
 			utils.TrimObjectMeta(&configMap.ObjectMeta)
+			configMap.Namespace = clientNamespace
 			controllers.SetObjectGlobal(&configMap.ObjectMeta)
 
-			_, err = v.client.CoreV1().ConfigMaps(ns).Create(ctx, configMap, metav1.CreateOptions{})
+			_, err = v.client.CoreV1().ConfigMaps(clientNamespace).Create(ctx, configMap, metav1.CreateOptions{})
 			if err != nil {
 				if errors.IsAlreadyExists(err) {
 					continue
@@ -441,7 +571,7 @@ func (v *VirtualK8S) createConfigMaps(ctx context.Context, configmaps []string,
 				klog.Errorf("Failed to create configmap %v err: %v", cm, err)
 				return err
 			}
-			klog.Infof("Create %v in %v success", cm, ns)
+			klog.Infof("Create %v in %v success", cm, clientNamespace)
 			continue
 		}
 		return fmt.Errorf("could not check configmap %s in external cluster: %v", cm, err)
@@ -452,7 +582,7 @@ func (v *VirtualK8S) createConfigMaps(ctx context.Context, configmaps []string,
 // deleteConfigMaps a Kubernetes Pod and deploys it within the provider.
 func (v *VirtualK8S) deleteConfigMaps(ctx context.Context, configmaps []string, ns string) error {
 	for _, cm := range configmaps {
-		err := v.client.CoreV1().ConfigMaps(ns).Delete(ctx, cm, metav1.DeleteOptions{})
+		err := v.client.CoreV1().ConfigMaps(v.namespaces.ToClient(ns)).Delete(ctx, cm, metav1.DeleteOptions{})
 		if err == nil {
 			continue
 		}
@@ -467,8 +597,9 @@ func (v *VirtualK8S) deleteConfigMaps(ctx context.Context, configmaps []string,
 
 // createPVCs a Kubernetes Pod and deploys it within the provider.
 func (v *VirtualK8S) createPVCs(ctx context.Context, pvcs []string, ns string) error {
+	clientNamespace := v.namespaces.ToClient(ns)
 	for _, cm := range pvcs {
-		_, err := v.client.CoreV1().PersistentVolumeClaims(ns).Get(ctx, cm, metav1.GetOptions{})
+		_, err := v.client.CoreV1().PersistentVolumeClaims(clientNamespace).Get(ctx, cm, metav1.GetOptions{})
 		if err == nil {
 			continue
 		}
@@ -478,8 +609,9 @@ func (v *VirtualK8S) createPVCs(ctx context.Context, pvcs []string, ns string) e
 				continue
 			}
 			utils.TrimObjectMeta(&pvc.ObjectMeta)
+			pvc.Namespace = clientNamespace
 			controllers.SetObjectGlobal(&pvc.ObjectMeta)
-			_, err = v.client.CoreV1().PersistentVolumeClaims(ns).Create(ctx, pvc, metav1.CreateOptions{})
+			_, err = v.client.CoreV1().PersistentVolumeClaims(clientNamespace).Create(ctx, pvc, metav1.CreateOptions{})
 			if err != nil {
 				if errors.IsAlreadyExists(err) {
 					continue
@@ -494,22 +626,31 @@ func (v *VirtualK8S) createPVCs(ctx context.Context, pvcs []string, ns string) e
 	return nil
 }
 
-/*// termSize helps exec termSize
+// termSize helps exec termSize
 type termSize struct {
-	attach api.AttachIO
+	ctx    context.Context
+	attach plugins.AttachIO
 }
 
 // Next returns the new terminal size after the terminal has been resized. It returns nil when
 // monitoring has been stopped.
 func (t *termSize) Next() *remotecommand.TerminalSize {
-	resize := <-t.attach.Resize()
-	return &remotecommand.TerminalSize{
-		Height: resize.Height,
-		Width:  resize.Width,
+	select {
+	case resize, ok := <-t.attach.Resize():
+		if !ok {
+			return nil
+		}
+		return &remotecommand.TerminalSize{
+			Height: resize.Height,
+			Width:  resize.Width,
+		}
+	case <-t.ctx.Done():
+		return nil
 	}
-}*/
+}
 
 func (v *VirtualK8S) createSA(ctx context.Context, sa string, ns string) (*corev1.ServiceAccount, error) {
+	ns = v.namespaces.ToClient(ns)
 	clientSA, err := v.client.CoreV1().ServiceAccounts(ns).Get(ctx, sa, metav1.GetOptions{})
 	if err != nil && !errors.IsNotFound(err) {
 		return nil, fmt.Errorf("could not check sa %s in member cluster: %v", sa, err)
@@ -546,7 +687,8 @@ func (v *VirtualK8S) createSAToken(ctx context.Context, saName string, ns string
 	}
 
 	csName := fmt.Sprintf("master-%s-token", sa.Name)
-	clientSecret, err := v.client.CoreV1().Secrets(ns).Get(ctx, csName, metav1.GetOptions{})
+	clientNamespace := v.namespaces.ToClient(ns)
+	clientSecret, err := v.client.CoreV1().Secrets(clientNamespace).Get(ctx, csName, metav1.GetOptions{})
 	if err != nil && !errors.IsNotFound(err) {
 		return nil, fmt.Errorf("could not check secret %s in member cluster: %v", secretName, err)
 	}
@@ -565,11 +707,11 @@ func (v *VirtualK8S) createSAToken(ctx context.Context, saName string, ns string
 	se := &corev1.Secret{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      csName,
-			Namespace: ns,
+			Namespace: clientNamespace,
 		},
 		Data: nData,
 	}
-	newSE, err := v.client.CoreV1().Secrets(ns).Create(ctx, se, metav1.CreateOptions{})
+	newSE, err := v.client.CoreV1().Secrets(clientNamespace).Create(ctx, se, metav1.CreateOptions{})
 	if err != nil && !errors.IsAlreadyExists(err) {
 		return nil, fmt.Errorf("could not create sa %s in member cluster: %v", sa, err)
 	}
@@ -579,7 +721,8 @@ func (v *VirtualK8S) createSAToken(ctx context.Context, saName string, ns string
 
 func (v *VirtualK8S) createCA(ctx context.Context, ns string) (*corev1.ConfigMap, error) {
 
-	masterCA, err := v.client.CoreV1().ConfigMaps(ns).Get(ctx, MasterRooTCAName, metav1.GetOptions{})
+	clientNamespace := v.namespaces.ToClient(ns)
+	masterCA, err := v.client.CoreV1().ConfigMaps(clientNamespace).Get(ctx, MasterRooTCAName, metav1.GetOptions{})
 	if err != nil && !errors.IsNotFound(err) {
 		return nil, fmt.Errorf("could not check configmap %s in member cluster: %v", MasterRooTCAName, err)
 	}
@@ -594,9 +737,10 @@ func (v *VirtualK8S) createCA(ctx context.Context, ns string) (*corev1.ConfigMap
 
 	newCA := ca.DeepCopy()
 	newCA.Name = MasterRooTCAName
+	newCA.Namespace = clientNamespace
 	utils.TrimObjectMeta(&newCA.ObjectMeta)
 
-	newCA, err = v.client.CoreV1().ConfigMaps(ns).Create(ctx, newCA, metav1.CreateOptions{})
+	newCA, err = v.client.CoreV1().ConfigMaps(clientNamespace).Create(ctx, newCA, metav1.CreateOptions{})
 	if err != nil && !errors.IsAlreadyExists(err) {
 		return nil, fmt.Errorf("could not create configmap %s in member cluster: %v", newCA.Name, err)
 	}
@@ -0,0 +1,796 @@
+package virtualk8s
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/clusterrouter-io/clusterrouter/pkg/common"
+	"github.com/clusterrouter-io/clusterrouter/pkg/controllers"
+	"github.com/clusterrouter-io/clusterrouter/pkg/plugins"
+	"github.com/clusterrouter-io/clusterrouter/pkg/utils"
+	"github.com/clusterrouter-io/clusterrouter/pkg/utils/errdefs"
+	"github.com/clusterrouter-io/clusterrouter/pkg/utils/manager"
+	"github.com/clusterrouter-io/clusterrouter/pkg/utils/queue"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+	listersv1 "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/rest"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/remotecommand"
+	"k8s.io/client-go/util/workqueue"
+	clocktesting "k8s.io/utils/clock/testing"
+)
+
+// newValidateTestProvider returns a provider with a fake client cluster, which has the given namespaces
+func newValidateTestProvider(t *testing.T, namespaces ...string) (*VirtualK8S, *fake.Clientset) {
+	t.Helper()
+	client := fake.NewSimpleClientset()
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	for _, name := range namespaces {
+		if err := indexer.Add(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	v := &VirtualK8S{
+		client:      client,
+		nodeName:    "vnode",
+		namespaces:  utils.NewNamespaceMapping("vk-"),
+		clientCache: clientCache{nsLister: listersv1.NewNamespaceLister(indexer)},
+	}
+	return v, client
+}
+
+func testPod() *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "pod"},
+		Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "c", Image: "busybox"}}},
+	}
+}
+
+func TestValidatePod(t *testing.T) {
+	v, client := newValidateTestProvider(t, "vk-default")
+	if err := v.ValidatePod(context.Background(), testPod()); err != nil {
+		t.Fatal(err)
+	}
+	var created bool
+	for _, action := range client.Actions() {
+		create, ok := action.(k8stesting.CreateAction)
+		if !ok {
+			continue
+		}
+		if create.GetNamespace() != "vk-default" || create.GetResource().Resource != "pods" {
+			t.Fatalf("unexpected create %v", action)
+		}
+		created = true
+	}
+	if !created {
+		t.Fatal("expected the pod to be created with dry run")
+	}
+}
+
+func TestValidatePodAlreadyExists(t *testing.T) {
+	v, client := newValidateTestProvider(t, "vk-default")
+	client.PrependReactor("create", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, errors.NewAlreadyExists(schema.GroupResource{Resource: "pods"}, "pod")
+	})
+	if err := v.ValidatePod(context.Background(), testPod()); err != nil {
+		t.Fatalf("expected a pod which already exists to be valid, got %v", err)
+	}
+}
+
+func TestValidatePodInvalid(t *testing.T) {
+	v, client := newValidateTestProvider(t, "vk-default")
+	client.PrependReactor("create", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, errors.NewBadRequest("denied by admission")
+	})
+	if err := v.ValidatePod(context.Background(), testPod()); err == nil {
+		t.Fatal("expected the rejected pod to be invalid")
+	}
+}
+
+func TestValidatePodMissingNamespace(t *testing.T) {
+	v, client := newValidateTestProvider(t)
+	err := v.ValidatePod(context.Background(), testPod())
+	if !errdefs.IsNotFound(err) {
+		t.Fatalf("expected a not found error for the missing namespace, got %v", err)
+	}
+	actions := client.Actions()
+	if len(actions) != 1 || actions[0].GetResource().Resource != "namespaces" {
+		t.Fatalf("expected only the namespace to be created with dry run, got %v", actions)
+	}
+}
+
+func TestValidatePodKubeSystem(t *testing.T) {
+	v, client := newValidateTestProvider(t)
+	pod := testPod()
+	pod.Namespace = "kube-system"
+	if err := v.ValidatePod(context.Background(), pod); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(client.Actions()); n != 0 {
+		t.Fatalf("expected no requests for kube-system pods, got %d", n)
+	}
+}
+
+// newIndexer returns an indexer by namespace holding objects
+func newIndexer(t *testing.T, objects ...runtime.Object) cache.Indexer {
+	t.Helper()
+	indexers := cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc}
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, indexers)
+	for _, obj := range objects {
+		if err := indexer.Add(obj); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return indexer
+}
+
+// newPodTestProvider returns a provider with a fake client cluster holding clientObjects, and a master cluster which
+// has masterObjects, that is the pods of the virtual node and the secrets and configmaps they depend on. The cache of
+// the client cluster is empty, so objects are read from the client.
+func newPodTestProvider(t *testing.T, masterObjects []runtime.Object,
+	clientObjects ...runtime.Object) (*VirtualK8S, *fake.Clientset) {
+	t.Helper()
+	var pods, secrets, configMaps []runtime.Object
+	for _, obj := range masterObjects {
+		switch obj.(type) {
+		case *corev1.Pod:
+			pods = append(pods, obj)
+		case *corev1.Secret:
+			secrets = append(secrets, obj)
+		case *corev1.ConfigMap:
+			configMaps = append(configMaps, obj)
+		}
+	}
+	rm, err := manager.NewResourceManager(
+		listersv1.NewPodLister(newIndexer(t, pods...)),
+		listersv1.NewSecretLister(newIndexer(t, secrets...)),
+		listersv1.NewConfigMapLister(newIndexer(t, configMaps...)),
+		nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := fake.NewSimpleClientset(clientObjects...)
+	v := &VirtualK8S{
+		client:     client,
+		nodeName:   "vnode",
+		namespaces: utils.NewNamespaceMapping("vk-"),
+		rm:         rm,
+		clientCache: clientCache{
+			podLister:    listersv1.NewPodLister(newIndexer(t)),
+			nsLister:     listersv1.NewNamespaceLister(newIndexer(t)),
+			cmLister:     listersv1.NewConfigMapLister(newIndexer(t)),
+			secretLister: listersv1.NewSecretLister(newIndexer(t)),
+		},
+	}
+	v.dependentsQueue = queue.New(workqueue.DefaultControllerRateLimiter(), "cleanupDependents", v.cleanupDependents)
+	return v, client
+}
+
+// testClientPod returns the pod backing testPod in the client cluster
+func testClientPod() *corev1.Pod {
+	pod := testPod()
+	pod.Namespace = "vk-default"
+	pod.Labels = map[string]string{utils.VirtualPodLabel: "true"}
+	pod.Annotations = map[string]string{utils.TrippedLabels: `{"app":"web"}`}
+	return pod
+}
+
+func TestGetPod(t *testing.T) {
+	v, _ := newPodTestProvider(t, nil, testClientPod())
+	pod, err := v.GetPod(context.Background(), "default", "pod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pod.Namespace != "default" || pod.Name != "pod" {
+		t.Fatalf("expected pod default/pod, got %s/%s", pod.Namespace, pod.Name)
+	}
+	if pod.Labels["app"] != "web" || !utils.IsVirtualPod(pod) {
+		t.Fatalf("expected the tripped labels to be recovered, got %v", pod.Labels)
+	}
+}
+
+func TestGetPodNotFound(t *testing.T) {
+	notVirtual := testClientPod()
+	notVirtual.Name = "not-virtual"
+	notVirtual.Labels = nil
+	v, _ := newPodTestProvider(t, nil, notVirtual)
+	for _, name := range []string{"missing", "not-virtual"} {
+		if _, err := v.GetPod(context.Background(), "default", name); !errdefs.IsNotFound(err) {
+			t.Fatalf("expected a not found error for pod %s, got %v", name, err)
+		}
+		if _, err := v.GetPodStatus(context.Background(), "default", name); !errdefs.IsNotFound(err) {
+			t.Fatalf("expected a not found error for the status of pod %s, got %v", name, err)
+		}
+	}
+}
+
+func TestGetPods(t *testing.T) {
+	other := testClientPod()
+	other.Name = "other"
+	other.Namespace = "vk-other"
+	other.Annotations = nil
+	notVirtual := testClientPod()
+	notVirtual.Name = "not-virtual"
+	notVirtual.Labels = nil
+	unmapped := testClientPod()
+	unmapped.Namespace = "kube-system"
+	clientPod := testClientPod()
+	v, _ := newPodTestProvider(t, nil)
+	v.clientCache.podLister = listersv1.NewPodLister(newIndexer(t, clientPod, other, notVirtual, unmapped))
+
+	pods, err := v.GetPods(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]*corev1.Pod{}
+	for _, pod := range pods {
+		got[pod.Namespace+"/"+pod.Name] = pod
+	}
+	if len(got) != 2 || got["default/pod"] == nil || got["other/other"] == nil {
+		t.Fatalf("expected only the virtual pods default/pod and other/other, got %v", got)
+	}
+	if pod := got["default/pod"]; pod.Labels["app"] != "web" || !utils.IsVirtualPod(pod) {
+		t.Fatalf("expected the tripped labels to be recovered, got %v", pod.Labels)
+	}
+	// The pods are copies, the client cache is left untouched
+	if clientPod.Namespace != "vk-default" || clientPod.Labels["app"] != "" {
+		t.Fatalf("expected the cached client pod to be unchanged, got %s with labels %v", clientPod.Namespace,
+			clientPod.Labels)
+	}
+}
+
+func TestGetPodStatus(t *testing.T) {
+	clientPod := testClientPod()
+	clientPod.Status = corev1.PodStatus{
+		Phase:      corev1.PodRunning,
+		Conditions: []corev1.PodCondition{{Type: corev1.PodReady, Status: corev1.ConditionTrue}},
+		ContainerStatuses: []corev1.ContainerStatus{
+			{Name: "sidecar", Ready: true},
+			{Name: "c", Ready: true, RestartCount: 2},
+		},
+	}
+	v, _ := newPodTestProvider(t, []runtime.Object{testPod()}, clientPod)
+
+	status, err := v.GetPodStatus(context.Background(), "default", "pod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Phase != corev1.PodRunning || !reflect.DeepEqual(status.Conditions, clientPod.Status.Conditions) {
+		t.Fatalf("expected the status of the client pod, got %+v", status)
+	}
+	expected := []corev1.ContainerStatus{{Name: "c", Ready: true, RestartCount: 2}}
+	if !reflect.DeepEqual(status.ContainerStatuses, expected) {
+		t.Fatalf("expected only the statuses of the containers of the master pod, got %+v", status.ContainerStatuses)
+	}
+}
+
+func TestContainerLogOptions(t *testing.T) {
+	since := time.Date(2022, 8, 1, 12, 0, 0, 0, time.UTC)
+	int64Ptr := func(i int64) *int64 { return &i }
+	tests := []struct {
+		name     string
+		opts     plugins.ContainerLogOpts
+		expected *corev1.PodLogOptions
+	}{
+		{
+			name:     "defaults",
+			expected: &corev1.PodLogOptions{Container: "c"},
+		},
+		{
+			name:     "flags",
+			opts:     plugins.ContainerLogOpts{Timestamps: true, Follow: true, Previous: true},
+			expected: &corev1.PodLogOptions{Container: "c", Timestamps: true, Follow: true, Previous: true},
+		},
+		{
+			name:     "tail and limit",
+			opts:     plugins.ContainerLogOpts{Tail: 10, LimitBytes: 1024},
+			expected: &corev1.PodLogOptions{Container: "c", TailLines: int64Ptr(10), LimitBytes: int64Ptr(1024)},
+		},
+		{
+			name:     "since seconds",
+			opts:     plugins.ContainerLogOpts{SinceSeconds: 60},
+			expected: &corev1.PodLogOptions{Container: "c", SinceSeconds: int64Ptr(60)},
+		},
+		{
+			name:     "since time takes precedence",
+			opts:     plugins.ContainerLogOpts{SinceSeconds: 60, SinceTime: since},
+			expected: &corev1.PodLogOptions{Container: "c", SinceTime: &metav1.Time{Time: since}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if options := containerLogOptions("c", tt.opts); !reflect.DeepEqual(options, tt.expected) {
+				t.Fatalf("expected %+v, got %+v", tt.expected, options)
+			}
+		})
+	}
+}
+
+func TestGetContainerLogs(t *testing.T) {
+	v, client := newPodTestProvider(t, nil, testClientPod())
+	stream, err := v.GetContainerLogs(context.Background(), "default", "pod", "c", plugins.ContainerLogOpts{Tail: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	logs, err := io.ReadAll(stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(logs) != "fake logs" {
+		t.Fatalf("expected the stream of the client cluster, got %q", logs)
+	}
+
+	var requested bool
+	for _, action := range client.Actions() {
+		if action.GetSubresource() != "log" {
+			continue
+		}
+		requested = true
+		if action.GetNamespace() != "vk-default" {
+			t.Fatalf("expected the logs to be requested in namespace vk-default, got %s", action.GetNamespace())
+		}
+		options := action.(k8stesting.GenericAction).GetValue().(*corev1.PodLogOptions)
+		if options.Container != "c" || options.TailLines == nil || *options.TailLines != 5 {
+			t.Fatalf("expected the logs of container c with 5 tail lines, got %+v", options)
+		}
+	}
+	if !requested {
+		t.Fatal("expected the logs to be requested from the client cluster")
+	}
+}
+
+func TestGetContainerLogsNotVirtual(t *testing.T) {
+	pod := testClientPod()
+	pod.Labels = nil
+	v, client := newPodTestProvider(t, nil, pod)
+	_, err := v.GetContainerLogs(context.Background(), "default", "pod", "c", plugins.ContainerLogOpts{})
+	if !errdefs.IsNotFound(err) {
+		t.Fatalf("expected a not found error, got %v", err)
+	}
+	for _, action := range client.Actions() {
+		if action.GetSubresource() == "log" {
+			t.Fatal("expected no logs to be requested for pods not created by the virtual kubelet")
+		}
+	}
+}
+
+// testAttachIO attaches to a command run in a container, with stdin serving in and stdout and stderr recorded
+type testAttachIO struct {
+	in             io.Reader
+	stdout, stderr *closeBuffer
+	tty            bool
+	resize         chan plugins.TermSize
+}
+
+func (a *testAttachIO) Stdin() io.Reader                { return a.in }
+func (a *testAttachIO) Stdout() io.WriteCloser          { return a.stdout }
+func (a *testAttachIO) Stderr() io.WriteCloser          { return a.stderr }
+func (a *testAttachIO) TTY() bool                       { return a.tty }
+func (a *testAttachIO) Resize() <-chan plugins.TermSize { return a.resize }
+
+// closeBuffer is a buffer which records whether it was closed
+type closeBuffer struct {
+	bytes.Buffer
+	closed bool
+}
+
+func (b *closeBuffer) Close() error {
+	b.closed = true
+	return nil
+}
+
+// fakeExecutor echoes stdin to stdout, writes to stderr, and records the first terminal size
+type fakeExecutor struct {
+	url  *url.URL
+	size *remotecommand.TerminalSize
+}
+
+func (e *fakeExecutor) Stream(options remotecommand.StreamOptions) error {
+	return e.StreamWithContext(context.Background(), options)
+}
+
+func (e *fakeExecutor) StreamWithContext(ctx context.Context, options remotecommand.StreamOptions) error {
+	if options.TerminalSizeQueue != nil {
+		e.size = options.TerminalSizeQueue.Next()
+	}
+	if _, err := io.Copy(options.Stdout, options.Stdin); err != nil {
+		return err
+	}
+	if options.Stderr != nil {
+		_, err := io.WriteString(options.Stderr, "stderr")
+		return err
+	}
+	return nil
+}
+
+func TestRunInContainer(t *testing.T) {
+	tests := []struct {
+		name           string
+		tty            bool
+		expectedQuery  url.Values
+		expectedStderr string
+	}{
+		{
+			name: "no tty",
+			expectedQuery: url.Values{
+				"command": {"sh", "-c", "cat"}, "container": {"c"}, "stdin": {"true"}, "stdout": {"true"},
+				"stderr": {"true"},
+			},
+			expectedStderr: "stderr",
+		},
+		{
+			name: "tty",
+			tty:  true,
+			expectedQuery: url.Values{
+				"command": {"sh", "-c", "cat"}, "container": {"c"}, "stdin": {"true"}, "stdout": {"true"},
+				"tty": {"true"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v, _ := newPodTestProvider(t, nil)
+			config := &rest.Config{Host: "https://client.example.com"}
+			client, err := kubernetes.NewForConfig(config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			v.client, v.config = client, config
+			v.clientCache.podLister = listersv1.NewPodLister(newIndexer(t, testClientPod()))
+			executor := &fakeExecutor{}
+			v.newExecutor = func(c *rest.Config, method string, u *url.URL) (remotecommand.Executor, error) {
+				if c != config || method != "POST" {
+					t.Fatalf("expected a POST with the config of the client cluster, got %s", method)
+				}
+				executor.url = u
+				return executor, nil
+			}
+
+			attach := &testAttachIO{
+				in:     strings.NewReader("stdin"),
+				stdout: &closeBuffer{},
+				stderr: &closeBuffer{},
+				tty:    tt.tty,
+				resize: make(chan plugins.TermSize, 1),
+			}
+			attach.resize <- plugins.TermSize{Width: 80, Height: 24}
+			err = v.RunInContainer(context.Background(), "default", "pod", "c", []string{"sh", "-c", "cat"}, attach)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if executor.url.Path != "/api/v1/namespaces/vk-default/pods/pod/exec" {
+				t.Fatalf("expected an exec into the client pod, got %s", executor.url.Path)
+			}
+			if query := executor.url.Query(); !reflect.DeepEqual(query, tt.expectedQuery) {
+				t.Fatalf("expected query %v, got %v", tt.expectedQuery, query)
+			}
+			if attach.stdout.String() != "stdin" || attach.stderr.String() != tt.expectedStderr {
+				t.Fatalf("expected stdout %q and stderr %q, got %q and %q", "stdin", tt.expectedStderr,
+					attach.stdout.String(), attach.stderr.String())
+			}
+			if !attach.stdout.closed || !attach.stderr.closed {
+				t.Fatal("expected stdout and stderr to be closed")
+			}
+			if tt.tty && (executor.size == nil || executor.size.Width != 80 || executor.size.Height != 24) {
+				t.Fatalf("expected the terminal size to be forwarded, got %+v", executor.size)
+			}
+			if !tt.tty && executor.size != nil {
+				t.Fatalf("expected no terminal size without a tty, got %+v", executor.size)
+			}
+		})
+	}
+}
+
+// createdPods returns the pods created in the client cluster
+func createdPods(client *fake.Clientset) []*corev1.Pod {
+	var pods []*corev1.Pod
+	for _, action := range client.Actions() {
+		if create, ok := action.(k8stesting.CreateAction); ok && create.GetResource().Resource == "pods" {
+			pods = append(pods, create.GetObject().(*corev1.Pod))
+		}
+	}
+	return pods
+}
+
+func TestCreatePod(t *testing.T) {
+	tests := []struct {
+		name              string
+		namespaces        []runtime.Object
+		expectedNamespace bool
+	}{
+		{name: "existing namespace", namespaces: []runtime.Object{
+			&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "vk-default"}},
+		}},
+		{name: "missing namespace", expectedNamespace: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v, client := newPodTestProvider(t, nil)
+			v.clientCache.nsLister = listersv1.NewNamespaceLister(newIndexer(t, tt.namespaces...))
+			pod := testPod()
+			pod.Spec.NodeName = "vnode"
+			pod.Spec.AutomountServiceAccountToken = new(bool)
+			if err := v.CreatePod(context.Background(), pod); err != nil {
+				t.Fatal(err)
+			}
+
+			_, err := client.CoreV1().Namespaces().Get(context.Background(), "vk-default", metav1.GetOptions{})
+			if created := err == nil; created != tt.expectedNamespace {
+				t.Fatalf("expected the namespace to be created %v, got %v", tt.expectedNamespace, created)
+			}
+			created, err := client.CoreV1().Pods("vk-default").Get(context.Background(), "pod", metav1.GetOptions{})
+			if err != nil {
+				t.Fatalf("expected the pod to be created in the mapped namespace: %v", err)
+			}
+			if !utils.IsVirtualPod(created) {
+				t.Fatalf("expected the pod to carry the virtual pod label, got %v", created.Labels)
+			}
+			if created.Spec.NodeName != "" {
+				t.Fatalf("expected the node name to be stripped, got %s", created.Spec.NodeName)
+			}
+			if pod.Namespace != "default" || pod.Spec.NodeName != "vnode" {
+				t.Fatal("expected the master pod not to be modified")
+			}
+		})
+	}
+}
+
+func TestCreatePodAlreadyExists(t *testing.T) {
+	v, client := newPodTestProvider(t, nil, testClientPod())
+	v.clientCache.nsLister = listersv1.NewNamespaceLister(newIndexer(t,
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "vk-default"}}))
+	pod := testPod()
+	pod.Spec.AutomountServiceAccountToken = new(bool)
+	if err := v.CreatePod(context.Background(), pod); err != nil {
+		t.Fatalf("expected a pod which already exists to be created, got %v", err)
+	}
+	if n := len(createdPods(client)); n != 1 {
+		t.Fatalf("expected 1 attempt to create the pod, got %d", n)
+	}
+}
+
+func TestCreatePodKubeSystem(t *testing.T) {
+	v, client := newPodTestProvider(t, nil)
+	pod := testPod()
+	pod.Namespace = "kube-system"
+	if err := v.CreatePod(context.Background(), pod); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(client.Actions()); n != 0 {
+		t.Fatalf("expected no requests for kube-system pods, got %d", n)
+	}
+}
+
+// deleteOptions returns the options of the pod deletions in the client cluster
+func deleteOptions(client *fake.Clientset) []metav1.DeleteOptions {
+	var options []metav1.DeleteOptions
+	for _, action := range client.Actions() {
+		if del, ok := action.(k8stesting.DeleteAction); ok && del.GetResource().Resource == "pods" {
+			options = append(options, del.GetDeleteOptions())
+		}
+	}
+	return options
+}
+
+func TestDeletePod(t *testing.T) {
+	gracePeriod := int64(30)
+	tests := []struct {
+		name                string
+		gracePeriodSeconds  *int64
+		expectedGracePeriod int64
+	}{
+		{name: "grace period", gracePeriodSeconds: &gracePeriod, expectedGracePeriod: 30},
+		{name: "no grace period", expectedGracePeriod: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clientPod := testClientPod()
+			clientPod.UID = "client-uid"
+			v, client := newPodTestProvider(t, nil, clientPod)
+			pod := testPod()
+			pod.UID = "master-uid"
+			pod.DeletionGracePeriodSeconds = tt.gracePeriodSeconds
+			if err := v.DeletePod(context.Background(), pod); err != nil {
+				t.Fatal(err)
+			}
+
+			options := deleteOptions(client)
+			if len(options) != 1 {
+				t.Fatalf("expected 1 deletion, got %d", len(options))
+			}
+			if options[0].GracePeriodSeconds == nil || *options[0].GracePeriodSeconds != tt.expectedGracePeriod {
+				t.Fatalf("expected a grace period of %d, got %v", tt.expectedGracePeriod, options[0].GracePeriodSeconds)
+			}
+			if options[0].Preconditions == nil || *options[0].Preconditions.UID != "client-uid" {
+				t.Fatalf("expected the deletion to be conditional on the client pod UID, got %+v",
+					options[0].Preconditions)
+			}
+			_, err := client.CoreV1().Pods("vk-default").Get(context.Background(), "pod", metav1.GetOptions{})
+			if !errors.IsNotFound(err) {
+				t.Fatalf("expected the client pod to be deleted, got %v", err)
+			}
+		})
+	}
+}
+
+func TestDeletePodNotFound(t *testing.T) {
+	notVirtual := testClientPod()
+	notVirtual.Name = "not-virtual"
+	notVirtual.Labels = nil
+	v, client := newPodTestProvider(t, nil, testClientPod(), notVirtual)
+	client.PrependReactor("delete", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, errors.NewNotFound(schema.GroupResource{Resource: "pods"}, "pod")
+	})
+	for _, name := range []string{"pod", "missing", "not-virtual"} {
+		pod := testPod()
+		pod.Name = name
+		if err := v.DeletePod(context.Background(), pod); err != nil {
+			t.Fatalf("expected deleting pod %s which does not exist to succeed, got %v", name, err)
+		}
+	}
+	if n := len(deleteOptions(client)); n != 1 {
+		t.Fatalf("expected only the virtual pod to be deleted, got %d deletions", n)
+	}
+}
+
+func TestCreatePodMirrorsDependents(t *testing.T) {
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "creds", UID: "master-uid"},
+		Data:       map[string][]byte{"password": []byte("secret")},
+	}
+	configMap := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "config"},
+		Data:       map[string]string{"key": "value"},
+	}
+	v, client := newPodTestProvider(t, []runtime.Object{secret, configMap})
+	v.clientCache.nsLister = listersv1.NewNamespaceLister(newIndexer(t,
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "vk-default"}}))
+	pod := testPod()
+	pod.Spec.AutomountServiceAccountToken = new(bool)
+	pod.Spec.Volumes = []corev1.Volume{{
+		Name:         "creds",
+		VolumeSource: corev1.VolumeSource{Secret: &corev1.SecretVolumeSource{SecretName: "creds"}},
+	}}
+	pod.Spec.Containers[0].EnvFrom = []corev1.EnvFromSource{{
+		ConfigMapRef: &corev1.ConfigMapEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: "config"}},
+	}}
+	if err := v.CreatePod(context.Background(), pod); err != nil {
+		t.Fatal(err)
+	}
+
+	// The secret must be mirrored before the pod is created, so the pod can start
+	var created []string
+	for _, action := range client.Actions() {
+		if create, ok := action.(k8stesting.CreateAction); ok {
+			created = append(created, create.GetResource().Resource)
+		}
+	}
+	if len(created) < 2 || created[0] != "secrets" || created[len(created)-1] != "pods" {
+		t.Fatalf("expected the secret to be created before the pod, got %v", created)
+	}
+	mirrored, err := client.CoreV1().Secrets("vk-default").Get(context.Background(), "creds", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(mirrored.Data["password"]) != "secret" || mirrored.UID != "" {
+		t.Fatalf("expected a copy of the secret without its UID, got %+v", mirrored)
+	}
+	if !controllers.IsObjectGlobal(&mirrored.ObjectMeta) {
+		t.Fatal("expected the copy of the secret to be marked global, so it is kept updated")
+	}
+
+	// Configmaps are mirrored in the background
+	configMaps := client.CoreV1().ConfigMaps("vk-default")
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mirrored, err := configMaps.Get(context.Background(), "config", metav1.GetOptions{})
+		if err == nil {
+			if !controllers.IsObjectGlobal(&mirrored.ObjectMeta) || mirrored.Data["key"] != "value" {
+				t.Fatalf("expected a global copy of the configmap, got %+v", mirrored)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the configmap to be mirrored: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestNotifyPods(t *testing.T) {
+	masterPod := testPod()
+	masterPod.Spec.Containers = append(masterPod.Spec.Containers, corev1.Container{Name: "d"})
+	v, _ := newPodTestProvider(t, []runtime.Object{masterPod})
+	fakeClock := clocktesting.NewFakeClock(time.Date(2022, 8, 1, 12, 0, 0, 0, time.UTC))
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	v.clock, v.stopCh = fakeClock, stopCh
+	v.providerNode = &common.ProviderNode{}
+	v.configured = true
+	v.updatedPod = make(chan *corev1.Pod, 10)
+
+	notified := make(chan *corev1.Pod, 10)
+	v.NotifyPods(context.Background(), func(pod *corev1.Pod) { notified <- pod })
+
+	old := testClientPod()
+	old.UID = "client-uid"
+	old.Status.Phase = corev1.PodPending
+	updated := old.DeepCopy()
+	updated.Status.Phase = corev1.PodRunning
+	updated.Status.ContainerStatuses = []corev1.ContainerStatus{{Name: "sidecar"}, {Name: "d"}, {Name: "c"}}
+	v.updatePod(old, updated)
+	// Updates without changes to the status are not passed on
+	v.updatePod(updated, updated.DeepCopy())
+
+	// Updates are held back until the pods are known to the caller
+	select {
+	case pod := <-notified:
+		t.Fatalf("expected no update before the start delay, got %v", pod)
+	case <-time.After(10 * time.Millisecond):
+	}
+	for !fakeClock.HasWaiters() {
+		time.Sleep(time.Millisecond)
+	}
+	fakeClock.Step(notifyPodsDelay)
+
+	select {
+	case pod := <-notified:
+		if pod.Namespace != "default" || pod.Name != "pod" || pod.Status.Phase != corev1.PodRunning {
+			t.Fatalf("expected the running pod default/pod, got %s/%s %s", pod.Namespace, pod.Name, pod.Status.Phase)
+		}
+		if pod.UID != "" {
+			t.Fatalf("expected the UID of the client pod to be trimmed, got %s", pod.UID)
+		}
+		if pod.Labels["app"] != "web" {
+			t.Fatalf("expected the tripped labels to be recovered, got %v", pod.Labels)
+		}
+		expected := []corev1.ContainerStatus{{Name: "c"}, {Name: "d"}}
+		if !reflect.DeepEqual(pod.Status.ContainerStatuses, expected) {
+			t.Fatalf("expected the statuses of the master pod containers, got %+v", pod.Status.ContainerStatuses)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the updated pod to be notified")
+	}
+	select {
+	case pod := <-notified:
+		t.Fatalf("expected a single update, got %v", pod)
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+func TestNotifyPodsStopsDuringDelay(t *testing.T) {
+	v, _ := newPodTestProvider(t, nil)
+	fakeClock := clocktesting.NewFakeClock(time.Date(2022, 8, 1, 12, 0, 0, 0, time.UTC))
+	v.clock, v.stopCh = fakeClock, make(chan struct{})
+	v.updatedPod = make(chan *corev1.Pod, 10)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	v.NotifyPods(ctx, func(pod *corev1.Pod) { t.Errorf("expected no updates, got %v", pod) })
+	for !fakeClock.HasWaiters() {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	// Give NotifyPods time to stop, the updates are no longer read afterwards even once the delay passed
+	time.Sleep(50 * time.Millisecond)
+	v.updatedPod <- testClientPod()
+	fakeClock.Step(notifyPodsDelay)
+	time.Sleep(50 * time.Millisecond)
+	if n := len(v.updatedPod); n != 1 {
+		t.Fatalf("expected the update to be left unread, got %d pending updates", n)
+	}
+}
@@ -0,0 +1,164 @@
+package virtualk8s
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/selection"
+)
+
+// rewriteScheduling translates the scheduling constraints of a pod created in the client cluster. Tolerations of the
+// taints of the virtual node, and node selectors and affinities referencing the virtual node are meaningless in the
+// client cluster, and would keep the pod from being scheduled there, so they are removed. If the node selector is
+// propagated, pods are constrained to the client cluster nodes making up the virtual node.
+func (v *VirtualK8S) rewriteScheduling(pod *corev1.Pod) {
+	pod.Spec.Tolerations = v.clientTolerations(pod.Spec.Tolerations)
+	if pod.Spec.NodeSelector[corev1.LabelHostname] == v.nodeName {
+		delete(pod.Spec.NodeSelector, corev1.LabelHostname)
+	}
+	if affinity := pod.Spec.Affinity; affinity != nil && affinity.NodeAffinity != nil {
+		v.rewriteNodeAffinity(affinity.NodeAffinity)
+		if affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution == nil &&
+			len(affinity.NodeAffinity.PreferredDuringSchedulingIgnoredDuringExecution) == 0 {
+			affinity.NodeAffinity = nil
+		}
+	}
+	if v.propagateSelector {
+		v.requireSelectedNodes(pod)
+	}
+}
+
+// clientTolerations returns tolerations without the ones of the taints of the virtual node
+func (v *VirtualK8S) clientTolerations(tolerations []corev1.Toleration) []corev1.Toleration {
+	if len(tolerations) == 0 {
+		return tolerations
+	}
+	virtualKeys := make(map[string]bool, len(v.nodeTaints)+1)
+	virtualKeys[v.taintKey] = true
+	for _, t := range v.nodeTaints {
+		virtualKeys[t.Key] = true
+	}
+	kept := make([]corev1.Toleration, 0, len(tolerations))
+	for _, t := range tolerations {
+		// A toleration without a key tolerates every taint, so it is kept
+		if t.Key != "" && virtualKeys[t.Key] {
+			continue
+		}
+		kept = append(kept, t)
+	}
+	return kept
+}
+
+// rewriteNodeAffinity removes the requirements referencing the virtual node from affinity. Terms which end up empty are
+// dropped, since an empty term matches no node.
+func (v *VirtualK8S) rewriteNodeAffinity(affinity *corev1.NodeAffinity) {
+	if required := affinity.RequiredDuringSchedulingIgnoredDuringExecution; required != nil {
+		terms := make([]corev1.NodeSelectorTerm, 0, len(required.NodeSelectorTerms))
+		for _, term := range required.NodeSelectorTerms {
+			if term, ok := v.clientNodeSelectorTerm(term); ok {
+				terms = append(terms, term)
+			}
+		}
+		required.NodeSelectorTerms = terms
+		if len(terms) == 0 {
+			affinity.RequiredDuringSchedulingIgnoredDuringExecution = nil
+		}
+	}
+	preferred := make([]corev1.PreferredSchedulingTerm, 0, len(affinity.PreferredDuringSchedulingIgnoredDuringExecution))
+	for _, p := range affinity.PreferredDuringSchedulingIgnoredDuringExecution {
+		if term, ok := v.clientNodeSelectorTerm(p.Preference); ok {
+			p.Preference = term
+			preferred = append(preferred, p)
+		}
+	}
+	affinity.PreferredDuringSchedulingIgnoredDuringExecution = preferred
+}
+
+// clientNodeSelectorTerm returns term without the requirements referencing the virtual node by its name or hostname
+// label. ok is false if nothing is left of the term.
+func (v *VirtualK8S) clientNodeSelectorTerm(term corev1.NodeSelectorTerm) (corev1.NodeSelectorTerm, bool) {
+	if len(term.MatchExpressions) == 0 && len(term.MatchFields) == 0 {
+		return term, true
+	}
+	rewritten := corev1.NodeSelectorTerm{}
+	for _, r := range term.MatchExpressions {
+		if r.Key == corev1.LabelHostname && v.referencesNode(r) {
+			continue
+		}
+		rewritten.MatchExpressions = append(rewritten.MatchExpressions, r)
+	}
+	for _, r := range term.MatchFields {
+		if r.Key == "metadata.name" && v.referencesNode(r) {
+			continue
+		}
+		rewritten.MatchFields = append(rewritten.MatchFields, r)
+	}
+	return rewritten, len(rewritten.MatchExpressions) > 0 || len(rewritten.MatchFields) > 0
+}
+
+// referencesNode returns true if requirement selects the virtual node by one of its values
+func (v *VirtualK8S) referencesNode(requirement corev1.NodeSelectorRequirement) bool {
+	for _, value := range requirement.Values {
+		if value == v.nodeName {
+			return true
+		}
+	}
+	return false
+}
+
+// requireSelectedNodes adds the node selector of the virtual node to every required node affinity term of pod, so it
+// is only scheduled to the client cluster nodes making up the virtual node.
+func (v *VirtualK8S) requireSelectedNodes(pod *corev1.Pod) {
+	requirements := v.nodeSelectorRequirements()
+	if len(requirements) == 0 {
+		return
+	}
+	if pod.Spec.Affinity == nil {
+		pod.Spec.Affinity = &corev1.Affinity{}
+	}
+	if pod.Spec.Affinity.NodeAffinity == nil {
+		pod.Spec.Affinity.NodeAffinity = &corev1.NodeAffinity{}
+	}
+	affinity := pod.Spec.Affinity.NodeAffinity
+	if affinity.RequiredDuringSchedulingIgnoredDuringExecution == nil {
+		affinity.RequiredDuringSchedulingIgnoredDuringExecution = &corev1.NodeSelector{
+			NodeSelectorTerms: []corev1.NodeSelectorTerm{{}},
+		}
+	}
+	terms := affinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms
+	for i := range terms {
+		terms[i].MatchExpressions = append(terms[i].MatchExpressions, requirements...)
+	}
+}
+
+// nodeSelectorRequirements returns the node selector of the virtual node as node selector requirements
+func (v *VirtualK8S) nodeSelectorRequirements() []corev1.NodeSelectorRequirement {
+	requirements, selectable := v.nodeSelector.Requirements()
+	if !selectable {
+		return nil
+	}
+	result := make([]corev1.NodeSelectorRequirement, 0, len(requirements))
+	for _, r := range requirements {
+		var operator corev1.NodeSelectorOperator
+		switch r.Operator() {
+		case selection.Equals, selection.DoubleEquals, selection.In:
+			operator = corev1.NodeSelectorOpIn
+		case selection.NotEquals, selection.NotIn:
+			operator = corev1.NodeSelectorOpNotIn
+		case selection.Exists:
+			operator = corev1.NodeSelectorOpExists
+		case selection.DoesNotExist:
+			operator = corev1.NodeSelectorOpDoesNotExist
+		case selection.GreaterThan:
+			operator = corev1.NodeSelectorOpGt
+		case selection.LessThan:
+			operator = corev1.NodeSelectorOpLt
+		default:
+			continue
+		}
+		requirement := corev1.NodeSelectorRequirement{Key: r.Key(), Operator: operator}
+		if r.Values().Len() > 0 {
+			requirement.Values = r.Values().List()
+		}
+		result = append(result, requirement)
+	}
+	return result
+}
@@ -0,0 +1,159 @@
+package virtualk8s
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	listersv1 "k8s.io/client-go/listers/core/v1"
+)
+
+// hostnameTerm returns a node selector term requiring the hostname label to be one of hostnames
+func hostnameTerm(hostnames ...string) corev1.NodeSelectorTerm {
+	return corev1.NodeSelectorTerm{MatchExpressions: []corev1.NodeSelectorRequirement{
+		{Key: corev1.LabelHostname, Operator: corev1.NodeSelectorOpIn, Values: hostnames},
+	}}
+}
+
+func TestRewriteScheduling(t *testing.T) {
+	zone := corev1.NodeSelectorRequirement{
+		Key:      corev1.LabelTopologyZone,
+		Operator: corev1.NodeSelectorOpIn,
+		Values:   []string{"zone-a"},
+	}
+	tests := []struct {
+		name              string
+		propagateSelector bool
+		spec              corev1.PodSpec
+		expected          corev1.PodSpec
+	}{
+		{
+			name: "tolerations of the virtual node taints",
+			spec: corev1.PodSpec{Tolerations: []corev1.Toleration{
+				{Key: "virtual-kubelet.io/provider", Operator: corev1.TolerationOpExists},
+				{Key: "dedicated", Value: "vk", Effect: corev1.TaintEffectNoSchedule},
+				{Key: "gpu", Operator: corev1.TolerationOpExists},
+				{Operator: corev1.TolerationOpExists},
+			}},
+			expected: corev1.PodSpec{Tolerations: []corev1.Toleration{
+				{Key: "gpu", Operator: corev1.TolerationOpExists},
+				{Operator: corev1.TolerationOpExists},
+			}},
+		},
+		{
+			name: "node selector of the virtual node",
+			spec: corev1.PodSpec{NodeSelector: map[string]string{
+				corev1.LabelHostname: "vnode",
+				"disk":               "ssd",
+			}},
+			expected: corev1.PodSpec{NodeSelector: map[string]string{"disk": "ssd"}},
+		},
+		{
+			name: "affinity only referencing the virtual node",
+			spec: corev1.PodSpec{Affinity: &corev1.Affinity{NodeAffinity: &corev1.NodeAffinity{
+				RequiredDuringSchedulingIgnoredDuringExecution: &corev1.NodeSelector{
+					NodeSelectorTerms: []corev1.NodeSelectorTerm{hostnameTerm("vnode")},
+				},
+				PreferredDuringSchedulingIgnoredDuringExecution: []corev1.PreferredSchedulingTerm{
+					{Weight: 1, Preference: corev1.NodeSelectorTerm{MatchFields: []corev1.NodeSelectorRequirement{
+						{Key: "metadata.name", Operator: corev1.NodeSelectorOpIn, Values: []string{"vnode"}},
+					}}},
+				},
+			}}},
+			expected: corev1.PodSpec{Affinity: &corev1.Affinity{}},
+		},
+		{
+			name: "affinity with other requirements",
+			spec: corev1.PodSpec{Affinity: &corev1.Affinity{NodeAffinity: &corev1.NodeAffinity{
+				RequiredDuringSchedulingIgnoredDuringExecution: &corev1.NodeSelector{
+					NodeSelectorTerms: []corev1.NodeSelectorTerm{
+						{MatchExpressions: append(hostnameTerm("vnode").MatchExpressions, zone)},
+						hostnameTerm("other-node"),
+					},
+				},
+			}}},
+			expected: corev1.PodSpec{Affinity: &corev1.Affinity{NodeAffinity: &corev1.NodeAffinity{
+				RequiredDuringSchedulingIgnoredDuringExecution: &corev1.NodeSelector{
+					NodeSelectorTerms: []corev1.NodeSelectorTerm{
+						{MatchExpressions: []corev1.NodeSelectorRequirement{zone}},
+						hostnameTerm("other-node"),
+					},
+				},
+				PreferredDuringSchedulingIgnoredDuringExecution: []corev1.PreferredSchedulingTerm{},
+			}}},
+		},
+		{
+			name:              "propagated node selector",
+			propagateSelector: true,
+			spec:              corev1.PodSpec{NodeSelector: map[string]string{corev1.LabelHostname: "vnode"}},
+			expected: corev1.PodSpec{
+				NodeSelector: map[string]string{},
+				Affinity: &corev1.Affinity{NodeAffinity: &corev1.NodeAffinity{
+					RequiredDuringSchedulingIgnoredDuringExecution: &corev1.NodeSelector{
+						NodeSelectorTerms: []corev1.NodeSelectorTerm{{
+							MatchExpressions: []corev1.NodeSelectorRequirement{
+								{Key: "pool", Operator: corev1.NodeSelectorOpIn, Values: []string{"gpu"}},
+							},
+						}},
+					},
+				}},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := &VirtualK8S{
+				nodeName: "vnode",
+				taintKey: "virtual-kubelet.io/provider",
+				nodeTaints: []corev1.Taint{
+					{Key: "dedicated", Value: "vk", Effect: corev1.TaintEffectNoSchedule},
+				},
+				nodeSelector:      labels.SelectorFromSet(labels.Set{"pool": "gpu"}),
+				propagateSelector: tt.propagateSelector,
+			}
+			pod := &corev1.Pod{Spec: tt.spec}
+			v.rewriteScheduling(pod)
+			if !reflect.DeepEqual(pod.Spec, tt.expected) {
+				t.Fatalf("expected the pod spec %+v, got %+v", tt.expected, pod.Spec)
+			}
+		})
+	}
+}
+
+func TestCreatePodRewritesScheduling(t *testing.T) {
+	v, client := newPodTestProvider(t, nil)
+	v.taintKey = "virtual-kubelet.io/provider"
+	v.clientCache.nsLister = listersv1.NewNamespaceLister(newIndexer(t,
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "vk-default"}}))
+	pod := testPod()
+	pod.Spec.NodeName = "vnode"
+	pod.Spec.AutomountServiceAccountToken = new(bool)
+	pod.Spec.Tolerations = []corev1.Toleration{
+		{Key: "virtual-kubelet.io/provider", Operator: corev1.TolerationOpExists},
+	}
+	pod.Spec.Affinity = &corev1.Affinity{NodeAffinity: &corev1.NodeAffinity{
+		RequiredDuringSchedulingIgnoredDuringExecution: &corev1.NodeSelector{
+			NodeSelectorTerms: []corev1.NodeSelectorTerm{hostnameTerm("vnode")},
+		},
+	}}
+	if err := v.CreatePod(context.Background(), pod); err != nil {
+		t.Fatal(err)
+	}
+
+	created, err := client.CoreV1().Pods("vk-default").Get(context.Background(), "pod", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(created.Spec.Tolerations) != 0 {
+		t.Fatalf("expected the virtual node toleration to be removed, got %v", created.Spec.Tolerations)
+	}
+	if created.Spec.Affinity != nil && created.Spec.Affinity.NodeAffinity != nil {
+		t.Fatalf("expected the virtual node affinity to be removed, got %+v", created.Spec.Affinity.NodeAffinity)
+	}
+	if pod.Spec.Affinity.NodeAffinity == nil || len(pod.Spec.Tolerations) != 1 {
+		t.Fatal("expected the master pod not to be modified")
+	}
+}
@@ -8,18 +8,26 @@ import (
 	"github.com/clusterrouter-io/clusterrouter/pkg/plugins"
 	"github.com/clusterrouter-io/clusterrouter/pkg/utils"
 	"github.com/clusterrouter-io/clusterrouter/pkg/utils/manager"
+	"github.com/clusterrouter-io/clusterrouter/pkg/utils/queue"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/labels"
 	kubeinformers "k8s.io/client-go/informers"
 	informerv1 "k8s.io/client-go/informers/core/v1"
 	"k8s.io/client-go/kubernetes"
 	v1 "k8s.io/client-go/listers/core/v1"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/remotecommand"
+	"k8s.io/client-go/util/workqueue"
 	"k8s.io/klog/v2"
 	"k8s.io/metrics/pkg/client/clientset/versioned"
+	"k8s.io/utils/clock"
+	"net/url"
 	"reflect"
 	"strings"
+	"sync"
+	"time"
 )
 
 // ClientConfig defines the configuration of a lower cluster
@@ -49,7 +57,27 @@ type VirtualK8S struct {
 	config               *rest.Config
 	nodeName             string
 	version              string
+	operatingSystem      string
+	architecture         string
+	region               string
+	zone                 string
+	nodeTaints           []corev1.Taint
+	taintKey             string
+	nodeLabels           map[string]string
+	nodeSelector         labels.Selector
+	excludeNodeKey       string
+	providerID           string
+	reservation          *common.Reservation
+	overcommit           common.OvercommitRatios
+	propagateTaints      bool
+	propagateSelector    bool
+	countBoundPods       bool
+	pressureThreshold    float64
+	namespaces           utils.NamespaceMapping
 	daemonPort           int32
+	pingTimeout          time.Duration
+	heartbeatTimeout     time.Duration
+	nodeStatusInterval   time.Duration
 	ignoreLabels         []string
 	clientCache          clientCache
 	rm                   *manager.ResourceManager
@@ -59,6 +87,23 @@ type VirtualK8S struct {
 	stopCh               <-chan struct{}
 	providerNode         *common.ProviderNode
 	configured           bool
+	// capacityCache caches the capacity aggregated over the client cluster
+	capacityCache capacityCache
+	usageHistory  usageHistory
+	pingMetrics   *pingMetrics
+	// clock is used for the periodic node status reports
+	clock clock.WithTicker
+	// newExecutor opens the streams of commands run in containers of the client cluster
+	newExecutor func(config *rest.Config, method string, url *url.URL) (remotecommand.Executor, error)
+	// dependentsQueue cleans up the configmaps and secrets copied for deleted pods, keyed by the client cluster
+	// namespace. pendingDependents holds the dependents of every namespace waiting to be cleaned up, it is protected by
+	// dependentsLock.
+	dependentsQueue   *queue.Queue
+	dependentsLock    sync.Mutex
+	pendingDependents map[string]podDependents
+	// pingLock protects version and clientPingErr, the results of the last ping of the client cluster
+	pingLock      sync.Mutex
+	clientPingErr error
 }
 
 // NewVirtualK8S reads a kubeconfig file and sets up a client to interact
@@ -107,6 +152,55 @@ func NewVirtualK8S(cfg plugins.InitConfig, cc *ClientConfig,
 	cmInformer := informer.Core().V1().ConfigMaps()
 	secretInformer := informer.Core().V1().Secrets()
 
+	operatingSystem := strings.ToLower(cfg.OperatingSystem)
+	if operatingSystem == "" {
+		operatingSystem = strings.ToLower(config.DefaultOperatingSystem)
+	}
+	architecture := opts.Architecture
+	if architecture == "" {
+		architecture = config.DefaultArchitecture
+	}
+
+	pingTimeout := opts.PingTimeout
+	if pingTimeout <= 0 {
+		pingTimeout = config.DefaultPingTimeout
+	}
+
+	nodeTaints, err := utils.ParseTaints(opts.NodeTaints)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse node taints: %v", err)
+	}
+
+	nodeSelector, err := labels.Parse(opts.NodeSelector)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse node selector: %v", err)
+	}
+
+	reservation, err := common.ParseReservation(opts.NodeReserved)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse node reservation: %v", err)
+	}
+
+	overcommit, err := common.ParseOvercommitRatios(opts.Overcommit)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse overcommit ratios: %v", err)
+	}
+
+	var nodeLabels map[string]string
+	if opts.NodeLabelsFile != "" {
+		if nodeLabels, err = loadNodeLabels(opts.NodeLabelsFile); err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.PressureThreshold < 0 || opts.PressureThreshold > 100 {
+		return nil, fmt.Errorf("pressure threshold %v must be between 0 and 100", opts.PressureThreshold)
+	}
+
+	if opts.ProviderID != "" && !validProviderID(opts.ProviderID) {
+		return nil, fmt.Errorf("provider ID %q must be of the form <scheme>://<id>", opts.ProviderID)
+	}
+
 	ctx := context.TODO()
 
 	virtualK8S := &VirtualK8S{
@@ -116,7 +210,28 @@ func NewVirtualK8S(cfg plugins.InitConfig, cc *ClientConfig,
 		nodeName:             cfg.NodeName,
 		ignoreLabels:         ignoreLabels,
 		version:              serverVersion.GitVersion,
+		operatingSystem:      operatingSystem,
+		architecture:         architecture,
+		region:               opts.Region,
+		zone:                 opts.Zone,
+		nodeTaints:           nodeTaints,
+		taintKey:             opts.TaintKey,
+		nodeLabels:           nodeLabels,
+		nodeSelector:         nodeSelector,
+		excludeNodeKey:       opts.ExcludeNodeKey,
+		providerID:           opts.ProviderID,
+		reservation:          reservation,
+		overcommit:           overcommit,
+		propagateTaints:      opts.PropagateTaints,
+		propagateSelector:    opts.PropagateNodeSelector,
+		countBoundPods:       opts.CountBoundPods,
+		pressureThreshold:    opts.PressureThreshold,
+		usageHistory:         usageHistory{window: opts.CapacityHysteresis},
+		namespaces:           utils.NewNamespaceMapping(opts.NamespacePrefix),
 		daemonPort:           cfg.DaemonPort,
+		pingTimeout:          pingTimeout,
+		heartbeatTimeout:     opts.NodeHeartbeatTimeout,
+		nodeStatusInterval:   opts.NodeStatusInterval,
 		config:               clientConfig,
 		enableServiceAccount: enableServiceAccount,
 		clientCache: clientCache{
@@ -130,9 +245,24 @@ func NewVirtualK8S(cfg plugins.InitConfig, cc *ClientConfig,
 		updatedNode:  make(chan *corev1.Node, 100),
 		updatedPod:   make(chan *corev1.Pod, 100000),
 		providerNode: &common.ProviderNode{},
+		pingMetrics:  newPingMetrics(),
+		clock:        clock.RealClock{},
+		newExecutor:  remotecommand.NewSPDYExecutor,
 		stopCh:       ctx.Done(),
 	}
 
+	virtualK8S.dependentsQueue = queue.New(workqueue.DefaultControllerRateLimiter(), "cleanupDependents",
+		virtualK8S.cleanupDependents)
+	virtualK8S.capacityCache.ttl = opts.CapacityCacheTTL
+	virtualK8S.capacityCache.clock = virtualK8S.clock
+
+	if virtualK8S.providerID != "" {
+		if err := virtualK8S.checkProviderIDUnique(ctx, cfg.NodeName); err != nil {
+			klog.Errorf("Not setting provider ID of node %s: %v", cfg.NodeName, err)
+			virtualK8S.providerID = ""
+		}
+	}
+
 	virtualK8S.buildNodeInformer(nodeInformer)
 	virtualK8S.buildPodInformer(podInformer)
 
@@ -143,6 +273,7 @@ func NewVirtualK8S(cfg plugins.InitConfig, cc *ClientConfig,
 		secretInformer.Informer().HasSynced) {
 		klog.Fatal("WaitForCacheSync failed")
 	}
+	virtualK8S.runEventReflector(ctx)
 	return virtualK8S, nil
 }
 
@@ -165,24 +296,29 @@ func (v *VirtualK8S) buildNodeInformer(nodeInformer informerv1.NodeInformer) {
 	nodeInformer.Informer().AddEventHandler(
 		cache.ResourceEventHandlerFuncs{
 			AddFunc: func(obj interface{}) {
-				if !v.configured {
+				v.capacityCache.invalidate()
+				if !v.isConfigured() {
 					return
 				}
-				nodeCopy := v.providerNode.DeepCopy()
 				addNode := obj.(*corev1.Node).DeepCopy()
-				toAdd := common.ConvertResource(addNode.Status.Capacity)
-				if err := v.providerNode.AddResource(toAdd); err != nil {
+				if !v.nodeIncluded(addNode) {
+					return
+				}
+				nodeCopy := v.providerNode.DeepCopy()
+				if err := v.providerNode.AddCapacity(v.nodeCapacity(addNode)); err != nil {
 					return
 				}
+				v.providerNode.AddResource(v.nodeAllocatable(addNode))
 				// resource we did not add when ConfigureNode should sub
 				v.providerNode.SubResource(v.getResourceFromPodsByNodeName(addNode.Name))
 				copy := v.providerNode.DeepCopy()
 				if !reflect.DeepEqual(nodeCopy, copy) {
-					v.updatedNode <- copy
+					v.notifyNodeUpdate(copy)
 				}
 			},
 			UpdateFunc: func(oldObj, newObj interface{}) {
-				if !v.configured {
+				v.capacityCache.invalidate()
+				if !v.isConfigured() {
 					return
 				}
 				old, ok1 := oldObj.(*corev1.Node)
@@ -192,24 +328,40 @@ func (v *VirtualK8S) buildNodeInformer(nodeInformer informerv1.NodeInformer) {
 				if !ok1 || !ok2 {
 					return
 				}
+				oldSelected := v.nodeIncluded(oldCopy)
+				newSelected := v.nodeIncluded(newCopy)
+				if !oldSelected && !newSelected {
+					return
+				}
+				// A node moving in or out of the selection is accounted for like it became (un)schedulable
+				oldCopy.Spec.Unschedulable = oldCopy.Spec.Unschedulable || !oldSelected
+				newCopy.Spec.Unschedulable = newCopy.Spec.Unschedulable || !newSelected
 				klog.V(5).Infof("Node %v updated", old.Name)
 				v.updateVKCapacityFromNode(oldCopy, newCopy)
 			},
 			DeleteFunc: func(obj interface{}) {
-				if !v.configured {
+				v.capacityCache.invalidate()
+				if !v.isConfigured() {
+					return
+				}
+				deleteNode, ok := obj.(*corev1.Node)
+				if !ok {
+					return
+				}
+				deleteNode = deleteNode.DeepCopy()
+				if !v.nodeIncluded(deleteNode) {
 					return
 				}
 				nodeCopy := v.providerNode.DeepCopy()
-				deleteNode := obj.(*corev1.Node).DeepCopy()
-				toRemove := common.ConvertResource(deleteNode.Status.Capacity)
-				if err := v.providerNode.SubResource(toRemove); err != nil {
+				if err := v.providerNode.SubCapacity(v.nodeCapacity(deleteNode)); err != nil {
 					return
 				}
+				v.providerNode.SubResource(v.nodeAllocatable(deleteNode))
 				// resource we did not add when ConfigureNode should add
 				v.providerNode.AddResource(v.getResourceFromPodsByNodeName(deleteNode.Name))
 				copy := v.providerNode.DeepCopy()
 				if !reflect.DeepEqual(nodeCopy, copy) {
-					v.updatedNode <- copy
+					v.notifyNodeUpdate(copy)
 				}
 			},
 		},
@@ -227,7 +379,8 @@ func (v *VirtualK8S) buildPodInformer(podInformer informerv1.PodInformer) {
 }
 
 func (v *VirtualK8S) addPod(obj interface{}) {
-	if !v.configured {
+	v.invalidatePodUsage(nil, obj)
+	if !v.isConfigured() {
 		return
 	}
 	pod, ok := obj.(*corev1.Pod)
@@ -242,7 +395,7 @@ func (v *VirtualK8S) addPod(obj interface{}) {
 		}
 		// Pod created only by lower cluster
 		// we should change the node resource
-		if len(podCopy.Spec.NodeName) != 0 {
+		if len(podCopy.Spec.NodeName) != 0 && v.nodeSelected(podCopy.Spec.NodeName) {
 			podResource := utils.GetRequestFromPod(podCopy)
 			podResource.Pods = resource.MustParse("1")
 			v.providerNode.SubResource(podResource)
@@ -252,7 +405,7 @@ func (v *VirtualK8S) addPod(obj interface{}) {
 				return
 			}
 			copy := v.providerNode.DeepCopy()
-			v.updatedNode <- copy
+			v.notifyNodeUpdate(copy)
 		}
 		return
 	}
@@ -260,7 +413,8 @@ func (v *VirtualK8S) addPod(obj interface{}) {
 }
 
 func (v *VirtualK8S) updatePod(oldObj, newObj interface{}) {
-	if !v.configured {
+	v.invalidatePodUsage(oldObj, newObj)
+	if !v.isConfigured() {
 		return
 	}
 	old, ok1 := oldObj.(*corev1.Pod)
@@ -292,7 +446,8 @@ func (v *VirtualK8S) updatePod(oldObj, newObj interface{}) {
 }
 
 func (v *VirtualK8S) deletePod(obj interface{}) {
-	if !v.configured {
+	v.invalidatePodUsage(obj, nil)
+	if !v.isConfigured() {
 		return
 	}
 	pod, ok := obj.(*corev1.Pod)
@@ -310,7 +465,7 @@ func (v *VirtualK8S) deletePod(obj interface{}) {
 		}
 		// Pod created only by lower cluster
 		// we should change the node resource
-		if len(podCopy.Spec.NodeName) != 0 {
+		if len(podCopy.Spec.NodeName) != 0 && v.nodeSelected(podCopy.Spec.NodeName) {
 			podResource := utils.GetRequestFromPod(podCopy)
 			podResource.Pods = resource.MustParse("1")
 			v.providerNode.AddResource(podResource)
@@ -320,34 +475,56 @@ func (v *VirtualK8S) deletePod(obj interface{}) {
 				return
 			}
 			copy := v.providerNode.DeepCopy()
-			v.updatedNode <- copy
+			v.notifyNodeUpdate(copy)
 		}
 		return
 	}
+	v.enqueueDependentsCleanup(podCopy)
 	v.updatedPod <- podCopy
 }
 
+// nodeSelected returns true if the client cluster node named nodeName is represented by the virtual node
+func (v *VirtualK8S) nodeSelected(nodeName string) bool {
+	if v.nodeSelector.Empty() && v.excludeNodeKey == "" {
+		return true
+	}
+	node, err := v.clientCache.nodeLister.Get(nodeName)
+	if err != nil {
+		return false
+	}
+	return v.nodeIncluded(node)
+}
+
+// nodeIncluded returns true if node is picked by the node selector, and not excluded by the exclusion label or
+// annotation
+func (v *VirtualK8S) nodeIncluded(node *corev1.Node) bool {
+	return v.capacityOptions().includes(node)
+}
+
 func (v *VirtualK8S) updateVKCapacityFromNode(old, new *corev1.Node) {
-	oldStatus, newStatus := compareNodeStatusReady(old, new)
+	oldStatus, newStatus := compareNodeStatusReady(old, new, v.heartbeatTimeout, v.clock.Now())
 	if !oldStatus && !newStatus {
 		return
 	}
-	toRemove := common.ConvertResource(old.Status.Capacity)
-	toAdd := common.ConvertResource(new.Status.Capacity)
+	toRemove, capacityToRemove := v.nodeAllocatable(old), v.nodeCapacity(old)
+	toAdd, capacityToAdd := v.nodeAllocatable(new), v.nodeCapacity(new)
 	nodeCopy := v.providerNode.DeepCopy()
 	if old.Spec.Unschedulable && !new.Spec.Unschedulable || newStatus && !oldStatus {
+		v.providerNode.AddCapacity(capacityToAdd)
 		v.providerNode.AddResource(toAdd)
 		v.providerNode.SubResource(v.getResourceFromPodsByNodeName(old.Name))
 	}
 	if !old.Spec.Unschedulable && new.Spec.Unschedulable || oldStatus && !newStatus {
 		v.providerNode.AddResource(v.getResourceFromPodsByNodeName(old.Name))
 		v.providerNode.SubResource(toRemove)
-
+		v.providerNode.SubCapacity(capacityToRemove)
 	}
 	if !reflect.DeepEqual(old.Status.Allocatable, new.Status.Allocatable) ||
 		!reflect.DeepEqual(old.Status.Capacity, new.Status.Capacity) {
 		klog.Infof("Start to update node resource, old: %v, new %v", old.Status.Capacity,
 			new.Status.Capacity)
+		v.providerNode.AddCapacity(capacityToAdd)
+		v.providerNode.SubCapacity(capacityToRemove)
 		v.providerNode.AddResource(toAdd)
 		v.providerNode.SubResource(toRemove)
 		klog.Infof("Current node resource, resource: %v, allocatable %v", v.providerNode.Status.Capacity,
@@ -358,11 +535,14 @@ func (v *VirtualK8S) updateVKCapacityFromNode(old, new *corev1.Node) {
 	}
 	copy := v.providerNode.DeepCopy()
 	if !reflect.DeepEqual(nodeCopy, copy) {
-		v.updatedNode <- copy
+		v.notifyNodeUpdate(copy)
 	}
 }
 
 func (v *VirtualK8S) updateVKCapacityFromPod(old, new *corev1.Pod) {
+	if new.Spec.NodeName != "" && !v.nodeSelected(new.Spec.NodeName) {
+		return
+	}
 	newResource := utils.GetRequestFromPod(new)
 	oldResource := utils.GetRequestFromPod(old)
 	// create pod
@@ -394,6 +574,6 @@ func (v *VirtualK8S) updateVKCapacityFromPod(old, new *corev1.Pod) {
 		return
 	}
 	copy := v.providerNode.DeepCopy()
-	v.updatedNode <- copy
+	v.notifyNodeUpdate(copy)
 	return
 }
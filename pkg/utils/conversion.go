@@ -8,6 +8,32 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
+// TranslateContainerStatuses maps the container statuses of the pod backing pod in a sub cluster onto the containers of
+// pod. Statuses are matched by container name and ordered like the containers of pod, with their state, reasons,
+// restart counts and image IDs preserved. Statuses of containers pod does not have, like sidecars injected in the sub
+// cluster, are dropped.
+func TranslateContainerStatuses(pod *corev1.Pod, status *corev1.PodStatus) {
+	status.InitContainerStatuses = containerStatusesFor(pod.Spec.InitContainers, status.InitContainerStatuses)
+	status.ContainerStatuses = containerStatusesFor(pod.Spec.Containers, status.ContainerStatuses)
+}
+
+func containerStatusesFor(containers []corev1.Container, statuses []corev1.ContainerStatus) []corev1.ContainerStatus {
+	if len(statuses) == 0 {
+		return statuses
+	}
+	byName := make(map[string]corev1.ContainerStatus, len(statuses))
+	for _, s := range statuses {
+		byName[s.Name] = s
+	}
+	translated := make([]corev1.ContainerStatus, 0, len(containers))
+	for _, c := range containers {
+		if s, ok := byName[c.Name]; ok {
+			translated = append(translated, s)
+		}
+	}
+	return translated
+}
+
 // TrimPod filter some fields that should not be contained when created in
 // subClusters for example: ownerReference, serviceLink and Uid
 // we should also add some fields back for scheduling.
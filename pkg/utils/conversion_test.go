@@ -0,0 +1,52 @@
+package utils
+
+import (
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestTranslateContainerStatuses(t *testing.T) {
+	pod := &corev1.Pod{Spec: corev1.PodSpec{
+		InitContainers: []corev1.Container{{Name: "init"}},
+		Containers:     []corev1.Container{{Name: "app"}, {Name: "web"}},
+	}}
+	pullBackOff := corev1.ContainerStatus{
+		Name:  "web",
+		Image: "web:latest",
+		State: corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{
+			Reason:  "ImagePullBackOff",
+			Message: `Back-off pulling image "web:latest"`,
+		}},
+	}
+	running := corev1.ContainerStatus{
+		Name:         "app",
+		Ready:        true,
+		RestartCount: 3,
+		ImageID:      "docker-pullable://app@sha256:1234",
+		State:        corev1.ContainerState{Running: &corev1.ContainerStateRunning{}},
+	}
+	initDone := corev1.ContainerStatus{
+		Name:  "init",
+		State: corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{Reason: "Completed"}},
+	}
+	status := &corev1.PodStatus{
+		InitContainerStatuses: []corev1.ContainerStatus{initDone},
+		// The statuses of the sub cluster are in a different order, and include an injected sidecar
+		ContainerStatuses: []corev1.ContainerStatus{pullBackOff, {Name: "sidecar", Ready: true}, running},
+	}
+
+	TranslateContainerStatuses(pod, status)
+
+	expected := []corev1.ContainerStatus{running, pullBackOff}
+	if !reflect.DeepEqual(status.ContainerStatuses, expected) {
+		t.Fatalf("expected the container statuses %+v, got %+v", expected, status.ContainerStatuses)
+	}
+	if !reflect.DeepEqual(status.InitContainerStatuses, []corev1.ContainerStatus{initDone}) {
+		t.Fatalf("expected the init container statuses %+v, got %+v", initDone, status.InitContainerStatuses)
+	}
+	if waiting := status.ContainerStatuses[1].State.Waiting; waiting == nil || waiting.Reason != "ImagePullBackOff" {
+		t.Fatalf("expected the reason ImagePullBackOff to surface on container web, got %+v", waiting)
+	}
+}
@@ -10,8 +10,8 @@ import (
 	"k8s.io/klog/v2"
 )
 
-// Ensure log.Logger is fully implemented during compile time.
-var _ log.Logger = (*adapter)(nil)
+// Ensure log.LeveledLogger is fully implemented during compile time.
+var _ log.LeveledLogger = (*adapter)(nil)
 
 type fieldMap struct {
 	log.Fields
@@ -46,6 +46,14 @@ func New(fields log.Fields) log.Logger {
 	}
 }
 
+// Enabled reports debug as enabled at klog verbosity 4 and above, every other level is always enabled.
+func (l *adapter) Enabled(level log.Level) bool {
+	if level == log.DebugLevel {
+		return klog.V(4).Enabled()
+	}
+	return true
+}
+
 func (l *adapter) Debug(args ...interface{}) {
 	if klog.V(4).Enabled() {
 		l.Info(args...)
@@ -0,0 +1,91 @@
+package klogv2
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"strings"
+	"testing"
+
+	"github.com/clusterrouter-io/clusterrouter/pkg/utils/log"
+	"k8s.io/klog/v2"
+)
+
+// captureKlog sends klog output at verbosity v to a buffer until the test finishes
+func captureKlog(t *testing.T, v string) *bytes.Buffer {
+	t.Helper()
+	fs := flag.NewFlagSet("klog", flag.ContinueOnError)
+	klog.InitFlags(fs)
+	for name, value := range map[string]string{"logtostderr": "false", "alsologtostderr": "false", "v": v} {
+		if err := fs.Set(name, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	buf := &bytes.Buffer{}
+	klog.SetOutput(buf)
+	t.Cleanup(func() {
+		_ = fs.Set("logtostderr", "true")
+		_ = fs.Set("v", "0")
+	})
+	return buf
+}
+
+func TestFields(t *testing.T) {
+	buf := captureKlog(t, "0")
+	l := New(nil).WithField("node", "node-1").WithFields(log.Fields{"pods": 3}).WithError(errors.New("failed"))
+	l.Infof("synced %s", "node")
+	klog.Flush()
+
+	out := buf.String()
+	if !strings.Contains(out, "synced node [err=failed node=node-1 pods=3]") {
+		t.Fatalf("expected the message followed by the sorted fields, got %q", out)
+	}
+	if !strings.HasPrefix(out, "I") {
+		t.Fatalf("expected an info line, got %q", out)
+	}
+}
+
+func TestWithFieldsDoesNotModifyParent(t *testing.T) {
+	buf := captureKlog(t, "0")
+	parent := New(log.Fields{"node": "node-1"})
+	parent.WithField("node", "node-2").Info("child")
+	parent.Info("parent")
+	klog.Flush()
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 lines, got %q", lines)
+	}
+	if !strings.HasSuffix(lines[0], "child [node=node-2]") || !strings.HasSuffix(lines[1], "parent [node=node-1]") {
+		t.Fatalf("expected the child field to override the parent only in the child, got %q", lines)
+	}
+}
+
+func TestDebug(t *testing.T) {
+	tests := []struct {
+		name      string
+		verbosity string
+		enabled   bool
+	}{
+		{name: "default verbosity", verbosity: "0", enabled: false},
+		{name: "verbosity 4", verbosity: "4", enabled: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf := captureKlog(t, tt.verbosity)
+			l := New(nil)
+			l.Debugf("debug %d", 1)
+			klog.Flush()
+
+			if logged := strings.Contains(buf.String(), "debug 1"); logged != tt.enabled {
+				t.Fatalf("expected debug to be logged %v, got %q", tt.enabled, buf.String())
+			}
+			if enabled := l.(log.LeveledLogger).Enabled(log.DebugLevel); enabled != tt.enabled {
+				t.Fatalf("expected debug enabled %v, got %v", tt.enabled, enabled)
+			}
+			if !l.(log.LeveledLogger).Enabled(log.InfoLevel) {
+				t.Fatal("expected info to always be enabled")
+			}
+		})
+	}
+}
@@ -0,0 +1,47 @@
+package log
+
+import (
+	"context"
+)
+
+// Level is the severity of a log message
+type Level int
+
+// Levels supported by Logger, from least to most severe
+const (
+	DebugLevel Level = iota
+	InfoLevel
+	WarnLevel
+	ErrorLevel
+	FatalLevel
+)
+
+// LeveledLogger is a Logger which reports whether messages of a level are logged at all, so callers can skip building
+// messages which would be dropped. Implementing it is optional.
+type LeveledLogger interface {
+	Logger
+	Enabled(Level) bool
+}
+
+// Enabled returns true if the logger of ctx logs messages of level. Loggers which do not implement LeveledLogger are
+// assumed to log every level.
+func Enabled(ctx context.Context, level Level) bool {
+	if l, ok := GetLogger(ctx).(LeveledLogger); ok {
+		return l.Enabled(level)
+	}
+	return true
+}
+
+// Debug logs args at debug level with the logger of ctx, if debug logging is enabled.
+func Debug(ctx context.Context, args ...interface{}) {
+	if Enabled(ctx, DebugLevel) {
+		GetLogger(ctx).Debug(args...)
+	}
+}
+
+// Debugf formats and logs a message at debug level with the logger of ctx, if debug logging is enabled.
+func Debugf(ctx context.Context, format string, args ...interface{}) {
+	if Enabled(ctx, DebugLevel) {
+		GetLogger(ctx).Debugf(format, args...)
+	}
+}
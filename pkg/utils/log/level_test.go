@@ -0,0 +1,81 @@
+package log
+
+import (
+	"context"
+	"fmt"
+	"testing"
+)
+
+// recordingLogger keeps the messages logged at debug level, and logs debug messages only if debug is set
+type recordingLogger struct {
+	nopLogger
+	debug    bool
+	messages []string
+}
+
+func (l *recordingLogger) Enabled(level Level) bool {
+	return level != DebugLevel || l.debug
+}
+
+func (l *recordingLogger) Debug(args ...interface{}) {
+	l.messages = append(l.messages, fmt.Sprint(args...))
+}
+
+func (l *recordingLogger) Debugf(format string, args ...interface{}) {
+	l.messages = append(l.messages, fmt.Sprintf(format, args...))
+}
+
+// sprintfLogger is a Logger which does not implement LeveledLogger, and formats every debug message. Embedding the
+// Logger interface hides the Enabled method of nopLogger.
+type sprintfLogger struct {
+	Logger
+	last string
+}
+
+func (l *sprintfLogger) Debugf(format string, args ...interface{}) {
+	l.last = fmt.Sprintf(format, args...)
+}
+
+func TestDebug(t *testing.T) {
+	for _, debug := range []bool{true, false} {
+		l := &recordingLogger{debug: debug}
+		ctx := WithLogger(context.Background(), l)
+		if Enabled(ctx, DebugLevel) != debug {
+			t.Fatalf("expected debug to be enabled: %t", debug)
+		}
+		Debug(ctx, "got item")
+		Debugf(ctx, "processed %s", "key")
+		if want := 2; debug && len(l.messages) != want || !debug && len(l.messages) != 0 {
+			t.Fatalf("expected debug messages to be logged only if enabled (%t), got %v", debug, l.messages)
+		}
+	}
+}
+
+func TestEnabledNotLeveled(t *testing.T) {
+	ctx := WithLogger(context.Background(), &sprintfLogger{Logger: nopLogger{}})
+	if !Enabled(ctx, DebugLevel) {
+		t.Fatal("expected loggers which do not implement LeveledLogger to log every level")
+	}
+}
+
+func BenchmarkDebugf(b *testing.B) {
+	benchmarks := []struct {
+		name   string
+		logger Logger
+	}{
+		// Debug is disabled, the message is never formatted
+		{name: "disabled", logger: &recordingLogger{}},
+		// The logger does not tell whether debug is enabled, so every message is formatted
+		{name: "not leveled", logger: &sprintfLogger{Logger: nopLogger{}}},
+	}
+	for _, bm := range benchmarks {
+		b.Run(bm.name, func(b *testing.B) {
+			ctx := WithLogger(context.Background(), bm.logger)
+			key := "namespace/name"
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				Debugf(ctx, "processed %s after %d requeues", key, i)
+			}
+		})
+	}
+}
@@ -9,8 +9,8 @@ var (
 	G = GetLogger
 
 	// L is the default logger. It should be initialized before using `G` or `GetLogger`
-	// If L is uninitialized and no logger is available in a provided context, a
-	// panic will occur.
+	// If L is uninitialized and no logger is available in a provided context, logs are
+	// discarded, or MustGetLogger panics.
 	L Logger = nopLogger{}
 )
 
@@ -45,16 +45,26 @@ func WithLogger(ctx context.Context, logger Logger) context.Context {
 }
 
 // GetLogger retrieves the current logger from the context. If no logger is
-// available, the default logger is returned.
+// available, the default logger is returned, or a logger discarding all logs
+// if the default logger is not initialized.
 func GetLogger(ctx context.Context) Logger {
 	logger := ctx.Value(loggerKey{})
 
 	if logger == nil {
 		if L == nil {
-			panic("default logger not initialized")
+			return nopLogger{}
 		}
 		return L
 	}
 
 	return logger.(Logger)
 }
+
+// MustGetLogger is like GetLogger, but panics if neither the context nor the
+// default logger is initialized.
+func MustGetLogger(ctx context.Context) Logger {
+	if ctx.Value(loggerKey{}) == nil && L == nil {
+		panic("default logger not initialized")
+	}
+	return GetLogger(ctx)
+}
@@ -0,0 +1,65 @@
+package log
+
+import (
+	"context"
+	"testing"
+)
+
+// withDefaultLogger sets L for the duration of the test
+func withDefaultLogger(t *testing.T, l Logger) {
+	t.Helper()
+	old := L
+	L = l
+	t.Cleanup(func() { L = old })
+}
+
+func TestGetLogger(t *testing.T) {
+	ctxLogger := &recordingLogger{}
+	defaultLogger := &recordingLogger{}
+	withCtxLogger := WithLogger(context.Background(), ctxLogger)
+	tests := []struct {
+		name          string
+		ctx           context.Context
+		defaultLogger Logger
+		expected      Logger
+	}{
+		{name: "context logger", ctx: withCtxLogger, defaultLogger: defaultLogger, expected: ctxLogger},
+		{name: "default logger", ctx: context.Background(), defaultLogger: defaultLogger, expected: defaultLogger},
+		{name: "context logger without default", ctx: withCtxLogger, expected: ctxLogger},
+		{name: "no logger", ctx: context.Background(), expected: nopLogger{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withDefaultLogger(t, tt.defaultLogger)
+			if l := GetLogger(tt.ctx); l != tt.expected {
+				t.Fatalf("expected %#v, got %#v", tt.expected, l)
+			}
+		})
+	}
+}
+
+func TestGetLoggerWithoutDefault(t *testing.T) {
+	withDefaultLogger(t, nil)
+	l := GetLogger(context.Background())
+	if l == nil {
+		t.Fatal("expected a logger")
+	}
+	// The no-op logger must be usable, including loggers derived from it
+	l.WithField("key", "value").WithFields(Fields{"other": 1}).WithError(nil).Infof("discarded %d", 1)
+	l.Debug("discarded")
+}
+
+func TestMustGetLogger(t *testing.T) {
+	ctxLogger := &recordingLogger{}
+	withDefaultLogger(t, nil)
+	if l := MustGetLogger(WithLogger(context.Background(), ctxLogger)); l != ctxLogger {
+		t.Fatalf("expected the context logger, got %#v", l)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected MustGetLogger to panic without a logger")
+		}
+	}()
+	MustGetLogger(context.Background())
+}
@@ -0,0 +1,117 @@
+package logr
+
+import (
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/clusterrouter-io/clusterrouter/pkg/utils/log"
+	"github.com/go-logr/logr"
+)
+
+// debugLevel is the logr verbosity Debug messages are logged at
+const debugLevel = 1
+
+// Ensure log.LeveledLogger is fully implemented during compile time.
+var _ log.LeveledLogger = (*adapter)(nil)
+
+// adapter implements the `log.Logger` interface for logr
+type adapter struct {
+	logger logr.Logger
+	// err is set by WithError, it is passed to logr.Logger.Error and attached to other messages as a value
+	err error
+}
+
+// FromLogr creates a new `log.Logger` from the provided logr.Logger
+//
+// Debug is logged at V(1), Warn is logged as info with a "level" value of "warn", and Fatal is logged as an error
+// before exiting.
+func FromLogr(logger logr.Logger) log.Logger {
+	return &adapter{logger: logger}
+}
+
+// Enabled returns true if the logr sink logs messages of level, debug is checked at V(1).
+func (l *adapter) Enabled(level log.Level) bool {
+	if level == log.DebugLevel {
+		return l.logger.V(debugLevel).Enabled()
+	}
+	return l.logger.Enabled()
+}
+
+func (l *adapter) info(logger logr.Logger, msg string) {
+	if l.err != nil {
+		logger = logger.WithValues("error", l.err)
+	}
+	logger.Info(msg)
+}
+
+func (l *adapter) Debug(args ...interface{}) {
+	if l.logger.V(debugLevel).Enabled() {
+		l.info(l.logger.V(debugLevel), fmt.Sprint(args...))
+	}
+}
+
+func (l *adapter) Debugf(format string, args ...interface{}) {
+	if l.logger.V(debugLevel).Enabled() {
+		l.info(l.logger.V(debugLevel), fmt.Sprintf(format, args...))
+	}
+}
+
+func (l *adapter) Info(args ...interface{}) {
+	l.info(l.logger, fmt.Sprint(args...))
+}
+
+func (l *adapter) Infof(format string, args ...interface{}) {
+	l.info(l.logger, fmt.Sprintf(format, args...))
+}
+
+func (l *adapter) Warn(args ...interface{}) {
+	l.info(l.logger.WithValues("level", "warn"), fmt.Sprint(args...))
+}
+
+func (l *adapter) Warnf(format string, args ...interface{}) {
+	l.info(l.logger.WithValues("level", "warn"), fmt.Sprintf(format, args...))
+}
+
+func (l *adapter) Error(args ...interface{}) {
+	l.logger.Error(l.err, fmt.Sprint(args...))
+}
+
+func (l *adapter) Errorf(format string, args ...interface{}) {
+	l.logger.Error(l.err, fmt.Sprintf(format, args...))
+}
+
+func (l *adapter) Fatal(args ...interface{}) {
+	l.logger.Error(l.err, fmt.Sprint(args...))
+	os.Exit(1)
+}
+
+func (l *adapter) Fatalf(format string, args ...interface{}) {
+	l.logger.Error(l.err, fmt.Sprintf(format, args...))
+	os.Exit(1)
+}
+
+// WithField adds a field to the log entry.
+func (l *adapter) WithField(key string, val interface{}) log.Logger {
+	return &adapter{logger: l.logger.WithValues(key, val), err: l.err}
+}
+
+// WithFields adds multiple fields to a log entry.
+func (l *adapter) WithFields(fields log.Fields) log.Logger {
+	// Order fields lexically, so the output is stable.
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	keysAndValues := make([]interface{}, 0, 2*len(keys))
+	for _, k := range keys {
+		keysAndValues = append(keysAndValues, k, fields[k])
+	}
+	return &adapter{logger: l.logger.WithValues(keysAndValues...), err: l.err}
+}
+
+// WithError adds an error to the log entry
+func (l *adapter) WithError(err error) log.Logger {
+	return &adapter{logger: l.logger, err: err}
+}
@@ -0,0 +1,93 @@
+package logr
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/clusterrouter-io/clusterrouter/pkg/utils/log"
+	"github.com/go-logr/logr"
+)
+
+// entry is a message logged to a recordingSink
+type entry struct {
+	level         int
+	msg           string
+	err           error
+	keysAndValues []interface{}
+}
+
+// recordingSink is a logr.LogSink which records the messages logged to it, up to verbosity
+type recordingSink struct {
+	verbosity int
+	values    []interface{}
+	entries   *[]entry
+}
+
+func (s *recordingSink) Init(logr.RuntimeInfo) {}
+
+func (s *recordingSink) Enabled(level int) bool { return level <= s.verbosity }
+
+func (s *recordingSink) Info(level int, msg string, keysAndValues ...interface{}) {
+	*s.entries = append(*s.entries, entry{level: level, msg: msg, keysAndValues: s.with(keysAndValues)})
+}
+
+func (s *recordingSink) Error(err error, msg string, keysAndValues ...interface{}) {
+	*s.entries = append(*s.entries, entry{msg: msg, err: err, keysAndValues: s.with(keysAndValues)})
+}
+
+func (s *recordingSink) WithValues(keysAndValues ...interface{}) logr.LogSink {
+	return &recordingSink{verbosity: s.verbosity, values: s.with(keysAndValues), entries: s.entries}
+}
+
+// with returns the values of the sink followed by keysAndValues, in a new slice
+func (s *recordingSink) with(keysAndValues []interface{}) []interface{} {
+	if len(s.values)+len(keysAndValues) == 0 {
+		return nil
+	}
+	return append(append([]interface{}{}, s.values...), keysAndValues...)
+}
+
+func (s *recordingSink) WithName(string) logr.LogSink { return s }
+
+func newRecordingLogger(verbosity int) (log.Logger, *[]entry) {
+	entries := &[]entry{}
+	return FromLogr(logr.New(&recordingSink{verbosity: verbosity, entries: entries})), entries
+}
+
+func TestAdapter(t *testing.T) {
+	logger, entries := newRecordingLogger(0)
+	errFailed := errors.New("failed")
+	fields := logger.WithFields(log.Fields{"b": 2, "a": 1}).WithField("key", "ns/name")
+
+	fields.Infof("processed %d items", 3)
+	fields.WithError(errFailed).Warn("retrying")
+	fields.WithError(errFailed).Error("giving up")
+	fields.Debug("not logged at verbosity 0")
+
+	want := []entry{
+		{msg: "processed 3 items", keysAndValues: []interface{}{"a", 1, "b", 2, "key", "ns/name"}},
+		{msg: "retrying", keysAndValues: []interface{}{"a", 1, "b", 2, "key", "ns/name", "level", "warn", "error",
+			errFailed}},
+		{msg: "giving up", err: errFailed, keysAndValues: []interface{}{"a", 1, "b", 2, "key", "ns/name"}},
+	}
+	if !reflect.DeepEqual(*entries, want) {
+		t.Fatalf("expected entries %+v, got %+v", want, *entries)
+	}
+}
+
+func TestAdapterDebug(t *testing.T) {
+	logger, entries := newRecordingLogger(debugLevel)
+	if !logger.(log.LeveledLogger).Enabled(log.DebugLevel) {
+		t.Fatal("expected debug to be enabled at verbosity 1")
+	}
+	logger.Debugf("item %s", "a")
+	if want := []entry{{level: debugLevel, msg: "item a"}}; !reflect.DeepEqual(*entries, want) {
+		t.Fatalf("expected entries %+v, got %+v", want, *entries)
+	}
+
+	quiet, _ := newRecordingLogger(0)
+	if quiet.(log.LeveledLogger).Enabled(log.DebugLevel) {
+		t.Fatal("expected debug to be disabled at verbosity 0")
+	}
+}
@@ -5,8 +5,8 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
-// Ensure log.Logger is fully implemented during compile time.
-var _ log.Logger = (*adapter)(nil)
+// Ensure log.LeveledLogger is fully implemented during compile time.
+var _ log.LeveledLogger = (*adapter)(nil)
 
 // adapter implements the `log.Logger` interface for logrus
 type adapter struct {
@@ -18,6 +18,24 @@ func FromLogrus(entry *logrus.Entry) log.Logger {
 	return &adapter{entry}
 }
 
+// Enabled returns true if the logrus logger logs messages of level.
+func (l *adapter) Enabled(level log.Level) bool {
+	var lvl logrus.Level
+	switch level {
+	case log.DebugLevel:
+		lvl = logrus.DebugLevel
+	case log.InfoLevel:
+		lvl = logrus.InfoLevel
+	case log.WarnLevel:
+		lvl = logrus.WarnLevel
+	case log.ErrorLevel:
+		lvl = logrus.ErrorLevel
+	default:
+		lvl = logrus.FatalLevel
+	}
+	return l.Entry.Logger.IsLevelEnabled(lvl)
+}
+
 // WithField adds a field to the log entry.
 func (l *adapter) WithField(key string, val interface{}) log.Logger {
 	return FromLogrus(l.Entry.WithField(key, val))
@@ -13,6 +13,8 @@ func (nopLogger) Errorf(string, ...interface{}) {}
 func (nopLogger) Fatal(...interface{})          {}
 func (nopLogger) Fatalf(string, ...interface{}) {}
 
+func (nopLogger) Enabled(Level) bool { return false }
+
 func (l nopLogger) WithField(string, interface{}) Logger { return l }
 func (l nopLogger) WithFields(Fields) Logger             { return l }
 func (l nopLogger) WithError(error) Logger               { return l }
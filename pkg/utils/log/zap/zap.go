@@ -0,0 +1,66 @@
+package zap
+
+import (
+	"sort"
+
+	"github.com/clusterrouter-io/clusterrouter/pkg/utils/log"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// Ensure log.LeveledLogger is fully implemented during compile time.
+var _ log.LeveledLogger = (*adapter)(nil)
+
+// adapter implements the `log.Logger` interface for zap
+type adapter struct {
+	*zap.SugaredLogger
+}
+
+// FromZap creates a new `log.Logger` from the provided zap logger
+func FromZap(logger *zap.Logger) log.Logger {
+	// Skip the adapter's own frame, so the caller of the log.Logger is reported.
+	return &adapter{logger.WithOptions(zap.AddCallerSkip(1)).Sugar()}
+}
+
+// Enabled returns true if the zap core logs messages of level.
+func (l *adapter) Enabled(level log.Level) bool {
+	var lvl zapcore.Level
+	switch level {
+	case log.DebugLevel:
+		lvl = zapcore.DebugLevel
+	case log.InfoLevel:
+		lvl = zapcore.InfoLevel
+	case log.WarnLevel:
+		lvl = zapcore.WarnLevel
+	case log.ErrorLevel:
+		lvl = zapcore.ErrorLevel
+	default:
+		lvl = zapcore.FatalLevel
+	}
+	return l.SugaredLogger.Desugar().Core().Enabled(lvl)
+}
+
+// WithField adds a field to the log entry.
+func (l *adapter) WithField(key string, val interface{}) log.Logger {
+	return &adapter{l.SugaredLogger.With(key, val)}
+}
+
+// WithFields adds multiple fields to a log entry.
+func (l *adapter) WithFields(fields log.Fields) log.Logger {
+	// Order fields lexically, so the output is stable.
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	keysAndValues := make([]interface{}, 0, 2*len(keys))
+	for _, k := range keys {
+		keysAndValues = append(keysAndValues, k, fields[k])
+	}
+	return &adapter{l.SugaredLogger.With(keysAndValues...)}
+}
+
+// WithError adds an error to the log entry
+func (l *adapter) WithError(err error) log.Logger {
+	return &adapter{l.SugaredLogger.With(zap.Error(err))}
+}
@@ -0,0 +1,56 @@
+package zap
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/clusterrouter-io/clusterrouter/pkg/utils/log"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestAdapter(t *testing.T) {
+	core, logs := observer.New(zapcore.InfoLevel)
+	logger := FromZap(zap.New(core))
+	fields := logger.WithFields(log.Fields{"b": 2, "a": 1}).WithField("key", "ns/name")
+
+	fields.Infof("processed %d items", 3)
+	fields.WithError(errors.New("failed")).Warn("retrying")
+	fields.Debug("not logged at info level")
+
+	entries := logs.AllUntimed()
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 entries, got %d", len(entries))
+	}
+	tests := []struct {
+		level  zapcore.Level
+		msg    string
+		fields map[string]interface{}
+	}{
+		{level: zapcore.InfoLevel, msg: "processed 3 items",
+			fields: map[string]interface{}{"a": int64(1), "b": int64(2), "key": "ns/name"}},
+		{level: zapcore.WarnLevel, msg: "retrying",
+			fields: map[string]interface{}{"a": int64(1), "b": int64(2), "key": "ns/name", "error": "failed"}},
+	}
+	for i, want := range tests {
+		got := entries[i]
+		if got.Level != want.level || got.Message != want.msg {
+			t.Fatalf("expected %s entry %q, got %s entry %q", want.level, want.msg, got.Level, got.Message)
+		}
+		if fields := got.ContextMap(); !reflect.DeepEqual(fields, want.fields) {
+			t.Fatalf("expected fields %v, got %v", want.fields, fields)
+		}
+	}
+}
+
+func TestAdapterEnabled(t *testing.T) {
+	core, _ := observer.New(zapcore.InfoLevel)
+	logger := FromZap(zap.New(core)).(log.LeveledLogger)
+	for level, want := range map[log.Level]bool{log.DebugLevel: false, log.InfoLevel: true, log.ErrorLevel: true} {
+		if got := logger.Enabled(level); got != want {
+			t.Fatalf("expected level %d to be enabled: %t, got %t", level, want, got)
+		}
+	}
+}
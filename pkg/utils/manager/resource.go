@@ -51,3 +51,8 @@ func (rm *ResourceManager) GetSecret(name, namespace string) (*v1.Secret, error)
 func (rm *ResourceManager) ListServices() ([]*v1.Service, error) {
 	return rm.serviceLister.List(labels.Everything())
 }
+
+// GetPod retrieves the specified pod from the cache.
+func (rm *ResourceManager) GetPod(name, namespace string) (*v1.Pod, error) {
+	return rm.podLister.Pods(namespace).Get(name)
+}
@@ -0,0 +1,30 @@
+package utils
+
+import (
+	"strings"
+)
+
+// NamespaceMapping maps the namespaces of the master cluster to the namespaces of the client cluster pods, and the
+// objects they depend on, are created in. The zero value maps every namespace to itself.
+type NamespaceMapping struct {
+	prefix string
+}
+
+// NewNamespaceMapping returns a NamespaceMapping which prepends prefix to the namespaces of the master cluster
+func NewNamespaceMapping(prefix string) NamespaceMapping {
+	return NamespaceMapping{prefix: prefix}
+}
+
+// ToClient returns the namespace in the client cluster which objects of namespace in the master cluster are created in
+func (m NamespaceMapping) ToClient(namespace string) string {
+	return m.prefix + namespace
+}
+
+// ToMaster returns the namespace in the master cluster which namespace in the client cluster maps to. It returns false
+// if namespace is not mapped from the master cluster.
+func (m NamespaceMapping) ToMaster(namespace string) (string, bool) {
+	if !strings.HasPrefix(namespace, m.prefix) || len(namespace) == len(m.prefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(namespace, m.prefix), true
+}
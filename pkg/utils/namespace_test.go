@@ -0,0 +1,35 @@
+package utils
+
+import "testing"
+
+func TestNamespaceMapping(t *testing.T) {
+	tests := []struct {
+		name             string
+		prefix           string
+		master           string
+		client           string
+		expectedMaster   string
+		expectedMapped   bool
+		expectedToClient string
+	}{
+		{name: "prefixed", prefix: "vk-", master: "default", client: "vk-default", expectedMaster: "default",
+			expectedMapped: true, expectedToClient: "vk-default"},
+		{name: "not mapped", prefix: "vk-", master: "default", client: "default", expectedToClient: "vk-default"},
+		{name: "only the prefix", prefix: "vk-", master: "default", client: "vk-", expectedToClient: "vk-default"},
+		{name: "no prefix", master: "default", client: "default", expectedMaster: "default", expectedMapped: true,
+			expectedToClient: "default"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := NewNamespaceMapping(tt.prefix)
+			if client := m.ToClient(tt.master); client != tt.expectedToClient {
+				t.Fatalf("expected %s to map to %s, got %s", tt.master, tt.expectedToClient, client)
+			}
+			master, mapped := m.ToMaster(tt.client)
+			if master != tt.expectedMaster || mapped != tt.expectedMapped {
+				t.Fatalf("expected %s to map back to %q %v, got %q %v", tt.client, tt.expectedMaster,
+					tt.expectedMapped, master, mapped)
+			}
+		})
+	}
+}
@@ -56,16 +56,9 @@ func GetTaint(o *config.Opts) (*corev1.Taint, error) {
 		o.TaintValue = o.Provider
 	}
 
-	var effect corev1.TaintEffect
-	switch o.TaintEffect {
-	case "NoSchedule":
-		effect = corev1.TaintEffectNoSchedule
-	case "NoExecute":
-		effect = corev1.TaintEffectNoExecute
-	case "PreferNoSchedule":
-		effect = corev1.TaintEffectPreferNoSchedule
-	default:
-		return nil, errdefs.InvalidInputf("taint effect %q is not supported", o.TaintEffect)
+	effect, err := parseTaintEffect(o.TaintEffect)
+	if err != nil {
+		return nil, err
 	}
 
 	return &corev1.Taint{
@@ -74,3 +67,48 @@ func GetTaint(o *config.Opts) (*corev1.Taint, error) {
 		Effect: effect,
 	}, nil
 }
+
+// ParseTaints parses a comma separated list of taints, each of the form key=value:Effect or key:Effect.
+func ParseTaints(spec string) ([]corev1.Taint, error) {
+	var taints []corev1.Taint
+	for _, t := range strings.Split(spec, ",") {
+		t = strings.TrimSpace(t)
+		if t == "" {
+			continue
+		}
+		idx := strings.LastIndex(t, ":")
+		if idx <= 0 {
+			return nil, errdefs.InvalidInputf("taint %q must be of the form key=value:Effect", t)
+		}
+		effect, err := parseTaintEffect(t[idx+1:])
+		if err != nil {
+			return nil, err
+		}
+		key, value := t[:idx], ""
+		if i := strings.Index(key, "="); i >= 0 {
+			key, value = key[:i], key[i+1:]
+		}
+		if key == "" {
+			return nil, errdefs.InvalidInputf("taint %q has an empty key", t)
+		}
+		taints = append(taints, corev1.Taint{
+			Key:    key,
+			Value:  value,
+			Effect: effect,
+		})
+	}
+	return taints, nil
+}
+
+func parseTaintEffect(effect string) (corev1.TaintEffect, error) {
+	switch effect {
+	case "NoSchedule":
+		return corev1.TaintEffectNoSchedule, nil
+	case "NoExecute":
+		return corev1.TaintEffectNoExecute, nil
+	case "PreferNoSchedule":
+		return corev1.TaintEffectPreferNoSchedule, nil
+	default:
+		return "", errdefs.InvalidInputf("taint effect %q is not supported", effect)
+	}
+}
@@ -0,0 +1,46 @@
+package utils
+
+import (
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestParseTaints(t *testing.T) {
+	tests := []struct {
+		name    string
+		spec    string
+		want    []corev1.Taint
+		wantErr bool
+	}{
+		{name: "empty", spec: ""},
+		{
+			name: "key and value",
+			spec: "gpu=nvidia:NoSchedule",
+			want: []corev1.Taint{{Key: "gpu", Value: "nvidia", Effect: corev1.TaintEffectNoSchedule}},
+		},
+		{
+			name: "list without values",
+			spec: "dedicated:NoExecute, example.com/spot:PreferNoSchedule,",
+			want: []corev1.Taint{
+				{Key: "dedicated", Effect: corev1.TaintEffectNoExecute},
+				{Key: "example.com/spot", Effect: corev1.TaintEffectPreferNoSchedule},
+			},
+		},
+		{name: "missing effect", spec: "gpu=nvidia", wantErr: true},
+		{name: "unknown effect", spec: "gpu=nvidia:Never", wantErr: true},
+		{name: "empty key", spec: "=nvidia:NoSchedule", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseTaints(tt.spec)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("expected error %t, got %v", tt.wantErr, err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("expected taints %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
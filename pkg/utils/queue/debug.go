@@ -0,0 +1,48 @@
+package queue
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// debugState is the state of a queue served by DebugHandler
+type debugState struct {
+	Stats          QueueStats `json:"stats"`
+	Keys           []string   `json:"keys"`
+	ProcessingKeys []string   `json:"processingKeys"`
+	Paused         bool       `json:"paused"`
+	Running        bool       `json:"running"`
+	// Inconsistency describes how the internal state of the queue is inconsistent, it is empty if it is consistent
+	Inconsistency string `json:"inconsistency,omitempty"`
+}
+
+// DebugHandler returns a read-only http.Handler serving the stats, the waiting keys in the order they are planned to
+// be processed, and the keys being processed as JSON. It is not served by the queue on its own, consumers can mount it
+// on their debug endpoints.
+//
+// It should only be used for debugging, since it walks all items of the queue.
+func (q *Queue) DebugHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		state := debugState{
+			Stats:          q.Stats(),
+			Keys:           q.Keys(),
+			ProcessingKeys: q.ProcessingKeys(),
+		}
+		q.lock.Lock()
+		state.Paused = q.paused
+		state.Running = q.running
+		if err := q.checkInvariants(); err != nil {
+			state.Inconsistency = err.Error()
+		}
+		q.lock.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(state)
+	})
+}
@@ -0,0 +1,70 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDebugHandler(t *testing.T) {
+	q, fakeClock := newFakeClockQueue(t)
+	ctx := context.Background()
+	for _, key := range []string{"processing", "a", "b"} {
+		if err := q.EnqueueWithoutRateLimit(ctx, key); err != nil {
+			t.Fatal(err)
+		}
+		fakeClock.Step(time.Second)
+	}
+	nextKeys(t, q, 1)
+	q.Pause()
+	srv := httptest.NewServer(q.DebugHandler())
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/json" {
+		t.Fatalf("expected a JSON response, got %s of %s", resp.Status, resp.Header.Get("Content-Type"))
+	}
+	var state map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&state); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{
+		"stats": map[string]interface{}{
+			"name":                     t.Name(),
+			"pending":                  float64(2),
+			"processing":               float64(1),
+			"oldestPendingAge":         float64(2 * time.Second),
+			"totalRequeuesOutstanding": float64(0),
+		},
+		"keys":           []interface{}{"a", "b"},
+		"processingKeys": []interface{}{"processing"},
+		"paused":         true,
+		"running":        false,
+	}
+	if !reflect.DeepEqual(state, expected) {
+		t.Fatalf("expected the debug state %v, got %v", expected, state)
+	}
+}
+
+func TestDebugHandlerReadOnly(t *testing.T) {
+	q, _ := newFakeClockQueue(t)
+	srv := httptest.NewServer(q.DebugHandler())
+	defer srv.Close()
+
+	resp, err := http.Post(srv.URL, "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed || resp.Header.Get("Allow") != "GET, HEAD" {
+		t.Fatalf("expected the method not to be allowed, got %s allowing %q", resp.Status, resp.Header.Get("Allow"))
+	}
+}
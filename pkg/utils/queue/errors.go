@@ -0,0 +1,80 @@
+package queue
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrQueueFull is returned when enqueueing a new key into a bounded queue which is full
+var ErrQueueFull = errors.New("queue is full")
+
+// ErrAlreadyRunning is returned by RunE when the queue is already running
+var ErrAlreadyRunning = errors.New("queue is already running")
+
+// PermanentError is an error interface which denotes that a handler failed in a way
+// which will not be fixed by retrying the key.
+type PermanentError interface {
+	Permanent() bool
+	error
+}
+
+// causal is an error interface for errors which have wrapped another error
+// in a non-opaque way.
+//
+// This pattern is used by github.com/pkg/errors
+type causal interface {
+	Cause() error
+	error
+}
+
+type permanentError struct {
+	error
+}
+
+func (e *permanentError) Permanent() bool {
+	return true
+}
+
+func (e *permanentError) Cause() error {
+	return e.error
+}
+
+// AsPermanent wraps the passed in error to make it of type PermanentError
+//
+// Handlers returning a PermanentError have their key forgotten straight away,
+// instead of being requeued until MaxRetries is reached.
+func AsPermanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &permanentError{err}
+}
+
+// Permanent makes a PermanentError from the provided error message
+func Permanent(msg string) error {
+	return &permanentError{errors.New(msg)}
+}
+
+// Permanentf makes a PermanentError from the provided error format and args
+func Permanentf(format string, args ...interface{}) error {
+	return &permanentError{fmt.Errorf(format, args...)}
+}
+
+// IsPermanent determines if the passed in error is of type PermanentError
+//
+// This will traverse the causal chain (`Cause() error`), until it finds an error
+// which implements the `Permanent` interface.
+func IsPermanent(err error) bool {
+	if err == nil {
+		return false
+	}
+	if e, ok := err.(PermanentError); ok {
+		return e.Permanent()
+	}
+
+	if e, ok := err.(causal); ok {
+		return IsPermanent(e.Cause())
+	}
+
+	return false
+}
@@ -0,0 +1,33 @@
+package queue
+
+import (
+	"errors"
+	"testing"
+
+	pkgerrors "github.com/pkg/errors"
+)
+
+func TestIsPermanent(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "nil", err: nil, want: false},
+		{name: "plain error", err: errors.New("connection refused"), want: false},
+		{name: "permanent", err: Permanent("malformed key"), want: true},
+		{name: "permanentf", err: Permanentf("malformed key %q", "a/b/c"), want: true},
+		{name: "as permanent", err: AsPermanent(errors.New("not found")), want: true},
+		{name: "wrapped", err: pkgerrors.Wrap(Permanent("malformed key"), "syncing"), want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsPermanent(tt.err); got != tt.want {
+				t.Fatalf("expected IsPermanent to return %t, got %t", tt.want, got)
+			}
+		})
+	}
+	if AsPermanent(nil) != nil {
+		t.Fatal("expected AsPermanent(nil) to return nil")
+	}
+}
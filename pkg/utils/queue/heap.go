@@ -0,0 +1,74 @@
+package queue
+
+import (
+	"container/heap"
+	"sort"
+)
+
+// itemHeap is a min-heap of queue items ordered by the time they are planned to start work at. Items planned for the
+// same time are ordered by the sequence they were pushed in. It implements heap.Interface, and keeps the index of
+// every item up to date so items can be fixed or removed in O(log n).
+type itemHeap []*queueItem
+
+var _ heap.Interface = &itemHeap{}
+
+func (h itemHeap) Len() int {
+	return len(h)
+}
+
+func (h itemHeap) Less(i, j int) bool {
+	return h[i].before(h[j])
+}
+
+func (h itemHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+// Push is used by the heap package, use heap.Push instead.
+func (h *itemHeap) Push(x interface{}) {
+	qi := x.(*queueItem)
+	qi.index = len(*h)
+	*h = append(*h, qi)
+}
+
+// Pop is used by the heap package, use heap.Pop instead.
+func (h *itemHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	qi := old[n-1]
+	old[n-1] = nil
+	qi.index = -1
+	*h = old[:n-1]
+	return qi
+}
+
+// front returns the item planned to start work first, or nil if the heap is empty.
+func (h itemHeap) front() *queueItem {
+	if len(h) == 0 {
+		return nil
+	}
+	return h[0]
+}
+
+// sorted returns a copy of the items in the order they are planned to start work in.
+func (h itemHeap) sorted() []*queueItem {
+	items := make([]*queueItem, len(h))
+	copy(items, h)
+	sort.Slice(items, func(i, j int) bool {
+		return itemHeap(items).Less(i, j)
+	})
+	return items
+}
+
+// readyHeap is a min-heap of queue items which are ready to be processed, ordered by the order they are handed to
+// workers in when priorities or fair scheduling are in use. Items with a higher priority go first, then items with the
+// smaller fair share tag, then items planned to start work first. It shares the bookkeeping of itemHeap.
+type readyHeap struct {
+	itemHeap
+}
+
+func (h readyHeap) Less(i, j int) bool {
+	return h.itemHeap[i].readyBefore(h.itemHeap[j])
+}
@@ -0,0 +1,147 @@
+package queue
+
+import (
+	"container/heap"
+	"container/list"
+	"context"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestItemHeap(t *testing.T) {
+	start := time.Date(2022, 8, 1, 12, 0, 0, 0, time.UTC)
+	rnd := rand.New(rand.NewSource(1))
+	h := itemHeap{}
+	items := make([]*queueItem, 100)
+	for i := range items {
+		items[i] = &queueItem{
+			key:                  fmt.Sprintf("key-%d", i),
+			plannedToStartWorkAt: start.Add(time.Duration(rnd.Intn(10)) * time.Second),
+			seq:                  uint64(i),
+		}
+		heap.Push(&h, items[i])
+	}
+	// Bring some items forward, and remove others
+	for i := 0; i < len(items); i += 7 {
+		items[i].plannedToStartWorkAt = start.Add(-time.Duration(i) * time.Millisecond)
+		heap.Fix(&h, items[i].index)
+	}
+	for i := 3; i < len(items); i += 11 {
+		heap.Remove(&h, items[i].index)
+	}
+
+	sorted := h.sorted()
+	if len(sorted) != h.Len() {
+		t.Fatalf("expected %d sorted items, got %d", h.Len(), len(sorted))
+	}
+	var last *queueItem
+	for h.Len() > 0 {
+		qi := heap.Pop(&h).(*queueItem)
+		if qi.index != -1 {
+			t.Fatalf("expected popped item %s to have no index, got %d", qi.key, qi.index)
+		}
+		if last != nil && qi.before(last) {
+			t.Fatalf("item %s popped after %s, which it is planned before", qi.key, last.key)
+		}
+		if sorted[0] != qi {
+			t.Fatalf("expected sorted to return %s next, got %s", qi.key, sorted[0].key)
+		}
+		sorted = sorted[1:]
+		last = qi
+	}
+}
+
+// benchmarkPending is the number of items waiting in the queue while inserting
+const benchmarkPending = 100000
+
+// BenchmarkInsert measures inserting items into a queue holding benchmarkPending items, which are planned in random
+// order.
+func BenchmarkInsert(b *testing.B) {
+	q := New(fastRateLimiter(), "benchmark", func(ctx context.Context, key string) error { return nil })
+	ctx := context.Background()
+	rnd := rand.New(rand.NewSource(1))
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	for i := 0; i < benchmarkPending; i++ {
+		q.insert(ctx, fmt.Sprintf("pending-%d", i), false, time.Duration(rnd.Intn(3600))*time.Second)
+	}
+	keys := make([]string, b.N)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key-%d", i)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		q.insert(ctx, keys[i], false, time.Duration(rnd.Intn(3600))*time.Second)
+	}
+}
+
+// BenchmarkDequeue measures taking the next ready item from a queue holding benchmarkPending ready items, as after a
+// mass resync, and putting it back so the number of items stays the same.
+func BenchmarkDequeue(b *testing.B) {
+	namespace := func(key string) string { return strings.SplitN(key, "/", 2)[0] }
+	tests := []struct {
+		name     string
+		opts     []Option
+		priority func(i int) int
+	}{
+		{name: "fifo"},
+		{name: "priority", priority: func(i int) int { return i % 3 }},
+		{name: "fair", opts: []Option{WithFairScheduling(namespace, nil)}},
+	}
+	for _, tt := range tests {
+		b.Run(tt.name, func(b *testing.B) {
+			q := New(fastRateLimiter(), "benchmark", func(ctx context.Context, key string) error { return nil },
+				tt.opts...)
+			ctx := context.Background()
+			q.lock.Lock()
+			defer q.lock.Unlock()
+			for i := 0; i < benchmarkPending; i++ {
+				qi := q.insert(ctx, fmt.Sprintf("ns-%d/pending-%d", i%100, i), false, 0)
+				if tt.priority != nil {
+					q.setPriority(qi, tt.priority(i))
+				}
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				qi := q.next()
+				q.removeItem(qi)
+				q.chargeFairShare(qi)
+				q.setPriority(q.insert(ctx, qi.key, false, 0), qi.priority)
+			}
+		})
+	}
+}
+
+// BenchmarkListInsert measures inserting items into a list holding benchmarkPending items like the queue did before it
+// kept its items in a heap, by scanning back from the end of the list for the position to insert at.
+func BenchmarkListInsert(b *testing.B) {
+	start := time.Date(2022, 8, 1, 12, 0, 0, 0, time.UTC)
+	rnd := rand.New(rand.NewSource(1))
+	items := list.New()
+	insert := func(qi *queueItem) {
+		for e := items.Back(); e != nil; e = e.Prev() {
+			if e.Value.(*queueItem).plannedToStartWorkAt.Before(qi.plannedToStartWorkAt) {
+				items.InsertAfter(qi, e)
+				return
+			}
+		}
+		items.PushFront(qi)
+	}
+	// The pending items are sorted up front, inserting them one by one would take minutes
+	pending := make([]time.Time, benchmarkPending)
+	for i := range pending {
+		pending[i] = start.Add(time.Duration(rnd.Intn(3600)) * time.Second)
+	}
+	sort.Slice(pending, func(i, j int) bool { return pending[i].Before(pending[j]) })
+	for _, plannedAt := range pending {
+		items.PushBack(&queueItem{plannedToStartWorkAt: plannedAt})
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		insert(&queueItem{plannedToStartWorkAt: start.Add(time.Duration(rnd.Intn(3600)) * time.Second)})
+	}
+}
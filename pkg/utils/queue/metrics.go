@@ -0,0 +1,84 @@
+package queue
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	metricsNamespace = "queue"
+	queueNameLabel   = "queue"
+)
+
+// queueMetrics holds the prometheus metrics of a single Queue. Every metric carries the queue name as a const label,
+// so collectors of queues with distinct names can be registered against the same registry.
+type queueMetrics struct {
+	depth      *prometheus.Desc
+	processing *prometheus.Desc
+	retries    prometheus.Counter
+	duration   prometheus.Histogram
+}
+
+func newQueueMetrics(name string) *queueMetrics {
+	labels := prometheus.Labels{queueNameLabel: name}
+	return &queueMetrics{
+		depth: prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, "", "depth"),
+			"Number of items waiting in the queue to be processed.",
+			nil, labels,
+		),
+		processing: prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, "", "items_processing"),
+			"Number of items currently being processed by the workers.",
+			nil, labels,
+		),
+		retries: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace:   metricsNamespace,
+			Name:        "retries_total",
+			Help:        "Total number of items requeued due to a failed sync.",
+			ConstLabels: labels,
+		}),
+		duration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace:   metricsNamespace,
+			Name:        "process_duration_seconds",
+			Help:        "How long in seconds the handler takes to process an item.",
+			ConstLabels: labels,
+			Buckets:     prometheus.ExponentialBuckets(0.001, 2, 15),
+		}),
+	}
+}
+
+// metricsCollector implements prometheus.Collector for a Queue
+type metricsCollector struct {
+	q *Queue
+}
+
+var _ prometheus.Collector = &metricsCollector{}
+
+// MetricsCollector returns a prometheus.Collector reporting the depth, in-flight count, retries, and processing
+// duration of the queue.
+//
+// Registration is left to the caller, the queue does not register any metrics on its own.
+func (q *Queue) MetricsCollector() prometheus.Collector {
+	return &metricsCollector{q: q}
+}
+
+// Describe implements prometheus.Collector
+func (c *metricsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.q.metrics.depth
+	ch <- c.q.metrics.processing
+	c.q.metrics.retries.Describe(ch)
+	c.q.metrics.duration.Describe(ch)
+}
+
+// Collect implements prometheus.Collector
+func (c *metricsCollector) Collect(ch chan<- prometheus.Metric) {
+	c.q.lock.Lock()
+	depth := c.q.pending()
+	processing := len(c.q.itemsBeingProcessed)
+	c.q.lock.Unlock()
+
+	ch <- prometheus.MustNewConstMetric(c.q.metrics.depth, prometheus.GaugeValue, float64(depth))
+	ch <- prometheus.MustNewConstMetric(c.q.metrics.processing, prometheus.GaugeValue, float64(processing))
+	c.q.metrics.retries.Collect(ch)
+	c.q.metrics.duration.Collect(ch)
+}
@@ -0,0 +1,79 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// gatherMetrics returns the metrics of reg by name and queue label
+func gatherMetrics(t *testing.T, reg *prometheus.Registry) map[string]map[string]*dto.Metric {
+	t.Helper()
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics := map[string]map[string]*dto.Metric{}
+	for _, family := range families {
+		byQueue := map[string]*dto.Metric{}
+		for _, m := range family.GetMetric() {
+			for _, label := range m.GetLabel() {
+				if label.GetName() == queueNameLabel {
+					byQueue[label.GetValue()] = m
+				}
+			}
+		}
+		metrics[family.GetName()] = byQueue
+	}
+	return metrics
+}
+
+func TestMetricsCollector(t *testing.T) {
+	var calls int32
+	processed := New(fastRateLimiter(), "processed", func(ctx context.Context, key string) error {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			return errors.New("first call fails")
+		}
+		return nil
+	})
+	idle := New(fastRateLimiter(), "idle", func(ctx context.Context, key string) error { return nil })
+
+	// Queues with distinct names can share a registry
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(processed.MetricsCollector(), idle.MetricsCollector())
+
+	for _, key := range []string{"a", "b"} {
+		if err := idle.EnqueueWithoutRateLimit(context.Background(), key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	metrics := gatherMetrics(t, reg)
+	if depth := metrics["queue_depth"]["idle"].GetGauge().GetValue(); depth != 2 {
+		t.Fatalf("expected a depth of 2, got %v", depth)
+	}
+	if processing := metrics["queue_items_processing"]["idle"].GetGauge().GetValue(); processing != 0 {
+		t.Fatalf("expected no items being processed, got %v", processing)
+	}
+
+	runQueue(t, processed, 1)
+	if err := processed.Enqueue(context.Background(), "key"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "key to be processed twice", func() bool {
+		return atomic.LoadInt32(&calls) == 2 && processed.Empty()
+	})
+	metrics = gatherMetrics(t, reg)
+	if retries := metrics["queue_retries_total"]["processed"].GetCounter().GetValue(); retries != 1 {
+		t.Fatalf("expected 1 retry, got %v", retries)
+	}
+	if count := metrics["queue_process_duration_seconds"]["processed"].GetHistogram().GetSampleCount(); count != 2 {
+		t.Fatalf("expected 2 observed durations, got %v", count)
+	}
+	if depth := metrics["queue_depth"]["processed"].GetGauge().GetValue(); depth != 0 {
+		t.Fatalf("expected an empty queue, got a depth of %v", depth)
+	}
+}
@@ -0,0 +1,192 @@
+package queue
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	"github.com/clusterrouter-io/clusterrouter/pkg/utils/log"
+	"k8s.io/utils/clock"
+)
+
+// Option configures optional behaviour of a Queue, it is passed to New
+type Option func(*Queue)
+
+// DeadLetterHandler is a callback for keys that are permanently forgotten because they exhausted MaxRetries, or
+// failed with a PermanentError. lastErr is the error returned by the final attempt.
+type DeadLetterHandler func(ctx context.Context, key string, lastErr error)
+
+// BackoffFunc computes how long to wait before retrying a key whose handler returned err. requeues is the number of
+// times the key has been requeued so far, not counting this one.
+type BackoffFunc func(key string, err error, requeues int) time.Duration
+
+// BatchHandler handles a batch of keys in a single call. It returns the error of every key which failed, keys which are
+// not in the returned map succeeded.
+type BatchHandler func(ctx context.Context, keys []string) map[string]error
+
+// Dispatcher returns the handler for key. It allows a single queue, with a shared ratelimiter and worker pool, to route
+// keys of different kinds to different handlers. Returning nil falls back to the handler passed to New.
+type Dispatcher func(key string) ItemHandler
+
+// WithDeadLetterHandler sets a callback which is called exactly once for every key forgotten due to maximum retries
+// reached, or a PermanentError. It is not called for keys which are forgotten because they were processed
+// successfully, or via Forget.
+func WithDeadLetterHandler(handler DeadLetterHandler) Option {
+	return func(q *Queue) {
+		q.deadLetterHandler = handler
+	}
+}
+
+// WithBackoffFunc sets a function which overrides the ratelimiter when computing the delay of requeues after a failed
+// sync, so the backoff can depend on the error. Keys enqueued via Enqueue are still delayed by the ratelimiter.
+func WithBackoffFunc(backoff BackoffFunc) Option {
+	return func(q *Queue) {
+		q.backoffFunc = backoff
+	}
+}
+
+// WithDispatcher sets a function which routes every key to its handler, for example based on a key prefix.
+func WithDispatcher(dispatcher Dispatcher) Option {
+	return func(q *Queue) {
+		q.dispatcher = dispatcher
+	}
+}
+
+// WithMaxPending bounds the number of items waiting in the queue to max. Once the queue is full, enqueueing new keys
+// fails with ErrQueueFull, while keys already in the queue can still be rescheduled, and items being processed still
+// complete. A max of 0 leaves the queue unbounded.
+func WithMaxPending(max int) Option {
+	return func(q *Queue) {
+		q.maxPending = max
+	}
+}
+
+// WithClock sets the clock used to schedule items, measure delays, and drive the timers workers wait on. It defaults
+// to the real clock, and is meant to be replaced with a fake clock in tests.
+func WithClock(c clock.Clock) Option {
+	return func(q *Queue) {
+		q.clock = c
+	}
+}
+
+// WithJitter spreads out rate limited items, so keys enqueued at the same time do not all wake up at once. The delay of
+// every rate limited item is extended by a random fraction of up to maxFraction of it. A maxFraction of 0 disables
+// jitter.
+func WithJitter(maxFraction float64) Option {
+	return func(q *Queue) {
+		q.jitterFraction = maxFraction
+		if q.rand == nil {
+			q.rand = rand.New(rand.NewSource(time.Now().UnixNano())) // nolint:gosec
+		}
+	}
+}
+
+// WithHandlerTimeout bounds every handler call to timeout. The context passed to the handler expires after timeout, and
+// keys whose handler failed once it did are retried like any other failed sync. The worker still waits for the handler
+// to return, so a key is never processed twice at once, handlers are expected to return once their context is done. A
+// timeout of 0 leaves handler calls unbounded.
+func WithHandlerTimeout(timeout time.Duration) Option {
+	return func(q *Queue) {
+		q.handlerTimeout = timeout
+	}
+}
+
+// WithBatchHandler makes workers hand all keys which are ready, up to maxBatchSize, to handler at once, instead of
+// calling the handler passed to New, or the dispatcher, for every key. Keys which are not ready yet stay scheduled.
+// Every key of a batch is retried or forgotten on its own, according to the error returned for it. A maxBatchSize
+// below 1 is treated as 1.
+func WithBatchHandler(handler BatchHandler, maxBatchSize int) Option {
+	return func(q *Queue) {
+		if maxBatchSize < 1 {
+			maxBatchSize = 1
+		}
+		q.batchHandler = handler
+		q.maxBatchSize = maxBatchSize
+	}
+}
+
+// WithLogger sets the base logger the queue, its workers, and the contexts passed to handlers log through, instead of
+// the logger of the context passed to Run. Every entry is logged with the name of the queue. A nil logger is ignored,
+// so the logger of the context is used.
+func WithLogger(logger log.Logger) Option {
+	return func(q *Queue) {
+		if logger == nil {
+			return
+		}
+		q.logger = logger.WithField("queue", q.name)
+	}
+}
+
+// WithInFlightDeadline bounds how long an item may be processed to deadline. A watchdog cancels the context of handlers
+// exceeding it, and the key is retried like any other failed sync once the handler returned. Handlers which ignore
+// their context keep the key being processed until they return, so it is never processed twice at once. Unlike
+// WithHandlerTimeout, which bounds every handler call on its own, the deadline is enforced by the queue, and is checked
+// every quarter of it, so handlers may run up to a quarter longer. It does not apply to batch handlers. A deadline of 0
+// leaves processing unbounded.
+func WithInFlightDeadline(deadline time.Duration) Option {
+	return func(q *Queue) {
+		q.inFlightDeadline = deadline
+	}
+}
+
+// WithFairScheduling shares the workers fairly between groups of keys, for example namespaces, so a group flooding the
+// queue can not starve the others. prefix returns the group of a key. Among the items which are ready to be processed
+// and have the same priority, the group which received the smallest share of work so far goes first, where every item
+// of a group counts 1/weight against its share. Groups without a weight, or with a weight below 1, have a weight of 1.
+func WithFairScheduling(prefix func(key string) string, weights map[string]int) Option {
+	return func(q *Queue) {
+		q.fairPrefix = prefix
+		q.fairWeights = weights
+		q.fairServed = map[string]float64{}
+	}
+}
+
+// WithLogSampling limits how often failed syncs of the same key are logged, so a key which keeps failing does not flood
+// the logs. The first failure of a key is always logged, and after that every Nth failure if every is greater than 0,
+// and the first failure after interval passed since the last one logged if interval is greater than 0. Permanent
+// errors and keys forgotten after the maximum retries are always logged.
+func WithLogSampling(every int, interval time.Duration) Option {
+	return func(q *Queue) {
+		q.logSampleEvery = every
+		q.logSampleInterval = interval
+	}
+}
+
+// WithCancelOnForget cancels the context passed to the handler of a key when the key is forgotten while it is being
+// processed, instead of only discarding the result once the handler returns. It should not be used if handlers must
+// run to completion. It does not apply to batch handlers.
+func WithCancelOnForget() Option {
+	return func(q *Queue) {
+		q.cancelOnForget = true
+	}
+}
+
+// WithDebounce coalesces bursts of events for the same key. A key enqueued again within window of when it was last
+// processed, or requeued after a failed sync, is delayed until the window passed, and enqueues in the meantime are
+// folded into the same item. Unlike rate limiting, the window starts over every time the key is processed, and keys
+// enqueued for the first time, or after a quiet period, are not delayed.
+func WithDebounce(window time.Duration) Option {
+	return func(q *Queue) {
+		q.debounce = window
+		q.lastProcessed = map[string]time.Time{}
+	}
+}
+
+// WithTracingSampler limits the spans created by the queue, which start one or more spans for every key enqueued and
+// processed. sample is called whenever the queue would start a span, and no span is created if it returns false.
+// Fields are still added to the logger passed to handlers when a span is not sampled.
+func WithTracingSampler(sample func() bool) Option {
+	return func(q *Queue) {
+		q.tracingSampler = sample
+	}
+}
+
+// WithLifecycleSpans starts a span for every key when it is added to the queue, which covers all attempts to process
+// it, and ends once the key is forgotten after being processed successfully, a permanent error, reaching the maximum
+// retries, or being told to forget. The span of every attempt is a child of it. A key enqueued again while being
+// processed starts a new lifecycle once the current one ended. Attempts of batch handlers are not linked to it.
+func WithLifecycleSpans() Option {
+	return func(q *Queue) {
+		q.lifecycleSpans = true
+	}
+}
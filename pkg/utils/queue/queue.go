@@ -1,14 +1,16 @@
 package queue
 
 import (
-	"container/list"
+	"container/heap"
 	"context"
+	"errors"
 	"fmt"
+	"math/rand"
+	"sort"
 	"sync"
 	"time"
 
 	"github.com/clusterrouter-io/clusterrouter/pkg/utils/log"
-	"github.com/clusterrouter-io/clusterrouter/pkg/utils/trace"
 	pkgerrors "github.com/pkg/errors"
 	"golang.org/x/sync/semaphore"
 	"k8s.io/apimachinery/pkg/util/wait"
@@ -18,27 +20,108 @@ import (
 
 const (
 	// MaxRetries is the number of times we try to process a given key before permanently forgetting it.
+	//
+	// Only retries of the same work count against it. If a key is enqueued again while it is being processed, there is
+	// new work for it, so when the processing in progress fails, the key is retried with a fresh budget even if it ran
+	// out of retries: its retries start over at 0, the rate limiter forgets the backoff of the failed attempts, and the
+	// retry is planned at the earlier of when the key was enqueued again for, and the backoff of a first failure. A
+	// pure retry, without the key being enqueued again, counts against the budget and keeps backing off.
 	MaxRetries = 20
 )
 
+// errQueueDrained is returned to workers once a draining queue has run out of items
+var errQueueDrained = errors.New("queue drained")
+
 // ItemHandler is a callback that handles a single key on the Queue
 type ItemHandler func(ctx context.Context, key string) error
 
+// ProcessedFunc is called once the handler returns for a key. waited is the time between the key originally being
+// added to the queue and the handler starting, across requeues. handled is the time the handler took, and err is what
+// the handler returned.
+type ProcessedFunc func(key string, waited, handled time.Duration, err error)
+
+// ForgetFunc is called when a key is forgotten via Forget or ForgetWithReason, with the reason given, which is empty
+// for Forget.
+type ForgetFunc func(key, reason string)
+
 // Queue implements a wrapper around workqueue with native VK instrumentation
 type Queue struct {
-	// clock is used for testing
+	// clock is used for all scheduling decisions, it can be replaced via WithClock for testing
 	clock clock.Clock
-	// lock protects running, and the items list / map
+	// lock protects running, paused, draining, and the items heap / map
 	lock    sync.Mutex
 	running bool
-	name    string
-	handler ItemHandler
+	// paused stops workers from picking up items, while still accepting new ones
+	paused bool
+	// draining is set once Drain is called, after which no new work is accepted
+	draining bool
+	// drainedCh is closed once a draining queue has no items left
+	drainedCh chan struct{}
+	// hasWork is set once items are added, and cleared when the queue runs out of work again
+	hasWork bool
+	// onEmpty is called when the queue runs out of work
+	onEmpty func()
+	// onProcessed is called after the handler returns for an item
+	onProcessed ProcessedFunc
+	// onForget is called when a waiting or in progress item is forgotten
+	onForget ForgetFunc
+	name     string
+	handler  ItemHandler
+	// dispatcher picks the handler of every key, falling back to handler when unset or when it returns nil
+	dispatcher Dispatcher
+	// deadLetterHandler is called for keys which are forgotten due to maximum retries reached
+	deadLetterHandler DeadLetterHandler
+	// maxPending bounds the number of items waiting in the queue, 0 means unbounded
+	maxPending int
+	// jitterFraction spreads out rate limited items by up to this fraction of their delay, 0 disables jitter
+	jitterFraction float64
+	// rand is the source of jitter, it is protected by lock
+	rand *rand.Rand
+	// backoffFunc overrides the ratelimiter when computing the delay of requeues after a failed sync
+	backoffFunc BackoffFunc
+	// fairPrefix groups keys for weighted fair scheduling among ready items, it is nil when fair scheduling is disabled
+	fairPrefix  func(key string) string
+	fairWeights map[string]int
+	// fairServed holds the weighted share of work every prefix received, and fairVirtualTime the share of the prefix
+	// served last
+	fairServed      map[string]float64
+	fairVirtualTime float64
+	// debounce delays keys enqueued again within debounce of when they were last processed, lastProcessed holds when
+	// keys were last processed within the window, and lastProcessedPruned when expired entries were last removed
+	debounce            time.Duration
+	lastProcessed       map[string]time.Time
+	lastProcessedPruned time.Time
+	// tracingSampler decides whether spans are created for an operation of the queue, nil samples all of them
+	tracingSampler func() bool
+	// lifecycleSpans starts a span for every key covering its whole lifecycle, see WithLifecycleSpans
+	lifecycleSpans bool
+	// cancelOnForget cancels the context of the handler of an item when it is forgotten while being processed
+	cancelOnForget bool
+	// logSampleEvery and logSampleInterval limit how often failed syncs of the same key are logged, see WithLogSampling
+	logSampleEvery    int
+	logSampleInterval time.Duration
+	// batchHandler replaces the handler when set, handling up to maxBatchSize ready keys at once
+	batchHandler BatchHandler
+	maxBatchSize int
+	// logger is the base logger of the queue, when unset the logger of the context is used
+	logger log.Logger
+	// inFlightDeadline is how long an item may be processed before its handler is cancelled, 0 means unbounded
+	inFlightDeadline time.Duration
+	// handlerTimeout bounds the time a single handler call may take, 0 means unbounded
+	handlerTimeout time.Duration
 
 	ratelimiter workqueue.RateLimiter
-	// items are items that are marked dirty waiting for processing.
-	items *list.List
-	// itemInQueue is a map of (string) key -> item while it is in the items list
-	itemsInQueue map[string]*list.Element
+	// items are items that are marked dirty waiting for processing, kept as a min-heap on plannedToStartWorkAt.
+	items itemHeap
+	// ready holds the items which are ready to be processed once priorities or fair scheduling are in use, in the order
+	// they are handed to workers in. It is empty otherwise, and ready items are taken from the front of items.
+	ready readyHeap
+	// prioritized is the number of items in the queue with a priority other than 0
+	prioritized int
+	// itemInQueue is a map of (string) key -> item while it is in the items or the ready heap
+	itemsInQueue map[string]*queueItem
+	// nextSeq is handed out to items pushed on the heap, to keep the order of items planned for the same time
+	nextSeq uint64
 	// itemsBeingProcessed is a map of (string) key -> item once it has been moved
 	itemsBeingProcessed map[string]*queueItem
 	// Wait for next semaphore is an exclusive (1 item) lock that is taken every time items is checked to see if there
@@ -47,6 +130,17 @@ type Queue struct {
 
 	// wakeup
 	wakeupCh chan struct{}
+
+	// workerCtx is the context of the running queue, and workerGroup tracks its workers. workerGroup is nil when the
+	// queue is not running, or is shutting down.
+	workerCtx   context.Context
+	workerGroup *wait.Group
+	// workerStops holds a stop function for every active worker, in the order they were started
+	workerStops []context.CancelFunc
+	// nextWorkerID is handed out to workers as they are started, so IDs in logs stay unique across rescaling
+	nextWorkerID int
+
+	metrics *queueMetrics
 }
 
 type queueItem struct {
@@ -56,6 +150,34 @@ type queueItem struct {
 	redirtiedWithRatelimit bool
 	forget                 bool
 	requeues               int
+	// forgetReason is the reason the item was told to forget while in progress
+	forgetReason string
+	// startedProcessingAt is when a worker picked up the item, it is zero while the item waits in the queue
+	startedProcessingAt time.Time
+	// cancel cancels the context of the handler processing the item, it is only set with an in-flight deadline or
+	// cancel on forget
+	cancel context.CancelFunc
+	// inFlightDeadlineExceeded is set once the watchdog cancelled the handler for exceeding the in-flight deadline
+	inFlightDeadlineExceeded bool
+	// values is the context the item was enqueued with via EnqueueWithContext, and redirtiedValues the context it was
+	// enqueued with again while being processed
+	values          context.Context
+	redirtiedValues context.Context
+	// lifecycle is the span covering the lifecycle of the key, it is carried over requeues, and nil unless lifecycle
+	// spans are enabled
+	lifecycle *lifecycleSpan
+	// failureLoggedAt is when a failed sync of the key was last logged, it is carried over requeues for log sampling
+	failureLoggedAt time.Time
+	// priority is used to pick between items that are ready to be processed, higher goes first
+	priority int
+	// fairStart is the share of work the prefix of the key received when the item became ready, see promoteReady
+	fairStart float64
+	// ready is set while the item is in the ready heap rather than the items heap
+	ready bool
+	// index is the position of the item in the heap it is in, or -1 if it is in neither
+	index int
+	// seq orders items planned for the same time by when they were pushed on the heap
+	seq uint64
 
 	// Debugging information only
 	originallyAdded     time.Time
@@ -67,62 +189,160 @@ func (item *queueItem) String() string {
 	return fmt.Sprintf("<plannedToStartWorkAt:%s key: %s>", item.plannedToStartWorkAt.String(), item.key)
 }
 
+// before returns true if item is planned to start work before other
+func (item *queueItem) before(other *queueItem) bool {
+	if item.plannedToStartWorkAt.Equal(other.plannedToStartWorkAt) {
+		return item.seq < other.seq
+	}
+	return item.plannedToStartWorkAt.Before(other.plannedToStartWorkAt)
+}
+
+// readyBefore returns true if item is handed to a worker before other while both are ready to be processed
+func (item *queueItem) readyBefore(other *queueItem) bool {
+	if item.priority != other.priority {
+		return item.priority > other.priority
+	}
+	if item.fairStart != other.fairStart {
+		return item.fairStart < other.fairStart
+	}
+	return item.before(other)
+}
+
 // New creates a queue
 //
 // It expects to get a item rate limiter, and a friendly name which is used in logs, and
-// in the internal kubernetes metrics.
-func New(ratelimiter workqueue.RateLimiter, name string, handler ItemHandler) *Queue {
-	return &Queue{
+// in the internal kubernetes metrics. Optional behaviour can be configured through opts.
+//
+// It panics if name is empty, or handler is nil while neither a dispatcher nor a batch handler is set, so a
+// misconfigured queue fails when it is created rather than when the first item is processed.
+func New(ratelimiter workqueue.RateLimiter, name string, handler ItemHandler, opts ...Option) *Queue {
+	if name == "" {
+		panic("queue name must not be empty")
+	}
+	q := &Queue{
 		clock:                    clock.RealClock{},
 		name:                     name,
 		ratelimiter:              ratelimiter,
-		items:                    list.New(),
 		itemsBeingProcessed:      make(map[string]*queueItem),
-		itemsInQueue:             make(map[string]*list.Element),
+		itemsInQueue:             make(map[string]*queueItem),
 		handler:                  handler,
 		wakeupCh:                 make(chan struct{}, 1),
 		waitForNextItemSemaphore: semaphore.NewWeighted(1),
+		metrics:                  newQueueMetrics(name),
+	}
+	for _, opt := range opts {
+		if opt == nil {
+			continue
+		}
+		opt(q)
+	}
+	if handler == nil && q.dispatcher == nil && q.batchHandler == nil {
+		panic(fmt.Sprintf("queue %s needs a handler, a dispatcher, or a batch handler", name))
 	}
+	return q
 }
 
 // Enqueue enqueues the key in a rate limited fashion
-func (q *Queue) Enqueue(ctx context.Context, key string) {
+//
+// It returns ErrQueueFull if the queue is bounded, full, and the key is not already known to the queue.
+func (q *Queue) Enqueue(ctx context.Context, key string) error {
 	q.lock.Lock()
 	defer q.lock.Unlock()
 
-	q.insert(ctx, key, true, 0)
+	_, err := q.enqueue(ctx, key, true, 0)
+	return err
 }
 
 // EnqueueWithoutRateLimit enqueues the key without a rate limit
-func (q *Queue) EnqueueWithoutRateLimit(ctx context.Context, key string) {
+//
+// It returns ErrQueueFull if the queue is bounded, full, and the key is not already known to the queue.
+func (q *Queue) EnqueueWithoutRateLimit(ctx context.Context, key string) error {
 	q.lock.Lock()
 	defer q.lock.Unlock()
 
-	q.insert(ctx, key, false, 0)
+	_, err := q.enqueue(ctx, key, false, 0)
+	return err
+}
+
+// EnqueueWithContext enqueues the key in a rate limited fashion like Enqueue, and makes the values of ctx visible
+// through the context passed to the handler of the key. Only the values are kept, the handler is not cancelled along
+// with ctx, and values of the worker context, such as its logger and trace span, take precedence.
+//
+// The values survive requeues after failed syncs. When the key is enqueued with a context again, the values of the
+// latest context replace the earlier ones, while keys enqueued without a context keep them. They are not passed to
+// batch handlers.
+func (q *Queue) EnqueueWithContext(ctx context.Context, key string) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	qi, err := q.enqueue(ctx, key, true, 0)
+	if qi == nil {
+		return err
+	}
+	if q.itemsBeingProcessed[key] == qi {
+		qi.redirtiedValues = ctx
+	} else {
+		qi.values = ctx
+	}
+	return err
 }
 
 // Forget forgets the key
 func (q *Queue) Forget(ctx context.Context, key string) {
+	q.ForgetWithReason(ctx, key, "")
+}
+
+// ForgetWithReason forgets the key like Forget, recording why it was forgotten, for example "deleted" or "superseded".
+// The reason is added to the trace span, and passed to the callback registered via OnForget.
+func (q *Queue) ForgetWithReason(ctx context.Context, key, reason string) {
+	var onEmpty func()
+	defer func() {
+		if onEmpty != nil {
+			onEmpty()
+		}
+	}()
+
+	// onForget is read under the lock, but called after it is released, and only if the key was known.
+	var onForget ForgetFunc
+	defer func() {
+		if onForget != nil {
+			onForget(key, reason)
+		}
+	}()
+
 	q.lock.Lock()
 	defer q.lock.Unlock()
-	ctx, span := trace.StartSpan(ctx, "Forget")
+	defer func() {
+		if q.becameEmpty() {
+			onEmpty = q.onEmpty
+		}
+	}()
+	defer q.signalDrained()
+	ctx, span := q.startSpan(ctx, "Forget")
 	defer span.End()
 
 	ctx = span.WithFields(ctx, map[string]interface{}{
-		"queue": q.name,
-		"key":   key,
+		"queue":  q.name,
+		"key":    key,
+		"reason": reason,
 	})
 
-	if item, ok := q.itemsInQueue[key]; ok {
+	if qi, ok := q.itemsInQueue[key]; ok {
 		span.WithField(ctx, "status", "itemInQueue")
-		delete(q.itemsInQueue, key)
-		q.items.Remove(item)
+		q.removeItem(qi)
+		qi.endLifecycle(nil)
+		onForget = q.onForget
 		return
 	}
 
 	if qi, ok := q.itemsBeingProcessed[key]; ok {
 		span.WithField(ctx, "status", "itemBeingProcessed")
 		qi.forget = true
+		qi.forgetReason = reason
+		if q.cancelOnForget && qi.cancel != nil {
+			qi.cancel()
+		}
+		onForget = q.onForget
 		return
 	}
 	span.WithField(ctx, "status", "notfound")
@@ -131,7 +351,7 @@ func (q *Queue) Forget(ctx context.Context, key string) {
 // insert inserts a new item to be processed at time time. It will not further delay items if when is later than the
 // original time the item was scheduled to be processed. If when is earlier, it will "bring it forward"
 func (q *Queue) insert(ctx context.Context, key string, ratelimit bool, delay time.Duration) *queueItem {
-	ctx, span := trace.StartSpan(ctx, "insert")
+	ctx, span := q.startSpan(ctx, "insert")
 	defer span.End()
 
 	ctx = span.WithFields(ctx, map[string]interface{}{
@@ -167,16 +387,23 @@ func (q *Queue) insert(ctx context.Context, key string, ratelimit bool, delay ti
 	}
 
 	// Is the item already in the queue?
-	if item, ok := q.itemsInQueue[key]; ok {
+	if qi, ok := q.itemsInQueue[key]; ok {
 		span.WithField(ctx, "status", "itemsInQueue")
-		qi := item.Value.(*queueItem)
-		when := q.clock.Now().Add(delay)
-		q.adjustPosition(qi, item, when)
+		now := q.clock.Now()
+		// Enqueues within the debounce window are folded into the item, without moving it before the window passed
+		if debounced := q.debounceDelay(key, now); debounced > delay {
+			delay = debounced
+		}
+		q.adjustPosition(qi, now.Add(delay))
 		return qi
 	}
 
 	span.WithField(ctx, "status", "added")
 	now := q.clock.Now()
+	if debounced := q.debounceDelay(key, now); debounced > delay {
+		span.WithField(ctx, "debounce", debounced.String())
+		delay = debounced
+	}
 	val := &queueItem{
 		key:                  key,
 		plannedToStartWorkAt: now,
@@ -184,53 +411,346 @@ func (q *Queue) insert(ctx context.Context, key string, ratelimit bool, delay ti
 	}
 
 	if ratelimit {
-		if delay > 0 {
-			panic("Non-zero delay with rate limiting not supported")
-		}
+		// With a rate limit, delay acts as a floor, the later of the two wins
 		ratelimitDelay := q.ratelimiter.When(key)
 		span.WithField(ctx, "delay", ratelimitDelay.String())
-		val.plannedToStartWorkAt = val.plannedToStartWorkAt.Add(ratelimitDelay)
+		if delay < ratelimitDelay {
+			delay = ratelimitDelay
+		}
+		val.plannedToStartWorkAt = val.plannedToStartWorkAt.Add(q.jitter(delay))
 		val.delayedViaRateLimit = &ratelimitDelay
 	} else {
 		val.plannedToStartWorkAt = val.plannedToStartWorkAt.Add(delay)
 	}
 
-	for item := q.items.Back(); item != nil; item = item.Prev() {
-		qi := item.Value.(*queueItem)
-		if qi.plannedToStartWorkAt.Before(val.plannedToStartWorkAt) {
-			q.itemsInQueue[key] = q.items.InsertAfter(val, item)
-			return val
+	q.pushItem(val)
+	return val
+}
+
+// pushItem adds the item to the items heap. It must be called with the lock held.
+func (q *Queue) pushItem(qi *queueItem) {
+	qi.seq = q.nextSeq
+	q.nextSeq++
+	heap.Push(&q.items, qi)
+	q.itemsInQueue[qi.key] = qi
+	q.hasWork = true
+}
+
+// removeItem removes the item from the items or the ready heap. It must be called with the lock held.
+func (q *Queue) removeItem(qi *queueItem) {
+	if qi.ready {
+		heap.Remove(&q.ready, qi.index)
+		qi.ready = false
+	} else {
+		heap.Remove(&q.items, qi.index)
+	}
+	if qi.priority != 0 {
+		q.prioritized--
+	}
+	delete(q.itemsInQueue, qi.key)
+}
+
+// setPriority sets the priority of the item, which may be in the queue or being processed. It must be called with the
+// lock held.
+func (q *Queue) setPriority(qi *queueItem, priority int) {
+	if q.itemsInQueue[qi.key] == qi {
+		if qi.priority != 0 {
+			q.prioritized--
+		}
+		if priority != 0 {
+			q.prioritized++
 		}
 	}
+	qi.priority = priority
+	if qi.ready {
+		heap.Fix(&q.ready, qi.index)
+	}
+}
 
-	q.itemsInQueue[key] = q.items.PushFront(val)
-	return val
+// pending returns the number of items waiting in the queue. It must be called with the lock held.
+func (q *Queue) pending() int {
+	return q.items.Len() + q.ready.Len()
+}
+
+// queuedItems returns the items waiting in the queue, in no particular order. It must be called with the lock held.
+func (q *Queue) queuedItems() []*queueItem {
+	items := make([]*queueItem, 0, q.pending())
+	items = append(items, q.ready.itemHeap...)
+	return append(items, q.items...)
+}
+
+// sortedItems returns the items waiting in the queue, in the order they are planned to start work in. It must be
+// called with the lock held.
+func (q *Queue) sortedItems() []*queueItem {
+	if q.ready.Len() == 0 {
+		return q.items.sorted()
+	}
+	return itemHeap(q.queuedItems()).sorted()
+}
+
+// next returns the item which is handed to a worker next, or nil if the queue is empty. The item may not be ready to
+// be processed yet. Without priorities and fair scheduling, that is the front of the items heap, and taking it costs
+// O(log n). Otherwise the ready items are moved to the ready heap first, see promoteReady. It must be called with the
+// lock held.
+func (q *Queue) next() *queueItem {
+	if q.fairPrefix == nil && q.prioritized == 0 && q.ready.Len() == 0 {
+		return q.items.front()
+	}
+	q.promoteReady(q.clock.Now())
+	if qi := q.ready.front(); qi != nil {
+		return qi
+	}
+	return q.items.front()
+}
+
+// promoteReady moves the items which are ready to be processed at now from the items heap to the ready heap. Every
+// item is moved once, so handing out n ready items costs O(n log n) overall. With fair scheduling, every item is tagged
+// with the share of work its prefix received when it became ready, and the share of the prefix is raised by the weight
+// of the item right away, so the items of a flooding prefix are spread out among the items of other prefixes. It must
+// be called with the lock held.
+func (q *Queue) promoteReady(now time.Time) {
+	for {
+		qi := q.items.front()
+		if qi == nil || qi.plannedToStartWorkAt.After(now) {
+			return
+		}
+		heap.Pop(&q.items)
+		if q.fairPrefix != nil {
+			prefix := q.fairPrefix(qi.key)
+			qi.fairStart = q.fairTag(prefix)
+			q.fairServed[prefix] = qi.fairStart + 1/float64(q.fairWeight(prefix))
+		}
+		qi.ready = true
+		heap.Push(&q.ready, qi)
+	}
 }
 
-func (q *Queue) adjustPosition(qi *queueItem, element *list.Element, when time.Time) {
+// fairTag returns the share of work prefix received so far. Prefixes which were idle are treated as if they received
+// as much as the prefix served last, so they can not monopolize the workers when they become busy. It must be called
+// with the lock held.
+func (q *Queue) fairTag(prefix string) float64 {
+	if tag := q.fairServed[prefix]; tag > q.fairVirtualTime {
+		return tag
+	}
+	return q.fairVirtualTime
+}
+
+// fairWeight returns the weight of prefix, which is 1 unless configured otherwise
+func (q *Queue) fairWeight(prefix string) int {
+	if weight := q.fairWeights[prefix]; weight > 0 {
+		return weight
+	}
+	return 1
+}
+
+// chargeFairShare accounts for an item being picked up by a worker, by advancing the share of work idle prefixes are
+// treated as having received to the share of the item. It must be called with the lock held.
+func (q *Queue) chargeFairShare(qi *queueItem) {
+	if q.fairPrefix != nil && qi.fairStart > q.fairVirtualTime {
+		q.fairVirtualTime = qi.fairStart
+	}
+}
+
+func (q *Queue) adjustPosition(qi *queueItem, when time.Time) {
 	if when.After(qi.plannedToStartWorkAt) {
 		// The item has already been delayed appropriately
 		return
 	}
 
 	qi.plannedToStartWorkAt = when
-	for prev := element.Prev(); prev != nil; prev = prev.Prev() {
-		item := prev.Value.(*queueItem)
-		// does this item plan to start work *before* the new time? If so add it
-		if item.plannedToStartWorkAt.Before(when) {
-			q.items.MoveAfter(element, prev)
-			return
+	if qi.ready {
+		heap.Fix(&q.ready, qi.index)
+		return
+	}
+	heap.Fix(&q.items, qi.index)
+}
+
+// EnqueueWithoutRateLimitWithDelay enqueues without rate limiting, but work will not start for this given delay period
+func (q *Queue) EnqueueWithoutRateLimitWithDelay(ctx context.Context, key string, after time.Duration) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	_, err := q.enqueue(ctx, key, false, after)
+	return err
+}
+
+// EnqueueWithRateLimitAndDelay enqueues the key in a rate limited fashion, but work will not start before floor has
+// passed. The effective delay is the later of the rate limiter's delay and floor.
+//
+// If the key is being processed, it is redirtied to run no sooner than floor from now, and the rate limiter is
+// consulted again once the current processing finishes. If the key is already in the queue, it is only brought forward
+// to floor from now, it is never delayed further.
+func (q *Queue) EnqueueWithRateLimitAndDelay(ctx context.Context, key string, floor time.Duration) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	_, err := q.enqueue(ctx, key, true, floor)
+	return err
+}
+
+// EnqueueWithPriority enqueues the key without a rate limit. Among the items which are ready to be processed, items
+// with a higher priority are handed to workers first, items with the same priority keep their scheduled order.
+//
+// If the key is already in the queue, or being processed, its priority is raised to priority if that is higher. Like
+// with EnqueueWithoutRateLimit, a key waiting in the queue is made ready now.
+func (q *Queue) EnqueueWithPriority(ctx context.Context, key string, priority int) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	qi, err := q.enqueue(ctx, key, false, 0)
+	if qi != nil && priority > qi.priority {
+		q.setPriority(qi, priority)
+	}
+	return err
+}
+
+// FlushKey makes the key ready to be processed now, regardless of any delay it accumulated through rate limiting,
+// requeues, or debouncing. If the key is already in the queue, it is moved to the front, otherwise it is enqueued
+// without a rate limit. Items which became ready earlier, or have a higher priority, are still handed out first.
+//
+// If the key is being processed, it is redirtied to run again as soon as the current processing finishes.
+func (q *Queue) FlushKey(ctx context.Context, key string) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	qi, err := q.enqueue(ctx, key, false, 0)
+	if qi != nil && q.itemsInQueue[key] == qi {
+		// Debouncing may have delayed a new item, so it is brought forward as well
+		q.adjustPosition(qi, q.clock.Now())
+	}
+	return err
+}
+
+// Pause stops the workers from handing items to the handler. Items can still be enqueued while the queue is paused,
+// and keep their scheduled order. Items that are already being processed are not affected.
+func (q *Queue) Pause() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.paused = true
+}
+
+// Resume lets the workers pick up items again after Pause.
+func (q *Queue) Resume() {
+	q.lock.Lock()
+	q.paused = false
+	q.lock.Unlock()
+
+	select {
+	case q.wakeupCh <- struct{}{}:
+	default:
+	}
+}
+
+// enqueue inserts a key on behalf of a caller of the queue, as opposed to requeues of items the queue already
+// accepted. Keys are dropped if the queue is draining, in which case no item is returned. If the queue is bounded and
+// full, ErrQueueFull is returned for keys which are not already in the queue, or being processed. It must be called
+// with the lock held.
+func (q *Queue) enqueue(ctx context.Context, key string, ratelimit bool, delay time.Duration) (*queueItem, error) {
+	if q.draining {
+		log.G(q.withLogger(ctx)).Warnf("queue %s is draining, dropping key %q", q.name, key)
+		return nil, nil
+	}
+	if q.maxPending > 0 && len(q.itemsInQueue) >= q.maxPending {
+		_, inQueue := q.itemsInQueue[key]
+		_, beingProcessed := q.itemsBeingProcessed[key]
+		if !inQueue && !beingProcessed {
+			return nil, ErrQueueFull
 		}
 	}
+	qi := q.insert(ctx, key, ratelimit, delay)
+	q.startLifecycle(qi)
+	return qi, nil
+}
+
+// Drain stops the queue from accepting new work, and waits for the items that are already in the queue, or being
+// processed to be handled. Workers exit once there is nothing left for them to do.
+//
+// It returns once the queue is empty, or ctx is done. The queue has to be running for the remaining items to be
+// processed.
+func (q *Queue) Drain(ctx context.Context) error {
+	q.lock.Lock()
+	q.draining = true
+	if q.drainedCh == nil {
+		q.drainedCh = make(chan struct{})
+	}
+	drainedCh := q.drainedCh
+	q.signalDrained()
+	q.lock.Unlock()
+
+	select {
+	case q.wakeupCh <- struct{}{}:
+	default:
+	}
+
+	select {
+	case <-drainedCh:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
 
-	q.items.MoveToFront(element)
+// signalDrained closes drainedCh if the queue is draining, and has no items left. It must be called with the lock held.
+func (q *Queue) signalDrained() {
+	if !q.draining || q.pending() > 0 || len(q.itemsBeingProcessed) > 0 {
+		return
+	}
+	select {
+	case <-q.drainedCh:
+	default:
+		close(q.drainedCh)
+	}
 }
 
-// EnqueueWithoutRateLimitWithDelay enqueues without rate limiting, but work will not start for this given delay period
-func (q *Queue) EnqueueWithoutRateLimitWithDelay(ctx context.Context, key string, after time.Duration) {
+// OnEmpty registers a callback which is called every time the queue runs out of work, that is once there are neither
+// items waiting in the queue, nor items being processed. It is called at most once per transition to empty, and not
+// for a queue which starts out empty. Registering a new callback replaces the previous one.
+func (q *Queue) OnEmpty(f func()) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.onEmpty = f
+}
+
+// OnProcessed registers a callback which is called every time the handler returns for an item. It is called without
+// holding the queue lock, from the worker which processed the item. Registering a new callback replaces the previous
+// one.
+func (q *Queue) OnProcessed(f ProcessedFunc) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.onProcessed = f
+}
+
+// OnForget registers a callback which is called every time a key waiting in the queue, or being processed, is forgotten
+// via Forget or ForgetWithReason. It is called without holding the queue lock. Registering a new callback replaces the
+// previous one.
+func (q *Queue) OnForget(f ForgetFunc) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.onForget = f
+}
+
+// becameEmpty returns true if the queue has just run out of work after having had some. It must be called with the
+// lock held.
+func (q *Queue) becameEmpty() bool {
+	if q.pending() > 0 || len(q.itemsBeingProcessed) > 0 || !q.hasWork {
+		return false
+	}
+	q.hasWork = false
+	return true
+}
+
+// withLogger returns ctx carrying the logger of the queue, if one was set via WithLogger
+func (q *Queue) withLogger(ctx context.Context) context.Context {
+	if q.logger == nil {
+		return ctx
+	}
+	return log.WithLogger(ctx, q.logger)
+}
+
+// Running returns true while Run is running, and false once it has returned
+func (q *Queue) Running() bool {
 	q.lock.Lock()
 	defer q.lock.Unlock()
-	q.insert(ctx, key, false, after)
+	return q.running
 }
 
 // Empty returns if the queue has no items in it
@@ -240,35 +760,175 @@ func (q *Queue) Empty() bool {
 	return q.Len() == 0
 }
 
+// Peek returns the key at the front of the queue and the time it is planned to be processed at, without removing it
+// from the queue. ok is false if there are no items in the queue.
+//
+// It should only be used for debugging.
+func (q *Queue) Peek() (key string, plannedAt time.Time, ok bool) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	qi := q.next()
+	if qi == nil {
+		return "", time.Time{}, false
+	}
+	return qi.key, qi.plannedToStartWorkAt, true
+}
+
+// NumRequeues returns how many times the key has been requeued due to a failed sync, whether it is waiting in the
+// queue or being processed. It returns 0 for keys the queue does not know about.
+func (q *Queue) NumRequeues(key string) int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if qi, ok := q.itemsInQueue[key]; ok {
+		return qi.requeues
+	}
+	if qi, ok := q.itemsBeingProcessed[key]; ok {
+		return qi.requeues
+	}
+	return 0
+}
+
+// CurrentDelay returns how long until the key is planned to be processed, which is how long it is currently being
+// backed off for keys requeued after a failed sync. It is 0 for keys which are ready, or being processed and not
+// enqueued again since. ok is false for keys the queue does not know about.
+func (q *Queue) CurrentDelay(key string) (delay time.Duration, ok bool) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	var plannedAt time.Time
+	if qi, inQueue := q.itemsInQueue[key]; inQueue {
+		plannedAt = qi.plannedToStartWorkAt
+	} else if qi, beingProcessed := q.itemsBeingProcessed[key]; beingProcessed {
+		plannedAt = qi.redirtiedAt
+	} else {
+		return 0, false
+	}
+	if delay = plannedAt.Sub(q.clock.Now()); delay < 0 {
+		delay = 0
+	}
+	return delay, true
+}
+
+// OldestInFlight returns the key which has been processed for the longest time, and how long ago it was picked up by a
+// worker. ok is false if no items are being processed. It allows detecting handlers which are stuck.
+func (q *Queue) OldestInFlight() (key string, age time.Duration, ok bool) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	var oldest *queueItem
+	for _, qi := range q.itemsBeingProcessed {
+		if oldest == nil || qi.startedProcessingAt.Before(oldest.startedProcessingAt) {
+			oldest = qi
+		}
+	}
+	if oldest == nil {
+		return "", 0, false
+	}
+	return oldest.key, q.clock.Since(oldest.startedProcessingAt), true
+}
+
 // Len includes items that are in the queue, and are being processed
 func (q *Queue) Len() int {
 	q.lock.Lock()
 	defer q.lock.Unlock()
-	if q.items.Len() != len(q.itemsInQueue) {
-		panic("Internally inconsistent state")
+	if q.pending() != len(q.itemsInQueue) {
+		log.G(q.withLogger(context.TODO())).Errorf(
+			"queue %s is internally inconsistent, items heaps have %d items, but %d items are tracked as in queue",
+			q.name, q.pending(), len(q.itemsInQueue))
 	}
 
-	return q.items.Len() + len(q.itemsBeingProcessed)
+	return q.pending() + len(q.itemsBeingProcessed)
+}
+
+// checkInvariants verifies the items heap and maps agree with each other. It walks the whole heap, so it is meant
+// for debugging. It must be called with the lock held.
+func (q *Queue) checkInvariants() error {
+	if q.pending() != len(q.itemsInQueue) {
+		return fmt.Errorf("items heaps have %d items, but %d items are tracked as in queue", q.pending(),
+			len(q.itemsInQueue))
+	}
+	prioritized := 0
+	for _, h := range []struct {
+		name   string
+		items  []*queueItem
+		ready  bool
+		before func(a, b *queueItem) bool
+	}{
+		{name: "items", items: q.items, before: (*queueItem).before},
+		{name: "ready", items: q.ready.itemHeap, ready: true, before: (*queueItem).readyBefore},
+	} {
+		for idx, qi := range h.items {
+			if qi.index != idx || qi.ready != h.ready {
+				return fmt.Errorf("item %q is at index %d of the %s heap, but has index %d", qi.key, idx, h.name,
+					qi.index)
+			}
+			if parent := (idx - 1) / 2; idx > 0 && h.before(qi, h.items[parent]) {
+				return fmt.Errorf("item %q is ordered before its parent %q", qi.key, h.items[parent].key)
+			}
+			if tracked, ok := q.itemsInQueue[qi.key]; !ok || tracked != qi {
+				return fmt.Errorf("item %q in %s heap is not tracked as in queue", qi.key, h.name)
+			}
+			if _, ok := q.itemsBeingProcessed[qi.key]; ok {
+				return fmt.Errorf("item %q is both in queue and being processed", qi.key)
+			}
+			if qi.priority != 0 {
+				prioritized++
+			}
+		}
+	}
+	if prioritized != q.prioritized {
+		return fmt.Errorf("%d items have a priority, but %d are counted", prioritized, q.prioritized)
+	}
+	return nil
 }
 
 // Run starts the workers
 //
-// It blocks until context is cancelled, and all of the workers exit.
+// It blocks until context is cancelled, and all of the workers exit. Once it returned, Run can be called again, and
+// the new workers pick up the items which were requeued by the previous run or enqueued in between. A queue which was
+// drained stays drained.
+//
+// It panics if workers is not greater than 0 or the queue is already running, use RunE to handle these as errors.
 func (q *Queue) Run(ctx context.Context, workers int) {
+	if err := q.RunE(ctx, workers); err != nil {
+		panic(err.Error())
+	}
+}
+
+// RunE is like Run, but returns an error instead of panicking if workers is not greater than 0, or ErrAlreadyRunning
+// if the queue is already running. Otherwise it returns nil once the workers exited.
+func (q *Queue) RunE(ctx context.Context, workers int) error {
 	if workers <= 0 {
-		panic(fmt.Sprintf("Workers must be greater than 0, got: %d", workers))
+		return fmt.Errorf("workers must be greater than 0, got: %d", workers)
 	}
 
 	q.lock.Lock()
 	if q.running {
-		panic(fmt.Sprintf("Queue %s is already running", q.name))
+		q.lock.Unlock()
+		// Running can be used to check for this beforehand
+		return fmt.Errorf("queue %s: %w", q.name, ErrAlreadyRunning)
 	}
 	q.running = true
 	q.lock.Unlock()
+	ctx = q.withLogger(ctx)
+	// This runs once all workers have exited, leaving the queue ready to be run again.
 	defer func() {
 		q.lock.Lock()
 		defer q.lock.Unlock()
 		q.running = false
+		q.workerCtx = nil
+		// Workers finish the items they picked up before exiting, so none are left in flight.
+		if len(q.itemsBeingProcessed) > 0 {
+			log.G(ctx).Errorf("queue %s stopped with %d items still being processed", q.name,
+				len(q.itemsBeingProcessed))
+		}
+		// Drop a wakeup no worker is left to consume, the workers of the next run look at the items first anyway.
+		select {
+		case <-q.wakeupCh:
+		default:
+		}
 	}()
 
 	// Make sure all workers are stopped before we finish up.
@@ -276,27 +936,86 @@ func (q *Queue) Run(ctx context.Context, workers int) {
 	defer cancel()
 
 	group := &wait.Group{}
-	for i := 0; i < workers; i++ {
-		// This is required because i is referencing a mutable variable and that's running in a separate goroutine
-		idx := i
-		group.StartWithContext(ctx, func(ctx context.Context) {
-			q.worker(ctx, idx)
-		})
+	q.lock.Lock()
+	q.workerCtx = ctx
+	q.workerGroup = group
+	q.nextWorkerID = 0
+	q.scaleWorkers(workers)
+	if q.inFlightDeadline > 0 {
+		group.StartWithContext(ctx, q.watchInFlight)
 	}
+	q.lock.Unlock()
 	defer group.Wait()
 	<-ctx.Done()
+
+	// Stop SetWorkers from adding to the group while we wait on it
+	q.lock.Lock()
+	q.workerGroup = nil
+	q.workerStops = nil
+	q.lock.Unlock()
+	return nil
+}
+
+// SetWorkers changes the number of workers of a running queue to n. Additional workers are started straight away,
+// while workers which are no longer needed exit once they are done with the item they are processing.
+//
+// It is safe to call concurrently, and returns an error if the queue is not running.
+func (q *Queue) SetWorkers(ctx context.Context, n int) error {
+	if n <= 0 {
+		return fmt.Errorf("workers must be greater than 0, got: %d", n)
+	}
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if !q.running || q.workerGroup == nil {
+		return fmt.Errorf("queue %s is not running", q.name)
+	}
+
+	ctx = q.withLogger(ctx)
+	if log.Enabled(ctx, log.DebugLevel) {
+		log.G(ctx).WithFields(map[string]interface{}{
+			"queue":   q.name,
+			"current": len(q.workerStops),
+			"target":  n,
+		}).Debug("Rescaling queue workers")
+	}
+	q.scaleWorkers(n)
+	return nil
+}
+
+// scaleWorkers starts or stops workers until there are n of them. It must be called with the lock held, while the
+// queue is running.
+func (q *Queue) scaleWorkers(n int) {
+	runCtx := q.workerCtx
+	for len(q.workerStops) < n {
+		stopCtx, stop := context.WithCancel(runCtx)
+		idx := q.nextWorkerID
+		q.nextWorkerID++
+		q.workerStops = append(q.workerStops, stop)
+		q.workerGroup.StartWithContext(stopCtx, func(stopCtx context.Context) {
+			q.worker(runCtx, stopCtx, idx)
+		})
+	}
+	for len(q.workerStops) > n {
+		last := len(q.workerStops) - 1
+		q.workerStops[last]()
+		q.workerStops[last] = nil
+		q.workerStops = q.workerStops[:last]
+	}
 }
 
-func (q *Queue) worker(ctx context.Context, i int) {
+// worker processes items until stopCtx is done. Items are handled with ctx, so a worker which is asked to stop still
+// finishes the item it is working on.
+func (q *Queue) worker(ctx, stopCtx context.Context, i int) {
 	ctx = log.WithLogger(ctx, log.G(ctx).WithFields(map[string]interface{}{
 		"workerId": i,
 		"queue":    q.name,
 	}))
-	for q.handleQueueItem(ctx) {
+	for q.handleQueueItem(ctx, stopCtx) {
 	}
 }
 
-func (q *Queue) getNextItem(ctx context.Context) (*queueItem, error) {
+func (q *Queue) getNextItems(ctx context.Context, max int) ([]*queueItem, error) {
 	if err := q.waitForNextItemSemaphore.Acquire(ctx, 1); err != nil {
 		return nil, err
 	}
@@ -304,8 +1023,23 @@ func (q *Queue) getNextItem(ctx context.Context) (*queueItem, error) {
 
 	for {
 		q.lock.Lock()
-		element := q.items.Front()
-		if element == nil {
+		if q.paused {
+			// Wait to be resumed
+			q.lock.Unlock()
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-q.wakeupCh:
+			}
+			continue
+		}
+		qi := q.next()
+		if qi == nil {
+			if q.draining {
+				// Nothing left to do, let the worker exit
+				q.lock.Unlock()
+				return nil, errQueueDrained
+			}
 			// Wait for the next item
 			q.lock.Unlock()
 			select {
@@ -314,16 +1048,24 @@ func (q *Queue) getNextItem(ctx context.Context) (*queueItem, error) {
 			case <-q.wakeupCh:
 			}
 		} else {
-			qi := element.Value.(*queueItem)
-			timeUntilProcessing := time.Until(qi.plannedToStartWorkAt)
+			timeUntilProcessing := qi.plannedToStartWorkAt.Sub(q.clock.Now())
 
 			// Do we need to sleep? If not, let's party.
 			if timeUntilProcessing <= 0 {
-				q.itemsBeingProcessed[qi.key] = qi
-				q.items.Remove(element)
-				delete(q.itemsInQueue, qi.key)
+				items := make([]*queueItem, 0, 1)
+				for len(items) < max {
+					qi = q.next()
+					if qi == nil || qi.plannedToStartWorkAt.After(q.clock.Now()) {
+						break
+					}
+					q.removeItem(qi)
+					q.chargeFairShare(qi)
+					qi.startedProcessingAt = q.clock.Now()
+					q.itemsBeingProcessed[qi.key] = qi
+					items = append(items, qi)
+				}
 				q.lock.Unlock()
-				return qi, nil
+				return items, nil
 			}
 
 			q.lock.Unlock()
@@ -347,22 +1089,33 @@ func (q *Queue) getNextItem(ctx context.Context) (*queueItem, error) {
 // handleQueueItem handles a single item
 //
 // A return value of "false" indicates that further processing should be stopped.
-func (q *Queue) handleQueueItem(ctx context.Context) bool {
-	ctx, span := trace.StartSpan(ctx, "handleQueueItem")
+func (q *Queue) handleQueueItem(ctx, stopCtx context.Context) bool {
+	ctx, span := q.startSpan(ctx, "handleQueueItem")
 	defer span.End()
 
-	qi, err := q.getNextItem(ctx)
+	if q.batchHandler != nil {
+		items, err := q.getNextItems(stopCtx, q.maxBatchSize)
+		if err != nil {
+			span.SetStatus(err)
+			return false
+		}
+		q.handleQueueItemBatch(ctx, items)
+		return true
+	}
+
+	items, err := q.getNextItems(stopCtx, 1)
 	if err != nil {
 		span.SetStatus(err)
 		return false
 	}
+	qi := items[0]
 
 	// We expect strings to come off the work Queue.
 	// These are of the form namespace/name.
 	// We do this as the delayed nature of the work Queue means the items in the informer cache may actually be more u
 	// to date that when the item was initially put onto the workqueue.
 	ctx = span.WithField(ctx, "key", qi.key)
-	log.G(ctx).Debug("Got Queue object")
+	log.Debug(ctx, "Got Queue object")
 
 	err = q.handleQueueItemObject(ctx, qi)
 	if err != nil {
@@ -371,7 +1124,7 @@ func (q *Queue) handleQueueItem(ctx context.Context) bool {
 		log.G(ctx).WithError(err).Error("Error processing Queue item")
 		return true
 	}
-	log.G(ctx).Debug("Processed Queue item")
+	log.Debug(ctx, "Processed Queue item")
 
 	return true
 }
@@ -379,7 +1132,10 @@ func (q *Queue) handleQueueItem(ctx context.Context) bool {
 func (q *Queue) handleQueueItemObject(ctx context.Context, qi *queueItem) error {
 	// This is a separate function / span, because the handleQueueItem span is the time spent waiting for the object
 	// plus the time spend handling the object. Instead, this function / span is scoped to a single object.
-	ctx, span := trace.StartSpan(ctx, "handleQueueItemObject")
+	if qi.lifecycle != nil {
+		ctx = withParent(ctx, qi.lifecycle.ctx)
+	}
+	ctx, span := q.startSpan(ctx, "handleQueueItemObject")
 	defer span.End()
 
 	ctx = span.WithFields(ctx, map[string]interface{}{
@@ -396,49 +1152,370 @@ func (q *Queue) handleQueueItemObject(ctx context.Context, qi *queueItem) error
 	// Add the current key as an attribute to the current span.
 	ctx = span.WithField(ctx, "key", qi.key)
 	// Run the syncHandler, passing it the namespace/name string of the Pod resource to be synced.
-	err := q.handler(ctx, qi.key)
+	start := q.clock.Now()
+	err := q.runHandler(withValues(ctx, qi.values), qi)
+	handled := q.clock.Since(start)
+	q.metrics.duration.Observe(handled.Seconds())
+
+	return q.finishItem(ctx, qi, err, start, handled)
+}
+
+// handleQueueItemBatch hands the keys of items to the batch handler in a single call, and then finishes every item
+// with the error returned for its key, so each of them is retried or forgotten on its own.
+func (q *Queue) handleQueueItemBatch(ctx context.Context, items []*queueItem) {
+	ctx, span := q.startSpan(ctx, "handleQueueItemBatch")
+	defer span.End()
+
+	keys := make([]string, len(items))
+	for i, qi := range items {
+		keys[i] = qi.key
+	}
+	ctx = span.WithField(ctx, "batchSize", len(keys))
+
+	handlerCtx := ctx
+	if q.handlerTimeout > 0 {
+		var cancel context.CancelFunc
+		handlerCtx, cancel = context.WithTimeout(ctx, q.handlerTimeout)
+		defer cancel()
+	}
+	start := q.clock.Now()
+	errs := q.batchHandler(handlerCtx, keys)
+	handled := q.clock.Since(start)
+	q.metrics.duration.Observe(handled.Seconds())
+
+	failed := 0
+	for _, qi := range items {
+		itemCtx := span.WithField(ctx, "key", qi.key)
+		if err := q.finishItem(itemCtx, qi, errs[qi.key], start, handled); err != nil {
+			failed++
+			log.G(itemCtx).WithError(err).Error("Error processing Queue item")
+		}
+	}
+	if failed > 0 {
+		span.SetStatus(fmt.Errorf("%d of %d keys in batch failed", failed, len(keys)))
+	}
+}
+
+// finishItem retries or forgets the item once its handler returned err, and calls the callbacks registered for it.
+// start is when the handler started, and handled is how long it took.
+func (q *Queue) finishItem(ctx context.Context, qi *queueItem, err error, start time.Time,
+	handled time.Duration) error {
+	// onProcessed is read under the lock, but called after it is released.
+	var onProcessed ProcessedFunc
+	defer func(handlerErr error) {
+		if onProcessed != nil {
+			onProcessed(qi.key, start.Sub(qi.originallyAdded), handled, handlerErr)
+		}
+	}(err)
+
+	// onEmpty is set if handling this item emptied the queue. Like the dead letter handler, it is called without
+	// holding the lock.
+	var onEmpty func()
+	defer func() {
+		if onEmpty != nil {
+			onEmpty()
+		}
+	}()
+
+	// deadLetterErr is set if the key is forgotten due to maximum retries reached, or a permanent error. This is
+	// deferred before taking the lock, so the dead letter handler is called without holding it.
+	var deadLetterErr error
+	defer func() {
+		if deadLetterErr != nil && q.deadLetterHandler != nil {
+			q.deadLetterHandler(ctx, qi.key, deadLetterErr)
+		}
+	}()
 
 	q.lock.Lock()
 	defer q.lock.Unlock()
+	onProcessed = q.onProcessed
+	defer func() {
+		if q.becameEmpty() {
+			onEmpty = q.onEmpty
+		}
+	}()
+	defer q.signalDrained()
 
 	delete(q.itemsBeingProcessed, qi.key)
+	q.recordProcessed(qi.key)
 	if qi.forget {
 		q.ratelimiter.Forget(qi.key)
-		log.G(ctx).WithError(err).Warnf("forgetting %q as told to forget while in progress", qi.key)
+		log.G(ctx).WithError(err).WithField("reason", qi.forgetReason).
+			Warnf("forgetting %q as told to forget while in progress", qi.key)
+		qi.endLifecycle(nil)
 		return nil
 	}
 
-	if err != nil {
-		if qi.requeues+1 < MaxRetries {
+	if err != nil && IsPermanent(err) {
+		deadLetterErr = err
+		err = pkgerrors.Wrapf(err, "forgetting %q due to permanent error", qi.key)
+	} else if err != nil {
+		redirtied := !qi.redirtiedAt.IsZero()
+		if qi.requeues+1 < MaxRetries || redirtied {
 			// Put the item back on the work Queue to handle any transient errors.
-			log.G(ctx).WithError(err).Warnf("requeuing %q due to failed sync", qi.key)
-			newQI := q.insert(ctx, qi.key, true, 0)
-			newQI.requeues = qi.requeues + 1
+			if q.sampleFailureLog(qi) {
+				log.G(ctx).WithError(err).WithField("failures", qi.requeues+1).
+					Warnf("requeuing %q due to failed sync", qi.key)
+				qi.failureLoggedAt = q.clock.Now()
+			}
+			requeues := qi.requeues
+			if redirtied {
+				// New work starts over with a fresh budget, see MaxRetries
+				requeues = 0
+				q.ratelimiter.Forget(qi.key)
+			}
+			var newQI *queueItem
+			if q.backoffFunc != nil {
+				newQI = q.insert(ctx, qi.key, false, q.backoffFunc(qi.key, err, requeues))
+			} else {
+				newQI = q.insert(ctx, qi.key, true, 0)
+			}
+			if redirtied {
+				newQI.requeues = 0
+				q.adjustPosition(newQI, qi.redirtiedAt)
+			} else {
+				newQI.requeues = qi.requeues + 1
+			}
 			newQI.originallyAdded = qi.originallyAdded
+			q.setPriority(newQI, qi.priority)
+			newQI.values = qi.values
+			if qi.redirtiedValues != nil {
+				newQI.values = qi.redirtiedValues
+			}
+			newQI.failureLoggedAt = qi.failureLoggedAt
+			newQI.lifecycle = qi.lifecycle
+			q.metrics.retries.Inc()
 
 			return nil
 		}
+		deadLetterErr = err
 		err = pkgerrors.Wrapf(err, "forgetting %q due to maximum retries reached", qi.key)
 	}
 
-	// We've exceeded the maximum retries or we were successful.
+	// We've hit a permanent error, exceeded the maximum retries, or we were successful.
 	q.ratelimiter.Forget(qi.key)
+	qi.endLifecycle(err)
 	if !qi.redirtiedAt.IsZero() {
-		newQI := q.insert(ctx, qi.key, qi.redirtiedWithRatelimit, time.Until(qi.redirtiedAt))
+		newQI := q.insert(ctx, qi.key, qi.redirtiedWithRatelimit, qi.redirtiedAt.Sub(q.clock.Now()))
 		newQI.addedViaRedirty = true
+		q.startLifecycle(newQI)
+		q.setPriority(newQI, qi.priority)
+		newQI.values = qi.values
+		if qi.redirtiedValues != nil {
+			newQI.values = qi.redirtiedValues
+		}
 	}
 
 	return err
 }
 
+// debounceDelay returns how long a key which is added to the queue at now has to wait for the debounce window since it
+// was last processed to pass. It must be called with the lock held.
+func (q *Queue) debounceDelay(key string, now time.Time) time.Duration {
+	if q.debounce <= 0 {
+		return 0
+	}
+	last, ok := q.lastProcessed[key]
+	if !ok {
+		return 0
+	}
+	if remaining := last.Add(q.debounce).Sub(now); remaining > 0 {
+		return remaining
+	}
+	delete(q.lastProcessed, key)
+	return 0
+}
+
+// recordProcessed starts the debounce window of key. Keys whose window passed are removed at most once per window, so
+// keys which are not enqueued again do not pile up. It must be called with the lock held.
+func (q *Queue) recordProcessed(key string) {
+	if q.debounce <= 0 {
+		return
+	}
+	now := q.clock.Now()
+	q.lastProcessed[key] = now
+	if now.Sub(q.lastProcessedPruned) < q.debounce {
+		return
+	}
+	q.lastProcessedPruned = now
+	for k, last := range q.lastProcessed {
+		if now.Sub(last) >= q.debounce {
+			delete(q.lastProcessed, k)
+		}
+	}
+}
+
+// sampleFailureLog returns true if the failed sync of qi should be logged. Without log sampling every failure is
+// logged, otherwise the first failure of a key, every Nth one, and the first one after the sampling interval passed.
+func (q *Queue) sampleFailureLog(qi *queueItem) bool {
+	if q.logSampleEvery <= 0 && q.logSampleInterval <= 0 {
+		return true
+	}
+	failures := qi.requeues + 1
+	if failures == 1 || q.logSampleEvery > 0 && failures%q.logSampleEvery == 0 {
+		return true
+	}
+	return q.logSampleInterval > 0 && q.clock.Since(qi.failureLoggedAt) >= q.logSampleInterval
+}
+
+// handlerFor returns the handler responsible for key
+func (q *Queue) handlerFor(key string) ItemHandler {
+	if q.dispatcher != nil {
+		if handler := q.dispatcher(key); handler != nil {
+			return handler
+		}
+	}
+	if q.handler == nil {
+		return func(context.Context, string) error {
+			return Permanentf("queue %s has no handler for key %q", q.name, key)
+		}
+	}
+	return q.handler
+}
+
+// runHandler calls the handler of the item. If a handler timeout or an in-flight deadline is set, the handler is given
+// a context which is cancelled once either passes. The handler is always waited for, so the key is not processed again
+// before it returned. If it fails once its context is done, the error returned for it is not permanent, so the key is
+// retried.
+func (q *Queue) runHandler(ctx context.Context, qi *queueItem) error {
+	key := qi.key
+	handler := q.handlerFor(key)
+	if q.handlerTimeout <= 0 && q.inFlightDeadline <= 0 && !q.cancelOnForget {
+		return handler(ctx, key)
+	}
+
+	var cancel context.CancelFunc
+	if q.handlerTimeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, q.handlerTimeout)
+	} else {
+		ctx, cancel = context.WithCancel(ctx)
+	}
+	defer cancel()
+	if q.inFlightDeadline > 0 || q.cancelOnForget {
+		// The watchdog cancels the handler through this once the item exceeds the in-flight deadline, and Forget once
+		// the item is forgotten
+		q.lock.Lock()
+		qi.cancel = cancel
+		q.lock.Unlock()
+	}
+
+	// The handler is waited for even once its context is done, so the key stays being processed until it returns, and
+	// is never handed to another worker while the handler is still running.
+	err := handler(ctx, key)
+	if err == nil || ctx.Err() == nil {
+		return err
+	}
+
+	// The handler was cancelled, make sure the key is retried even if it reported the error as permanent.
+	q.lock.Lock()
+	exceeded := qi.inFlightDeadlineExceeded
+	q.lock.Unlock()
+	switch {
+	case exceeded:
+		return fmt.Errorf("handler of %q exceeded in-flight deadline of %s: %v", key, q.inFlightDeadline, err)
+	case ctx.Err() == context.Canceled:
+		// The key was forgotten, or the queue is shutting down
+		return pkgerrors.Wrapf(ctx.Err(), "handler of %q was cancelled", key)
+	default:
+		return pkgerrors.Wrapf(ctx.Err(), "handler of %q timed out after %s: %v", key, q.handlerTimeout, err)
+	}
+}
+
+// watchInFlight cancels the handlers of items which have been processed for longer than the in-flight deadline, until
+// ctx is done.
+func (q *Queue) watchInFlight(ctx context.Context) {
+	for {
+		timer := q.clock.NewTimer(q.inFlightDeadline / 4)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C():
+		}
+
+		q.lock.Lock()
+		for _, qi := range q.itemsBeingProcessed {
+			if qi.cancel == nil || qi.inFlightDeadlineExceeded {
+				continue
+			}
+			if q.clock.Since(qi.startedProcessingAt) <= q.inFlightDeadline {
+				continue
+			}
+			log.G(ctx).Warnf("cancelling handler of %q, which exceeded the in-flight deadline of %s", qi.key,
+				q.inFlightDeadline)
+			qi.inFlightDeadlineExceeded = true
+			qi.cancel()
+		}
+		q.lock.Unlock()
+	}
+}
+
+// StartResync enqueues the keys returned by keys without a rate limit every interval, so keys whose events were missed
+// are processed eventually. It returns straight away, and stops once ctx is done. Keys already in the queue keep their
+// position.
+func (q *Queue) StartResync(ctx context.Context, keys func() []string, interval time.Duration) {
+	ctx = q.withLogger(ctx)
+	go func() {
+		for {
+			timer := q.clock.NewTimer(interval)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			case <-timer.C():
+			}
+
+			for _, key := range keys() {
+				if err := q.EnqueueWithoutRateLimit(ctx, key); err != nil {
+					log.G(ctx).WithError(err).Warnf("queue %s could not resync %q", q.name, key)
+				}
+			}
+		}
+	}()
+}
+
+// jitter returns delay extended by a random fraction of up to jitterFraction of it. Since the delay only ever grows,
+// items are never planned before now. It must be called with the lock held.
+func (q *Queue) jitter(delay time.Duration) time.Duration {
+	if q.jitterFraction <= 0 || delay <= 0 {
+		return delay
+	}
+	return delay + time.Duration(q.rand.Float64()*q.jitterFraction*float64(delay))
+}
+
+// Keys returns the keys waiting in the queue, in the order they are planned to start work in.
+func (q *Queue) Keys() []string {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	keys := make([]string, 0, q.pending())
+	for _, qi := range q.sortedItems() {
+		keys = append(keys, qi.key)
+	}
+	return keys
+}
+
+// ProcessingKeys returns the keys currently being processed by the workers, sorted alphabetically.
+func (q *Queue) ProcessingKeys() []string {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	keys := make([]string, 0, len(q.itemsBeingProcessed))
+	for key := range q.itemsBeingProcessed {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
 func (q *Queue) String() string {
 	q.lock.Lock()
 	defer q.lock.Unlock()
 
-	items := make([]string, 0, q.items.Len())
+	items := make([]string, 0, q.pending())
 
-	for next := q.items.Front(); next != nil; next = next.Next() {
-		items = append(items, next.Value.(*queueItem).String())
+	for _, qi := range q.sortedItems() {
+		items = append(items, qi.String())
 	}
 	return fmt.Sprintf("<items:%s>", items)
 }
@@ -0,0 +1,1824 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/clusterrouter-io/clusterrouter/pkg/utils/log"
+	"github.com/clusterrouter-io/clusterrouter/pkg/utils/trace"
+	"k8s.io/client-go/util/workqueue"
+	clocktesting "k8s.io/utils/clock/testing"
+)
+
+// fastRateLimiter retries failed keys after a millisecond, so tests do not wait for the backoff
+func fastRateLimiter() workqueue.RateLimiter {
+	return workqueue.NewItemExponentialFailureRateLimiter(time.Millisecond, time.Millisecond)
+}
+
+// runQueue runs q with workers until the test ends
+func runQueue(t *testing.T, q *Queue, workers int) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		q.Run(ctx, workers)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+}
+
+// waitFor polls cond until it returns true, and fails the test if it does not within a few seconds
+func waitFor(t *testing.T, msg string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", msg)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// exclusiveHandler returns a handler which ignores its context and blocks for hold, and records whether a key was ever
+// processed twice at once
+type exclusiveHandler struct {
+	hold    time.Duration
+	running int32
+	overlap int32
+	calls   int32
+}
+
+func (h *exclusiveHandler) handle(ctx context.Context, key string) error {
+	if atomic.AddInt32(&h.running, 1) > 1 {
+		atomic.StoreInt32(&h.overlap, 1)
+	}
+	defer atomic.AddInt32(&h.running, -1)
+	call := atomic.AddInt32(&h.calls, 1)
+	time.Sleep(h.hold)
+	if call == 1 {
+		return errors.New("first call fails")
+	}
+	return nil
+}
+
+func TestHandlerTimeoutWaitsForHandler(t *testing.T) {
+	h := &exclusiveHandler{hold: 50 * time.Millisecond}
+	q := New(fastRateLimiter(), t.Name(), h.handle, WithHandlerTimeout(5*time.Millisecond))
+	runQueue(t, q, 4)
+
+	if err := q.Enqueue(context.Background(), "key"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "key to be processed twice", func() bool {
+		return atomic.LoadInt32(&h.calls) >= 2 && q.Empty()
+	})
+	if atomic.LoadInt32(&h.overlap) != 0 {
+		t.Fatal("key was processed by two workers at once")
+	}
+	if atomic.LoadInt32(&h.running) != 0 {
+		t.Fatal("handler is still running after the queue emptied")
+	}
+}
+
+func TestHandlerTimeoutCancelsContext(t *testing.T) {
+	var mu sync.Mutex
+	var errs []error
+	q := New(fastRateLimiter(), t.Name(), func(ctx context.Context, key string) error {
+		<-ctx.Done()
+		mu.Lock()
+		defer mu.Unlock()
+		errs = append(errs, ctx.Err())
+		if len(errs) == 1 {
+			return AsPermanent(ctx.Err())
+		}
+		return nil
+	}, WithHandlerTimeout(time.Millisecond))
+	runQueue(t, q, 1)
+
+	if err := q.Enqueue(context.Background(), "key"); err != nil {
+		t.Fatal(err)
+	}
+	// A permanent error returned because of the timeout must not forget the key
+	waitFor(t, "key to be retried", func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(errs) == 2
+	})
+	if !errors.Is(errs[0], context.DeadlineExceeded) {
+		t.Fatalf("expected the handler context to exceed its deadline, got %v", errs[0])
+	}
+}
+
+func TestInFlightDeadlineWaitsForHandler(t *testing.T) {
+	h := &exclusiveHandler{hold: 50 * time.Millisecond}
+	q := New(fastRateLimiter(), t.Name(), h.handle, WithInFlightDeadline(4*time.Millisecond))
+	runQueue(t, q, 4)
+
+	if err := q.Enqueue(context.Background(), "key"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the watchdog to cancel the handler", func() bool {
+		q.lock.Lock()
+		defer q.lock.Unlock()
+		qi, ok := q.itemsBeingProcessed["key"]
+		return ok && qi.inFlightDeadlineExceeded
+	})
+	// The key stays being processed until the handler ignoring its context returns
+	if n := len(q.ProcessingKeys()); n != 1 {
+		t.Fatalf("expected the key to still be processed, got %d keys", n)
+	}
+	if err := q.Enqueue(context.Background(), "key"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "key to be processed again", func() bool {
+		return atomic.LoadInt32(&h.calls) >= 2 && q.Empty()
+	})
+	if atomic.LoadInt32(&h.overlap) != 0 {
+		t.Fatal("key was processed by two workers at once")
+	}
+}
+
+// newFakeClockQueue returns a queue driven by a fake clock, whose handler does nothing
+func newFakeClockQueue(t *testing.T, opts ...Option) (*Queue, *clocktesting.FakeClock) {
+	t.Helper()
+	fakeClock := clocktesting.NewFakeClock(time.Date(2022, 8, 1, 12, 0, 0, 0, time.UTC))
+	opts = append([]Option{WithClock(fakeClock)}, opts...)
+	q := New(fastRateLimiter(), t.Name(), func(ctx context.Context, key string) error { return nil }, opts...)
+	return q, fakeClock
+}
+
+func TestPeek(t *testing.T) {
+	q, fakeClock := newFakeClockQueue(t)
+	if _, _, ok := q.Peek(); ok {
+		t.Fatal("expected nothing to peek at in an empty queue")
+	}
+	ctx := context.Background()
+	if err := q.EnqueueWithoutRateLimitWithDelay(ctx, "later", 2*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.EnqueueWithoutRateLimitWithDelay(ctx, "sooner", time.Second); err != nil {
+		t.Fatal(err)
+	}
+	key, plannedAt, ok := q.Peek()
+	if !ok || key != "sooner" {
+		t.Fatalf("expected to peek at sooner, got %q, %t", key, ok)
+	}
+	if want := fakeClock.Now().Add(time.Second); !plannedAt.Equal(want) {
+		t.Fatalf("expected sooner to be planned at %v, got %v", want, plannedAt)
+	}
+	if n := q.Len(); n != 2 {
+		t.Fatalf("expected Peek to leave both keys in the queue, got %d", n)
+	}
+}
+
+func TestDrain(t *testing.T) {
+	const n = 50
+	var mu sync.Mutex
+	handled := map[string]bool{}
+	q := New(fastRateLimiter(), t.Name(), func(ctx context.Context, key string) error {
+		mu.Lock()
+		defer mu.Unlock()
+		handled[key] = true
+		return nil
+	})
+	q.Pause()
+	ctx := context.Background()
+	for i := 0; i < n; i++ {
+		if err := q.EnqueueWithoutRateLimit(ctx, fmt.Sprintf("key-%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	runQueue(t, q, 4)
+	q.Resume()
+
+	drainCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	if err := q.Drain(drainCtx); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	if len(handled) != n {
+		t.Fatalf("expected all %d keys to be handled before Drain returned, got %d", n, len(handled))
+	}
+	mu.Unlock()
+
+	// A drained queue accepts no new work
+	if err := q.EnqueueWithoutRateLimit(ctx, "late"); err != nil {
+		t.Fatal(err)
+	}
+	if !q.Empty() {
+		t.Fatal("expected keys enqueued after Drain to be dropped")
+	}
+}
+
+func TestDrainContextDone(t *testing.T) {
+	q, _ := newFakeClockQueue(t)
+	if err := q.EnqueueWithoutRateLimit(context.Background(), "key"); err != nil {
+		t.Fatal(err)
+	}
+	// Nothing processes the key, since the queue is not running
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := q.Drain(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected Drain to give up once its context is done, got %v", err)
+	}
+}
+
+func TestPauseResume(t *testing.T) {
+	var mu sync.Mutex
+	var handled []string
+	q := New(fastRateLimiter(), t.Name(), func(ctx context.Context, key string) error {
+		mu.Lock()
+		defer mu.Unlock()
+		handled = append(handled, key)
+		return nil
+	})
+	runQueue(t, q, 1)
+	q.Pause()
+
+	ctx := context.Background()
+	for _, key := range []string{"a", "b", "c"} {
+		if err := q.EnqueueWithoutRateLimit(ctx, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(50 * time.Millisecond)
+	mu.Lock()
+	if len(handled) != 0 {
+		t.Fatalf("expected no keys to be handled while paused, got %v", handled)
+	}
+	mu.Unlock()
+	if keys := q.Keys(); !reflect.DeepEqual(keys, []string{"a", "b", "c"}) {
+		t.Fatalf("expected the keys to keep their order while paused, got %v", keys)
+	}
+
+	q.Resume()
+	waitFor(t, "keys to be handled after resuming", q.Empty)
+	mu.Lock()
+	defer mu.Unlock()
+	if !reflect.DeepEqual(handled, []string{"a", "b", "c"}) {
+		t.Fatalf("expected the keys to be handled in order, got %v", handled)
+	}
+}
+
+// deadLetters records the calls of a dead letter handler
+type deadLetters struct {
+	mu   sync.Mutex
+	keys []string
+	errs []error
+}
+
+func (d *deadLetters) handle(ctx context.Context, key string, lastErr error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.keys = append(d.keys, key)
+	d.errs = append(d.errs, lastErr)
+}
+
+func (d *deadLetters) len() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return len(d.keys)
+}
+
+func TestDeadLetterHandler(t *testing.T) {
+	var calls int32
+	dead := &deadLetters{}
+	q := New(fastRateLimiter(), t.Name(), func(ctx context.Context, key string) error {
+		if key == "ok" {
+			return nil
+		}
+		return fmt.Errorf("attempt %d failed", atomic.AddInt32(&calls, 1))
+	}, WithDeadLetterHandler(dead.handle))
+	runQueue(t, q, 1)
+
+	ctx := context.Background()
+	for _, key := range []string{"ok", "poison"} {
+		if err := q.Enqueue(ctx, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor(t, "poison to be dead lettered", func() bool { return dead.len() == 1 && q.Empty() })
+	// Give a second call a chance to show up
+	time.Sleep(20 * time.Millisecond)
+
+	dead.mu.Lock()
+	defer dead.mu.Unlock()
+	if len(dead.keys) != 1 || dead.keys[0] != "poison" {
+		t.Fatalf("expected only poison to be dead lettered once, got %v", dead.keys)
+	}
+	if n := atomic.LoadInt32(&calls); n != MaxRetries {
+		t.Fatalf("expected %d attempts, got %d", MaxRetries, n)
+	}
+	if want := fmt.Sprintf("attempt %d failed", MaxRetries); dead.errs[0].Error() != want {
+		t.Fatalf("expected the last error %q, got %q", want, dead.errs[0])
+	}
+}
+
+func TestDeadLetterHandlerNotCalledOnForget(t *testing.T) {
+	dead := &deadLetters{}
+	q, _ := newFakeClockQueue(t, WithDeadLetterHandler(dead.handle))
+	if err := q.Enqueue(context.Background(), "key"); err != nil {
+		t.Fatal(err)
+	}
+	q.Forget(context.Background(), "key")
+	if dead.len() != 0 {
+		t.Fatal("expected forgotten keys not to be dead lettered")
+	}
+}
+
+// nextKeys hands out n ready items like a worker would, and returns their keys
+func nextKeys(t *testing.T, q *Queue, n int) []string {
+	t.Helper()
+	var keys []string
+	for len(keys) < n {
+		items, err := q.getNextItems(context.Background(), n-len(keys))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, qi := range items {
+			keys = append(keys, qi.key)
+		}
+	}
+	return keys
+}
+
+func TestEnqueueWithPriority(t *testing.T) {
+	q, fakeClock := newFakeClockQueue(t)
+	ctx := context.Background()
+	for _, key := range []string{"low-1", "low-2", "low-3"} {
+		if err := q.EnqueueWithoutRateLimit(ctx, key); err != nil {
+			t.Fatal(err)
+		}
+		fakeClock.Step(time.Millisecond)
+	}
+	for _, key := range []string{"high-1", "high-2"} {
+		if err := q.EnqueueWithPriority(ctx, key, 10); err != nil {
+			t.Fatal(err)
+		}
+		fakeClock.Step(time.Millisecond)
+	}
+	// Raising the priority of a key already in the queue
+	if err := q.EnqueueWithPriority(ctx, "low-3", 5); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"high-1", "high-2", "low-3", "low-1", "low-2"}
+	if got := nextKeys(t, q, len(want)); !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected keys in order %v, got %v", want, got)
+	}
+}
+
+func TestEnqueueWithPriorityNotReady(t *testing.T) {
+	q, fakeClock := newFakeClockQueue(t)
+	ctx := context.Background()
+	if err := q.EnqueueWithoutRateLimit(ctx, "low"); err != nil {
+		t.Fatal(err)
+	}
+	// The priority only applies among items which are ready
+	q.lock.Lock()
+	q.setPriority(q.insert(ctx, "high-later", false, time.Second), 10)
+	q.lock.Unlock()
+
+	if got := nextKeys(t, q, 1); got[0] != "low" {
+		t.Fatalf("expected low to be handed out first, got %v", got)
+	}
+	fakeClock.Step(time.Second)
+	if got := nextKeys(t, q, 1); got[0] != "high-later" {
+		t.Fatalf("expected high-later once ready, got %v", got)
+	}
+}
+
+func TestEnqueueWithPriorityReadyHeap(t *testing.T) {
+	q, fakeClock := newFakeClockQueue(t)
+	ctx := context.Background()
+	checkInvariants := func() {
+		t.Helper()
+		q.lock.Lock()
+		defer q.lock.Unlock()
+		if err := q.checkInvariants(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, key := range []string{"a", "b", "c", "d"} {
+		if err := q.EnqueueWithoutRateLimit(ctx, key); err != nil {
+			t.Fatal(err)
+		}
+		fakeClock.Step(time.Millisecond)
+	}
+	if err := q.EnqueueWithPriority(ctx, "b", 5); err != nil {
+		t.Fatal(err)
+	}
+	// Peeking moves the ready items to the ready heap
+	if key, _, _ := q.Peek(); key != "b" {
+		t.Fatalf("expected b to be handed out next, got %q", key)
+	}
+	checkInvariants()
+
+	// Raising the priority of a ready item, and forgetting another one, keeps the ready heap in order
+	if err := q.EnqueueWithPriority(ctx, "d", 10); err != nil {
+		t.Fatal(err)
+	}
+	q.Forget(ctx, "b")
+	if err := q.EnqueueWithoutRateLimitWithDelay(ctx, "later", time.Second); err != nil {
+		t.Fatal(err)
+	}
+	checkInvariants()
+	if keys := q.Keys(); !reflect.DeepEqual(keys, []string{"a", "c", "d", "later"}) {
+		t.Fatalf("expected the keys in planned order, got %v", keys)
+	}
+
+	want := []string{"d", "a", "c"}
+	if got := nextKeys(t, q, len(want)); !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected keys in order %v, got %v", want, got)
+	}
+	checkInvariants()
+	fakeClock.Step(time.Second)
+	if got := nextKeys(t, q, 1); got[0] != "later" {
+		t.Fatalf("expected later once ready, got %v", got)
+	}
+	checkInvariants()
+}
+
+// finishNext hands out the next ready item like a worker would, and finishes it as if its handler returned err. It
+// returns the key of the item.
+func finishNext(t *testing.T, q *Queue, err error) string {
+	t.Helper()
+	items, getErr := q.getNextItems(context.Background(), 1)
+	if getErr != nil {
+		t.Fatal(getErr)
+	}
+	qi := items[0]
+	_ = q.finishItem(context.Background(), qi, err, q.clock.Now(), 0)
+	return qi.key
+}
+
+func TestNumRequeues(t *testing.T) {
+	q, fakeClock := newFakeClockQueue(t)
+	ctx := context.Background()
+	if n := q.NumRequeues("key"); n != 0 {
+		t.Fatalf("expected 0 requeues for an unknown key, got %d", n)
+	}
+	if err := q.EnqueueWithoutRateLimit(ctx, "key"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 3; i++ {
+		finishNext(t, q, errors.New("failed"))
+		if n := q.NumRequeues("key"); n != i {
+			t.Fatalf("expected %d requeues, got %d", i, n)
+		}
+		fakeClock.Step(time.Second)
+	}
+
+	// The count is also reported while the key is being processed
+	items, err := q.getNextItems(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := q.NumRequeues("key"); n != 3 {
+		t.Fatalf("expected 3 requeues while being processed, got %d", n)
+	}
+	_ = q.finishItem(ctx, items[0], nil, fakeClock.Now(), 0)
+	if n := q.NumRequeues("key"); n != 0 {
+		t.Fatalf("expected the requeues to reset once the key succeeded, got %d", n)
+	}
+}
+
+func TestNumRequeuesRedirty(t *testing.T) {
+	type attempt struct {
+		redirty  bool
+		err      error
+		requeues int
+	}
+	failed := errors.New("failed")
+	tests := []struct {
+		name     string
+		attempts []attempt
+	}{
+		{
+			name:     "pure retries count",
+			attempts: []attempt{{err: failed, requeues: 1}, {err: failed, requeues: 2}},
+		},
+		{
+			name:     "redirtied while failing",
+			attempts: []attempt{{redirty: true, err: failed}},
+		},
+		{
+			name: "retries count again after a redirty",
+			attempts: []attempt{
+				{err: failed, requeues: 1},
+				{err: failed, requeues: 2},
+				{redirty: true, err: failed},
+				{err: failed, requeues: 1},
+			},
+		},
+		{
+			name:     "redirtied while succeeding",
+			attempts: []attempt{{err: failed, requeues: 1}, {redirty: true}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q, fakeClock := newFakeClockQueue(t)
+			ctx := context.Background()
+			if err := q.EnqueueWithoutRateLimit(ctx, "key"); err != nil {
+				t.Fatal(err)
+			}
+			for i, a := range tt.attempts {
+				items, err := q.getNextItems(ctx, 1)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if a.redirty {
+					if err := q.EnqueueWithoutRateLimit(ctx, "key"); err != nil {
+						t.Fatal(err)
+					}
+				}
+				_ = q.finishItem(ctx, items[0], a.err, fakeClock.Now(), 0)
+				if q.Len() != 1 {
+					t.Fatalf("expected the key to be queued again after attempt %d, got %s", i, q)
+				}
+				if n := q.NumRequeues("key"); n != a.requeues {
+					t.Fatalf("expected %d requeues after attempt %d, got %d", a.requeues, i, n)
+				}
+				fakeClock.Step(time.Second)
+			}
+		})
+	}
+}
+
+func TestRedirtyWhileFailingResetsBackoff(t *testing.T) {
+	fakeClock := clocktesting.NewFakeClock(time.Date(2022, 8, 1, 12, 0, 0, 0, time.UTC))
+	ratelimiter := workqueue.NewItemExponentialFailureRateLimiter(time.Second, time.Hour)
+	q := New(ratelimiter, t.Name(), func(ctx context.Context, key string) error { return nil }, WithClock(fakeClock))
+	ctx := context.Background()
+	if err := q.EnqueueWithoutRateLimit(ctx, "key"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		finishNext(t, q, errors.New("failed"))
+		fakeClock.Step(time.Hour)
+	}
+	if n := ratelimiter.NumRequeues("key"); n != 5 {
+		t.Fatalf("expected the rate limiter to back off 5 failures, got %d", n)
+	}
+
+	// Enqueued again without a rate limit while failing, the retry is not held back by the failures before
+	items, err := q.getNextItems(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := q.EnqueueWithoutRateLimit(ctx, "key"); err != nil {
+		t.Fatal(err)
+	}
+	_ = q.finishItem(ctx, items[0], errors.New("failed"), fakeClock.Now(), 0)
+	if delay, ok := q.CurrentDelay("key"); !ok || delay != 0 {
+		t.Fatalf("expected the key to be retried right away, got %s (%t)", delay, ok)
+	}
+	if n := ratelimiter.NumRequeues("key"); n != 1 {
+		t.Fatalf("expected the rate limiter to start over, got %d failures", n)
+	}
+
+	// Enqueued again with a floor beyond the backoff of a first failure, the backoff wins
+	items, err = q.getNextItems(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := q.EnqueueWithRateLimitAndDelay(ctx, "key", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	_ = q.finishItem(ctx, items[0], errors.New("failed"), fakeClock.Now(), 0)
+	if delay, ok := q.CurrentDelay("key"); !ok || delay != time.Second {
+		t.Fatalf("expected the key to be retried after the backoff of a first failure, got %s (%t)", delay, ok)
+	}
+}
+
+func TestRedirtyWhileFailingAfterMaxRetries(t *testing.T) {
+	dead := &deadLetters{}
+	q, _ := newFakeClockQueue(t, WithDeadLetterHandler(dead.handle))
+	ctx := context.Background()
+	if err := q.EnqueueWithoutRateLimit(ctx, "key"); err != nil {
+		t.Fatal(err)
+	}
+	items, err := q.getNextItems(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	items[0].requeues = MaxRetries - 1
+	if err := q.EnqueueWithoutRateLimit(ctx, "key"); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.finishItem(ctx, items[0], errors.New("failed"), q.clock.Now(), 0); err != nil {
+		t.Fatalf("expected the new work to be retried, got %v", err)
+	}
+	if dead.len() != 0 || q.NumRequeues("key") != 0 {
+		t.Fatalf("expected the key to be retried with a fresh budget, got %v dead letters and %s", dead.keys, q)
+	}
+}
+
+func TestLenInconsistentState(t *testing.T) {
+	q, _ := newFakeClockQueue(t)
+	ctx := context.Background()
+	for _, key := range []string{"a", "b"} {
+		if err := q.EnqueueWithoutRateLimit(ctx, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	q.lock.Lock()
+	if err := q.checkInvariants(); err != nil {
+		t.Fatalf("expected a consistent queue, got %v", err)
+	}
+	delete(q.itemsInQueue, "a")
+	err := q.checkInvariants()
+	q.lock.Unlock()
+	if err == nil {
+		t.Fatal("expected the inconsistency to be detected")
+	}
+	// Len degrades to a best effort count instead of panicking
+	if n := q.Len(); n != 2 {
+		t.Fatalf("expected Len to count the items heap, got %d", n)
+	}
+}
+
+func TestCheckInvariantsHeapOrder(t *testing.T) {
+	q, fakeClock := newFakeClockQueue(t)
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		delay := time.Duration(i) * time.Second
+		if err := q.EnqueueWithoutRateLimitWithDelay(ctx, fmt.Sprintf("key-%d", i), delay); err != nil {
+			t.Fatal(err)
+		}
+	}
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	// Moving the front item back without fixing the heap breaks its order
+	q.items[0].plannedToStartWorkAt = fakeClock.Now().Add(time.Hour)
+	if err := q.checkInvariants(); err == nil {
+		t.Fatal("expected the broken heap order to be detected")
+	}
+}
+
+// constantRateLimiter delays every key by delay
+type constantRateLimiter struct {
+	delay time.Duration
+}
+
+func (r constantRateLimiter) When(item interface{}) time.Duration { return r.delay }
+func (r constantRateLimiter) Forget(item interface{})             {}
+func (r constantRateLimiter) NumRequeues(item interface{}) int    { return 0 }
+
+func TestEnqueueWithRateLimitAndDelay(t *testing.T) {
+	tests := []struct {
+		name      string
+		ratelimit time.Duration
+		floor     time.Duration
+		want      time.Duration
+	}{
+		{name: "floor wins", ratelimit: time.Second, floor: 5 * time.Second, want: 5 * time.Second},
+		{name: "rate limit wins", ratelimit: 5 * time.Second, floor: time.Second, want: 5 * time.Second},
+		{name: "no floor", ratelimit: 2 * time.Second, want: 2 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fakeClock := clocktesting.NewFakeClock(time.Date(2022, 8, 1, 12, 0, 0, 0, time.UTC))
+			q := New(constantRateLimiter{delay: tt.ratelimit}, t.Name(),
+				func(ctx context.Context, key string) error { return nil }, WithClock(fakeClock))
+			if err := q.EnqueueWithRateLimitAndDelay(context.Background(), "key", tt.floor); err != nil {
+				t.Fatal(err)
+			}
+			if delay, _ := q.CurrentDelay("key"); delay != tt.want {
+				t.Fatalf("expected a delay of %v, got %v", tt.want, delay)
+			}
+		})
+	}
+}
+
+func TestEnqueueWithRateLimitAndDelayRedirty(t *testing.T) {
+	q, fakeClock := newFakeClockQueue(t)
+	ctx := context.Background()
+	if err := q.EnqueueWithoutRateLimit(ctx, "key"); err != nil {
+		t.Fatal(err)
+	}
+	items, err := q.getNextItems(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// While the key is being processed, the floor is kept for when the processing finishes
+	if err := q.EnqueueWithRateLimitAndDelay(ctx, "key", 3*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	_ = q.finishItem(ctx, items[0], nil, fakeClock.Now(), 0)
+	if delay, ok := q.CurrentDelay("key"); !ok || delay != 3*time.Second {
+		t.Fatalf("expected the redirtied key to wait for the floor, got %v, %t", delay, ok)
+	}
+}
+
+func TestPermanentErrorForgetsKey(t *testing.T) {
+	dead := &deadLetters{}
+	q, _ := newFakeClockQueue(t, WithDeadLetterHandler(dead.handle))
+	if err := q.EnqueueWithoutRateLimit(context.Background(), "key"); err != nil {
+		t.Fatal(err)
+	}
+	finishNext(t, q, AsPermanent(errors.New("not found")))
+	if !q.Empty() {
+		t.Fatalf("expected the key to be forgotten without retries, got %s", q)
+	}
+	if dead.len() != 1 || dead.keys[0] != "key" {
+		t.Fatalf("expected key to be dead lettered once, got %v", dead.keys)
+	}
+	if !IsPermanent(dead.errs[0]) {
+		t.Fatalf("expected the permanent error to be dead lettered, got %v", dead.errs[0])
+	}
+}
+
+func TestTransientErrorRetriesKey(t *testing.T) {
+	dead := &deadLetters{}
+	q, _ := newFakeClockQueue(t, WithDeadLetterHandler(dead.handle))
+	if err := q.EnqueueWithoutRateLimit(context.Background(), "key"); err != nil {
+		t.Fatal(err)
+	}
+	finishNext(t, q, errors.New("connection refused"))
+	if q.Len() != 1 || q.NumRequeues("key") != 1 {
+		t.Fatalf("expected the key to be requeued once, got %s", q)
+	}
+	if dead.len() != 0 {
+		t.Fatalf("expected nothing to be dead lettered, got %v", dead.keys)
+	}
+}
+
+func TestBackoffFunc(t *testing.T) {
+	errThrottled := errors.New("429 too many requests")
+	errRefused := errors.New("connection refused")
+	var requeues []int
+	q, fakeClock := newFakeClockQueue(t, WithBackoffFunc(func(key string, err error, n int) time.Duration {
+		requeues = append(requeues, n)
+		if errors.Is(err, errThrottled) {
+			return 100 * time.Millisecond
+		}
+		return time.Minute
+	}))
+	ctx := context.Background()
+	for _, key := range []string{"throttled", "refused"} {
+		if err := q.EnqueueWithoutRateLimit(ctx, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	finishNext(t, q, errThrottled)
+	finishNext(t, q, errRefused)
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	for key, want := range map[string]time.Duration{"throttled": 100 * time.Millisecond, "refused": time.Minute} {
+		if got := q.itemsInQueue[key].plannedToStartWorkAt; !got.Equal(fakeClock.Now().Add(want)) {
+			t.Fatalf("expected %s to be planned in %v, got %v", key, want, got.Sub(fakeClock.Now()))
+		}
+	}
+	if !reflect.DeepEqual(requeues, []int{0, 0}) {
+		t.Fatalf("expected the backoff to be computed for the first requeues, got %v", requeues)
+	}
+}
+
+func TestOnEmpty(t *testing.T) {
+	q, _ := newFakeClockQueue(t)
+	var fired int32
+	q.OnEmpty(func() { atomic.AddInt32(&fired, 1) })
+	ctx := context.Background()
+	// Forgetting a key which is not in the queue does not count as running out of work
+	q.Forget(ctx, "unknown")
+	if n := atomic.LoadInt32(&fired); n != 0 {
+		t.Fatalf("expected no callback for a queue which starts empty, got %d", n)
+	}
+
+	for _, key := range []string{"a", "b"} {
+		if err := q.EnqueueWithoutRateLimit(ctx, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	items, err := q.getNextItems(ctx, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = q.finishItem(ctx, items[0], nil, q.clock.Now(), 0)
+	if n := atomic.LoadInt32(&fired); n != 0 {
+		t.Fatalf("expected no callback while %s is in flight, got %d", items[1].key, n)
+	}
+	_ = q.finishItem(ctx, items[1], nil, q.clock.Now(), 0)
+	if n := atomic.LoadInt32(&fired); n != 1 {
+		t.Fatalf("expected the callback to fire once after the last item, got %d", n)
+	}
+}
+
+func TestMaxPending(t *testing.T) {
+	q, _ := newFakeClockQueue(t, WithMaxPending(2))
+	ctx := context.Background()
+	if err := q.EnqueueWithoutRateLimitWithDelay(ctx, "a", time.Minute); err != nil {
+		t.Fatalf("expected a to fit in the queue, got %v", err)
+	}
+	if err := q.EnqueueWithoutRateLimit(ctx, "b"); err != nil {
+		t.Fatalf("expected b to fit in the queue, got %v", err)
+	}
+	if err := q.EnqueueWithoutRateLimit(ctx, "c"); !errors.Is(err, ErrQueueFull) {
+		t.Fatalf("expected ErrQueueFull at the boundary, got %v", err)
+	}
+	if err := q.Enqueue(ctx, "c"); !errors.Is(err, ErrQueueFull) {
+		t.Fatalf("expected ErrQueueFull from Enqueue, got %v", err)
+	}
+
+	// Keys already in the queue can still be rescheduled
+	if err := q.EnqueueWithoutRateLimit(ctx, "a"); err != nil {
+		t.Fatalf("expected a to be rescheduled while full, got %v", err)
+	}
+	if delay, _ := q.CurrentDelay("a"); delay != 0 {
+		t.Fatalf("expected a to be brought forward, got a delay of %v", delay)
+	}
+
+	// Handing out an item makes room, while the key being processed can still be enqueued again
+	processing := nextKeys(t, q, 1)[0]
+	if err := q.EnqueueWithoutRateLimit(ctx, "c"); err != nil {
+		t.Fatalf("expected c to fit once %s is being processed, got %v", processing, err)
+	}
+	if err := q.EnqueueWithoutRateLimit(ctx, processing); err != nil {
+		t.Fatalf("expected %s to be redirtied while full, got %v", processing, err)
+	}
+	if n := len(q.Keys()); n != 2 {
+		t.Fatalf("expected 2 items waiting, got %d", n)
+	}
+}
+
+func TestSetWorkers(t *testing.T) {
+	var running, maxRunning int32
+	release := make(chan struct{})
+	q := New(fastRateLimiter(), t.Name(), func(ctx context.Context, key string) error {
+		n := atomic.AddInt32(&running, 1)
+		defer atomic.AddInt32(&running, -1)
+		for {
+			max := atomic.LoadInt32(&maxRunning)
+			if n <= max || atomic.CompareAndSwapInt32(&maxRunning, max, n) {
+				break
+			}
+		}
+		<-release
+		return nil
+	})
+	if err := q.SetWorkers(context.Background(), 4); err == nil {
+		t.Fatal("expected an error rescaling a queue which is not running")
+	}
+	runQueue(t, q, 1)
+	waitFor(t, "queue to run", q.Running)
+
+	ctx := context.Background()
+	for i := 0; i < 4; i++ {
+		if err := q.EnqueueWithoutRateLimit(ctx, fmt.Sprintf("key-%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor(t, "the only worker to pick up a key", func() bool { return atomic.LoadInt32(&running) == 1 })
+	time.Sleep(20 * time.Millisecond)
+	if n := atomic.LoadInt32(&maxRunning); n != 1 {
+		t.Fatalf("expected 1 key to be processed at once with 1 worker, got %d", n)
+	}
+
+	if err := q.SetWorkers(ctx, 4); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "4 keys to be processed at once", func() bool { return atomic.LoadInt32(&running) == 4 })
+	close(release)
+	waitFor(t, "all keys to be processed", q.Empty)
+	if err := q.SetWorkers(ctx, 0); err == nil {
+		t.Fatal("expected an error for 0 workers")
+	}
+}
+
+// processedCall records the arguments of a ProcessedFunc call
+type processedCall struct {
+	key             string
+	waited, handled time.Duration
+	err             error
+}
+
+func TestOnProcessed(t *testing.T) {
+	fakeClock := clocktesting.NewFakeClock(time.Date(2022, 8, 1, 12, 0, 0, 0, time.UTC))
+	var calls int
+	q := New(fastRateLimiter(), t.Name(), func(ctx context.Context, key string) error {
+		// Every call takes 2 seconds, and the first one fails
+		fakeClock.Step(2 * time.Second)
+		if calls++; calls == 1 {
+			return errors.New("first call fails")
+		}
+		return nil
+	}, WithClock(fakeClock))
+	var processed []processedCall
+	q.OnProcessed(func(key string, waited, handled time.Duration, err error) {
+		processed = append(processed, processedCall{key: key, waited: waited, handled: handled, err: err})
+	})
+
+	ctx := context.Background()
+	if err := q.EnqueueWithoutRateLimit(ctx, "key"); err != nil {
+		t.Fatal(err)
+	}
+	for _, wait := range []time.Duration{5 * time.Second, 3 * time.Second} {
+		fakeClock.Step(wait)
+		items, err := q.getNextItems(ctx, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = q.handleQueueItemObject(ctx, items[0])
+	}
+
+	if len(processed) != 2 {
+		t.Fatalf("expected 2 calls of the hook, got %v", processed)
+	}
+	if got := processed[0]; got.key != "key" || got.waited != 5*time.Second || got.handled != 2*time.Second ||
+		got.err == nil {
+		t.Fatalf("expected the failed call to wait 5s and take 2s, got %+v", got)
+	}
+	// The wait of the retry is measured from when the key was originally added, across the requeue
+	if got := processed[1]; got.waited != 10*time.Second || got.handled != 2*time.Second || got.err != nil {
+		t.Fatalf("expected the retry to wait 10s and take 2s, got %+v", got)
+	}
+}
+
+func TestWithClockDelayedItems(t *testing.T) {
+	fakeClock := clocktesting.NewFakeClock(time.Date(2022, 8, 1, 12, 0, 0, 0, time.UTC))
+	processed := make(chan string, 1)
+	q := New(fastRateLimiter(), t.Name(), func(ctx context.Context, key string) error {
+		processed <- key
+		return nil
+	}, WithClock(fakeClock))
+	if err := q.EnqueueWithoutRateLimitWithDelay(context.Background(), "key", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	runQueue(t, q, 1)
+	// The worker sleeps on a timer of the fake clock until the item is ready
+	waitFor(t, "the worker to wait on the fake clock", fakeClock.HasWaiters)
+
+	fakeClock.Step(time.Minute - time.Nanosecond)
+	select {
+	case key := <-processed:
+		t.Fatalf("%s was processed before it was ready", key)
+	case <-time.After(20 * time.Millisecond):
+	}
+	fakeClock.Step(time.Nanosecond)
+	select {
+	case <-processed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("key was not processed once it was ready")
+	}
+}
+
+func TestKeys(t *testing.T) {
+	q, _ := newFakeClockQueue(t)
+	ctx := context.Background()
+	delays := map[string]time.Duration{"c": 3 * time.Second, "a": time.Second, "d": 4 * time.Second, "b": 0}
+	for _, key := range []string{"c", "a", "d", "b"} {
+		if err := q.EnqueueWithoutRateLimitWithDelay(ctx, key, delays[key]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if keys := q.Keys(); !reflect.DeepEqual(keys, []string{"b", "a", "c", "d"}) {
+		t.Fatalf("expected keys in planned order, got %v", keys)
+	}
+	if keys := q.ProcessingKeys(); len(keys) != 0 {
+		t.Fatalf("expected no keys being processed, got %v", keys)
+	}
+
+	if err := q.EnqueueWithoutRateLimit(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	nextKeys(t, q, 2)
+	if keys := q.ProcessingKeys(); !reflect.DeepEqual(keys, []string{"a", "b"}) {
+		t.Fatalf("expected a and b to be processed, got %v", keys)
+	}
+	if keys := q.Keys(); !reflect.DeepEqual(keys, []string{"c", "d"}) {
+		t.Fatalf("expected c and d to be left waiting, got %v", keys)
+	}
+}
+
+func TestJitter(t *testing.T) {
+	delay := 10 * time.Second
+	q, fakeClock := newFakeClockQueue(t, WithJitter(0.5))
+	q.ratelimiter = constantRateLimiter{delay: delay}
+	q.rand = rand.New(rand.NewSource(1))
+	ctx := context.Background()
+	planned := map[time.Time]bool{}
+	for i := 0; i < 50; i++ {
+		if err := q.Enqueue(ctx, fmt.Sprintf("key-%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	earliest, latest := fakeClock.Now().Add(delay), fakeClock.Now().Add(delay*3/2)
+	for _, qi := range q.items {
+		if qi.plannedToStartWorkAt.Before(earliest) || qi.plannedToStartWorkAt.After(latest) {
+			t.Fatalf("expected %s to be planned within [%v, %v], got %v", qi.key, earliest, latest,
+				qi.plannedToStartWorkAt)
+		}
+		planned[qi.plannedToStartWorkAt] = true
+	}
+	// The items do not all wake up at once
+	if len(planned) < 45 {
+		t.Fatalf("expected the items to be spread out, got %d distinct planned times for 50 items", len(planned))
+	}
+
+	// Items which are not rate limited are not jittered
+	if qi := q.insert(ctx, "unlimited", false, delay); !qi.plannedToStartWorkAt.Equal(earliest) {
+		t.Fatalf("expected unlimited to be planned at %v, got %v", earliest, qi.plannedToStartWorkAt)
+	}
+}
+
+func TestDispatcher(t *testing.T) {
+	var mu sync.Mutex
+	handled := map[string][]string{}
+	handlerOf := func(name string) ItemHandler {
+		return func(ctx context.Context, key string) error {
+			mu.Lock()
+			defer mu.Unlock()
+			handled[name] = append(handled[name], key)
+			return nil
+		}
+	}
+	pods, nodes := handlerOf("pods"), handlerOf("nodes")
+	q := New(fastRateLimiter(), t.Name(), handlerOf("default"), WithDispatcher(func(key string) ItemHandler {
+		switch {
+		case strings.HasPrefix(key, "pods/"):
+			return pods
+		case strings.HasPrefix(key, "nodes/"):
+			return nodes
+		}
+		return nil
+	}))
+	runQueue(t, q, 2)
+	keys := []string{"pods/ns/a", "nodes/n1", "pods/ns/b", "other"}
+	for _, key := range keys {
+		if err := q.EnqueueWithoutRateLimit(context.Background(), key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor(t, "all keys to be handled", q.Empty)
+
+	mu.Lock()
+	defer mu.Unlock()
+	for _, keys := range handled {
+		sort.Strings(keys)
+	}
+	want := map[string][]string{
+		"pods":    {"pods/ns/a", "pods/ns/b"},
+		"nodes":   {"nodes/n1"},
+		"default": {"other"},
+	}
+	if !reflect.DeepEqual(handled, want) {
+		t.Fatalf("expected keys to be routed as %v, got %v", want, handled)
+	}
+}
+
+func TestForgetWithReason(t *testing.T) {
+	q, _ := newFakeClockQueue(t)
+	type forgotten struct{ key, reason string }
+	var calls []forgotten
+	q.OnForget(func(key, reason string) { calls = append(calls, forgotten{key: key, reason: reason}) })
+	tracer := &recordingTracer{}
+	ctx := trace.WithTracer(context.Background(), tracer)
+	for _, key := range []string{"processing", "waiting", "plain"} {
+		if err := q.EnqueueWithoutRateLimit(ctx, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if keys := nextKeys(t, q, 1); keys[0] != "processing" {
+		t.Fatalf("expected to process key processing first, got %v", keys)
+	}
+
+	q.ForgetWithReason(ctx, "waiting", "deleted")
+	q.ForgetWithReason(ctx, "processing", "superseded")
+	q.Forget(ctx, "plain")
+	q.ForgetWithReason(ctx, "missing", "deleted")
+
+	expectedCalls := []forgotten{{"waiting", "deleted"}, {"processing", "superseded"}, {"plain", ""}}
+	if !reflect.DeepEqual(calls, expectedCalls) {
+		t.Fatalf("expected the forgotten keys %v, got %v", expectedCalls, calls)
+	}
+	spans := tracer.named("Forget")
+	if len(spans) != 4 {
+		t.Fatalf("expected 4 Forget spans, got %d", len(spans))
+	}
+	expectedFields := []struct{ key, reason, status string }{
+		{"waiting", "deleted", "itemInQueue"},
+		{"processing", "superseded", "itemBeingProcessed"},
+		{"plain", "", "itemInQueue"},
+		{"missing", "deleted", "notfound"},
+	}
+	for i, expected := range expectedFields {
+		s := spans[i]
+		if s.field("key") != expected.key || s.field("reason") != expected.reason ||
+			s.field("status") != expected.status {
+			t.Fatalf("expected span fields %+v, got %v", expected, s.fields)
+		}
+		if !s.ended {
+			t.Fatalf("expected span of key %s to be ended", expected.key)
+		}
+	}
+}
+
+func TestBatchHandler(t *testing.T) {
+	var mu sync.Mutex
+	var batches [][]string
+	handler := func(ctx context.Context, keys []string) map[string]error {
+		mu.Lock()
+		defer mu.Unlock()
+		batches = append(batches, append([]string(nil), keys...))
+		if len(batches) == 1 {
+			return map[string]error{"b": errors.New("failed")}
+		}
+		return nil
+	}
+	// The failed key is backed off long enough for the remaining ready key to be handled in a batch of its own
+	q := New(constantRateLimiter{delay: 50 * time.Millisecond}, t.Name(), func(ctx context.Context, key string) error {
+		t.Errorf("expected key %s to be handed to the batch handler", key)
+		return nil
+	}, WithBatchHandler(handler, 3))
+	for _, key := range []string{"a", "b", "c", "d"} {
+		if err := q.EnqueueWithoutRateLimit(context.Background(), key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	runQueue(t, q, 1)
+
+	waitFor(t, "the failed key to be retried", func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(batches) == 3 && q.Empty()
+	})
+	// The first batch is capped at the maximum batch size, and the failed key is retried on its own
+	expected := [][]string{{"a", "b", "c"}, {"d"}, {"b"}}
+	if !reflect.DeepEqual(batches, expected) {
+		t.Fatalf("expected the batches %v, got %v", expected, batches)
+	}
+	if n := q.NumRequeues("b"); n != 0 {
+		t.Fatalf("expected the retried key to be forgotten, got %d requeues", n)
+	}
+}
+
+func TestRunning(t *testing.T) {
+	q, _ := newFakeClockQueue(t)
+	if q.Running() {
+		t.Fatal("expected the queue not to be running before Run")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- q.RunE(ctx, 1)
+	}()
+	waitFor(t, "the queue to run", q.Running)
+
+	if err := q.RunE(context.Background(), 1); !errors.Is(err, ErrAlreadyRunning) {
+		t.Fatalf("expected running the queue twice to fail with ErrAlreadyRunning, got %v", err)
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("expected Run to return nil, got %v", err)
+	}
+	if q.Running() {
+		t.Fatal("expected the queue not to be running once Run returned")
+	}
+}
+
+func TestRunAgainAfterShutdown(t *testing.T) {
+	var mu sync.Mutex
+	var processed []string
+	q := New(fastRateLimiter(), t.Name(), func(ctx context.Context, key string) error {
+		mu.Lock()
+		defer mu.Unlock()
+		processed = append(processed, key)
+		return nil
+	})
+	processedKeys := func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), processed...)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		q.Run(ctx, 2)
+	}()
+	if err := q.Enqueue(context.Background(), "first"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the first key to be processed", func() bool { return len(processedKeys()) == 1 && q.Empty() })
+	cancel()
+	<-done
+
+	// Keys enqueued while the queue is stopped are processed once it runs again
+	if err := q.Enqueue(context.Background(), "second"); err != nil {
+		t.Fatal(err)
+	}
+	runQueue(t, q, 2)
+	if err := q.Enqueue(context.Background(), "third"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the keys to be processed after restarting", func() bool {
+		return len(processedKeys()) == 3 && q.Empty()
+	})
+	keys := processedKeys()
+	sort.Strings(keys)
+	if !reflect.DeepEqual(keys, []string{"first", "second", "third"}) {
+		t.Fatalf("expected the keys [first second third] to be processed, got %v", keys)
+	}
+}
+
+// logEntry is an entry logged through a recordingLogger
+type logEntry struct {
+	level  string
+	msg    string
+	fields log.Fields
+}
+
+// recordingLogger records the entries logged at warning and error level, and the fields they were logged with
+type recordingLogger struct {
+	log.Logger
+	mu      *sync.Mutex
+	entries *[]logEntry
+	fields  log.Fields
+}
+
+func newRecordingLogger() *recordingLogger {
+	return &recordingLogger{Logger: log.L, mu: &sync.Mutex{}, entries: &[]logEntry{}, fields: log.Fields{}}
+}
+
+func (l *recordingLogger) record(level, msg string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	*l.entries = append(*l.entries, logEntry{level: level, msg: msg, fields: l.fields})
+}
+
+func (l *recordingLogger) Warn(args ...interface{}) {
+	l.record("warning", fmt.Sprint(args...))
+}
+
+func (l *recordingLogger) Warnf(format string, args ...interface{}) {
+	l.record("warning", fmt.Sprintf(format, args...))
+}
+
+func (l *recordingLogger) Error(args ...interface{}) {
+	l.record("error", fmt.Sprint(args...))
+}
+
+func (l *recordingLogger) Errorf(format string, args ...interface{}) {
+	l.record("error", fmt.Sprintf(format, args...))
+}
+
+func (l *recordingLogger) WithField(key string, val interface{}) log.Logger {
+	return l.WithFields(log.Fields{key: val})
+}
+
+func (l *recordingLogger) WithFields(fields log.Fields) log.Logger {
+	merged := log.Fields{}
+	for k, v := range l.fields {
+		merged[k] = v
+	}
+	for k, v := range fields {
+		merged[k] = v
+	}
+	return &recordingLogger{Logger: l.Logger, mu: l.mu, entries: l.entries, fields: merged}
+}
+
+func (l *recordingLogger) WithError(err error) log.Logger {
+	return l.WithField("error", err)
+}
+
+func (l *recordingLogger) logged() []logEntry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]logEntry(nil), *l.entries...)
+}
+
+func TestWithLogger(t *testing.T) {
+	logger := newRecordingLogger()
+	q := New(fastRateLimiter(), t.Name(), func(ctx context.Context, key string) error {
+		return AsPermanent(errors.New("failed"))
+	}, WithLogger(logger.WithField("component", "test")))
+	// The logger of the context passed to Run is not used
+	ctxLogger := newRecordingLogger()
+	ctx := trace.WithTracer(log.WithLogger(context.Background(), ctxLogger), &recordingTracer{})
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		q.Run(ctx, 1)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	if err := q.Enqueue(context.Background(), "key"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the failure to be logged", func() bool { return len(logger.logged()) > 0 })
+	entry := logger.logged()[0]
+	if entry.level != "error" || entry.msg != "Error processing Queue item" {
+		t.Fatalf("expected the failure to be logged, got %q", entry.msg)
+	}
+	if entry.fields["queue"] != t.Name() || entry.fields["component"] != "test" || entry.fields["key"] != "key" {
+		t.Fatalf("expected the entry to carry the queue name, the key, and the fields of the logger, got %v",
+			entry.fields)
+	}
+	if entries := ctxLogger.logged(); len(entries) != 0 {
+		t.Fatalf("expected nothing to be logged through the context logger, got %v", entries)
+	}
+}
+
+func TestWithLoggerNil(t *testing.T) {
+	q := New(fastRateLimiter(), t.Name(), func(ctx context.Context, key string) error {
+		return AsPermanent(errors.New("failed"))
+	}, WithLogger(nil))
+	ctxLogger := newRecordingLogger()
+	ctx := trace.WithTracer(log.WithLogger(context.Background(), ctxLogger), &recordingTracer{})
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		q.Run(ctx, 1)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	if err := q.Enqueue(context.Background(), "key"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the failure to be logged", func() bool { return len(ctxLogger.logged()) > 0 })
+	if entry := ctxLogger.logged()[0]; entry.msg != "Error processing Queue item" {
+		t.Fatalf("expected the failure to be logged through the context logger, got %q", entry.msg)
+	}
+}
+
+func TestOldestInFlight(t *testing.T) {
+	fakeClock := clocktesting.NewFakeClock(time.Date(2022, 8, 1, 12, 0, 0, 0, time.UTC))
+	release := make(chan struct{})
+	q := New(fastRateLimiter(), t.Name(), func(ctx context.Context, key string) error {
+		if key == "stuck" {
+			<-release
+		}
+		return nil
+	}, WithClock(fakeClock))
+	if _, _, ok := q.OldestInFlight(); ok {
+		t.Fatal("expected no key to be in flight before running the queue")
+	}
+	runQueue(t, q, 2)
+	defer close(release)
+
+	if err := q.EnqueueWithoutRateLimit(context.Background(), "stuck"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the stuck key to be picked up", func() bool {
+		_, _, ok := q.OldestInFlight()
+		return ok
+	})
+	for _, age := range []time.Duration{0, time.Minute, time.Hour} {
+		fakeClock.SetTime(time.Date(2022, 8, 1, 12, 0, 0, 0, time.UTC).Add(age))
+		key, got, ok := q.OldestInFlight()
+		if !ok || key != "stuck" || got != age {
+			t.Fatalf("expected the stuck key to be in flight for %s, got %q for %s (%t)", age, key, got, ok)
+		}
+	}
+}
+
+func TestFairScheduling(t *testing.T) {
+	namespace := func(key string) string { return strings.SplitN(key, "/", 2)[0] }
+	tests := []struct {
+		name     string
+		weights  map[string]int
+		b        int
+		expected []string
+	}{
+		{
+			name:     "flooding group does not starve others",
+			b:        1,
+			expected: []string{"a/0", "b/0", "a/1", "a/2"},
+		},
+		{
+			name:     "weighted group gets a larger share",
+			weights:  map[string]int{"a": 2},
+			b:        3,
+			expected: []string{"a/0", "b/0", "a/1", "a/2", "b/1", "a/3", "a/4", "b/2"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q, _ := newFakeClockQueue(t, WithFairScheduling(namespace, tt.weights))
+			ctx := context.Background()
+			for i := 0; i < 100; i++ {
+				if err := q.EnqueueWithoutRateLimit(ctx, fmt.Sprintf("a/%d", i)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for i := 0; i < tt.b; i++ {
+				if err := q.EnqueueWithoutRateLimit(ctx, fmt.Sprintf("b/%d", i)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if keys := nextKeys(t, q, len(tt.expected)); !reflect.DeepEqual(keys, tt.expected) {
+				t.Fatalf("expected the keys %v to be processed first, got %v", tt.expected, keys)
+			}
+		})
+	}
+}
+
+func TestRunEErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		workers int
+		running bool
+		check   func(err error) bool
+	}{
+		{name: "no workers", workers: 0, check: func(err error) bool { return err != nil }},
+		{name: "negative workers", workers: -1, check: func(err error) bool { return err != nil }},
+		{name: "already running", workers: 1, running: true, check: func(err error) bool {
+			return errors.Is(err, ErrAlreadyRunning)
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q, _ := newFakeClockQueue(t)
+			if tt.running {
+				runQueue(t, q, 1)
+				waitFor(t, "the queue to run", q.Running)
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := q.RunE(ctx, tt.workers); !tt.check(err) {
+				t.Fatalf("expected RunE to fail, got %v", err)
+			}
+			if q.Running() != tt.running {
+				t.Fatalf("expected the queue to be running: %t", tt.running)
+			}
+		})
+	}
+}
+
+func TestRunPanics(t *testing.T) {
+	q, _ := newFakeClockQueue(t)
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected Run to panic without workers")
+		}
+	}()
+	q.Run(context.Background(), 0)
+}
+
+// tenantKey is a context key for values passed from Enqueue to the handler
+type tenantKey struct{}
+
+func TestEnqueueWithContext(t *testing.T) {
+	var mu sync.Mutex
+	var tenants []interface{}
+	var handlerErrs []error
+	q := New(fastRateLimiter(), t.Name(), func(ctx context.Context, key string) error {
+		mu.Lock()
+		defer mu.Unlock()
+		tenants = append(tenants, ctx.Value(tenantKey{}))
+		handlerErrs = append(handlerErrs, ctx.Err())
+		if len(tenants) == 1 {
+			return errors.New("first call fails")
+		}
+		return nil
+	})
+
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), tenantKey{}, "tenant-a"))
+	if err := q.EnqueueWithContext(ctx, "key"); err != nil {
+		t.Fatal(err)
+	}
+	// Only the values are kept, the handler is not cancelled along with the context it was enqueued with
+	cancel()
+	runQueue(t, q, 1)
+
+	waitFor(t, "the key to be retried", func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(tenants) == 2 && q.Empty()
+	})
+	// The values survive the requeue after the failed sync
+	if !reflect.DeepEqual(tenants, []interface{}{"tenant-a", "tenant-a"}) {
+		t.Fatalf("expected the handler to see the tenant on every call, got %v", tenants)
+	}
+	for _, err := range handlerErrs {
+		if err != nil {
+			t.Fatalf("expected the handler context not to be cancelled, got %v", err)
+		}
+	}
+}
+
+func TestLogSampling(t *testing.T) {
+	tests := []struct {
+		name     string
+		opts     []Option
+		warnings int
+	}{
+		{name: "every failure without sampling", warnings: MaxRetries - 1},
+		// The first failure, and the 5th, 10th and 15th
+		{name: "every 5th failure", opts: []Option{WithLogSampling(5, 0)}, warnings: 4},
+		// Retries follow each other within a millisecond, only the first failure is logged
+		{name: "once per interval", opts: []Option{WithLogSampling(0, time.Hour)}, warnings: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logger := newRecordingLogger()
+			opts := append([]Option{WithLogger(logger)}, tt.opts...)
+			q := New(fastRateLimiter(), t.Name(), func(ctx context.Context, key string) error {
+				return errors.New("failed")
+			}, opts...)
+			ctx, cancel := context.WithCancel(trace.WithTracer(context.Background(), &recordingTracer{}))
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				q.Run(ctx, 1)
+			}()
+			defer func() {
+				cancel()
+				<-done
+			}()
+
+			if err := q.Enqueue(context.Background(), "key"); err != nil {
+				t.Fatal(err)
+			}
+			errorsLogged := func() int {
+				n := 0
+				for _, entry := range logger.logged() {
+					if entry.level == "error" {
+						n++
+					}
+				}
+				return n
+			}
+			waitFor(t, "the key to be forgotten after the maximum retries", func() bool {
+				return errorsLogged() == 1 && q.Empty()
+			})
+			warnings := len(logger.logged()) - errorsLogged()
+			if warnings != tt.warnings {
+				t.Fatalf("expected %d of %d failures to be logged, got %d", tt.warnings, MaxRetries-1, warnings)
+			}
+		})
+	}
+}
+
+func TestCancelOnForget(t *testing.T) {
+	tests := []struct {
+		name      string
+		opts      []Option
+		cancelled bool
+	}{
+		{name: "handler runs to completion"},
+		{name: "handler is cancelled", opts: []Option{WithCancelOnForget()}, cancelled: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			started := make(chan struct{})
+			release := make(chan struct{})
+			result := make(chan error, 1)
+			var calls int32
+			q := New(fastRateLimiter(), t.Name(), func(ctx context.Context, key string) error {
+				atomic.AddInt32(&calls, 1)
+				close(started)
+				select {
+				case <-ctx.Done():
+				case <-release:
+				}
+				result <- ctx.Err()
+				return ctx.Err()
+			}, tt.opts...)
+			runQueue(t, q, 1)
+
+			if err := q.Enqueue(context.Background(), "key"); err != nil {
+				t.Fatal(err)
+			}
+			<-started
+			q.Forget(context.Background(), "key")
+			if !tt.cancelled {
+				close(release)
+			}
+			select {
+			case err := <-result:
+				if cancelled := errors.Is(err, context.Canceled); cancelled != tt.cancelled {
+					t.Fatalf("expected the handler context to be cancelled: %t, got %v", tt.cancelled, err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("handler of the forgotten key did not return")
+			}
+			// The forgotten key is not retried, even though its handler failed
+			waitFor(t, "the key to be forgotten", q.Empty)
+			time.Sleep(10 * time.Millisecond)
+			if n := atomic.LoadInt32(&calls); n != 1 {
+				t.Fatalf("expected the forgotten key to be handled once, got %d calls", n)
+			}
+		})
+	}
+}
+
+func TestStartResync(t *testing.T) {
+	q, fakeClock := newFakeClockQueue(t)
+	var mu sync.Mutex
+	resyncKeys := []string{"a", "b"}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	q.StartResync(ctx, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return resyncKeys
+	}, time.Minute)
+
+	for _, expected := range [][]string{{"a", "b"}, {"a", "c"}} {
+		mu.Lock()
+		resyncKeys = expected
+		mu.Unlock()
+		waitFor(t, "the resync timer", fakeClock.HasWaiters)
+		if !q.Empty() {
+			t.Fatalf("expected nothing to be enqueued before the interval passed, got %v", q.Keys())
+		}
+		fakeClock.Step(time.Minute)
+		waitFor(t, "the keys to be resynced", func() bool { return q.Len() == len(expected) })
+		keys := q.Keys()
+		sort.Strings(keys)
+		if !reflect.DeepEqual(keys, expected) {
+			t.Fatalf("expected the keys %v to be resynced, got %v", expected, keys)
+		}
+		for range expected {
+			finishNext(t, q, nil)
+		}
+	}
+
+	cancel()
+	waitFor(t, "the resync to stop", func() bool { return !fakeClock.HasWaiters() })
+	fakeClock.Step(time.Minute)
+	time.Sleep(10 * time.Millisecond)
+	if !q.Empty() {
+		t.Fatalf("expected no keys to be resynced once the context is done, got %v", q.Keys())
+	}
+}
+
+func TestDebounce(t *testing.T) {
+	q, fakeClock := newFakeClockQueue(t, WithDebounce(time.Minute))
+	ctx := context.Background()
+	if err := q.EnqueueWithoutRateLimit(ctx, "key"); err != nil {
+		t.Fatal(err)
+	}
+	// Keys enqueued for the first time are not delayed
+	if delay, ok := q.CurrentDelay("key"); !ok || delay != 0 {
+		t.Fatalf("expected the new key not to be delayed, got %v, %t", delay, ok)
+	}
+	if key := finishNext(t, q, nil); key != "key" {
+		t.Fatalf("expected key to be processed, got %q", key)
+	}
+
+	// A burst of enqueues within the window is coalesced into a single item at the end of the window
+	for i := 0; i < 5; i++ {
+		fakeClock.Step(10 * time.Second)
+		if err := q.EnqueueWithoutRateLimit(ctx, "key"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := q.Len(); n != 1 {
+		t.Fatalf("expected the enqueues to be coalesced into a single item, got %d", n)
+	}
+	if delay, _ := q.CurrentDelay("key"); delay != 10*time.Second {
+		t.Fatalf("expected the key to wait for the rest of the window, got %v", delay)
+	}
+	fakeClock.Step(10 * time.Second)
+	if keys := nextKeys(t, q, 1); keys[0] != "key" {
+		t.Fatalf("expected key to be processed once the window passed, got %v", keys)
+	}
+	if n := q.Len(); n != 1 {
+		t.Fatalf("expected only the coalesced item to be processed, got %d items", n)
+	}
+}
+
+func TestCurrentDelay(t *testing.T) {
+	fakeClock := clocktesting.NewFakeClock(time.Date(2022, 8, 1, 12, 0, 0, 0, time.UTC))
+	q := New(constantRateLimiter{delay: 30 * time.Second}, t.Name(),
+		func(ctx context.Context, key string) error { return nil }, WithClock(fakeClock))
+	ctx := context.Background()
+	if _, ok := q.CurrentDelay("unknown"); ok {
+		t.Fatal("expected no delay for an unknown key")
+	}
+	if err := q.Enqueue(ctx, "limited"); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.EnqueueWithoutRateLimitWithDelay(ctx, "delayed", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.EnqueueWithoutRateLimit(ctx, "ready"); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]time.Duration{"limited": 30 * time.Second, "delayed": time.Minute, "ready": 0}
+	for key, want := range expected {
+		if delay, ok := q.CurrentDelay(key); !ok || delay != want {
+			t.Fatalf("expected %s to be delayed for %v, got %v, %t", key, want, delay, ok)
+		}
+	}
+	// The delay counts down, and does not drop below zero
+	fakeClock.Step(45 * time.Second)
+	expected = map[string]time.Duration{"limited": 0, "delayed": 15 * time.Second, "ready": 0}
+	for key, want := range expected {
+		if delay, ok := q.CurrentDelay(key); !ok || delay != want {
+			t.Fatalf("expected %s to be delayed for %v, got %v, %t", key, want, delay, ok)
+		}
+	}
+	// Keys being processed are known, and not delayed unless they were enqueued again
+	if keys := nextKeys(t, q, 2); !reflect.DeepEqual(keys, []string{"ready", "limited"}) {
+		t.Fatalf("expected the ready keys to be processed, got %v", keys)
+	}
+	if delay, ok := q.CurrentDelay("limited"); !ok || delay != 0 {
+		t.Fatalf("expected the key being processed not to be delayed, got %v, %t", delay, ok)
+	}
+}
+
+func TestNewValidatesArguments(t *testing.T) {
+	handler := func(ctx context.Context, key string) error { return nil }
+	tests := []struct {
+		name      string
+		queueName string
+		handler   ItemHandler
+		opts      []Option
+		expected  string
+	}{
+		{name: "empty name", handler: handler, expected: "queue name must not be empty"},
+		{
+			name:      "nil handler",
+			queueName: "nil-handler",
+			expected:  "queue nil-handler needs a handler, a dispatcher, or a batch handler",
+		},
+		{
+			name:      "nil handler with batch handler",
+			queueName: "batch",
+			opts: []Option{WithBatchHandler(func(ctx context.Context, keys []string) map[string]error {
+				return nil
+			}, 10)},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var recovered interface{}
+			func() {
+				defer func() { recovered = recover() }()
+				New(fastRateLimiter(), tt.queueName, tt.handler, tt.opts...)
+			}()
+			if tt.expected == "" && recovered != nil {
+				t.Fatalf("expected the queue to be created, got panic %v", recovered)
+			}
+			if tt.expected != "" && recovered != tt.expected {
+				t.Fatalf("expected New to panic with %q, got %v", tt.expected, recovered)
+			}
+		})
+	}
+}
+
+func TestFlushKey(t *testing.T) {
+	q, _ := newFakeClockQueue(t, WithDebounce(time.Hour))
+	ctx := context.Background()
+	if err := q.EnqueueWithoutRateLimitWithDelay(ctx, "delayed", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	// The key is processed, so enqueueing it again is delayed for the debounce window
+	if err := q.EnqueueWithoutRateLimit(ctx, "debounced"); err != nil {
+		t.Fatal(err)
+	}
+	finishNext(t, q, nil)
+	if err := q.EnqueueWithoutRateLimit(ctx, "debounced"); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"delayed", "debounced"} {
+		if delay, _ := q.CurrentDelay(key); delay != time.Hour {
+			t.Fatalf("expected %s to be delayed for an hour, got %v", key, delay)
+		}
+	}
+
+	for _, key := range []string{"delayed", "debounced", "new"} {
+		if err := q.FlushKey(ctx, key); err != nil {
+			t.Fatal(err)
+		}
+		if delay, ok := q.CurrentDelay(key); !ok || delay != 0 {
+			t.Fatalf("expected %s to be ready once flushed, got %v, %t", key, delay, ok)
+		}
+	}
+	keys := nextKeys(t, q, 3)
+	sort.Strings(keys)
+	if !reflect.DeepEqual(keys, []string{"debounced", "delayed", "new"}) {
+		t.Fatalf("expected the flushed keys to be processed immediately, got %v", keys)
+	}
+}
@@ -0,0 +1,48 @@
+package queue
+
+import (
+	"context"
+	"time"
+)
+
+// Queuer is the interface implemented by Queue. Consumers can depend on it instead of *Queue, so they can replace the
+// queue with their own implementation, for example in tests.
+type Queuer interface {
+	// Enqueue enqueues the key in a rate limited fashion.
+	Enqueue(ctx context.Context, key string) error
+
+	// EnqueueWithoutRateLimit enqueues the key without a rate limit.
+	EnqueueWithoutRateLimit(ctx context.Context, key string) error
+
+	// EnqueueWithoutRateLimitWithDelay enqueues the key without a rate limit, to be processed after the delay.
+	EnqueueWithoutRateLimitWithDelay(ctx context.Context, key string, after time.Duration) error
+
+	// EnqueueWithRateLimitAndDelay enqueues the key in a rate limited fashion, to be processed no sooner than floor.
+	EnqueueWithRateLimitAndDelay(ctx context.Context, key string, floor time.Duration) error
+
+	// FlushKey makes the key ready to be processed now.
+	FlushKey(ctx context.Context, key string) error
+
+	// Forget forgets the key.
+	Forget(ctx context.Context, key string)
+
+	// ForgetWithReason forgets the key, and records why it was forgotten.
+	ForgetWithReason(ctx context.Context, key, reason string)
+
+	// Len returns the number of items in the queue, including those being processed.
+	Len() int
+
+	// Empty returns true if there are no items in the queue.
+	Empty() bool
+
+	// Running returns true while Run is running.
+	Running() bool
+
+	// Run starts the workers, and blocks until ctx is done.
+	Run(ctx context.Context, workers int)
+
+	// Drain stops the queue from accepting new work, and waits for the remaining items to be handled.
+	Drain(ctx context.Context) error
+}
+
+var _ Queuer = &Queue{}
@@ -0,0 +1,77 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// mockQueuer records the keys enqueued and forgotten through it, as consumers would mock the queue in their tests
+type mockQueuer struct {
+	Queuer
+	enqueued  []string
+	forgotten []string
+	err       error
+}
+
+func (m *mockQueuer) Enqueue(ctx context.Context, key string) error {
+	if m.err != nil {
+		return m.err
+	}
+	m.enqueued = append(m.enqueued, key)
+	return nil
+}
+
+func (m *mockQueuer) Forget(ctx context.Context, key string) {
+	m.forgotten = append(m.forgotten, key)
+}
+
+func (m *mockQueuer) Len() int {
+	return len(m.enqueued)
+}
+
+var _ Queuer = &mockQueuer{}
+
+// syncKeys is a consumer depending on Queuer rather than *Queue. It enqueues the keys which exist, and forgets the
+// ones which were deleted.
+func syncKeys(ctx context.Context, q Queuer, keys map[string]bool) error {
+	for key, exists := range keys {
+		if !exists {
+			q.Forget(ctx, key)
+			continue
+		}
+		if err := q.Enqueue(ctx, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestQueuerMock(t *testing.T) {
+	m := &mockQueuer{}
+	if err := syncKeys(context.Background(), m, map[string]bool{"default/a": true, "default/b": false}); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(m.enqueued, []string{"default/a"}) || !reflect.DeepEqual(m.forgotten, []string{"default/b"}) {
+		t.Fatalf("expected default/a to be enqueued and default/b forgotten, got %v and %v", m.enqueued, m.forgotten)
+	}
+
+	m = &mockQueuer{err: ErrQueueFull}
+	if err := syncKeys(context.Background(), m, map[string]bool{"default/a": true}); !errors.Is(err, ErrQueueFull) {
+		t.Fatalf("expected the error of the queue to be returned, got %v", err)
+	}
+}
+
+func TestQueuerQueue(t *testing.T) {
+	// The consumer works the same with the real queue
+	var q Queuer = New(constantRateLimiter{delay: time.Hour}, t.Name(),
+		func(ctx context.Context, key string) error { return nil })
+	if err := syncKeys(context.Background(), q, map[string]bool{"default/a": true, "default/b": false}); err != nil {
+		t.Fatal(err)
+	}
+	if n := q.Len(); n != 1 {
+		t.Fatalf("expected 1 key to be enqueued, got %d", n)
+	}
+}
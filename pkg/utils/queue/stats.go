@@ -0,0 +1,44 @@
+package queue
+
+import (
+	"time"
+)
+
+// QueueStats is a point in time snapshot of a Queue
+type QueueStats struct { // nolint:golint
+	// Name is the name the queue was created with
+	Name string `json:"name"`
+	// Pending is the number of items waiting in the queue
+	Pending int `json:"pending"`
+	// Processing is the number of items currently being processed by the workers
+	Processing int `json:"processing"`
+	// OldestPendingAge is how long ago the oldest waiting item was originally added, across requeues
+	OldestPendingAge time.Duration `json:"oldestPendingAge"`
+	// TotalRequeuesOutstanding is the sum of the requeues of all items which are waiting or being processed
+	TotalRequeuesOutstanding int `json:"totalRequeuesOutstanding"`
+}
+
+// Stats returns a snapshot of the queue. All fields are read under a single acquisition of the lock, so they are
+// consistent with each other.
+func (q *Queue) Stats() QueueStats {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	stats := QueueStats{
+		Name:       q.name,
+		Pending:    q.pending(),
+		Processing: len(q.itemsBeingProcessed),
+	}
+
+	now := q.clock.Now()
+	for _, qi := range q.queuedItems() {
+		if age := now.Sub(qi.originallyAdded); age > stats.OldestPendingAge {
+			stats.OldestPendingAge = age
+		}
+		stats.TotalRequeuesOutstanding += qi.requeues
+	}
+	for _, qi := range q.itemsBeingProcessed {
+		stats.TotalRequeuesOutstanding += qi.requeues
+	}
+	return stats
+}
@@ -0,0 +1,44 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestStats(t *testing.T) {
+	q, fakeClock := newFakeClockQueue(t)
+	ctx := context.Background()
+	if stats := q.Stats(); stats != (QueueStats{Name: t.Name()}) {
+		t.Fatalf("expected empty stats, got %+v", stats)
+	}
+
+	if err := q.EnqueueWithoutRateLimit(ctx, "processing"); err != nil {
+		t.Fatal(err)
+	}
+	nextKeys(t, q, 1)
+	// failed is requeued twice, and keeps the time it was originally added
+	if err := q.EnqueueWithoutRateLimit(ctx, "failed"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		finishNext(t, q, errors.New("failed"))
+		fakeClock.Step(time.Second)
+	}
+	if err := q.EnqueueWithoutRateLimit(ctx, "waiting"); err != nil {
+		t.Fatal(err)
+	}
+	fakeClock.Step(time.Second)
+
+	want := QueueStats{
+		Name:                     t.Name(),
+		Pending:                  2,
+		Processing:               1,
+		OldestPendingAge:         3 * time.Second,
+		TotalRequeuesOutstanding: 2,
+	}
+	if stats := q.Stats(); stats != want {
+		t.Fatalf("expected stats %+v, got %+v", want, stats)
+	}
+}
@@ -0,0 +1,86 @@
+package queue
+
+import (
+	"context"
+
+	"github.com/clusterrouter-io/clusterrouter/pkg/utils/log"
+	"github.com/clusterrouter-io/clusterrouter/pkg/utils/trace"
+)
+
+// startSpan starts a span via trace.StartSpan, unless the tracing sampler of the queue declines it. In that case no
+// span is created, and an unsampledSpan is returned instead, so callers can attach fields as usual.
+func (q *Queue) startSpan(ctx context.Context, name string) (context.Context, trace.Span) {
+	if q.tracingSampler != nil && !q.tracingSampler() {
+		return ctx, unsampledSpan{}
+	}
+	return trace.StartSpan(ctx, name)
+}
+
+// unsampledSpan is used in place of spans which were not sampled. It does not record anything, but fields are still
+// added to the logger in the context, so log entries carry the same fields as they do for sampled spans.
+type unsampledSpan struct{}
+
+var _ trace.Span = unsampledSpan{}
+
+func (unsampledSpan) End()               {}
+func (unsampledSpan) SetStatus(error)    {}
+func (unsampledSpan) Logger() log.Logger { return nil }
+
+func (unsampledSpan) WithField(ctx context.Context, key string, val interface{}) context.Context {
+	return log.WithLogger(ctx, log.G(ctx).WithField(key, val))
+}
+
+func (unsampledSpan) WithFields(ctx context.Context, fields log.Fields) context.Context {
+	return log.WithLogger(ctx, log.G(ctx).WithFields(fields))
+}
+
+// lifecycleSpan is the span covering the lifecycle of a key, and the context it was started with
+type lifecycleSpan struct {
+	ctx  context.Context
+	span trace.Span
+}
+
+// startLifecycle starts the lifecycle span of qi if lifecycle spans are enabled, and it does not have one yet. The span
+// is a root span, not a child of the span of whoever enqueued the key. It must be called with the lock held.
+func (q *Queue) startLifecycle(qi *queueItem) {
+	if !q.lifecycleSpans || qi.lifecycle != nil {
+		return
+	}
+	ctx, span := q.startSpan(q.withLogger(context.Background()), "lifecycle")
+	ctx = span.WithFields(ctx, map[string]interface{}{
+		"queue":           q.name,
+		"key":             qi.key,
+		"originallyAdded": qi.originallyAdded.String(),
+	})
+	qi.lifecycle = &lifecycleSpan{ctx: ctx, span: span}
+}
+
+// endLifecycle ends the lifecycle span of the item with err, if it has one
+func (item *queueItem) endLifecycle(err error) {
+	if item.lifecycle == nil {
+		return
+	}
+	item.lifecycle.span.SetStatus(err)
+	item.lifecycle.span.End()
+	item.lifecycle = nil
+}
+
+// parentContext is a context which takes its deadline, cancellation and values from the worker processing an item,
+// except for the values of the lifecycle span of the item, which take precedence, so spans started from it are
+// children of the lifecycle span.
+type parentContext struct {
+	context.Context
+	parent context.Context
+}
+
+// withParent returns ctx with the span of parent as the parent of spans started from it
+func withParent(ctx, parent context.Context) context.Context {
+	return &parentContext{Context: ctx, parent: parent}
+}
+
+func (c *parentContext) Value(key interface{}) interface{} {
+	if v := c.parent.Value(key); v != nil {
+		return v
+	}
+	return c.Context.Value(key)
+}
@@ -0,0 +1,181 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/clusterrouter-io/clusterrouter/pkg/utils/log"
+	"github.com/clusterrouter-io/clusterrouter/pkg/utils/trace"
+)
+
+// recordingTracer records the spans started through it. Like the tracers of the trace packages, its spans log through
+// the logger of the context they were started with.
+type recordingTracer struct {
+	mu    sync.Mutex
+	spans []*recordingSpan
+}
+
+// recordingSpanKey is the context key of the span a context belongs to
+type recordingSpanKey struct{}
+
+func (t *recordingTracer) StartSpan(ctx context.Context, name string) (context.Context, trace.Span) {
+	s := &recordingSpan{name: name, fields: log.Fields{}, logger: log.G(ctx)}
+	s.parent, _ = ctx.Value(recordingSpanKey{}).(*recordingSpan)
+	t.mu.Lock()
+	t.spans = append(t.spans, s)
+	t.mu.Unlock()
+	return context.WithValue(ctx, recordingSpanKey{}, s), s
+}
+
+// named returns the spans named name, in the order they were started
+func (t *recordingTracer) named(name string) []*recordingSpan {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var spans []*recordingSpan
+	for _, s := range t.spans {
+		if s.name == name {
+			spans = append(spans, s)
+		}
+	}
+	return spans
+}
+
+// recordingSpan records the fields and status set on it, and the span it was started from
+type recordingSpan struct {
+	mu     sync.Mutex
+	name   string
+	parent *recordingSpan
+	fields log.Fields
+	err    error
+	ended  bool
+	logger log.Logger
+}
+
+func (s *recordingSpan) End() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ended = true
+}
+
+func (s *recordingSpan) SetStatus(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.err = err
+}
+
+func (s *recordingSpan) WithField(ctx context.Context, key string, val interface{}) context.Context {
+	return s.WithFields(ctx, log.Fields{key: val})
+}
+
+func (s *recordingSpan) WithFields(ctx context.Context, fields log.Fields) context.Context {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for k, v := range fields {
+		s.fields[k] = v
+	}
+	return log.WithLogger(ctx, log.G(ctx).WithFields(fields))
+}
+
+func (s *recordingSpan) Logger() log.Logger {
+	return s.logger
+}
+
+// field returns the value of the field key
+func (s *recordingSpan) field(key string) interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.fields[key]
+}
+
+func TestTracingSampler(t *testing.T) {
+	tests := []struct {
+		name    string
+		sampled bool
+	}{
+		{name: "sampled", sampled: true},
+		{name: "not sampled"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logger := newRecordingLogger()
+			tracer := &recordingTracer{}
+			q := New(fastRateLimiter(), t.Name(), func(ctx context.Context, key string) error {
+				return AsPermanent(errors.New("failed"))
+			}, WithLogger(logger), WithTracingSampler(func() bool { return tt.sampled }))
+			ctx, cancel := context.WithCancel(trace.WithTracer(context.Background(), tracer))
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				q.Run(ctx, 1)
+			}()
+			defer func() {
+				cancel()
+				<-done
+			}()
+
+			if err := q.Enqueue(trace.WithTracer(context.Background(), tracer), "key"); err != nil {
+				t.Fatal(err)
+			}
+			waitFor(t, "the failure to be logged", func() bool { return len(logger.logged()) > 0 })
+			for _, name := range []string{"insert", "handleQueueItem", "handleQueueItemObject"} {
+				if spans := tracer.named(name); (len(spans) > 0) != tt.sampled {
+					t.Fatalf("expected %s spans to be recorded: %t, got %d", name, tt.sampled, len(spans))
+				}
+			}
+			// Fields are attached to the logger whether or not the spans are sampled
+			if entry := logger.logged()[0]; entry.fields["key"] != "key" {
+				t.Fatalf("expected the entry to carry the key, got %v", entry.fields)
+			}
+		})
+	}
+}
+
+func TestLifecycleSpans(t *testing.T) {
+	tracer := &recordingTracer{}
+	// Lifecycle spans are root spans, started with the default tracer
+	defaultTracer := trace.T
+	trace.T = tracer
+	defer func() { trace.T = defaultTracer }()
+
+	var calls int32
+	q := New(fastRateLimiter(), t.Name(), func(ctx context.Context, key string) error {
+		if atomic.AddInt32(&calls, 1) <= 2 {
+			return errors.New("failed")
+		}
+		return nil
+	}, WithLifecycleSpans())
+	runQueue(t, q, 1)
+	if err := q.Enqueue(context.Background(), "key"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the lifecycle to end", func() bool {
+		spans := tracer.named("lifecycle")
+		if len(spans) != 1 {
+			return false
+		}
+		spans[0].mu.Lock()
+		defer spans[0].mu.Unlock()
+		return spans[0].ended
+	})
+
+	lifecycle := tracer.named("lifecycle")[0]
+	if lifecycle.parent != nil || lifecycle.field("key") != "key" || lifecycle.err != nil {
+		t.Fatalf("expected a successful root span of key, got parent %v, fields %v, and error %v", lifecycle.parent,
+			lifecycle.fields, lifecycle.err)
+	}
+	attempts := tracer.named("handleQueueItemObject")
+	if len(attempts) != 3 {
+		t.Fatalf("expected 3 attempts, got %d", len(attempts))
+	}
+	for i, attempt := range attempts {
+		if attempt.parent != lifecycle {
+			t.Fatalf("expected attempt %d to be a child of the lifecycle span", i)
+		}
+		if requeues := attempt.field("requeues"); requeues != i {
+			t.Fatalf("expected attempt %d after %d requeues, got %v", i, i, requeues)
+		}
+	}
+}
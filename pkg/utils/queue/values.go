@@ -0,0 +1,28 @@
+package queue
+
+import (
+	"context"
+)
+
+// valuesContext is a context which takes its deadline and cancellation from the worker processing an item, and looks
+// up values in the worker context first, and then in the context the item was enqueued with.
+type valuesContext struct {
+	context.Context
+	values context.Context
+}
+
+// withValues returns ctx with the values of values visible through it, without inheriting the deadline or
+// cancellation of values. Values of ctx take precedence.
+func withValues(ctx, values context.Context) context.Context {
+	if values == nil {
+		return ctx
+	}
+	return &valuesContext{Context: ctx, values: values}
+}
+
+func (c *valuesContext) Value(key interface{}) interface{} {
+	if v := c.Context.Value(key); v != nil {
+		return v
+	}
+	return c.values.Value(key)
+}
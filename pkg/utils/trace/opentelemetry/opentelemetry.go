@@ -0,0 +1,221 @@
+package opentelemetry
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/clusterrouter-io/clusterrouter/pkg/utils/log"
+	"github.com/clusterrouter-io/clusterrouter/pkg/utils/trace"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	oteltrace "go.opentelemetry.io/otel/trace"
+)
+
+// instrumentationName is the name of the tracer requested from the provider
+const instrumentationName = "github.com/clusterrouter-io/clusterrouter"
+
+const (
+	lDebug = "DEBUG"
+	lInfo  = "INFO"
+	lWarn  = "WARN"
+	lErr   = "ERROR"
+	lFatal = "FATAL"
+)
+
+// Register sets trace.T to a tracer of provider, so all spans started via trace.StartSpan are exported through it.
+func Register(provider oteltrace.TracerProvider) {
+	trace.T = New(provider)
+}
+
+// New returns a trace.Tracer backed by a tracer of provider
+func New(provider oteltrace.TracerProvider) *Adapter {
+	return &Adapter{tracer: provider.Tracer(instrumentationName)}
+}
+
+// Adapter implements the trace.Tracer interface for OpenTelemetry
+type Adapter struct {
+	tracer oteltrace.Tracer
+}
+
+// StartSpan creates a new span from OpenTelemetry using the given name.
+func (a *Adapter) StartSpan(ctx context.Context, name string) (context.Context, trace.Span) {
+	ctx, ots := a.tracer.Start(ctx, name)
+	l := log.G(ctx).WithField("method", name)
+
+	s := &span{s: ots, l: l}
+	ctx = log.WithLogger(ctx, s.Logger())
+
+	return ctx, s
+}
+
+type span struct {
+	mu sync.Mutex
+	s  oteltrace.Span
+	l  log.Logger
+}
+
+func (s *span) End() {
+	s.s.End()
+}
+
+func (s *span) SetStatus(err error) {
+	if !s.s.IsRecording() {
+		return
+	}
+	if err == nil {
+		s.s.SetStatus(codes.Ok, "")
+		return
+	}
+	s.s.RecordError(err)
+	s.s.SetStatus(codes.Error, err.Error())
+}
+
+func (s *span) WithField(ctx context.Context, key string, val interface{}) context.Context {
+	s.mu.Lock()
+	s.l = s.l.WithField(key, val)
+	ctx = log.WithLogger(ctx, &logger{s: s.s, l: s.l})
+	s.mu.Unlock()
+
+	if s.s.IsRecording() {
+		s.s.SetAttributes(makeAttribute(key, val))
+	}
+
+	return ctx
+}
+
+func (s *span) WithFields(ctx context.Context, f log.Fields) context.Context {
+	s.mu.Lock()
+	s.l = s.l.WithFields(f)
+	ctx = log.WithLogger(ctx, &logger{s: s.s, l: s.l})
+	s.mu.Unlock()
+
+	if s.s.IsRecording() {
+		attrs := make([]attribute.KeyValue, 0, len(f))
+		for k, v := range f {
+			attrs = append(attrs, makeAttribute(k, v))
+		}
+		s.s.SetAttributes(attrs...)
+	}
+
+	return ctx
+}
+
+func (s *span) Logger() log.Logger {
+	return &logger{s: s.s, l: s.l}
+}
+
+// logger logs through l, and records every entry as an event on the span
+type logger struct {
+	s oteltrace.Span
+	l log.Logger
+	a []attribute.KeyValue
+}
+
+func (l *logger) event(level, msg string) {
+	if !l.s.IsRecording() {
+		return
+	}
+	l.s.AddEvent(msg, oteltrace.WithAttributes(withLevel(level, l.a)...))
+}
+
+func (l *logger) Debug(args ...interface{}) {
+	l.l.Debug(args...)
+	l.event(lDebug, fmt.Sprint(args...))
+}
+
+func (l *logger) Debugf(f string, args ...interface{}) {
+	l.l.Debugf(f, args...)
+	l.event(lDebug, fmt.Sprintf(f, args...))
+}
+
+func (l *logger) Info(args ...interface{}) {
+	l.l.Info(args...)
+	l.event(lInfo, fmt.Sprint(args...))
+}
+
+func (l *logger) Infof(f string, args ...interface{}) {
+	l.l.Infof(f, args...)
+	l.event(lInfo, fmt.Sprintf(f, args...))
+}
+
+func (l *logger) Warn(args ...interface{}) {
+	l.l.Warn(args...)
+	l.event(lWarn, fmt.Sprint(args...))
+}
+
+func (l *logger) Warnf(f string, args ...interface{}) {
+	l.l.Warnf(f, args...)
+	l.event(lWarn, fmt.Sprintf(f, args...))
+}
+
+func (l *logger) Error(args ...interface{}) {
+	l.l.Error(args...)
+	l.event(lErr, fmt.Sprint(args...))
+}
+
+func (l *logger) Errorf(f string, args ...interface{}) {
+	l.l.Errorf(f, args...)
+	l.event(lErr, fmt.Sprintf(f, args...))
+}
+
+func (l *logger) Fatal(args ...interface{}) {
+	l.event(lFatal, fmt.Sprint(args...))
+	l.l.Fatal(args...)
+}
+
+func (l *logger) Fatalf(f string, args ...interface{}) {
+	l.event(lFatal, fmt.Sprintf(f, args...))
+	l.l.Fatalf(f, args...)
+}
+
+func (l *logger) WithError(err error) log.Logger {
+	return l.with(l.l.WithError(err), makeAttribute("err", err))
+}
+
+func (l *logger) WithField(k string, value interface{}) log.Logger {
+	return l.with(l.l.WithField(k, value), makeAttribute(k, value))
+}
+
+func (l *logger) WithFields(fields log.Fields) log.Logger {
+	var attrs []attribute.KeyValue
+	if l.s.IsRecording() {
+		attrs = make([]attribute.KeyValue, 0, len(fields))
+		for k, v := range fields {
+			attrs = append(attrs, makeAttribute(k, v))
+		}
+	}
+	return l.with(l.l.WithFields(fields), attrs...)
+}
+
+// with returns a logger logging through log, which adds attrs to the events it records
+func (l *logger) with(log log.Logger, attrs ...attribute.KeyValue) log.Logger {
+	var a []attribute.KeyValue
+	if l.s.IsRecording() {
+		a = make([]attribute.KeyValue, len(l.a), len(l.a)+len(attrs))
+		copy(a, l.a)
+		a = append(a, attrs...)
+	}
+	return &logger{s: l.s, l: log, a: a}
+}
+
+func makeAttribute(key string, val interface{}) attribute.KeyValue {
+	switch v := val.(type) {
+	case string:
+		return attribute.String(key, v)
+	case int:
+		return attribute.Int(key, v)
+	case int64:
+		return attribute.Int64(key, v)
+	case bool:
+		return attribute.Bool(key, v)
+	case error:
+		return attribute.String(key, v.Error())
+	default:
+		return attribute.String(key, fmt.Sprintf("%+v", val))
+	}
+}
+
+func withLevel(l string, attrs []attribute.KeyValue) []attribute.KeyValue {
+	return append(attrs, attribute.String("level", l))
+}
@@ -0,0 +1,128 @@
+package opentelemetry
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/clusterrouter-io/clusterrouter/pkg/utils/queue"
+	"github.com/clusterrouter-io/clusterrouter/pkg/utils/trace"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"k8s.io/client-go/util/workqueue"
+)
+
+// registerExporter registers a provider exporting to an in-memory exporter until the test finishes
+func registerExporter(t *testing.T) *tracetest.InMemoryExporter {
+	t.Helper()
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	old := trace.T
+	Register(provider)
+	t.Cleanup(func() {
+		trace.T = old
+		_ = provider.Shutdown(context.Background())
+	})
+	return exporter
+}
+
+// findSpan returns the first exported span named name which has the attribute key set to value
+func findSpan(exporter *tracetest.InMemoryExporter, name string, key, value string) *tracetest.SpanStub {
+	for _, s := range exporter.GetSpans() {
+		if s.Name != name {
+			continue
+		}
+		for _, attr := range s.Attributes {
+			if string(attr.Key) == key && attr.Value.AsString() == value {
+				s := s
+				return &s
+			}
+		}
+	}
+	return nil
+}
+
+func TestQueueSpans(t *testing.T) {
+	exporter := registerExporter(t)
+	var processed int32
+	q := queue.New(workqueue.NewItemExponentialFailureRateLimiter(time.Millisecond, time.Millisecond), "otel",
+		func(ctx context.Context, key string) error {
+			atomic.AddInt32(&processed, 1)
+			return nil
+		})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		q.Run(ctx, 1)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	if err := q.Enqueue(context.Background(), "ok"); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(&processed) == 0 || !q.Empty() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the queue to process all keys")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	s := findSpan(exporter, "handleQueueItemObject", "key", "ok")
+	if s == nil {
+		t.Fatalf("expected a handleQueueItemObject span for key ok, got %d spans", len(exporter.GetSpans()))
+	}
+	attrs := attribute.NewSet(s.Attributes...)
+	if requeues, ok := attrs.Value("requeues"); !ok || requeues.AsInt64() != 0 {
+		t.Fatalf("expected a requeues attribute of 0, got %v", requeues.Emit())
+	}
+	if _, ok := attrs.Value("plannedForWork"); !ok {
+		t.Fatal("expected a plannedForWork attribute")
+	}
+	if s := findSpan(exporter, "handleQueueItem", "key", "ok"); s == nil {
+		t.Fatal("expected a handleQueueItem span for key ok")
+	} else if s.Status.Code == codes.Error {
+		t.Fatalf("expected no error status, got %+v", s.Status)
+	}
+}
+
+func TestSpanStatus(t *testing.T) {
+	exporter := registerExporter(t)
+	ctx, span := trace.StartSpan(context.Background(), "ok")
+	span.WithFields(ctx, map[string]interface{}{"count": 3, "enabled": true})
+	span.SetStatus(nil)
+	span.End()
+
+	_, span = trace.StartSpan(context.Background(), "failed")
+	span.SetStatus(errors.New("failed"))
+	span.End()
+
+	spans := exporter.GetSpans()
+	if len(spans) != 2 {
+		t.Fatalf("expected 2 spans, got %d", len(spans))
+	}
+	if spans[0].Status.Code != codes.Ok {
+		t.Fatalf("expected an ok status, got %+v", spans[0].Status)
+	}
+	attrs := attribute.NewSet(spans[0].Attributes...)
+	if count, _ := attrs.Value("count"); count.AsInt64() != 3 {
+		t.Fatalf("expected a count attribute of 3, got %v", count.Emit())
+	}
+	if enabled, _ := attrs.Value("enabled"); !enabled.AsBool() {
+		t.Fatalf("expected an enabled attribute of true, got %v", enabled.Emit())
+	}
+	if spans[1].Status.Code != codes.Error || spans[1].Status.Description != "failed" {
+		t.Fatalf("expected an error status, got %+v", spans[1].Status)
+	}
+	if len(spans[1].Events) != 1 || spans[1].Events[0].Name != "exception" {
+		t.Fatalf("expected the error to be recorded as an exception event, got %+v", spans[1].Events)
+	}
+}
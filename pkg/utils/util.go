@@ -3,7 +3,6 @@ package utils
 import (
 	"github.com/clusterrouter-io/clusterrouter/pkg/common"
 	corev1 "k8s.io/api/core/v1"
-	utilfeature "k8s.io/apiserver/pkg/util/feature"
 )
 
 // GetRequestFromPod get resources required by pod
@@ -16,10 +15,18 @@ func GetRequestFromPod(pod *corev1.Pod) *common.Resource {
 	return capacity
 }
 
+// GetLimitsFromPod get resource limits of pod
+func GetLimitsFromPod(pod *corev1.Pod) *common.Resource {
+	if pod == nil {
+		return nil
+	}
+	_, limits := PodRequestsAndLimits(pod)
+	return common.ConvertResource(limits)
+}
+
 // PodRequestsAndLimits returns a dictionary of all defined resources summed up for all
-// containers of the pod. If PodOverhead feature is enabled, pod overhead is added to the
-// total container resource requests and to the total container limits which have a
-// non-zero quantity.
+// containers of the pod. Pod overhead is added to the total container resource requests
+// and to the total container limits which have a non-zero quantity.
 func PodRequestsAndLimits(pod *corev1.Pod) (reqs, limits corev1.ResourceList) {
 	reqs, limits = corev1.ResourceList{}, corev1.ResourceList{}
 	for _, container := range pod.Spec.Containers {
@@ -27,14 +34,18 @@ func PodRequestsAndLimits(pod *corev1.Pod) (reqs, limits corev1.ResourceList) {
 		addResourceList(limits, container.Resources.Limits)
 	}
 	// init containers define the minimum of any resource
+	//
+	// TODO: native sidecars, init containers with restartPolicy Always, run alongside the containers, so their
+	// requests should be added rather than maxed. Container.RestartPolicy only exists as of k8s.io/api v0.28, so they
+	// can not be told apart from classic init containers until the kubernetes dependencies are bumped.
 	for _, container := range pod.Spec.InitContainers {
 		maxResourceList(reqs, container.Resources.Requests)
 		maxResourceList(limits, container.Resources.Limits)
 	}
 
-	// if PodOverhead feature is supported, add overhead for running a pod
-	// to the sum of reqeuests and to non-zero limits:
-	if pod.Spec.Overhead != nil && utilfeature.DefaultFeatureGate.Enabled("PodOverhead") {
+	// add overhead for running a pod to the sum of requests and to non-zero limits.
+	// PodOverhead is GA, so it is honored whenever the pod carries an overhead.
+	if pod.Spec.Overhead != nil {
 		addResourceList(reqs, pod.Spec.Overhead)
 
 		for name, quantity := range pod.Spec.Overhead {
@@ -0,0 +1,80 @@
+package utils
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	apiequality "k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// testContainer returns a container requesting cpu and memory, and limited to them
+func testContainer(cpu, memory string) corev1.Container {
+	list := corev1.ResourceList{
+		corev1.ResourceCPU:    resource.MustParse(cpu),
+		corev1.ResourceMemory: resource.MustParse(memory),
+	}
+	return corev1.Container{Resources: corev1.ResourceRequirements{Requests: list, Limits: list.DeepCopy()}}
+}
+
+func TestPodRequestsAndLimitsOverhead(t *testing.T) {
+	pod := &corev1.Pod{Spec: corev1.PodSpec{
+		Containers: []corev1.Container{testContainer("1", "1Gi"), testContainer("500m", "512Mi")},
+		Overhead: corev1.ResourceList{
+			corev1.ResourceCPU:    resource.MustParse("250m"),
+			corev1.ResourceMemory: resource.MustParse("128Mi"),
+		},
+	}}
+	reqs, limits := PodRequestsAndLimits(pod)
+	want := corev1.ResourceList{
+		corev1.ResourceCPU:    resource.MustParse("1750m"),
+		corev1.ResourceMemory: resource.MustParse("1664Mi"),
+	}
+	if !apiequality.Semantic.DeepEqual(reqs, want) {
+		t.Fatalf("expected the overhead to be added to the requests %v, got %v", want, reqs)
+	}
+	if !apiequality.Semantic.DeepEqual(limits, want) {
+		t.Fatalf("expected the overhead to be added to the limits %v, got %v", want, limits)
+	}
+}
+
+func TestPodRequestsAndLimitsInitContainers(t *testing.T) {
+	// Classic init containers run one after the other before the containers, so the larger of them and the sum of the
+	// containers is requested per resource
+	pod := &corev1.Pod{Spec: corev1.PodSpec{
+		InitContainers: []corev1.Container{testContainer("2", "256Mi"), testContainer("500m", "4Gi")},
+		Containers:     []corev1.Container{testContainer("1", "1Gi"), testContainer("500m", "512Mi")},
+	}}
+	reqs, _ := PodRequestsAndLimits(pod)
+	want := corev1.ResourceList{
+		corev1.ResourceCPU:    resource.MustParse("2"),
+		corev1.ResourceMemory: resource.MustParse("4Gi"),
+	}
+	if !apiequality.Semantic.DeepEqual(reqs, want) {
+		t.Fatalf("expected requests %v, got %v", want, reqs)
+	}
+}
+
+func TestGetLimitsFromPod(t *testing.T) {
+	container := testContainer("500m", "512Mi")
+	container.Resources.Limits = corev1.ResourceList{
+		corev1.ResourceCPU:    resource.MustParse("2"),
+		corev1.ResourceMemory: resource.MustParse("1Gi"),
+	}
+	pod := &corev1.Pod{Spec: corev1.PodSpec{
+		InitContainers: []corev1.Container{testContainer("1", "2Gi")},
+		Containers:     []corev1.Container{container},
+	}}
+	// The init container is maxed into both the requests and the limits
+	if reqs := GetRequestFromPod(pod); !reqs.CPU.Equal(resource.MustParse("1")) ||
+		!reqs.Memory.Equal(resource.MustParse("2Gi")) {
+		t.Fatalf("expected requests of 1 cpu and 2Gi, got %s", reqs)
+	}
+	if limits := GetLimitsFromPod(pod); !limits.CPU.Equal(resource.MustParse("2")) ||
+		!limits.Memory.Equal(resource.MustParse("2Gi")) {
+		t.Fatalf("expected limits of 2 cpus and 2Gi, got %s", limits)
+	}
+	if GetLimitsFromPod(nil) != nil {
+		t.Fatal("expected no limits for a nil pod")
+	}
+}
@@ -239,7 +239,8 @@ func ControllerRunners(ctx context.Context, hostIP string, opts *config.Opts, cc
 		return nil, nil, nil, fmt.Errorf("could not build clientInformer")
 	}
 
-	runningControllers := []controllers.Controller{buildCommonControllers(client, masterInformer, clientInformer)}
+	runningControllers := []controllers.Controller{buildCommonControllers(client, masterInformer, clientInformer,
+		utils.NewNamespaceMapping(opts.NamespacePrefix))}
 
 	pvCtrl := controllers.NewPVController(master, client, masterInformer, clientInformer, hostIP)
 	runningControllers = append(runningControllers, pvCtrl)
@@ -296,12 +297,13 @@ func (v *VirtualNode) Shutdown() {
 }
 
 func buildCommonControllers(client kubernetes.Interface, masterInformer,
-	clientInformer kubeinformers.SharedInformerFactory) controllers.Controller {
+	clientInformer kubeinformers.SharedInformerFactory, namespaces utils.NamespaceMapping) controllers.Controller {
 
 	configMapRateLimiter := workqueue.NewItemExponentialFailureRateLimiter(time.Second, 30*time.Second)
 	secretRateLimiter := workqueue.NewItemExponentialFailureRateLimiter(time.Second, 30*time.Second)
 
-	return controllers.NewCommonController(client, masterInformer, clientInformer, configMapRateLimiter, secretRateLimiter)
+	return controllers.NewCommonController(client, masterInformer, clientInformer, namespaces,
+		configMapRateLimiter, secretRateLimiter)
 }
 
 func rateLimiter() workqueue.RateLimiter {